@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// vaultTarget is a vault together with the unsealer that manages it, which
+// in operator mode is the one of its VaultUnsealConfig.
+type vaultTarget struct {
+	u *Unsealer
+	v *vaultConfig
+}
+
+// findVaults returns the vaults that name refers to: a vault address, or the
+// host (with or without port) of one. The config query parameter narrows the
+// search to one VaultUnsealConfig in operator mode.
+func (u *Unsealer) findVaults(r *http.Request, name string) []vaultTarget {
+	name = strings.TrimRight(name, "/")
+	config := r.URL.Query().Get("config")
+	var found []vaultTarget
+	for _, c := range u.clusterUnsealers() {
+		if config != "" && c.shardKey != config {
+			continue
+		}
+		for _, v := range c.vaultList() {
+			if v.addr == name {
+				return []vaultTarget{{c, v}}
+			}
+			if p, err := url.Parse(v.addr); err == nil && (p.Host == name || p.Hostname() == name) {
+				found = append(found, vaultTarget{c, v})
+			}
+		}
+	}
+	return found
+}
+
+// findVault is findVaults for handlers that act on a single vault. It writes
+// the error response and returns false when name does not identify exactly
+// one.
+func (u *Unsealer) findVault(w http.ResponseWriter, r *http.Request, name string) (vaultTarget, bool) {
+	found := u.findVaults(r, name)
+	switch len(found) {
+	case 0:
+		http.Error(w, fmt.Sprintf("unknown vault %q", name), http.StatusNotFound)
+		return vaultTarget{}, false
+	case 1:
+		return found[0], true
+	}
+	addrs := make([]string, len(found))
+	for i, t := range found {
+		addrs[i] = t.v.addr
+		if t.u.shardKey != "" {
+			addrs[i] = t.u.shardKey + "/" + t.v.addr
+		}
+	}
+	http.Error(w, fmt.Sprintf("%q matches several vaults, use the address or config: %s", name, strings.Join(addrs, ", ")), http.StatusConflict)
+	return vaultTarget{}, false
+}
+
+// requestVaultUnseal asks the unsealer's loop to unseal v right away. It
+// returns false when too many requests are pending.
+func (u *Unsealer) requestVaultUnseal(v *vaultConfig) bool {
+	select {
+	case u.unsealVaultNow <- v:
+		return true
+	default:
+		return false
+	}
+}
+
+// unsealVault runs an unseal attempt for v alone, outside the poll cycle.
+func (u *Unsealer) unsealVault(ctx context.Context, v *vaultConfig) {
+	if !u.owns(v.addr) {
+		return
+	}
+	ctx = withCycleID(ctx)
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		u.unsealWithRetry(ctx, v)
+	}()
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+// handleUnsealAll starts an unseal cycle of every vault, or of those of one
+// VaultUnsealConfig with ?config=. It requires ?all=true, so that a request
+// missing its vault does not act on all of them.
+func (u *Unsealer) handleUnsealAll(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("all") != "true" {
+		http.Error(w, "name a vault or pass all=true", http.StatusBadRequest)
+		return
+	}
+	config := r.URL.Query().Get("config")
+	triggered := 0
+	for _, c := range u.clusterUnsealers() {
+		if config != "" && c.shardKey != config {
+			continue
+		}
+		if c.operator != nil {
+			// The root unsealer of operator mode has no vaults of its own.
+			continue
+		}
+		c.requestUnseal(initiatorAPI)
+		triggered++
+	}
+	if triggered == 0 {
+		http.Error(w, fmt.Sprintf("unknown config %q", config), http.StatusNotFound)
+		return
+	}
+	u.logger.Info("unseal of all vaults requested through the admin API", "config", config, "remote", r.RemoteAddr)
+	body := map[string]interface{}{"status": "accepted", "all": true}
+	if config != "" {
+		body["config"] = config
+	}
+	writeJSON(w, http.StatusAccepted, body)
+}
+
+// handleUnsealVault starts an unseal attempt of one vault. The attempt runs in
+// the background; its outcome shows in /status and /events.
+func (u *Unsealer) handleUnsealVault(w http.ResponseWriter, r *http.Request) {
+	t, ok := u.findVault(w, r, r.PathValue("vault"))
+	if !ok {
+		return
+	}
+	if !t.u.owns(t.v.addr) {
+		http.Error(w, "this replica is not responsible for the vault; send the request to the leader or the shard owner", http.StatusConflict)
+		return
+	}
+	if reason := t.u.holdReason(t.v); reason != "" {
+		http.Error(w, "unsealing the vault is "+reason, http.StatusConflict)
+		return
+	}
+	if !t.u.requestVaultUnseal(t.v) {
+		http.Error(w, "too many unseal requests pending", http.StatusTooManyRequests)
+		return
+	}
+	u.logger.Info("unseal requested through the admin API", "vault", t.v.addr, "config", t.u.shardKey, "remote", r.RemoteAddr)
+	body := map[string]interface{}{"status": "accepted", "vault": t.v.addr}
+	if t.u.shardKey != "" {
+		body["config"] = t.u.shardKey
+	}
+	writeJSON(w, http.StatusAccepted, body)
+}
+
+// handleDisableVault stops the unsealer from acting on a vault until it is
+// enabled again or the unsealer restarts. The vault is still polled.
+func (u *Unsealer) handleDisableVault(w http.ResponseWriter, r *http.Request) {
+	u.handleVaultToggle(w, r, true)
+}
+
+// handleEnableVault enables a vault again and starts an unseal attempt.
+func (u *Unsealer) handleEnableVault(w http.ResponseWriter, r *http.Request) {
+	u.handleVaultToggle(w, r, false)
+}
+
+func (u *Unsealer) handleVaultToggle(w http.ResponseWriter, r *http.Request, disable bool) {
+	t, ok := u.findVault(w, r, r.PathValue("vault"))
+	if !ok {
+		return
+	}
+	if prev := t.v.state.setDisabled(disable); prev != disable {
+		action := "enabled"
+		if disable {
+			action = "disabled"
+		}
+		u.logger.Warn("vault "+action+" through the admin API", "vault", t.v.addr, "config", t.u.shardKey, "remote", r.RemoteAddr)
+		if !disable && t.u.owns(t.v.addr) {
+			t.u.requestVaultUnseal(t.v)
+		}
+	}
+	body := map[string]interface{}{"vault": t.v.addr, "disabled": disable}
+	if t.u.shardKey != "" {
+		body["config"] = t.u.shardKey
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+// handleKeyRefresh fetches the keys from the provider right away and reports
+// how many were loaded and how long it took. In operator mode it needs
+// ?config= to pick the VaultUnsealConfig whose keys to fetch.
+func (u *Unsealer) handleKeyRefresh(w http.ResponseWriter, r *http.Request) {
+	c := u
+	if u.operator != nil {
+		config := r.URL.Query().Get("config")
+		if config == "" {
+			http.Error(w, "config is required in operator mode", http.StatusBadRequest)
+			return
+		}
+		if c = u.operator.unsealers()[config]; c == nil {
+			http.Error(w, fmt.Sprintf("unknown config %q", config), http.StatusNotFound)
+			return
+		}
+	}
+	u.logger.Info("key refresh requested through the admin API", "config", c.shardKey, "remote", r.RemoteAddr)
+	// A slow provider can take longer than the server's write timeout.
+	http.NewResponseController(w).SetWriteDeadline(time.Now().Add(2 * time.Minute))
+	start := time.Now()
+	if err := c.fetchKeys(); err != nil {
+		http.Error(w, "key refresh failed: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	duration := time.Since(start)
+	c.keysMu.RLock()
+	count := len(c.keys)
+	c.keysMu.RUnlock()
+	body := map[string]interface{}{"keys": count, "duration_seconds": duration.Seconds()}
+	if c.shardKey != "" {
+		body["config"] = c.shardKey
+	}
+	writeJSON(w, http.StatusOK, body)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Roles of admin API callers. A read-only caller may read the state behind the
+// admin API; an operator may also change it.
+const (
+	roleNone     = "none"
+	roleReadOnly = "read-only"
+	roleOperator = "operator"
+)
+
+var roleRank = map[string]int{roleNone: 0, roleReadOnly: 1, roleOperator: 2}
+
+// grpcReadOnly are the RPCs of grpcService that only read.
+var grpcReadOnly = map[string]bool{"GetStatus": true, "GetPauseState": true}
+
+// adminAuth decides what callers of the admin API may do. Callers present a
+// token from ADMIN_TOKENS_FILE, a client certificate whose name has a role in
+// ADMIN_CERT_ROLES, or with ADMIN_KUBE_AUTH a Kubernetes token; everyone else,
+// including callers authenticated with the health server's own credentials,
+// gets ADMIN_DEFAULT_ROLE.
+type adminAuth struct {
+	tokensFile  string
+	certRoles   []certRole
+	kube        *kubeAuth
+	defaultRole string
+}
+
+type certRole struct {
+	pattern *regexp.Regexp
+	role    string
+}
+
+// loadAdminAuth reads ADMIN_TOKENS_FILE, ADMIN_CERT_ROLES, ADMIN_KUBE_AUTH and
+// ADMIN_DEFAULT_ROLE. Certificate roles need client certificates verified by
+// the health server.
+func loadAdminAuth(healthTLS *healthTLS, log hclog.Logger) (*adminAuth, error) {
+	a := &adminAuth{tokensFile: os.Getenv("ADMIN_TOKENS_FILE")}
+	var err error
+	if a.defaultRole, err = parseRole(getEnv("ADMIN_DEFAULT_ROLE", roleReadOnly)); err != nil {
+		return nil, fmt.Errorf("ADMIN_DEFAULT_ROLE: %w", err)
+	}
+	if a.tokensFile != "" {
+		if _, err := a.tokens(); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range splitList(os.Getenv("ADMIN_CERT_ROLES")) {
+		pattern, role, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("ADMIN_CERT_ROLES entry %q must be name=role", entry)
+		}
+		re, err := compilePattern(strings.TrimSpace(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("ADMIN_CERT_ROLES: %w", err)
+		}
+		if role, err = parseRole(strings.TrimSpace(role)); err != nil {
+			return nil, fmt.Errorf("ADMIN_CERT_ROLES entry %q: %w", entry, err)
+		}
+		a.certRoles = append(a.certRoles, certRole{re, role})
+	}
+	if len(a.certRoles) > 0 && (healthTLS == nil || healthTLS.config.ClientCAs == nil) {
+		return nil, fmt.Errorf("ADMIN_CERT_ROLES requires HEALTH_TLS_CLIENT_CA")
+	}
+	if a.kube, err = newKubeAuth(log); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func parseRole(role string) (string, error) {
+	if _, ok := roleRank[role]; !ok {
+		return "", fmt.Errorf("unknown role %q, use none, read-only or operator", role)
+	}
+	return role, nil
+}
+
+// tokens reads ADMIN_TOKENS_FILE: one "<role> <token>" per line, with blank
+// lines and lines starting with # ignored. It is read on every request, so a
+// rotated Secret takes effect without a restart.
+func (a *adminAuth) tokens() (map[string]string, error) {
+	data, err := os.ReadFile(a.tokensFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ADMIN_TOKENS_FILE: %w", err)
+	}
+	tokens := map[string]string{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("ADMIN_TOKENS_FILE line %d must be \"<role> <token>\"", i+1)
+		}
+		role, err := parseRole(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("ADMIN_TOKENS_FILE line %d: %w", i+1, err)
+		}
+		tokens[fields[1]] = role
+	}
+	return tokens, nil
+}
+
+// credentialRole returns the role of the admin credentials r presents, and
+// false when it presents none that are valid.
+func (a *adminAuth) credentialRole(r *http.Request) (string, bool) {
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if a.tokensFile != "" {
+			tokens, err := a.tokens()
+			if err == nil {
+				for token, role := range tokens {
+					if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1 {
+						return role, true
+					}
+				}
+			}
+		}
+		if a.kube != nil && bearer != "" {
+			if role, ok := a.kube.role(r.Context(), bearer); ok {
+				return role, true
+			}
+		}
+	}
+	if len(a.certRoles) > 0 && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+		names = append(names, cert.EmailAddresses...)
+		for _, uri := range cert.URIs {
+			names = append(names, uri.String())
+		}
+		for _, cr := range a.certRoles {
+			if matchesAny([]*regexp.Regexp{cr.pattern}, names) {
+				return cr.role, true
+			}
+		}
+	}
+	return "", false
+}
+
+// requiredRole returns the role a request needs, and false for requests
+// outside the admin API.
+func requiredRole(r *http.Request) (string, bool) {
+	if method, ok := strings.CutPrefix(r.URL.Path, "/"+grpcService+"/"); ok {
+		if grpcReadOnly[method] {
+			return roleReadOnly, true
+		}
+		return roleOperator, true
+	}
+	if !strings.HasPrefix(r.URL.Path, "/api/") {
+		return "", false
+	}
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return roleReadOnly, true
+	}
+	return roleOperator, true
+}
+
+// wrap rejects admin API requests whose caller lacks the role they need.
+func (a *adminAuth) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		need, ok := requiredRole(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		role, authenticated := a.credentialRole(r)
+		if !authenticated {
+			role = a.defaultRole
+		}
+		if roleRank[role] < roleRank[need] {
+			if !authenticated {
+				http.Error(w, "unauthorized: the "+need+" role is required", http.StatusUnauthorized)
+				return
+			}
+			http.Error(w, "forbidden: the "+need+" role is required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRequiredRole(t *testing.T) {
+	tests := []struct {
+		method, path string
+		role         string
+		admin        bool
+	}{
+		{"GET", "/api/v1/vaults", roleReadOnly, true},
+		{"HEAD", "/api/v1/status", roleReadOnly, true},
+		{"POST", "/api/v1/unseal", roleOperator, true},
+		{"DELETE", "/api/v1/pause", roleOperator, true},
+		{"POST", "/" + grpcService + "/GetStatus", roleReadOnly, true},
+		{"POST", "/" + grpcService + "/GetPauseState", roleReadOnly, true},
+		{"POST", "/" + grpcService + "/Unseal", roleOperator, true},
+		{"GET", "/health", "", false},
+		{"GET", "/metrics", "", false},
+		{"GET", "/apiary", "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		role, admin := requiredRole(r)
+		if role != tt.role || admin != tt.admin {
+			t.Errorf("requiredRole(%s %s) = %q, %v, want %q, %v", tt.method, tt.path, role, admin, tt.role, tt.admin)
+		}
+	}
+}
+
+// writeTokens writes an ADMIN_TOKENS_FILE and returns its path.
+func writeTokens(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAdminAuthWrap(t *testing.T) {
+	a := &adminAuth{
+		tokensFile:  writeTokens(t, "# admin tokens\noperator op-token\nread-only ro-token\n\nnone no-token\n"),
+		defaultRole: roleNone,
+	}
+	tests := []struct {
+		method, path, token string
+		code                int
+	}{
+		{"GET", "/api/v1/vaults", "", 401},
+		{"GET", "/api/v1/vaults", "wrong", 401},
+		{"GET", "/api/v1/vaults", "no-token", 403},
+		{"GET", "/api/v1/vaults", "ro-token", 200},
+		{"POST", "/api/v1/unseal", "ro-token", 403},
+		{"POST", "/api/v1/unseal", "op-token", 200},
+		{"POST", "/" + grpcService + "/GetStatus", "ro-token", 200},
+		{"POST", "/" + grpcService + "/Unseal", "ro-token", 403},
+		{"GET", "/health", "", 200},
+	}
+	h := a.wrap(httpOK)
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s %s with token %q: got %d, want %d", tt.method, tt.path, tt.token, w.Code, tt.code)
+		}
+	}
+}
+
+func TestAdminAuthDefaultRole(t *testing.T) {
+	tests := []struct {
+		defaultRole string
+		get, post   int
+	}{
+		{roleNone, 401, 401},
+		{roleReadOnly, 200, 401},
+		{roleOperator, 200, 200},
+	}
+	for _, tt := range tests {
+		h := (&adminAuth{defaultRole: tt.defaultRole}).wrap(httpOK)
+		for method, want := range map[string]int{"GET": tt.get, "POST": tt.post} {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(method, "/api/v1/pause", nil))
+			if w.Code != want {
+				t.Errorf("default role %s, %s: got %d, want %d", tt.defaultRole, method, w.Code, want)
+			}
+		}
+	}
+}
+
+func TestAdminTokens(t *testing.T) {
+	tests := []struct {
+		content string
+		wantErr bool
+	}{
+		{"operator a\nread-only b\n", false},
+		{"  # comment\n\noperator a", false},
+		{"operator", true},
+		{"operator a b", true},
+		{"admin a", true},
+	}
+	for _, tt := range tests {
+		_, err := (&adminAuth{tokensFile: writeTokens(t, tt.content)}).tokens()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("tokens(%q) error = %v, want error %v", tt.content, err, tt.wantErr)
+		}
+	}
+}
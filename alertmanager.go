@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// alertmanagerNames are the alert names of the events that fire an alert.
+// The events in alertResolutions resolve them.
+var alertmanagerNames = map[string]string{
+	historySealDetected:  "VaultSealed",
+	historyUnsealFailure: "VaultUnsealFailed",
+	historyProviderError: "VaultUnsealerKeyProviderError",
+	historyFlapping:      "VaultFlapping",
+	historyEscalated:     "VaultUnsealEscalated",
+}
+
+// Alertmanager resolves an alert on its own once endsAt passes, so firing
+// alerts are sent again every alertmanagerResend with endsAt
+// alertmanagerTimeout ahead, the way Prometheus does. If the unsealer stops,
+// its alerts resolve after that time.
+const (
+	alertmanagerResend  = time.Minute
+	alertmanagerTimeout = 5 * time.Minute
+)
+
+type alertmanagerAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// alertmanagerSink pushes alerts to one or more Alertmanagers through the
+// v2 API, so they go through an existing routing tree without a Prometheus
+// in between.
+type alertmanagerSink struct {
+	urls         []string
+	token        string
+	labels       map[string]string
+	generatorURL string
+	client       *http.Client
+
+	mu     sync.Mutex
+	firing map[string]alertmanagerAlert
+}
+
+func init() {
+	registerSink("alertmanager", singleSink(loadAlertmanagerSink))
+}
+
+// loadAlertmanagerSink reads ALERTMANAGER_URLS, ALERTMANAGER_BEARER_TOKEN
+// (or ALERTMANAGER_BEARER_TOKEN_FILE), ALERTMANAGER_LABELS and
+// ALERTMANAGER_GENERATOR_URL. It returns nil when no URL is set.
+func loadAlertmanagerSink() (sink, error) {
+	urls := splitList(os.Getenv("ALERTMANAGER_URLS"))
+	if len(urls) == 0 {
+		return nil, nil
+	}
+	s := &alertmanagerSink{
+		labels:       make(map[string]string),
+		generatorURL: os.Getenv("ALERTMANAGER_GENERATOR_URL"),
+		client:       &http.Client{Timeout: 10 * time.Second},
+		firing:       make(map[string]alertmanagerAlert),
+	}
+	for _, raw := range urls {
+		if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid ALERTMANAGER_URLS entry %q", raw)
+		}
+		s.urls = append(s.urls, strings.TrimSuffix(raw, "/")+"/api/v2/alerts")
+	}
+	var err error
+	if s.token, err = readSecretEnv("ALERTMANAGER_BEARER_TOKEN"); err != nil {
+		return nil, err
+	}
+	for _, pair := range splitList(os.Getenv("ALERTMANAGER_LABELS")) {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("ALERTMANAGER_LABELS entries must be name=value, got %q", pair)
+		}
+		s.labels[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return s, nil
+}
+
+func (s *alertmanagerSink) name() string {
+	return "alertmanager"
+}
+
+func (s *alertmanagerSink) resolves(eventType string) bool {
+	return alertResolutions[eventType] != nil
+}
+
+// alertLabels identify the alert of eventType for the vault of n. They do
+// not include the sending instance, so another replica, or the same one
+// after a restart, resolves the same alert.
+func (s *alertmanagerSink) alertLabels(eventType string, n notification) map[string]string {
+	labels := make(map[string]string, len(s.labels)+5)
+	for k, v := range s.labels {
+		labels[k] = v
+	}
+	labels["alertname"] = alertmanagerNames[eventType]
+	labels["severity"] = "warning"
+	if eventType == historyUnsealFailure || eventType == historyFlapping || eventType == historyEscalated {
+		labels["severity"] = "critical"
+	}
+	if n.Vault != "" {
+		labels["vault"] = n.Vault
+	}
+	if n.Group != "" {
+		labels["group"] = n.Group
+	}
+	if n.Config != "" {
+		labels["config"] = n.Config
+	}
+	return labels
+}
+
+func alertKey(labels map[string]string) string {
+	data, _ := json.Marshal(labels)
+	return string(data)
+}
+
+func (s *alertmanagerSink) send(ctx context.Context, n notification) error {
+	now := time.Now()
+	var alerts []alertmanagerAlert
+	s.mu.Lock()
+	if _, ok := alertmanagerNames[n.Type]; ok {
+		summary := n.Message
+		if n.Vault != "" {
+			summary = n.Vault + ": " + n.Message
+		}
+		a := alertmanagerAlert{
+			Labels:       s.alertLabels(n.Type, n),
+			Annotations:  map[string]string{"summary": summary, "instance": n.Instance},
+			StartsAt:     n.Time,
+			EndsAt:       now.Add(alertmanagerTimeout),
+			GeneratorURL: s.generatorURL,
+		}
+		if n.RequestID != "" {
+			a.Annotations["request_id"] = n.RequestID
+		}
+		key := alertKey(a.Labels)
+		if prev, ok := s.firing[key]; ok {
+			a.StartsAt = prev.StartsAt
+		}
+		s.firing[key] = a
+		alerts = append(alerts, a)
+	}
+	for _, eventType := range alertResolutions[n.Type] {
+		labels := s.alertLabels(eventType, n)
+		key := alertKey(labels)
+		a, ok := s.firing[key]
+		if !ok {
+			// Resolve it anyway; it may have been fired before a restart.
+			a = alertmanagerAlert{Labels: labels, Annotations: map[string]string{}, StartsAt: n.Time, GeneratorURL: s.generatorURL}
+		}
+		delete(s.firing, key)
+		a.EndsAt = now
+		alerts = append(alerts, a)
+	}
+	s.mu.Unlock()
+	if len(alerts) == 0 {
+		return nil
+	}
+	return s.post(ctx, alerts)
+}
+
+// run sends the firing alerts again before Alertmanager times them out.
+func (s *alertmanagerSink) run(ctx context.Context) {
+	ticker := time.NewTicker(alertmanagerResend)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		alerts := make([]alertmanagerAlert, 0, len(s.firing))
+		for key, a := range s.firing {
+			a.EndsAt = time.Now().Add(alertmanagerTimeout)
+			s.firing[key] = a
+			alerts = append(alerts, a)
+		}
+		s.mu.Unlock()
+		if len(alerts) > 0 {
+			// A failed resend is made up for by the next one.
+			s.post(ctx, alerts)
+		}
+	}
+}
+
+// post sends alerts to every Alertmanager, as they do not share alerts
+// between each other. It fails if any of them could not be reached.
+func (s *alertmanagerSink) post(ctx context.Context, alerts []alertmanagerAlert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	if s.token != "" {
+		header.Set("Authorization", "Bearer "+s.token)
+	}
+	var errs []error
+	for _, u := range s.urls {
+		if err := postJSON(ctx, s.client, u, body, header); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
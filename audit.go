@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit log actions.
+const (
+	auditKeySubmitted  = "key_submitted"
+	auditProgressReset = "progress_reset"
+	auditUnseal        = "unseal"
+)
+
+// Initiators of an unseal, recorded in the audit log.
+const (
+	initiatorPoll         = "poll"
+	initiatorPodWatch     = "pod_watch"
+	initiatorLeaderChange = "leader_change"
+	initiatorShardChange  = "shard_change"
+	initiatorDrain        = "drain"
+	initiatorAPI          = "api"
+	initiatorSignal       = "signal"
+)
+
+// auditGenesis is the previous hash of the first entry.
+var auditGenesis = strings.Repeat("0", 64)
+
+// auditEntry is one line of the audit log. Keys are identified only by their
+// position in the key set, never by value. Hash is the SHA-256 of the entry
+// encoded without it, and PrevHash links it to the entry before, so removing
+// or editing a line breaks the chain from there on.
+type auditEntry struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Vault     string    `json:"vault"`
+	Config    string    `json:"config,omitempty"`
+	KeyIndex  *int      `json:"key_index,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+	Initiator string    `json:"initiator"`
+	RequestID string    `json:"request_id,omitempty"`
+	PrevHash  string    `json:"prev_hash"`
+	Hash      string    `json:"hash,omitempty"`
+}
+
+func (e auditEntry) computeHash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// auditLog appends hash-chained entries to a JSONL file.
+type auditLog struct {
+	mu       sync.Mutex
+	f        *os.File
+	seq      int64
+	lastHash string
+}
+
+// openAuditLog opens the log for appending and continues the chain from its
+// last entry.
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	a := &auditLog{f: f, lastHash: auditGenesis}
+	last, err := lastLine(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if last != nil {
+		var e auditEntry
+		if err := json.Unmarshal(last, &e); err != nil || e.Hash == "" {
+			f.Close()
+			return nil, fmt.Errorf("last entry of %s is not an audit entry", path)
+		}
+		a.seq, a.lastHash = e.Seq, e.Hash
+	}
+	return a, nil
+}
+
+// lastLine returns the last non-empty line of f, or nil for an empty file.
+func lastLine(f *os.File) ([]byte, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var last []byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			last = append(last[:0], line...)
+		}
+	}
+	return last, scanner.Err()
+}
+
+// append chains e to the previous entry and writes it to disk before
+// returning.
+func (a *auditLog) append(e auditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e.Seq = a.seq + 1
+	e.PrevHash = a.lastHash
+	hash, err := e.computeHash()
+	if err != nil {
+		return err
+	}
+	e.Hash = hash
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := a.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := a.f.Sync(); err != nil {
+		return err
+	}
+	a.seq, a.lastHash = e.Seq, e.Hash
+	return nil
+}
+
+type initiatorKey struct{}
+
+// withInitiator marks the unseals started with ctx as caused by initiator.
+func withInitiator(ctx context.Context, initiator string) context.Context {
+	return context.WithValue(ctx, initiatorKey{}, initiator)
+}
+
+func initiatorOf(ctx context.Context) string {
+	if initiator, ok := ctx.Value(initiatorKey{}).(string); ok {
+		return initiator
+	}
+	return initiatorPoll
+}
+
+// audit writes an entry for v to the audit log, if one is configured. A key
+// index below zero means the entry is not about a single key.
+func (u *Unsealer) audit(ctx context.Context, v *vaultConfig, action string, keyIndex int, outcome string, err error) {
+	if u.auditLog == nil {
+		return
+	}
+	e := auditEntry{
+		Time:      time.Now().UTC(),
+		Action:    action,
+		Vault:     v.addr,
+		Config:    u.shardKey,
+		Outcome:   outcome,
+		Initiator: initiatorOf(ctx),
+		RequestID: requestIDOf(ctx),
+	}
+	if keyIndex >= 0 {
+		e.KeyIndex = &keyIndex
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if err := u.auditLog.append(e); err != nil {
+		u.logger.Error("failed to write audit log entry", "vault", v.addr, "action", action, "error", err)
+	}
+}
+
+// verifyAuditLog checks the hash chain of an audit log and returns the number
+// of entries.
+func verifyAuditLog(r io.Reader) (int64, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	prev := auditGenesis
+	var n int64
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var e auditEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return n, fmt.Errorf("line %d: %w", line, err)
+		}
+		hash, err := e.computeHash()
+		if err != nil {
+			return n, fmt.Errorf("line %d: %w", line, err)
+		}
+		switch {
+		case e.Hash != hash:
+			return n, fmt.Errorf("line %d: entry was modified (hash mismatch)", line)
+		case e.PrevHash != prev:
+			return n, fmt.Errorf("line %d: chain is broken, an entry before it was removed or modified", line)
+		case e.Seq != n+1:
+			return n, fmt.Errorf("line %d: expected sequence number %d, got %d", line, n+1, e.Seq)
+		}
+		prev = e.Hash
+		n++
+	}
+	return n, scanner.Err()
+}
+
+// runAuditVerify implements the "audit-verify" subcommand.
+func runAuditVerify(args []string) int {
+	fs := flag.NewFlagSet("audit-verify", flag.ContinueOnError)
+	path := fs.String("file", os.Getenv("AUDIT_LOG_FILE"), "audit log to verify")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *path == "" {
+		fmt.Fprintln(os.Stderr, "usage: vault-unsealer audit-verify -file <path>")
+		return 2
+	}
+	f, err := os.Open(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+	n, err := verifyAuditLog(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "audit log verification failed after %d valid entries: %v\n", n, err)
+		return 1
+	}
+	fmt.Printf("audit log is intact: %d entries\n", n)
+	return 0
+}
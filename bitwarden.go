@@ -0,0 +1,517 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sdk "github.com/bitwarden/sdk-go"
+	"github.com/hashicorp/go-hclog"
+)
+
+const defaultCredential = "default"
+
+type bitwardenProvider struct {
+	logger      hclog.Logger
+	mu          sync.Mutex
+	creds       map[string]*bwCredential
+	keyRefs     []keyRef
+	apiURL      string
+	identityURL string
+
+	// authErrs holds the last login error of each credential. It has its
+	// own lock so readiness checks do not wait for a hanging fetch.
+	authMu   sync.Mutex
+	authErrs map[string]error
+
+	// logins counts logins after the initial one.
+	logins int64
+}
+
+type bwCredential struct {
+	name        string
+	orgID       string
+	token       string
+	tokenFile   string
+	tokenSecret string
+	kube        *kubeClient
+	client      sdk.BitwardenClientInterface
+}
+
+type keyRef struct {
+	cred     string
+	secretID string
+}
+
+func newBitwardenProvider(log hclog.Logger, values []string) (*bitwardenProvider, error) {
+	apiURL, identityURL, err := loadBitwardenURLs()
+	if err != nil {
+		return nil, fmt.Errorf("invalid bitwarden server configuration: %w", err)
+	}
+	creds, err := loadCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("invalid bitwarden credentials: %w", err)
+	}
+	keyRefs, err := parseKeyRefs(values, creds)
+	if err != nil {
+		return nil, fmt.Errorf("invalid unseal key configuration: %w", err)
+	}
+
+	p := &bitwardenProvider{
+		logger:      log,
+		creds:       creds,
+		keyRefs:     keyRefs,
+		apiURL:      apiURL,
+		identityURL: identityURL,
+		authErrs:    make(map[string]error),
+	}
+
+	if apiURL != "" && getEnv("BW_CONNECTIVITY_CHECK", "true") == "true" {
+		if err := checkBitwardenConnectivity(apiURL, identityURL); err != nil {
+			return nil, fmt.Errorf("bitwarden server unreachable: %w", err)
+		}
+		log.Info("bitwarden server reachable", "api_url", apiURL, "identity_url", identityURL)
+	}
+
+	for _, cred := range creds {
+		if err := p.initClient(cred); err != nil {
+			return nil, fmt.Errorf("bitwarden init failed for credential %s: %w", cred.name, err)
+		}
+	}
+
+	return p, nil
+}
+
+// initClient logs the credential in with its current token.
+func (p *bitwardenProvider) initClient(cred *bwCredential) error {
+	return p.login(cred, cred.token)
+}
+
+// login logs in with token on a new client. Only once that succeeds do the
+// client and token replace the credential's, and the replaced client is
+// closed, so a failed login leaves the credential as it was. Callers other
+// than the constructor must hold mu.
+func (p *bitwardenProvider) login(cred *bwCredential, token string) (err error) {
+	defer func() { p.setAuthError(cred.name, err) }()
+	var client sdk.BitwardenClientInterface
+	if p.apiURL != "" && p.identityURL != "" {
+		client, err = sdk.NewBitwardenClient(&p.apiURL, &p.identityURL)
+	} else {
+		client, err = sdk.NewBitwardenClient(nil, nil)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create client: %w", err)
+	}
+
+	if err := client.AccessTokenLogin(token, &cred.orgID); err != nil {
+		client.Close()
+		return fmt.Errorf("login failed: %w", err)
+	}
+
+	previous := cred.client
+	cred.client, cred.token = client, token
+	if previous != nil {
+		previous.Close()
+	}
+	return nil
+}
+
+func (p *bitwardenProvider) setAuthError(cred string, err error) {
+	p.authMu.Lock()
+	defer p.authMu.Unlock()
+	p.authErrs[cred] = err
+}
+
+// authError returns why a credential is not logged in, if any is not.
+func (p *bitwardenProvider) authError() error {
+	p.authMu.Lock()
+	defer p.authMu.Unlock()
+	for name, err := range p.authErrs {
+		if err != nil {
+			return fmt.Errorf("credential %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (p *bitwardenProvider) fetchKeys() ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.reloadTokens()
+	return p.doFetchKeys(true)
+}
+
+// reloadTokens re-reads access tokens kept in files or Kubernetes Secrets and
+// logs in again when one has been rotated. Callers must hold mu.
+func (p *bitwardenProvider) reloadTokens() {
+	for _, cred := range p.creds {
+		p.reloadToken(cred)
+	}
+}
+
+// reloadToken reports whether the credential logged in with a rotated token.
+func (p *bitwardenProvider) reloadToken(cred *bwCredential) bool {
+	if cred.tokenFile == "" && cred.tokenSecret == "" {
+		return false
+	}
+
+	token, err := cred.readToken()
+	if err != nil {
+		p.logger.Warn("failed to re-read access token, keeping current token", "credential", cred.name, "error", err)
+		return false
+	}
+	if token == cred.token {
+		return false
+	}
+
+	p.logger.Info("access token rotated, logging in again", "credential", cred.name)
+	atomic.AddInt64(&p.logins, 1)
+	if err := p.login(cred, token); err != nil {
+		p.logger.Error("login with rotated access token failed", "credential", cred.name, "error", err)
+		return false
+	}
+	return true
+}
+
+func (p *bitwardenProvider) doFetchKeys(allowRelogin bool) ([]string, error) {
+	// Note: Bitwarden SDK doesn't support context timeouts
+	// If this hangs, the entire refresh loop blocks
+	keys := make([]string, 0, len(p.keyRefs))
+
+	for i, ref := range p.keyRefs {
+		cred := p.creds[ref.cred]
+		secret, err := cred.client.Secrets().Get(ref.secretID)
+		if err != nil {
+			if allowRelogin && isAuthError(err) {
+				p.logger.Warn("authentication error detected, attempting re-login", "credential", cred.name)
+				// The token may have been rotated and revoked since the last
+				// refresh, so pick up the new one before logging in again.
+				if !p.reloadToken(cred) {
+					atomic.AddInt64(&p.logins, 1)
+					if reloginErr := p.initClient(cred); reloginErr != nil {
+						return nil, fmt.Errorf("re-login failed for credential %s: %w", cred.name, reloginErr)
+					}
+				}
+				return p.doFetchKeys(false)
+			}
+			if isAuthError(err) {
+				p.setAuthError(cred.name, err)
+			}
+			return nil, fmt.Errorf("failed to get key %d: %w", i+1, err)
+		}
+		value := strings.TrimSpace(secret.Value)
+		if value == "" {
+			return nil, fmt.Errorf("empty value for key %d", i+1)
+		}
+		keys = append(keys, value)
+	}
+	for _, ref := range p.keyRefs {
+		p.setAuthError(ref.cred, nil)
+	}
+
+	return keys, nil
+}
+
+func (p *bitwardenProvider) relogins() int64 {
+	return atomic.LoadInt64(&p.logins)
+}
+
+func isAuthError(err error) bool {
+	return strings.Contains(err.Error(), "unauthorized") || strings.Contains(err.Error(), "auth")
+}
+
+func (p *bitwardenProvider) keyCount() int {
+	return len(p.keyRefs)
+}
+
+// storeKeys overwrites the value of every configured key secret.
+func (p *bitwardenProvider) storeKeys(keys []string) error {
+	if len(keys) != len(p.keyRefs) {
+		return fmt.Errorf("got %d keys but %d key secrets are configured", len(keys), len(p.keyRefs))
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, ref := range p.keyRefs {
+		if err := p.updateSecret(ref, keys[i]); err != nil {
+			return fmt.Errorf("key secret %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// storeSecret overwrites the value of an existing secret. ref uses the same
+// "<credential>:<id>" form as UNSEAL_KEY_<n>.
+func (p *bitwardenProvider) storeSecret(ref, value string) error {
+	refs, err := parseKeyRefs([]string{ref}, p.creds)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.updateSecret(refs[0], value)
+}
+
+// fetchSecret reads the value of a single secret. ref uses the same
+// "<credential>:<id>" form as UNSEAL_KEY_<n>.
+func (p *bitwardenProvider) fetchSecret(ref string) (string, error) {
+	refs, err := parseKeyRefs([]string{ref}, p.creds)
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	secret, err := p.creds[refs[0].cred].client.Secrets().Get(refs[0].secretID)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret: %w", err)
+	}
+	value := strings.TrimSpace(secret.Value)
+	if value == "" {
+		return "", fmt.Errorf("secret is empty")
+	}
+	return value, nil
+}
+
+// updateSecret replaces a secret's value, keeping its name, note and project.
+// Callers must hold mu.
+func (p *bitwardenProvider) updateSecret(ref keyRef, value string) error {
+	secrets := p.creds[ref.cred].client.Secrets()
+	secret, err := secrets.Get(ref.secretID)
+	if err != nil {
+		return fmt.Errorf("failed to read secret: %w", err)
+	}
+
+	var projectIDs []string
+	if secret.ProjectID != nil {
+		projectIDs = []string{*secret.ProjectID}
+	}
+	if _, err := secrets.Update(ref.secretID, secret.Key, value, secret.Note, secret.OrganizationID, projectIDs); err != nil {
+		return fmt.Errorf("failed to update secret: %w", err)
+	}
+	return nil
+}
+
+// loadBitwardenURLs reads BW_API_URL and BW_IDENTITY_URL, falling back to the
+// legacy API_URL and IDENTITY_URL. Both must be set together or not at all.
+func loadBitwardenURLs() (string, string, error) {
+	apiURL := getEnv("BW_API_URL", os.Getenv("API_URL"))
+	identityURL := getEnv("BW_IDENTITY_URL", os.Getenv("IDENTITY_URL"))
+	if apiURL == "" && identityURL == "" {
+		return "", "", nil
+	}
+	if apiURL == "" || identityURL == "" {
+		return "", "", fmt.Errorf("BW_API_URL and BW_IDENTITY_URL must be set together")
+	}
+
+	var err error
+	if apiURL, err = validateServerURL("BW_API_URL", apiURL); err != nil {
+		return "", "", err
+	}
+	if identityURL, err = validateServerURL("BW_IDENTITY_URL", identityURL); err != nil {
+		return "", "", err
+	}
+	return apiURL, identityURL, nil
+}
+
+func validateServerURL(name, raw string) (string, error) {
+	parsed, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", fmt.Errorf("%s is not a valid URL: %w", name, err)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return "", fmt.Errorf("%s must use http or https, got %q", name, parsed.Scheme)
+	}
+	if parsed.Host == "" {
+		return "", fmt.Errorf("%s is missing a host", name)
+	}
+	if parsed.RawQuery != "" || parsed.Fragment != "" {
+		return "", fmt.Errorf("%s must not contain a query or fragment", name)
+	}
+	return strings.TrimRight(parsed.String(), "/"), nil
+}
+
+// checkBitwardenConnectivity only verifies that both servers answer HTTP; any
+// status code counts as reachable since the endpoints differ between
+// Bitwarden and Vaultwarden.
+func checkBitwardenConnectivity(apiURL, identityURL string) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, endpoint := range []string{apiURL, identityURL} {
+		resp, err := client.Get(endpoint)
+		if err != nil {
+			return fmt.Errorf("%s: %w", endpoint, err)
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// loadCredentials reads the default ORGANIZATION_ID/ACCESS_TOKEN pair plus any
+// named credentials listed in BW_CREDENTIALS (ORGANIZATION_ID_<NAME> and
+// ACCESS_TOKEN_<NAME>).
+func loadCredentials() (map[string]*bwCredential, error) {
+	creds := make(map[string]*bwCredential)
+
+	if cred, err := loadCredential(defaultCredential, "ORGANIZATION_ID", "ACCESS_TOKEN", "ACCESS_TOKEN_FILE", "ACCESS_TOKEN_SECRET"); err != nil {
+		return nil, err
+	} else if cred != nil {
+		creds[defaultCredential] = cred
+	}
+
+	for _, name := range strings.Split(os.Getenv("BW_CREDENTIALS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, exists := creds[name]; exists {
+			return nil, fmt.Errorf("credential %s defined more than once", name)
+		}
+		suffix := envSuffix(name)
+		cred, err := loadCredential(name, "ORGANIZATION_ID_"+suffix, "ACCESS_TOKEN_"+suffix, "ACCESS_TOKEN_FILE_"+suffix, "ACCESS_TOKEN_SECRET_"+suffix)
+		if err != nil {
+			return nil, err
+		}
+		if cred == nil {
+			return nil, fmt.Errorf("credential %s requires ACCESS_TOKEN_%s, ACCESS_TOKEN_FILE_%s or ACCESS_TOKEN_SECRET_%s", name, suffix, suffix, suffix)
+		}
+		creds[name] = cred
+	}
+
+	if len(creds) == 0 {
+		return nil, fmt.Errorf("no credentials configured, set ACCESS_TOKEN (or ACCESS_TOKEN_FILE or ACCESS_TOKEN_SECRET) and ORGANIZATION_ID")
+	}
+	return creds, nil
+}
+
+// loadCredential returns nil when none of the token variables is set.
+func loadCredential(name, orgVar, tokenVar, tokenFileVar, tokenSecretVar string) (*bwCredential, error) {
+	cred := &bwCredential{
+		name:        name,
+		token:       os.Getenv(tokenVar),
+		tokenFile:   os.Getenv(tokenFileVar),
+		tokenSecret: os.Getenv(tokenSecretVar),
+	}
+	set := 0
+	for _, v := range []string{cred.token, cred.tokenFile, cred.tokenSecret} {
+		if v != "" {
+			set++
+		}
+	}
+	if set == 0 {
+		return nil, nil
+	}
+	if set > 1 {
+		return nil, fmt.Errorf("%s, %s and %s are mutually exclusive", tokenVar, tokenFileVar, tokenSecretVar)
+	}
+
+	if cred.tokenSecret != "" {
+		kube, err := newKubeClient()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", tokenSecretVar, err)
+		}
+		cred.kube = kube
+	}
+	if cred.tokenFile != "" || cred.tokenSecret != "" {
+		source := tokenFileVar
+		if cred.tokenSecret != "" {
+			source = tokenSecretVar
+		}
+		var err error
+		if cred.token, err = cred.readToken(); err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+	}
+
+	cred.orgID = os.Getenv(orgVar)
+	if cred.orgID == "" {
+		return nil, fmt.Errorf("%s must be set for credential %s", orgVar, name)
+	}
+	return cred, nil
+}
+
+// readToken reads the current token from the credential's file or Secret.
+func (c *bwCredential) readToken() (string, error) {
+	if c.tokenSecret != "" {
+		return readTokenSecret(c.kube, c.tokenSecret)
+	}
+	return readTokenFile(c.tokenFile)
+}
+
+func readTokenFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("access token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// readTokenSecret reads a token from a Kubernetes Secret in the unsealer's
+// namespace, given as "<secret>/<key>" or "<secret>" for the key "token".
+func readTokenSecret(kube *kubeClient, ref string) (string, error) {
+	name, key, ok := strings.Cut(ref, "/")
+	if !ok {
+		key = "token"
+	}
+	if name == "" || key == "" {
+		return "", fmt.Errorf("secret reference %q must be <secret>/<key>", ref)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	value, err := kube.secretValue(ctx, name, key)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(value))
+	if token == "" {
+		return "", fmt.Errorf("key %s of secret %s is empty", key, name)
+	}
+	return token, nil
+}
+
+// parseKeyRefs binds each UNSEAL_KEY_<n> value to a credential. A value of the
+// form "<credential>:<id>" fetches the secret with a named credential, a bare
+// ID uses the default one.
+func parseKeyRefs(values []string, creds map[string]*bwCredential) ([]keyRef, error) {
+	refs := make([]keyRef, 0, len(values))
+	for i, v := range values {
+		keyName := fmt.Sprintf("UNSEAL_KEY_%d", i+1)
+
+		ref := keyRef{cred: defaultCredential, secretID: v}
+		if idx := strings.Index(v, ":"); idx > 0 {
+			ref = keyRef{cred: strings.ToLower(v[:idx]), secretID: v[idx+1:]}
+		}
+		if ref.secretID == "" {
+			return nil, fmt.Errorf("%s has an empty secret ID", keyName)
+		}
+		if _, ok := creds[ref.cred]; !ok {
+			return nil, fmt.Errorf("%s references unknown credential %s", keyName, ref.cred)
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+func envSuffix(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(name))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	caKubeOnce sync.Once
+	caKube     *kubeClient
+	caKubeErr  error
+)
+
+// readCACert reads a CA bundle from a file, from a ConfigMap
+// ("configmap:<name>/<key>") or from a Secret ("kubesecret:<name>/<key>") in
+// the unsealer's namespace. The key defaults to ca.crt.
+func readCACert(value string) ([]byte, error) {
+	kind, ref, ok := strings.Cut(value, ":")
+	if !ok || (kind != "configmap" && kind != "kubesecret") {
+		return os.ReadFile(value)
+	}
+
+	name, key, ok := strings.Cut(ref, "/")
+	if !ok {
+		key = "ca.crt"
+	}
+	if name == "" || key == "" {
+		return nil, fmt.Errorf("%s reference %q must be <name>/<key>", kind, ref)
+	}
+
+	caKubeOnce.Do(func() { caKube, caKubeErr = newKubeClient() })
+	if caKubeErr != nil {
+		return nil, caKubeErr
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if kind == "configmap" {
+		return caKube.configMapValue(ctx, name, key)
+	}
+	return caKube.secretValue(ctx, name, key)
+}
+
+// caReloadLoop re-reads the CA bundle of every vault that has one and
+// rebuilds its transport when the bundle changed, so a rotated CA is trusted
+// without a restart. A bundle that cannot be read or parsed keeps the current
+// transport.
+func (u *Unsealer) caReloadLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		bundles := make(map[string][]byte)
+		for _, v := range u.vaultList() {
+			if v.caCert == "" {
+				continue
+			}
+			transport, ok := v.client.Transport.(*headerTransport)
+			if !ok {
+				continue
+			}
+			pem, ok := bundles[v.caCert]
+			if !ok {
+				var err error
+				if pem, err = readCACert(v.caCert); err != nil {
+					u.logger.Warn("failed to re-read CA certificate, keeping current one", "vault", v.addr, "error", err)
+					continue
+				}
+				bundles[v.caCert] = pem
+			}
+			changed, err := transport.reloadCA(pem)
+			if err != nil {
+				u.logger.Warn("invalid CA certificate, keeping current one", "vault", v.addr, "error", err)
+				continue
+			}
+			if changed {
+				atomic.AddInt64(&u.caReloads, 1)
+				u.logger.Info("vault CA certificate changed, transport rebuilt", "vault", v.addr)
+			}
+		}
+	}
+}
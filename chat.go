@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const defaultChatTemplate = "{{with .Vault}}**{{.}}**: {{end}}{{.Message}}"
+
+// chatSink posts notifications to a chat tool's incoming webhook. The tools
+// differ only in the shape of the message, which format builds.
+type chatSink struct {
+	kind      string
+	url       string
+	templates messageTemplates
+	format    func(n notification, text string) interface{}
+	client    *http.Client
+}
+
+func init() {
+	registerSink("teams", singleSink(chatLoader("teams", "TEAMS", teamsMessage)))
+	registerSink("discord", singleSink(chatLoader("discord", "DISCORD", discordMessage)))
+}
+
+// chatLoader reads <PREFIX>_WEBHOOK_URL (or its _FILE variant) and
+// <PREFIX>_TEMPLATE, such as TEAMS_WEBHOOK_URL and TEAMS_TEMPLATE.
+func chatLoader(kind, prefix string, format func(n notification, text string) interface{}) func() (sink, error) {
+	return func() (sink, error) {
+		raw, err := readSecretEnv(prefix + "_WEBHOOK_URL")
+		if err != nil || raw == "" {
+			return nil, err
+		}
+		if u, err := url.Parse(raw); err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("%s_WEBHOOK_URL must be an https URL", prefix)
+		}
+		templates, err := loadTemplates(prefix+"_TEMPLATE", defaultChatTemplate)
+		if err != nil {
+			return nil, err
+		}
+		return &chatSink{
+			kind:      kind,
+			url:       raw,
+			templates: templates,
+			format:    format,
+			client:    &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	}
+}
+
+func (s *chatSink) name() string {
+	return s.kind
+}
+
+func (s *chatSink) send(ctx context.Context, n notification) error {
+	text, err := s.templates.render(n)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(s.format(n, text))
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, s.client, s.url, body, nil)
+}
+
+// teamsMessage is an Adaptive Card, which both Workflows webhooks and the
+// older Office 365 connectors accept.
+func teamsMessage(n notification, text string) interface{} {
+	color := "Good"
+	switch n.Severity {
+	case severityError, severityCritical:
+		color = "Attention"
+	case severityWarning:
+		color = "Warning"
+	}
+	card := map[string]interface{}{
+		"type":    "AdaptiveCard",
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"version": "1.4",
+		"body": []map[string]interface{}{
+			{"type": "TextBlock", "text": n.Type, "weight": "Bolder", "color": color},
+			{"type": "TextBlock", "text": text, "wrap": true},
+			{"type": "TextBlock", "text": n.Instance + " · " + n.Time.UTC().Format(time.RFC3339), "isSubtle": true, "size": "Small"},
+		},
+	}
+	return map[string]interface{}{
+		"type": "message",
+		"attachments": []map[string]interface{}{
+			{"contentType": "application/vnd.microsoft.card.adaptive", "content": card},
+		},
+	}
+}
+
+// discordMessage is an embed colored by severity.
+func discordMessage(n notification, text string) interface{} {
+	color := 0x2eb67d
+	switch n.Severity {
+	case severityError, severityCritical:
+		color = 0xe01e5a
+	case severityWarning:
+		color = 0xecb22e
+	}
+	return map[string]interface{}{
+		"username": "vault-unsealer",
+		"embeds": []map[string]interface{}{{
+			"title":       n.Type,
+			"description": text,
+			"color":       color,
+			"timestamp":   n.Time.UTC().Format(time.RFC3339),
+			"footer":      map[string]string{"text": n.Instance},
+		}},
+	}
+}
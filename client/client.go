@@ -0,0 +1,331 @@
+// Package client calls the vault-unsealer admin API. It follows the OpenAPI
+// document the unsealer serves at /api/openapi.json, one method per
+// operation, named after its operationId.
+//
+//	c := client.New("http://vault-unsealer:8080")
+//	c.Token = token // an operator token from ADMIN_TOKENS_FILE
+//	if _, err := c.UnsealVault(ctx, "vault-1.vault-internal:8200", ""); err != nil {
+//		...
+//	}
+//
+// Vaults are named by address or host, as in the API. config names the
+// VaultUnsealConfig in operator mode and is ignored when empty.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client calls the admin API of one unsealer.
+type Client struct {
+	// BaseURL is the unsealer's health server, such as
+	// http://vault-unsealer:8080.
+	BaseURL string
+	// HTTPClient defaults to a client with a two minute timeout, which
+	// leaves room for slow key providers in RefreshKeys.
+	HTTPClient *http.Client
+	// Token is sent as a bearer token, Username and Password as basic auth.
+	Token    string
+	Username string
+	Password string
+}
+
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 2 * time.Minute},
+	}
+}
+
+// Error is a response with a status code other than the operation's own. The
+// API answers with a plain text message.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("vault-unsealer: status code %d: %s", e.StatusCode, e.Message)
+}
+
+// IsStatus reports whether err is an Error with the given status code, such
+// as http.StatusConflict for a vault that is paused.
+func IsStatus(err error, code int) bool {
+	e, ok := err.(*Error)
+	return ok && e.StatusCode == code
+}
+
+type StatusResponse struct {
+	Vaults []VaultStatus `json:"vaults"`
+}
+
+type VaultStatus struct {
+	Address             string     `json:"address"`
+	Config              string     `json:"config,omitempty"`
+	State               string     `json:"state"`
+	Role                string     `json:"role,omitempty"`
+	SealType            string     `json:"seal_type,omitempty"`
+	Version             string     `json:"version,omitempty"`
+	LastCheck           *time.Time `json:"last_check,omitempty"`
+	LastUnseal          *time.Time `json:"last_unseal,omitempty"`
+	SealedSince         *time.Time `json:"sealed_since,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	CircuitOpenUntil    *time.Time `json:"circuit_open_until,omitempty"`
+	Flapping            bool       `json:"flapping,omitempty"`
+	Disabled            bool       `json:"disabled,omitempty"`
+	Paused              bool       `json:"paused,omitempty"`
+	KeyState            string     `json:"key_state"`
+	KeyAgeSeconds       int64      `json:"key_age_seconds"`
+}
+
+type VaultList struct {
+	Vaults []VaultInfo `json:"vaults"`
+}
+
+// VaultInfo is a vault with the options in effect for it and its state.
+type VaultInfo struct {
+	Address string `json:"address"`
+	Config  string `json:"config,omitempty"`
+	// Source is "configured", "registered" or "discovered".
+	Source       string        `json:"source"`
+	DiscoveredBy string        `json:"discovered_by,omitempty"`
+	Options      VaultSettings `json:"options"`
+	Status       VaultStatus   `json:"status"`
+}
+
+// VaultSettings are the effective per-vault options, formatted as in
+// VAULT_URLS. Secrets are redacted.
+type VaultSettings struct {
+	Disabled              bool    `json:"disabled"`
+	Reset                 bool    `json:"reset"`
+	Migrate               bool    `json:"migrate"`
+	Shuffle               bool    `json:"shuffle"`
+	RetryAttempts         int     `json:"retry_attempts"`
+	RetryBackoff          string  `json:"retry_backoff"`
+	RetryMultiplier       float64 `json:"retry_multiplier"`
+	RetryMaxBackoff       string  `json:"retry_max_backoff,omitempty"`
+	RetryJitter           float64 `json:"retry_jitter"`
+	BreakerThreshold      int     `json:"breaker_threshold"`
+	BreakerCooldown       string  `json:"breaker_cooldown"`
+	Group                 string  `json:"group,omitempty"`
+	EscalateAfter         int     `json:"escalate_after"`
+	Timeout               string  `json:"timeout"`
+	TLSHandshakeTimeout   string  `json:"tls_handshake_timeout"`
+	ResponseHeaderTimeout string  `json:"response_header_timeout"`
+	Init                  bool    `json:"init"`
+	RaftJoin              string  `json:"raft_join,omitempty"`
+	RaftLeaderCACert      string  `json:"raft_leader_ca_cert,omitempty"`
+	DRSecondary           string  `json:"dr_secondary"`
+	PerfStandby           string  `json:"perf_standby"`
+	Standby               string  `json:"standby"`
+	Uninitialized         string  `json:"uninitialized"`
+	HealthPath            string  `json:"health_path,omitempty"`
+	HealthQuery           string  `json:"health_query,omitempty"`
+	HealthCodes           string  `json:"health_codes,omitempty"`
+	StatusCodes           string  `json:"status_codes,omitempty"`
+	BearerToken           string  `json:"bearer_token,omitempty"`
+	BearerTokenSecret     string  `json:"bearer_token_secret,omitempty"`
+	VerifyCert            bool    `json:"verify_cert"`
+	CACert                string  `json:"ca_cert,omitempty"`
+	ServerName            string  `json:"server_name,omitempty"`
+	Proxy                 string  `json:"proxy,omitempty"`
+	ClusterID             string  `json:"cluster_id,omitempty"`
+	ClusterName           string  `json:"cluster_name,omitempty"`
+	TLSFingerprint        string  `json:"tls_fingerprint,omitempty"`
+	APIClient             string  `json:"api_client,omitempty"`
+	Mesh                  string  `json:"mesh,omitempty"`
+	Namespace             string  `json:"namespace,omitempty"`
+	ClientCert            string  `json:"client_cert,omitempty"`
+	ClientKey             string  `json:"client_key,omitempty"`
+}
+
+type UnsealAccepted struct {
+	Status string `json:"status"`
+	Vault  string `json:"vault,omitempty"`
+	All    bool   `json:"all,omitempty"`
+	Config string `json:"config,omitempty"`
+}
+
+type KeyRefresh struct {
+	Keys            int     `json:"keys"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Config          string  `json:"config,omitempty"`
+}
+
+type RegisteredVault struct {
+	Vault string `json:"vault"`
+}
+
+type VaultToggle struct {
+	Vault    string `json:"vault"`
+	Config   string `json:"config,omitempty"`
+	Disabled bool   `json:"disabled"`
+}
+
+type PauseState struct {
+	All     bool          `json:"all,omitempty"`
+	Configs []string      `json:"configs,omitempty"`
+	Vaults  []PausedVault `json:"vaults,omitempty"`
+}
+
+type PausedVault struct {
+	Config  string `json:"config,omitempty"`
+	Address string `json:"address"`
+}
+
+func (c *Client) GetStatus(ctx context.Context) (*StatusResponse, error) {
+	var out StatusResponse
+	return &out, c.do(ctx, "GET", "/status", nil, nil, http.StatusOK, &out)
+}
+
+// UnsealAll starts an unseal cycle of every vault.
+func (c *Client) UnsealAll(ctx context.Context, config string) (*UnsealAccepted, error) {
+	var out UnsealAccepted
+	query := configQuery(config)
+	query.Set("all", "true")
+	return &out, c.do(ctx, "POST", "/api/v1/unseal", query, nil, http.StatusAccepted, &out)
+}
+
+// UnsealVault starts an unseal attempt of one vault. It returns once the
+// attempt has started.
+func (c *Client) UnsealVault(ctx context.Context, vault, config string) (*UnsealAccepted, error) {
+	var out UnsealAccepted
+	return &out, c.do(ctx, "POST", "/api/v1/unseal/"+url.PathEscape(vault), configQuery(config), nil, http.StatusAccepted, &out)
+}
+
+// RefreshKeys fetches the keys from the provider and waits for the result.
+// config is required in operator mode.
+func (c *Client) RefreshKeys(ctx context.Context, config string) (*KeyRefresh, error) {
+	var out KeyRefresh
+	return &out, c.do(ctx, "POST", "/api/v1/keys/refresh", configQuery(config), nil, http.StatusOK, &out)
+}
+
+// ListVaults returns every vault, or with config, those of one
+// VaultUnsealConfig.
+func (c *Client) ListVaults(ctx context.Context, config string) (*VaultList, error) {
+	var out VaultList
+	return &out, c.do(ctx, "GET", "/api/v1/vaults", configQuery(config), nil, http.StatusOK, &out)
+}
+
+func (c *Client) GetVault(ctx context.Context, vault, config string) (*VaultInfo, error) {
+	var out VaultInfo
+	return &out, c.do(ctx, "GET", "/api/v1/vaults/"+url.PathEscape(vault), configQuery(config), nil, http.StatusOK, &out)
+}
+
+// RegisterVault adds a vault from an entry in the VAULT_URLS syntax, such as
+// "https://vault-3.example.com:8200;group=prod".
+func (c *Client) RegisterVault(ctx context.Context, entry string) (*RegisteredVault, error) {
+	var out RegisteredVault
+	body := map[string]string{"vault": entry}
+	return &out, c.do(ctx, "POST", "/api/v1/vaults", nil, body, http.StatusCreated, &out)
+}
+
+// UnregisterVault removes a vault added with RegisterVault.
+func (c *Client) UnregisterVault(ctx context.Context, vault string) error {
+	return c.do(ctx, "DELETE", "/api/v1/vaults/"+url.PathEscape(vault), nil, nil, http.StatusNoContent, nil)
+}
+
+func (c *Client) DisableVault(ctx context.Context, vault, config string) (*VaultToggle, error) {
+	var out VaultToggle
+	return &out, c.do(ctx, "POST", "/api/v1/vaults/"+url.PathEscape(vault)+"/disable", configQuery(config), nil, http.StatusOK, &out)
+}
+
+func (c *Client) EnableVault(ctx context.Context, vault, config string) (*VaultToggle, error) {
+	var out VaultToggle
+	return &out, c.do(ctx, "POST", "/api/v1/vaults/"+url.PathEscape(vault)+"/enable", configQuery(config), nil, http.StatusOK, &out)
+}
+
+func (c *Client) GetPauseState(ctx context.Context) (*PauseState, error) {
+	var out PauseState
+	return &out, c.do(ctx, "GET", "/api/v1/pause", nil, nil, http.StatusOK, &out)
+}
+
+// Pause pauses unsealing of every vault, or with config, of one
+// VaultUnsealConfig.
+func (c *Client) Pause(ctx context.Context, config string) (*PauseState, error) {
+	var out PauseState
+	return &out, c.do(ctx, "POST", "/api/v1/pause", configQuery(config), nil, http.StatusOK, &out)
+}
+
+func (c *Client) PauseVault(ctx context.Context, vault, config string) (*PauseState, error) {
+	var out PauseState
+	return &out, c.do(ctx, "POST", "/api/v1/pause/"+url.PathEscape(vault), configQuery(config), nil, http.StatusOK, &out)
+}
+
+// Resume lifts every pause, or with config, the pause of one
+// VaultUnsealConfig.
+func (c *Client) Resume(ctx context.Context, config string) (*PauseState, error) {
+	var out PauseState
+	return &out, c.do(ctx, "POST", "/api/v1/resume", configQuery(config), nil, http.StatusOK, &out)
+}
+
+func (c *Client) ResumeVault(ctx context.Context, vault, config string) (*PauseState, error) {
+	var out PauseState
+	return &out, c.do(ctx, "POST", "/api/v1/resume/"+url.PathEscape(vault), configQuery(config), nil, http.StatusOK, &out)
+}
+
+func configQuery(config string) url.Values {
+	query := url.Values{}
+	if config != "" {
+		query.Set("config", config)
+	}
+	return query
+}
+
+// do sends a request and decodes the response into out, if the status code
+// is the one the operation answers with.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body interface{}, want int, out interface{}) error {
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, payload)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	switch {
+	case c.Token != "":
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	case c.Username != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != want {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("vault-unsealer: invalid response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type operation struct {
+	OperationID string `json:"operationId"`
+	Parameters  []struct {
+		Ref    string `json:"$ref"`
+		Name   string `json:"name"`
+		In     string `json:"in"`
+		Schema struct {
+			Enum []interface{} `json:"enum"`
+		} `json:"schema"`
+	} `json:"parameters"`
+	RequestBody json.RawMessage            `json:"requestBody"`
+	Responses   map[string]json.RawMessage `json:"responses"`
+}
+
+// TestClientMatchesOpenAPI calls every operation of the unsealer's OpenAPI
+// document through the method named after its operationId, and checks the
+// method, path, query, body and expected status code against the document.
+func TestClientMatchesOpenAPI(t *testing.T) {
+	data, err := os.ReadFile("../openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		t.Fatal(err)
+	}
+
+	operations := 0
+	for path, methods := range spec.Paths {
+		for method, raw := range methods {
+			var op operation
+			if json.Unmarshal(raw, &op) != nil || op.OperationID == "" {
+				continue
+			}
+			operations++
+			t.Run(op.OperationID, func(t *testing.T) {
+				checkOperation(t, strings.ToUpper(method), path, op)
+			})
+		}
+	}
+	if n := reflect.TypeOf(&Client{}).NumMethod(); n != operations {
+		t.Errorf("Client has %d methods, the OpenAPI document %d operations", n, operations)
+	}
+}
+
+func checkOperation(t *testing.T, method, path string, op operation) {
+	status := 0
+	for code := range op.Responses {
+		if n, err := strconv.Atoi(code); err == nil && n >= 200 && n < 300 {
+			status = n
+		}
+	}
+	if status == 0 {
+		t.Fatalf("no success response in the OpenAPI document")
+	}
+
+	name := strings.ToUpper(op.OperationID[:1]) + op.OperationID[1:]
+	m := reflect.ValueOf(New("")).MethodByName(name)
+	if !m.IsValid() {
+		t.Fatalf("Client has no method %s", name)
+	}
+	args := []reflect.Value{reflect.ValueOf(context.Background())}
+	wantPath, wantQuery := path, url.Values{}
+	for _, p := range op.Parameters {
+		switch p.Ref {
+		case "#/components/parameters/vault":
+			args = append(args, reflect.ValueOf("vault-1"))
+			wantPath = strings.ReplaceAll(wantPath, "{vault}", "vault-1")
+		case "#/components/parameters/config":
+			args = append(args, reflect.ValueOf("prod"))
+			wantQuery.Set("config", "prod")
+		default:
+			// Inline parameters with a single allowed value, such as all=true,
+			// are set by the method itself.
+			if p.In == "query" && len(p.Schema.Enum) == 1 {
+				wantQuery.Set(p.Name, fmt.Sprint(p.Schema.Enum[0]))
+				continue
+			}
+			t.Fatalf("unknown parameter %s%s", p.Ref, p.Name)
+		}
+	}
+	if op.RequestBody != nil {
+		args = append(args, reflect.ValueOf("https://vault-1:8200"))
+	}
+	if m.Type().NumIn() != len(args) {
+		t.Fatalf("%s takes %d arguments, want %d", name, m.Type().NumIn(), len(args))
+	}
+
+	var got *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+		if status != http.StatusNoContent {
+			w.Write([]byte("{}"))
+		}
+	}))
+	defer srv.Close()
+	c := New(srv.URL)
+	out := reflect.ValueOf(c).MethodByName(name).Call(args)
+	if err := out[len(out)-1].Interface(); err != nil {
+		t.Fatalf("%s() error = %v", name, err)
+	}
+	if got.Method != method || got.URL.Path != wantPath {
+		t.Errorf("%s() sent %s %s, want %s %s", name, got.Method, got.URL.Path, method, wantPath)
+	}
+	if query := got.URL.Query(); !reflect.DeepEqual(query, wantQuery) {
+		t.Errorf("%s() sent query %v, want %v", name, query, wantQuery)
+	}
+	if (len(body) > 0) != (op.RequestBody != nil) {
+		t.Errorf("%s() sent body %q, OpenAPI request body %s", name, body, op.RequestBody)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+type cycleIDKey struct{}
+type requestIDKey struct{}
+
+func newCorrelationID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withCycleID starts a new unseal cycle, a pass over one or more vaults.
+func withCycleID(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cycleIDKey{}, newCorrelationID(4))
+}
+
+// withRequestID starts the attempt on a single vault within the current
+// cycle. The request ID embeds the cycle ID, so it alone is enough to find
+// both in the logs. It is sent to Vault as X-Request-Id.
+func withRequestID(ctx context.Context) context.Context {
+	cycle, ok := ctx.Value(cycleIDKey{}).(string)
+	if !ok {
+		ctx = withCycleID(ctx)
+		cycle = ctx.Value(cycleIDKey{}).(string)
+	}
+	return context.WithValue(ctx, requestIDKey{}, cycle+"-"+newCorrelationID(2))
+}
+
+func cycleIDOf(ctx context.Context) string {
+	id, _ := ctx.Value(cycleIDKey{}).(string)
+	return id
+}
+
+func requestIDOf(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// log returns the logger with the correlation IDs of ctx attached.
+func (u *Unsealer) log(ctx context.Context) hclog.Logger {
+	var args []interface{}
+	if id := cycleIDOf(ctx); id != "" {
+		args = append(args, "cycle_id", id)
+	}
+	if id := requestIDOf(ctx); id != "" {
+		args = append(args, "request_id", id)
+	}
+	if len(args) == 0 {
+		return u.logger
+	}
+	return u.logger.With(args...)
+}
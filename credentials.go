@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// checkVaultCredentials makes sure the key provider can read the secrets
+// referenced by the vault configuration.
+func checkVaultCredentials(vaults []*vaultConfig, provider keyProvider) error {
+	_, canRead := provider.(secretSource)
+	for _, v := range vaults {
+		if (v.clientCert != "" && v.clientKey == "") || (v.clientCert == "" && v.clientKey != "") {
+			return fmt.Errorf("vault %s: client_cert and client_key must be set together", v.addr)
+		}
+		if canRead {
+			continue
+		}
+		for option, ref := range map[string]string{
+			"bearer_token_secret": v.bearerSecret,
+			"client_cert":         secretRef(v.clientCert),
+			"client_key":          secretRef(v.clientKey),
+		} {
+			if ref != "" {
+				return fmt.Errorf("vault %s: reading %s from the key provider is not supported by it", v.addr, option)
+			}
+		}
+	}
+	return nil
+}
+
+// refreshVaultCredentials re-reads bearer tokens and client certificates.
+func (u *Unsealer) refreshVaultCredentials() {
+	u.refreshBearerTokens()
+	u.refreshClientCerts()
+}
+
+// refreshBearerTokens re-reads provider-backed bearer tokens. A token that
+// cannot be read keeps its previous value.
+func (u *Unsealer) refreshBearerTokens() {
+	source, ok := u.getProvider().(secretSource)
+	if !ok {
+		return
+	}
+
+	tokens := make(map[string]string)
+	for _, v := range u.vaultList() {
+		if v.bearerSecret == "" {
+			continue
+		}
+		token, ok := tokens[v.bearerSecret]
+		if !ok {
+			var err error
+			if token, err = source.fetchSecret(v.bearerSecret); err != nil {
+				u.logger.Warn("failed to read bearer token, keeping current token", "vault", v.addr, "error", err)
+				continue
+			}
+			tokens[v.bearerSecret] = token
+		}
+		v.state.setBearerToken(token)
+	}
+}
+
+// secretRef returns the provider reference of a "secret:<ref>" value, or ""
+// when the value is a file path.
+func secretRef(value string) string {
+	ref, _ := strings.CutPrefix(value, "secret:")
+	if ref == value {
+		return ""
+	}
+	return ref
+}
+
+// readPEM reads a PEM document from a file or, for "secret:<ref>" values,
+// from the key provider.
+func (u *Unsealer) readPEM(value string) ([]byte, error) {
+	if ref := secretRef(value); ref != "" {
+		source, ok := u.getProvider().(secretSource)
+		if !ok {
+			return nil, fmt.Errorf("key provider cannot read secrets")
+		}
+		data, err := source.fetchSecret(ref)
+		return []byte(data), err
+	}
+	return os.ReadFile(value)
+}
+
+// refreshClientCerts loads the client certificate of every vault that uses
+// mutual TLS. A certificate that cannot be loaded keeps its previous value.
+func (u *Unsealer) refreshClientCerts() {
+	for _, v := range u.vaultList() {
+		if v.clientCert == "" {
+			continue
+		}
+		certPEM, err := u.readPEM(v.clientCert)
+		if err != nil {
+			u.logger.Warn("failed to read client certificate, keeping current one", "vault", v.addr, "error", err)
+			continue
+		}
+		keyPEM, err := u.readPEM(v.clientKey)
+		if err != nil {
+			u.logger.Warn("failed to read client key, keeping current one", "vault", v.addr, "error", err)
+			continue
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			u.logger.Warn("invalid client certificate, keeping current one", "vault", v.addr, "error", err)
+			continue
+		}
+		v.state.setClientCert(&cert)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// condition is an ongoing problem that was notified about, such as a vault
+// that is still sealed. Further events of the same type for the same vault
+// are suppressed until an event resolves it, apart from a reminder every
+// NOTIFY_REMINDER_INTERVAL.
+type condition struct {
+	last       notification
+	since      time.Time
+	sent       time.Time
+	suppressed int
+}
+
+// conditionTypes are the event types that start a condition: those that
+// alertResolutions can resolve.
+var conditionTypes = func() map[string]bool {
+	types := map[string]bool{}
+	for _, started := range alertResolutions {
+		for _, t := range started {
+			types[t] = true
+		}
+	}
+	return types
+}()
+
+func conditionKey(eventType, config, vault string) string {
+	return eventType + "|" + config + "|" + vault
+}
+
+// loadDedup reads NOTIFY_DEDUP and NOTIFY_REMINDER_INTERVAL.
+func (n *notifier) loadDedup() error {
+	if getEnv("NOTIFY_DEDUP", "true") != "true" {
+		return nil
+	}
+	reminder, err := time.ParseDuration(getEnv("NOTIFY_REMINDER_INTERVAL", "4h"))
+	if err != nil || reminder < 0 {
+		return fmt.Errorf("NOTIFY_REMINDER_INTERVAL must be a non-negative duration")
+	}
+	n.conditions = map[string]*condition{}
+	n.reminder = reminder
+	return nil
+}
+
+// track updates the conditions with msg and reports whether msg should be
+// sent: it starts a new condition or does not belong to one.
+func (n *notifier) track(msg notification) bool {
+	n.conditionsMu.Lock()
+	defer n.conditionsMu.Unlock()
+	for _, t := range alertResolutions[msg.Type] {
+		delete(n.conditions, conditionKey(t, msg.Config, msg.Vault))
+	}
+	if msg.Type == historyVaultRemoved {
+		n.forget(msg.Config, msg.Vault)
+	}
+	if !conditionTypes[msg.Type] {
+		return true
+	}
+	key := conditionKey(msg.Type, msg.Config, msg.Vault)
+	if c, ok := n.conditions[key]; ok {
+		c.last = msg
+		c.suppressed++
+		return false
+	}
+	n.conditions[key] = &condition{last: msg, since: msg.Time, sent: msg.Time}
+	return true
+}
+
+// vaultUnsealed ends the conditions of a vault that was unsealed without an
+// unseal_succeeded event, for example by hand.
+func (n *notifier) vaultUnsealed(config, vault string) {
+	if n.conditions == nil {
+		return
+	}
+	n.conditionsMu.Lock()
+	defer n.conditionsMu.Unlock()
+	n.forget(config, vault)
+}
+
+func (n *notifier) forget(config, vault string) {
+	suffix := "|" + config + "|" + vault
+	for key := range n.conditions {
+		if strings.HasSuffix(key, suffix) {
+			delete(n.conditions, key)
+		}
+	}
+}
+
+// remind resends the conditions that have not been notified about for the
+// reminder interval, with the latest event of each.
+func (n *notifier) remind(now time.Time) {
+	n.conditionsMu.Lock()
+	var due []notification
+	for _, c := range n.conditions {
+		if now.Sub(c.sent) < n.reminder {
+			continue
+		}
+		msg := c.last
+		msg.Message = fmt.Sprintf("still unresolved after %s: %s", now.Sub(c.since).Round(time.Minute), msg.Message)
+		msg.Reminder = true
+		msg.Since = c.since
+		msg.Suppressed = c.suppressed
+		due = append(due, msg)
+		c.sent = now
+		c.suppressed = 0
+	}
+	n.conditionsMu.Unlock()
+	for _, msg := range due {
+		n.enqueue(msg)
+	}
+}
+
+// rateLimiter is a token bucket that allows a number of notifications per
+// minute, in bursts of up to the same number.
+type rateLimiter struct {
+	mu      sync.Mutex
+	perMin  float64
+	tokens  float64
+	last    time.Time
+	dropped int
+}
+
+// rateLimitEnv reads NOTIFY_RATE_LIMIT, the notifications per minute and
+// sink. It returns 0 when rate limiting is disabled.
+func rateLimitEnv() (int, error) {
+	limit, err := strconv.Atoi(getEnv("NOTIFY_RATE_LIMIT", "20"))
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("NOTIFY_RATE_LIMIT must be a non-negative number")
+	}
+	return limit, nil
+}
+
+func newRateLimiter(perMin int) *rateLimiter {
+	if perMin == 0 {
+		return nil
+	}
+	return &rateLimiter{perMin: float64(perMin), tokens: float64(perMin), last: time.Now()}
+}
+
+// allow takes a token if there is one. When notifications were dropped
+// before, it also returns how many.
+func (l *rateLimiter) allow(now time.Time) (ok bool, dropped int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens += now.Sub(l.last).Minutes() * l.perMin
+	if l.tokens > l.perMin {
+		l.tokens = l.perMin
+	}
+	l.last = now
+	if l.tokens < 1 {
+		l.dropped++
+		return false, l.dropped
+	}
+	l.tokens--
+	dropped, l.dropped = l.dropped, 0
+	return true, dropped
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	l := &rateLimiter{perMin: 2, tokens: 2, last: start}
+	tests := []struct {
+		after   time.Duration
+		ok      bool
+		dropped int
+	}{
+		{0, true, 0},
+		{0, true, 0},
+		{0, false, 1},
+		{10 * time.Second, false, 2},
+		// Half a minute refills one token and reports the two dropped.
+		{30 * time.Second, true, 2},
+		{30 * time.Second, false, 1},
+		// The bucket never holds more than a minute's worth.
+		{time.Hour, true, 1},
+		{time.Hour, true, 0},
+		{time.Hour, false, 1},
+	}
+	for i, tt := range tests {
+		ok, dropped := l.allow(start.Add(tt.after))
+		if ok != tt.ok || dropped != tt.dropped {
+			t.Errorf("call %d at +%s: allow() = %v, %d, want %v, %d", i+1, tt.after, ok, dropped, tt.ok, tt.dropped)
+		}
+	}
+}
+
+func TestNewRateLimiterDisabled(t *testing.T) {
+	if l := newRateLimiter(0); l != nil {
+		t.Errorf("newRateLimiter(0) = %+v, want nil", l)
+	}
+}
+
+func TestTrack(t *testing.T) {
+	n := &notifier{conditions: map[string]*condition{}}
+	now := time.Now()
+	event := func(eventType, vault string) notification {
+		return notification{Type: eventType, Config: "default", Vault: vault, Time: now}
+	}
+	tests := []struct {
+		msg  notification
+		want bool
+	}{
+		{event(historySealDetected, "https://a"), true},
+		{event(historySealDetected, "https://a"), false},
+		{event(historySealDetected, "https://b"), true},
+		{event(historyUnsealFailure, "https://a"), true},
+		{event(historyUnsealFailure, "https://a"), false},
+		// Events that start no condition are always sent.
+		{event(historyKeyRefresh, ""), true},
+		{event(historyKeyRefresh, ""), true},
+		// An unseal resolves the conditions of its vault only.
+		{event(historyUnsealSuccess, "https://a"), true},
+		{event(historySealDetected, "https://a"), true},
+		{event(historySealDetected, "https://b"), false},
+		// A removed vault forgets all its conditions.
+		{event(historyVaultRemoved, "https://b"), true},
+		{event(historySealDetected, "https://b"), true},
+	}
+	for i, tt := range tests {
+		if got := n.track(tt.msg); got != tt.want {
+			t.Errorf("event %d (%s on %s): track() = %v, want %v", i+1, tt.msg.Type, tt.msg.Vault, got, tt.want)
+		}
+	}
+	if c := n.conditions[conditionKey(historyUnsealFailure, "default", "https://a")]; c != nil {
+		t.Errorf("unseal_failed condition of https://a survived the unseal")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// startDiagnosticsServer serves pprof and expvar on their own listener, so
+// they can stay off the port that Prometheus and the kubelet are allowed to
+// reach. Profiles can be taken in place, for example with
+// "go tool pprof http://localhost:6060/debug/pprof/heap".
+func (u *Unsealer) startDiagnosticsServer(addr string) {
+	expvar.Publish("unsealer", expvar.Func(func() interface{} { return u.allMetrics() }))
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	server := &http.Server{
+		Addr:        addr,
+		Handler:     mux,
+		ReadTimeout: 5 * time.Second,
+		// CPU profiles and traces stream for as long as the seconds
+		// parameter asks, 30 by default.
+		WriteTimeout: 5 * time.Minute,
+		IdleTimeout:  120 * time.Second,
+	}
+	u.logger.Info("diagnostics server starting", "addr", addr)
+	if err := server.ListenAndServe(); err != nil {
+		u.logger.Error("diagnostics server failed", "error", err)
+	}
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// discoverer finds vault addresses at runtime, in addition to VAULT_URLS.
+type discoverer interface {
+	discover(ctx context.Context) ([]discoveredVault, error)
+}
+
+// discoveredVault is a discovered address and the pod or service it belongs
+// to, if known.
+type discoveredVault struct {
+	addr string
+	ref  *objectRef
+}
+
+func sortDiscovered(vaults []discoveredVault) {
+	sort.Slice(vaults, func(i, j int) bool { return vaults[i].addr < vaults[j].addr })
+}
+
+func newDiscoverer(mode string) (discoverer, error) {
+	d, err := newModeDiscoverer(mode)
+	if err != nil || d == nil {
+		return d, err
+	}
+	include, err := compileFilters(os.Getenv("DISCOVERY_INCLUDE"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DISCOVERY_INCLUDE: %w", err)
+	}
+	exclude, err := compileFilters(os.Getenv("DISCOVERY_EXCLUDE"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DISCOVERY_EXCLUDE: %w", err)
+	}
+	if len(include) == 0 && len(exclude) == 0 {
+		return d, nil
+	}
+	return &filteredDiscoverer{d: d, include: include, exclude: exclude}, nil
+}
+
+func newModeDiscoverer(mode string) (discoverer, error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case "dns":
+		return newDNSDiscoverer()
+	case "kubernetes", "statefulset", "annotations":
+	default:
+		return nil, fmt.Errorf("unknown VAULT_DISCOVERY %q", mode)
+	}
+
+	targets, err := kubeTargets()
+	if err != nil {
+		return nil, err
+	}
+	var multi multiDiscoverer
+	for _, kube := range targets {
+		var d discoverer
+		switch mode {
+		case "kubernetes":
+			d, err = newEndpointsDiscoverer(kube)
+		case "statefulset":
+			d, err = newStatefulSetDiscoverer(kube)
+		case "annotations":
+			d = newAnnotationDiscoverer(kube)
+		}
+		if err != nil {
+			return nil, err
+		}
+		multi = append(multi, d)
+	}
+	if len(multi) == 1 {
+		return multi[0], nil
+	}
+	return multi, nil
+}
+
+// multiDiscoverer merges the vaults found in several namespaces or clusters.
+// A target that fails fails the whole run, so the previous vault list is kept
+// instead of dropping that target's vaults.
+type multiDiscoverer []discoverer
+
+func (m multiDiscoverer) discover(ctx context.Context) ([]discoveredVault, error) {
+	seen := make(map[string]bool)
+	var vaults []discoveredVault
+	for _, d := range m {
+		found, err := d.discover(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, dv := range found {
+			if !seen[dv.addr] {
+				seen[dv.addr] = true
+				vaults = append(vaults, dv)
+			}
+		}
+	}
+	sortDiscovered(vaults)
+	return vaults, nil
+}
+
+// filteredDiscoverer drops discovered vaults that do not match any include
+// pattern or match an exclude pattern. Patterns are checked against the
+// address and the name of the pod or service the vault was found through.
+type filteredDiscoverer struct {
+	d       discoverer
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// compileFilters parses a comma-separated list of patterns. Patterns starting
+// with "re:" are regular expressions, the others globs where * matches any
+// run of characters and ? a single one, matched against the whole value.
+func compileFilters(value string) ([]*regexp.Regexp, error) {
+	var filters []*regexp.Regexp
+	for _, pattern := range splitList(value) {
+		re, err := compilePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, re)
+	}
+	return filters, nil
+}
+
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	expr, ok := strings.CutPrefix(pattern, "re:")
+	if !ok {
+		expr = regexp.QuoteMeta(pattern)
+		expr = strings.ReplaceAll(expr, `\*`, ".*")
+		expr = strings.ReplaceAll(expr, `\?`, ".")
+		expr = "^" + expr + "$"
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("pattern %q: %w", pattern, err)
+	}
+	return re, nil
+}
+
+func (f *filteredDiscoverer) discover(ctx context.Context) ([]discoveredVault, error) {
+	found, err := f.d.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	vaults := found[:0]
+	for _, dv := range found {
+		values := []string{dv.addr}
+		if dv.ref != nil {
+			values = append(values, dv.ref.name)
+		}
+		if len(f.include) > 0 && !matchesAny(f.include, values) || matchesAny(f.exclude, values) {
+			continue
+		}
+		vaults = append(vaults, dv)
+	}
+	return vaults, nil
+}
+
+func matchesAny(filters []*regexp.Regexp, values []string) bool {
+	for _, re := range filters {
+		for _, value := range values {
+			if re.MatchString(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// endpointsDiscoverer lists the endpoints of the services matching a label
+// selector. Not-ready endpoints are included on purpose: a sealed vault pod
+// fails its readiness probe.
+type endpointsDiscoverer struct {
+	kube     *kubeClient
+	selector string
+	portName string
+	scheme   string
+}
+
+func newEndpointsDiscoverer(kube *kubeClient) (*endpointsDiscoverer, error) {
+	selector := getEnv("KUBERNETES_LABEL_SELECTOR", "")
+	if selector == "" {
+		return nil, fmt.Errorf("VAULT_DISCOVERY=kubernetes requires KUBERNETES_LABEL_SELECTOR")
+	}
+	return &endpointsDiscoverer{
+		kube:     kube,
+		selector: selector,
+		portName: getEnv("VAULT_PORT_NAME", "http"),
+		scheme:   getEnv("VAULT_SCHEME", "https"),
+	}, nil
+}
+
+type endpointSliceList struct {
+	Items []struct {
+		Endpoints []struct {
+			Addresses []string     `json:"addresses"`
+			TargetRef *endpointRef `json:"targetRef"`
+		} `json:"endpoints"`
+		Ports []endpointPort `json:"ports"`
+	} `json:"items"`
+}
+
+type endpointsList struct {
+	Items []struct {
+		Subsets []struct {
+			Addresses         []endpointAddress `json:"addresses"`
+			NotReadyAddresses []endpointAddress `json:"notReadyAddresses"`
+			Ports             []endpointPort    `json:"ports"`
+		} `json:"subsets"`
+	} `json:"items"`
+}
+
+type endpointAddress struct {
+	IP        string       `json:"ip"`
+	TargetRef *endpointRef `json:"targetRef"`
+}
+
+type endpointRef struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	UID       string `json:"uid"`
+}
+
+type endpointPort struct {
+	Name string `json:"name"`
+	Port int    `json:"port"`
+}
+
+func (d *endpointsDiscoverer) discover(ctx context.Context) ([]discoveredVault, error) {
+	query := "?labelSelector=" + url.QueryEscape(d.selector)
+	found := make(map[string]*objectRef)
+
+	var slices endpointSliceList
+	err := d.kube.get(ctx, "/apis/discovery.k8s.io/v1/namespaces/"+d.kube.namespace+"/endpointslices"+query, &slices)
+	switch {
+	case err == nil:
+		for _, slice := range slices.Items {
+			port, ok := d.port(slice.Ports)
+			if !ok {
+				continue
+			}
+			for _, ep := range slice.Endpoints {
+				for _, ip := range ep.Addresses {
+					found[d.addr(ip, port)] = d.ref(ep.TargetRef)
+				}
+			}
+		}
+	case isKubeStatus(err, 404) || isKubeStatus(err, 403):
+		// Older clusters or roles without access to EndpointSlices.
+		var endpoints endpointsList
+		if err := d.kube.get(ctx, "/api/v1/namespaces/"+d.kube.namespace+"/endpoints"+query, &endpoints); err != nil {
+			return nil, fmt.Errorf("failed to list endpoints: %w", err)
+		}
+		for _, item := range endpoints.Items {
+			for _, subset := range item.Subsets {
+				port, ok := d.port(subset.Ports)
+				if !ok {
+					continue
+				}
+				for _, a := range append(subset.Addresses, subset.NotReadyAddresses...) {
+					found[d.addr(a.IP, port)] = d.ref(a.TargetRef)
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("failed to list endpoint slices: %w", err)
+	}
+
+	vaults := make([]discoveredVault, 0, len(found))
+	for addr, ref := range found {
+		vaults = append(vaults, discoveredVault{addr: addr, ref: ref})
+	}
+	sortDiscovered(vaults)
+	return vaults, nil
+}
+
+func (d *endpointsDiscoverer) port(ports []endpointPort) (int, bool) {
+	for _, p := range ports {
+		if p.Name == d.portName {
+			return p.Port, true
+		}
+	}
+	if len(ports) == 1 && d.portName == "" {
+		return ports[0].Port, true
+	}
+	return 0, false
+}
+
+func (d *endpointsDiscoverer) addr(ip string, port int) string {
+	return d.scheme + "://" + net.JoinHostPort(ip, strconv.Itoa(port))
+}
+
+// ref returns the pod behind an endpoint, if the endpoint names one.
+func (d *endpointsDiscoverer) ref(target *endpointRef) *objectRef {
+	if target == nil || target.Kind != "Pod" {
+		return nil
+	}
+	namespace := target.Namespace
+	if namespace == "" {
+		namespace = d.kube.namespace
+	}
+	return podRef(d.kube, namespace, target.Name, target.UID)
+}
+
+// statefulSetDiscoverer addresses every pod of a StatefulSet through its
+// headless service, e.g. vault-0.vault-internal.vault.svc:8200, so each Raft
+// member is reached individually instead of through the service VIP.
+type statefulSetDiscoverer struct {
+	kube        *kubeClient
+	name        string
+	serviceName string
+	port        string
+	scheme      string
+}
+
+func newStatefulSetDiscoverer(kube *kubeClient) (*statefulSetDiscoverer, error) {
+	name := getEnv("KUBERNETES_STATEFULSET", "")
+	if name == "" {
+		return nil, fmt.Errorf("VAULT_DISCOVERY=statefulset requires KUBERNETES_STATEFULSET")
+	}
+	port := getEnv("VAULT_PORT", "8200")
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return nil, fmt.Errorf("invalid VAULT_PORT %q", port)
+	}
+	return &statefulSetDiscoverer{
+		kube:        kube,
+		name:        name,
+		serviceName: getEnv("VAULT_HEADLESS_SERVICE", ""),
+		port:        port,
+		scheme:      getEnv("VAULT_SCHEME", "https"),
+	}, nil
+}
+
+func (d *statefulSetDiscoverer) discover(ctx context.Context) ([]discoveredVault, error) {
+	var sts struct {
+		Spec struct {
+			Replicas    *int   `json:"replicas"`
+			ServiceName string `json:"serviceName"`
+		} `json:"spec"`
+	}
+	if err := d.kube.get(ctx, "/apis/apps/v1/namespaces/"+d.kube.namespace+"/statefulsets/"+d.name, &sts); err != nil {
+		return nil, fmt.Errorf("failed to read statefulset %s: %w", d.name, err)
+	}
+
+	replicas := 1
+	if sts.Spec.Replicas != nil {
+		replicas = *sts.Spec.Replicas
+	}
+	service := d.serviceName
+	if service == "" {
+		service = sts.Spec.ServiceName
+	}
+	if service == "" {
+		return nil, fmt.Errorf("statefulset %s has no serviceName, set VAULT_HEADLESS_SERVICE", d.name)
+	}
+
+	vaults := make([]discoveredVault, 0, replicas)
+	for i := 0; i < replicas; i++ {
+		pod := fmt.Sprintf("%s-%d", d.name, i)
+		host := pod + "." + service + "." + d.kube.namespace + ".svc"
+		vaults = append(vaults, discoveredVault{
+			addr: d.scheme + "://" + net.JoinHostPort(host, d.port),
+			ref:  podRef(d.kube, d.kube.namespace, pod, ""),
+		})
+	}
+	return vaults, nil
+}
+
+// dnsDiscoverer resolves a headless service name to the addresses of all its
+// pods. It needs no API access at all.
+type dnsDiscoverer struct {
+	name   string
+	port   string
+	scheme string
+}
+
+func newDNSDiscoverer() (*dnsDiscoverer, error) {
+	name := getEnv("VAULT_DNS_NAME", "")
+	if name == "" {
+		return nil, fmt.Errorf("VAULT_DISCOVERY=dns requires VAULT_DNS_NAME")
+	}
+	port := getEnv("VAULT_PORT", "8200")
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return nil, fmt.Errorf("invalid VAULT_PORT %q", port)
+	}
+	return &dnsDiscoverer{name: name, port: port, scheme: getEnv("VAULT_SCHEME", "https")}, nil
+}
+
+func (d *dnsDiscoverer) discover(ctx context.Context) ([]discoveredVault, error) {
+	ips, err := net.DefaultResolver.LookupHost(ctx, d.name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", d.name, err)
+	}
+	vaults := make([]discoveredVault, 0, len(ips))
+	for _, ip := range ips {
+		vaults = append(vaults, discoveredVault{addr: d.scheme + "://" + net.JoinHostPort(ip, d.port)})
+	}
+	sortDiscovered(vaults)
+	return vaults, nil
+}
+
+const (
+	annotationEnabled = "unsealer.mackcoding.io/enabled"
+	annotationPort    = "unsealer.mackcoding.io/port"
+	annotationScheme  = "unsealer.mackcoding.io/scheme"
+)
+
+// annotationDiscoverer finds the pods and services that opted in to unsealing
+// through the unsealer.mackcoding.io/enabled annotation. Pods are addressed by
+// IP, services by their cluster DNS name.
+type annotationDiscoverer struct {
+	kube     *kubeClient
+	selector string
+	scheme   string
+}
+
+func newAnnotationDiscoverer(kube *kubeClient) *annotationDiscoverer {
+	return &annotationDiscoverer{
+		kube:     kube,
+		selector: getEnv("KUBERNETES_LABEL_SELECTOR", ""),
+		scheme:   getEnv("VAULT_SCHEME", "https"),
+	}
+}
+
+type annotatedObject struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		UID         string            `json:"uid"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Status struct {
+		PodIP string `json:"podIP"`
+	} `json:"status"`
+}
+
+func (d *annotationDiscoverer) discover(ctx context.Context) ([]discoveredVault, error) {
+	query := ""
+	if d.selector != "" {
+		query = "?labelSelector=" + url.QueryEscape(d.selector)
+	}
+	base := "/api/v1/namespaces/" + d.kube.namespace
+
+	var pods, services struct {
+		Items []annotatedObject `json:"items"`
+	}
+	if err := d.kube.get(ctx, base+"/pods"+query, &pods); err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+	if err := d.kube.get(ctx, base+"/services"+query, &services); err != nil {
+		return nil, fmt.Errorf("failed to list services: %w", err)
+	}
+
+	var vaults []discoveredVault
+	for _, p := range pods.Items {
+		if p.Status.PodIP == "" {
+			continue
+		}
+		if addr, ok := d.addr(&p, p.Status.PodIP); ok {
+			ref := podRef(d.kube, p.Metadata.Namespace, p.Metadata.Name, p.Metadata.UID)
+			vaults = append(vaults, discoveredVault{addr: addr, ref: ref})
+		}
+	}
+	for _, s := range services.Items {
+		if addr, ok := d.addr(&s, s.Metadata.Name+"."+s.Metadata.Namespace+".svc"); ok {
+			ref := &objectRef{kube: d.kube, apiVersion: "v1", kind: "Service", namespace: s.Metadata.Namespace, name: s.Metadata.Name, uid: s.Metadata.UID}
+			vaults = append(vaults, discoveredVault{addr: addr, ref: ref})
+		}
+	}
+	sortDiscovered(vaults)
+	return vaults, nil
+}
+
+// addr returns the address of an object that opted in. Objects with an
+// invalid port annotation are skipped.
+func (d *annotationDiscoverer) addr(obj *annotatedObject, host string) (string, bool) {
+	annotations := obj.Metadata.Annotations
+	if annotations[annotationEnabled] != "true" {
+		return "", false
+	}
+	port := annotations[annotationPort]
+	if port == "" {
+		port = "8200"
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", false
+	}
+	scheme := annotations[annotationScheme]
+	if scheme != "http" && scheme != "https" {
+		scheme = d.scheme
+	}
+	return scheme + "://" + net.JoinHostPort(host, port), true
+}
+
+// discover refreshes the discovered part of the vault list. Vaults that are
+// still present keep their state; new ones start from the global defaults.
+func (u *Unsealer) discover(ctx context.Context) {
+	found, err := u.discoverer.discover(ctx)
+	if err != nil {
+		u.logger.Warn("vault discovery failed, keeping current vault list", "error", err)
+		return
+	}
+
+	u.vaultsMu.Lock()
+	current := make(map[string]*vaultConfig, len(u.vaults))
+	for _, v := range u.vaults {
+		current[v.addr] = v
+	}
+	vaults := append([]*vaultConfig(nil), u.staticVaults...)
+	for _, e := range u.registered {
+		vaults = append(vaults, e.vault)
+	}
+	seen := make(map[string]bool)
+	for _, v := range vaults {
+		seen[v.addr] = true
+	}
+
+	added := 0
+	for _, dv := range found {
+		addr := dv.addr
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		if v, ok := current[addr]; ok {
+			vaults = append(vaults, v)
+			continue
+		}
+		v, err := parseVaultSpec(addr, u.vaultDefaults)
+		if err == nil {
+			err = v.connect(u.tlsPolicy)
+		}
+		if err != nil {
+			u.logger.Warn("ignoring discovered vault", "vault", addr, "error", err)
+			continue
+		}
+		v.ref = dv.ref
+		u.logger.Info("vault discovered", "vault", addr)
+		u.record(ctx, historyVaultAdded, severityInfo, v, "vault discovered")
+		vaults = append(vaults, v)
+		added++
+	}
+	for addr, v := range current {
+		if !seen[addr] {
+			u.logger.Info("vault no longer discovered", "vault", addr)
+			u.record(ctx, historyVaultRemoved, severityInfo, v, "vault no longer discovered")
+		}
+	}
+	u.vaults = vaults
+	u.vaultsMu.Unlock()
+
+	if added > 0 {
+		u.refreshVaultCredentials()
+	}
+}
+
+func (u *Unsealer) discoveryLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			u.discover(ctx)
+		}
+	}
+}
+
+// vaultList returns the current vault list. The slice is replaced, never
+// modified, so callers may iterate it without holding the lock.
+func (u *Unsealer) vaultList() []*vaultConfig {
+	u.vaultsMu.RLock()
+	defer u.vaultsMu.RUnlock()
+	return u.vaults
+}
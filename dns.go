@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// dnsRefreshLoop re-resolves vault host names. When the addresses behind a
+// name change, idle keep-alive connections to the old addresses are closed so
+// the next request dials the new ones.
+func (u *Unsealer) dnsRefreshLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, v := range u.vaultList() {
+				u.resolveVault(ctx, v)
+			}
+		}
+	}
+}
+
+func (u *Unsealer) resolveVault(ctx context.Context, v *vaultConfig) {
+	parsed, err := url.Parse(v.addr)
+	if err != nil || net.ParseIP(parsed.Hostname()) != nil {
+		return
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, parsed.Hostname())
+	if err != nil {
+		u.logger.Debug("failed to resolve vault host", "vault", v.addr, "error", err)
+		return
+	}
+	sort.Strings(addrs)
+	resolved := strings.Join(addrs, ",")
+
+	if prev := v.state.setResolved(resolved); prev != "" && prev != resolved {
+		atomic.AddInt64(&u.dnsChanges, 1)
+		u.logger.Info("vault address changed, reconnecting", "vault", v.addr, "previous", prev, "current", resolved)
+		v.client.CloseIdleConnections()
+	}
+}
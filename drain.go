@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// drainTaints mark nodes that are being drained or are about to be removed:
+// cordons, the cluster autoscaler and Karpenter, and the spot interruption
+// handlers of AWS and GKE.
+var drainTaints = []string{
+	"node.kubernetes.io/unschedulable",
+	"node.cloudprovider.kubernetes.io/shutdown",
+	"ToBeDeletedByClusterAutoscaler",
+	"karpenter.sh/disrupted",
+	"karpenter.sh/disruption",
+	"aws-node-termination-handler/spot-itn",
+	"aws-node-termination-handler/rebalance-recommendation",
+	"aws-node-termination-handler/asg-lifecycle-termination",
+	"aws-node-termination-handler/scheduled-maintenance",
+	"cloud.google.com/impending-node-termination",
+}
+
+// drainWatcher finds vault pods on nodes that are being drained or
+// interrupted. Their vaults are polled at a short interval for a while, so
+// they are unsealed within seconds of being rescheduled.
+type drainWatcher struct {
+	logger   hclog.Logger
+	targets  []*kubeClient
+	selector string
+	taints   map[string]bool
+	window   time.Duration
+
+	mu       sync.Mutex
+	affected map[string]time.Time
+}
+
+func newDrainWatcher(log hclog.Logger) (*drainWatcher, error) {
+	selector := getEnv("KUBERNETES_POD_SELECTOR", os.Getenv("KUBERNETES_LABEL_SELECTOR"))
+	if selector == "" {
+		return nil, fmt.Errorf("DRAIN_WATCH requires KUBERNETES_POD_SELECTOR or KUBERNETES_LABEL_SELECTOR")
+	}
+	window, err := time.ParseDuration(getEnv("DRAIN_FAST_POLL_WINDOW", "10m"))
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("DRAIN_FAST_POLL_WINDOW must be a positive duration")
+	}
+	targets, err := kubeTargets()
+	if err != nil {
+		return nil, err
+	}
+	taints := make(map[string]bool)
+	for _, t := range append(drainTaints, splitList(os.Getenv("DRAIN_TAINTS"))...) {
+		taints[t] = true
+	}
+	return &drainWatcher{
+		logger:   log,
+		targets:  targets,
+		selector: selector,
+		taints:   taints,
+		window:   window,
+		affected: make(map[string]time.Time),
+	}, nil
+}
+
+type drainPod struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+	Status struct {
+		PodIP string `json:"podIP"`
+	} `json:"status"`
+}
+
+type drainNode struct {
+	Spec struct {
+		Unschedulable bool `json:"unschedulable"`
+		Taints        []struct {
+			Key string `json:"key"`
+		} `json:"taints"`
+	} `json:"spec"`
+}
+
+// draining returns why a node is being drained, or "" if it is not.
+func (w *drainWatcher) draining(n *drainNode) string {
+	if n.Spec.Unschedulable {
+		return "cordoned"
+	}
+	for _, t := range n.Spec.Taints {
+		if w.taints[t.Key] {
+			return t.Key
+		}
+	}
+	return ""
+}
+
+// check looks up the nodes of all vault pods and marks the pods on draining
+// nodes, and their IPs, as affected for the fast poll window. It returns the
+// number of newly affected pods.
+func (w *drainWatcher) check(ctx context.Context) (int, error) {
+	found := 0
+	for _, kube := range w.targets {
+		var pods struct {
+			Items []drainPod `json:"items"`
+		}
+		path := "/api/v1/namespaces/" + url.PathEscape(kube.namespace) + "/pods?labelSelector=" + url.QueryEscape(w.selector)
+		if err := kube.get(ctx, path, &pods); err != nil {
+			return found, fmt.Errorf("failed to list pods: %w", err)
+		}
+
+		reasons := make(map[string]string)
+		for _, p := range pods.Items {
+			node := p.Spec.NodeName
+			if node == "" {
+				continue
+			}
+			if _, ok := reasons[node]; !ok {
+				var n drainNode
+				if err := kube.get(ctx, "/api/v1/nodes/"+url.PathEscape(node), &n); err != nil {
+					return found, fmt.Errorf("failed to read node %s: %w", node, err)
+				}
+				reasons[node] = w.draining(&n)
+			}
+			if reasons[node] == "" {
+				continue
+			}
+			if w.mark(kube.qualify(p.Metadata.Name), p.Status.PodIP) {
+				found++
+				w.logger.Info("vault pod is on a draining node, polling it at the fast interval", "pod", kube.qualify(p.Metadata.Name), "node", node, "reason", reasons[node], "window", w.window)
+			}
+		}
+	}
+	return found, nil
+}
+
+// mark records a pod as affected and reports whether it was not already.
+func (w *drainWatcher) mark(pod, ip string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	fresh := !now.Before(w.affected[pod])
+	until := now.Add(w.window)
+	w.affected[pod] = until
+	if ip != "" {
+		w.affected[ip] = until
+	}
+	return fresh
+}
+
+// affects reports whether v belongs to a pod that was recently on a draining
+// node, matched by the pod it was discovered through or its IP address.
+func (w *drainWatcher) affects(v *vaultConfig) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	for key, until := range w.affected {
+		if !now.Before(until) {
+			delete(w.affected, key)
+		}
+	}
+	if len(w.affected) == 0 {
+		return false
+	}
+	if v.ref != nil && v.ref.kind == "Pod" && now.Before(w.affected[v.ref.kube.qualify(v.ref.name)]) {
+		return true
+	}
+	if parsed, err := url.Parse(v.addr); err == nil && now.Before(w.affected[parsed.Hostname()]) {
+		return true
+	}
+	return false
+}
+
+func (w *drainWatcher) active() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	var keys []string
+	for key, until := range w.affected {
+		if now.Before(until) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// drainWatchLoop checks for draining nodes every checkInt. While any vault pod
+// is affected, discovery (if enabled) and the affected vaults are polled
+// every fastInt.
+func (u *Unsealer) drainWatchLoop(ctx context.Context, w *drainWatcher, checkInt, fastInt time.Duration) {
+	check := time.NewTicker(checkInt)
+	defer check.Stop()
+	fast := time.NewTicker(fastInt)
+	defer fast.Stop()
+
+	for {
+		if n, err := w.check(ctx); err != nil {
+			if ctx.Err() == nil {
+				u.logger.Warn("drain check failed", "error", err)
+			}
+		} else if n > 0 {
+			atomic.AddInt64(&u.drainDetections, int64(n))
+		}
+
+		for waiting := true; waiting; {
+			select {
+			case <-ctx.Done():
+				return
+			case <-check.C:
+				waiting = false
+			case <-fast.C:
+				if len(w.active()) == 0 {
+					continue
+				}
+				if u.discoverer != nil {
+					u.discover(ctx)
+				}
+				drainCtx := withCycleID(withInitiator(ctx, initiatorDrain))
+				for _, vault := range u.vaultList() {
+					if !w.affects(vault) || !u.owns(vault.addr) {
+						continue
+					}
+					u.wg.Add(1)
+					go func(v *vaultConfig) {
+						defer u.wg.Done()
+						u.unsealWithRetry(drainCtx, v)
+					}(vault)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// Reasons an unseal can fail, the reason label of the failure counters.
+const (
+	reasonNetwork     = "network"
+	reasonTLS         = "tls"
+	reasonTimeout     = "timeout"
+	reasonBadStatus   = "bad_status"
+	reasonInvalidKey  = "invalid_key"
+	reasonDecodeError = "decode_error"
+	reasonOther       = "other"
+)
+
+var failureReasons = []string{reasonNetwork, reasonTLS, reasonTimeout, reasonBadStatus, reasonInvalidKey, reasonDecodeError, reasonOther}
+
+// statusError is a response from Vault with an unexpected status code.
+type statusError struct {
+	code    int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
+// failureReason classifies err into one of failureReasons.
+func failureReason(err error) string {
+	var (
+		status    *statusError
+		urlErr    *url.Error
+		netErr    net.Error
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+	)
+	switch {
+	case errors.Is(err, errInvalidKey):
+		return reasonInvalidKey
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return reasonTimeout
+	case isTLSError(err):
+		return reasonTLS
+	case errors.As(err, &status):
+		return reasonBadStatus
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return reasonDecodeError
+	case errors.As(err, &urlErr), errors.As(err, &netErr), errors.Is(err, errMeshUnavailable), errors.Is(err, syscall.ECONNREFUSED):
+		return reasonNetwork
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		// Outside a request, a short read means the body was cut off.
+		return reasonDecodeError
+	}
+	return reasonOther
+}
+
+func isTLSError(err error) bool {
+	var (
+		verifyErr    *tls.CertificateVerificationError
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+		authorityErr x509.UnknownAuthorityError
+		hostErr      x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	if errors.As(err, &verifyErr) || errors.As(err, &recordErr) || errors.As(err, &alertErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostErr) || errors.As(err, &invalidErr) {
+		return true
+	}
+	// Some handshake failures are only plain errors.
+	msg := err.Error()
+	return strings.Contains(msg, "tls: ") || strings.Contains(msg, "x509: ")
+}
+
+// countFailure counts a failed unseal run by the reason of its last error.
+func (u *Unsealer) countFailure(err error) {
+	atomic.AddInt64(&u.failures, 1)
+	reason := reasonOther
+	if err != nil {
+		reason = failureReason(err)
+	}
+	u.failureReasonsMu.Lock()
+	defer u.failureReasonsMu.Unlock()
+	if u.failureReasons == nil {
+		u.failureReasons = make(map[string]int64)
+	}
+	u.failureReasons[reason]++
+}
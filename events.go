@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// objectRef is the Kubernetes object a vault was found through, the target of
+// its events.
+type objectRef struct {
+	kube       *kubeClient
+	apiVersion string
+	kind       string
+	namespace  string
+	name       string
+	uid        string
+}
+
+func podRef(kube *kubeClient, namespace, name, uid string) *objectRef {
+	return &objectRef{kube: kube, apiVersion: "v1", kind: "Pod", namespace: namespace, name: name, uid: uid}
+}
+
+type kubeEvent struct {
+	ref       *objectRef
+	eventType string
+	reason    string
+	message   string
+	time      time.Time
+}
+
+// eventRecorder posts Kubernetes Events about unseal actions. Events are
+// queued and posted in the background so a slow API server never delays an
+// unseal; when the queue is full they are dropped.
+type eventRecorder struct {
+	logger   hclog.Logger
+	instance string
+	queue    chan kubeEvent
+}
+
+func newEventRecorder(log hclog.Logger) *eventRecorder {
+	instance, err := leaseIdentity()
+	if err != nil {
+		instance = "vault-unsealer"
+	}
+	return &eventRecorder{logger: log, instance: instance, queue: make(chan kubeEvent, 100)}
+}
+
+func (r *eventRecorder) record(ref *objectRef, eventType, reason, message string) {
+	select {
+	case r.queue <- kubeEvent{ref: ref, eventType: eventType, reason: reason, message: message, time: time.Now()}:
+	default:
+		r.logger.Debug("event queue full, dropping event", "object", ref.namespace+"/"+ref.name, "reason", reason)
+	}
+}
+
+func (r *eventRecorder) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-r.queue:
+			if err := r.post(ctx, e); err != nil && ctx.Err() == nil {
+				r.logger.Warn("failed to post event", "object", e.ref.namespace+"/"+e.ref.name, "reason", e.reason, "error", err)
+			}
+		}
+	}
+}
+
+func (r *eventRecorder) post(ctx context.Context, e kubeEvent) error {
+	ts := e.time.UTC().Format(time.RFC3339)
+	involved := map[string]string{
+		"apiVersion": e.ref.apiVersion,
+		"kind":       e.ref.kind,
+		"namespace":  e.ref.namespace,
+		"name":       e.ref.name,
+	}
+	if e.ref.uid != "" {
+		involved["uid"] = e.ref.uid
+	}
+	event := map[string]interface{}{
+		"apiVersion":         "v1",
+		"kind":               "Event",
+		"metadata":           map[string]string{"generateName": e.ref.name + "."},
+		"involvedObject":     involved,
+		"type":               e.eventType,
+		"reason":             e.reason,
+		"message":            e.message,
+		"firstTimestamp":     ts,
+		"lastTimestamp":      ts,
+		"count":              1,
+		"source":             map[string]string{"component": "vault-unsealer"},
+		"reportingComponent": "vault-unsealer",
+		"reportingInstance":  r.instance,
+	}
+	path := "/api/v1/namespaces/" + url.PathEscape(e.ref.namespace) + "/events"
+	return e.ref.kube.do(ctx, "POST", path, "application/json", event, nil)
+}
+
+// event records an event for v on the object it was discovered through, or on
+// the VaultUnsealConfig in operator mode. Vaults without either get none.
+func (u *Unsealer) event(ctx context.Context, v *vaultConfig, eventType, reason, message string) {
+	if u.events == nil {
+		return
+	}
+	ref := v.ref
+	if ref == nil {
+		ref = u.eventRef
+	}
+	if ref == nil {
+		return
+	}
+	if ref == u.eventRef {
+		message = v.addr + ": " + message
+	}
+	if id := requestIDOf(ctx); id != "" {
+		message += " (request " + id + ")"
+	}
+	u.events.record(ref, eventType, reason, message)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// flapPolicy decides when a vault counts as flapping: sealed threshold times
+// within window. A vault that keeps sealing usually has a storage or memory
+// problem that unsealing it again will not fix.
+type flapPolicy struct {
+	threshold int
+	window    time.Duration
+}
+
+// updateFlapping drops seal times that fell out of the window and reports
+// whether the vault is flapping now and whether that changed.
+func (s *vaultState) updateFlapping(p flapPolicy) (flapping, changed bool) {
+	if p.threshold <= 0 {
+		return false, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := time.Now().Add(-p.window)
+	for len(s.sealTimes) > 0 && (s.sealTimes[0].Before(cutoff) || len(s.sealTimes) > p.threshold) {
+		s.sealTimes = s.sealTimes[1:]
+	}
+	flapping = len(s.sealTimes) >= p.threshold
+	changed = flapping != s.flapping
+	s.flapping = flapping
+	return flapping, changed
+}
+
+// checkFlapping raises an alert when v starts flapping and notes when it has
+// settled again.
+func (u *Unsealer) checkFlapping(ctx context.Context, v *vaultConfig) {
+	flapping, changed := v.state.updateFlapping(u.flap)
+	if !changed {
+		return
+	}
+	if flapping {
+		msg := fmt.Sprintf("vault sealed %d times within %s, check its storage and memory", u.flap.threshold, u.flap.window)
+		u.log(ctx).Error("vault is flapping", "vault", v.addr, "seals", u.flap.threshold, "window", u.flap.window)
+		u.record(ctx, historyFlapping, severityError, v, msg)
+		u.event(ctx, v, "Warning", "VaultFlapping", msg)
+		return
+	}
+	msg := fmt.Sprintf("vault has sealed fewer than %d times within %s", u.flap.threshold, u.flap.window)
+	u.log(ctx).Info("vault stopped flapping", "vault", v.addr)
+	u.record(ctx, historyFlapResolved, severityInfo, v, msg)
+	u.event(ctx, v, "Normal", "VaultStable", msg)
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grpcService is the admin service of proto/vaultunsealer/admin/v1/admin.proto.
+// It is served on the health port next to the HTTP admin API, over HTTP/2,
+// and every RPC runs the HTTP handler of the same operation, so the two APIs
+// cannot drift apart. This is a minimal gRPC server: it handles unary calls
+// without compression, which is all the service needs.
+const grpcService = "vaultunsealer.admin.v1.AdminService"
+
+// grpcMethod maps an RPC onto the HTTP admin API. request builds the HTTP
+// request from the decoded message; response encodes the JSON answer.
+type grpcMethod struct {
+	request  func(f protoFields) (method, path string, body interface{}, err error)
+	response func(data []byte) (protoBuffer, error)
+}
+
+var grpcMethods = map[string]grpcMethod{
+	"GetStatus": {
+		request: func(f protoFields) (string, string, interface{}, error) {
+			return "GET", "/status", nil, nil
+		},
+		response: func(data []byte) (protoBuffer, error) {
+			var status struct {
+				Vaults []vaultStatus `json:"vaults"`
+			}
+			if err := json.Unmarshal(data, &status); err != nil {
+				return nil, err
+			}
+			var b protoBuffer
+			for _, v := range status.Vaults {
+				b.message(1, encodeVaultStatus(v))
+			}
+			return b, nil
+		},
+	},
+	"Unseal": {
+		request: func(f protoFields) (string, string, interface{}, error) {
+			if vault := f.string(1); vault != "" {
+				return "POST", adminPath("/api/v1/unseal/"+url.PathEscape(vault), f.string(2), false), nil, nil
+			}
+			return "POST", adminPath("/api/v1/unseal", f.string(2), f.bool(3)), nil, nil
+		},
+		response: func(data []byte) (protoBuffer, error) {
+			var resp struct {
+				Vault  string `json:"vault"`
+				Config string `json:"config"`
+			}
+			if err := json.Unmarshal(data, &resp); err != nil {
+				return nil, err
+			}
+			var b protoBuffer
+			b.string(1, resp.Vault)
+			b.string(2, resp.Config)
+			return b, nil
+		},
+	},
+	"RefreshKeys": {
+		request: func(f protoFields) (string, string, interface{}, error) {
+			return "POST", adminPath("/api/v1/keys/refresh", f.string(1), false), nil, nil
+		},
+		response: func(data []byte) (protoBuffer, error) {
+			var resp struct {
+				Keys            int     `json:"keys"`
+				DurationSeconds float64 `json:"duration_seconds"`
+				Config          string  `json:"config"`
+			}
+			if err := json.Unmarshal(data, &resp); err != nil {
+				return nil, err
+			}
+			var b protoBuffer
+			b.int(1, int64(resp.Keys))
+			b.double(2, resp.DurationSeconds)
+			b.string(3, resp.Config)
+			return b, nil
+		},
+	},
+	"GetPauseState": {
+		request: func(f protoFields) (string, string, interface{}, error) {
+			return "GET", "/api/v1/pause", nil, nil
+		},
+		response: encodePauseState,
+	},
+	"Pause": {
+		request:  pauseRequest("/api/v1/pause"),
+		response: encodePauseState,
+	},
+	"Resume": {
+		request:  pauseRequest("/api/v1/resume"),
+		response: encodePauseState,
+	},
+	"RegisterVault": {
+		request: func(f protoFields) (string, string, interface{}, error) {
+			return "POST", "/api/v1/vaults", map[string]string{"vault": f.string(1)}, nil
+		},
+		response: func(data []byte) (protoBuffer, error) {
+			var resp struct {
+				Vault string `json:"vault"`
+			}
+			if err := json.Unmarshal(data, &resp); err != nil {
+				return nil, err
+			}
+			var b protoBuffer
+			b.string(1, resp.Vault)
+			return b, nil
+		},
+	},
+	"UnregisterVault": {
+		request: func(f protoFields) (string, string, interface{}, error) {
+			if f.string(1) == "" {
+				return "", "", nil, fmt.Errorf("vault is required")
+			}
+			return "DELETE", "/api/v1/vaults/" + url.PathEscape(f.string(1)), nil, nil
+		},
+		response: func(data []byte) (protoBuffer, error) {
+			return protoBuffer{}, nil
+		},
+	},
+	"SetVaultDisabled": {
+		request: func(f protoFields) (string, string, interface{}, error) {
+			if f.string(1) == "" {
+				return "", "", nil, fmt.Errorf("vault is required")
+			}
+			action := "enable"
+			if f.bool(3) {
+				action = "disable"
+			}
+			return "POST", adminPath("/api/v1/vaults/"+url.PathEscape(f.string(1))+"/"+action, f.string(2), false), nil, nil
+		},
+		response: func(data []byte) (protoBuffer, error) {
+			var resp struct {
+				Vault    string `json:"vault"`
+				Config   string `json:"config"`
+				Disabled bool   `json:"disabled"`
+			}
+			if err := json.Unmarshal(data, &resp); err != nil {
+				return nil, err
+			}
+			var b protoBuffer
+			b.string(1, resp.Vault)
+			b.string(2, resp.Config)
+			b.bool(3, resp.Disabled)
+			return b, nil
+		},
+	},
+}
+
+func adminPath(path, config string, all bool) string {
+	query := url.Values{}
+	if config != "" {
+		query.Set("config", config)
+	}
+	if all {
+		query.Set("all", "true")
+	}
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	return path
+}
+
+func pauseRequest(base string) func(f protoFields) (string, string, interface{}, error) {
+	return func(f protoFields) (string, string, interface{}, error) {
+		path := base
+		if vault := f.string(1); vault != "" {
+			path += "/" + url.PathEscape(vault)
+		}
+		return "POST", adminPath(path, f.string(2), false), nil, nil
+	}
+}
+
+func encodeVaultStatus(v vaultStatus) protoBuffer {
+	var b protoBuffer
+	b.string(1, v.Address)
+	b.string(2, v.Config)
+	b.string(3, v.State)
+	b.string(4, v.Role)
+	b.string(5, v.SealType)
+	b.string(6, v.Version)
+	b.timestamp(7, v.LastCheck)
+	b.timestamp(8, v.LastUnseal)
+	b.timestamp(9, v.SealedSince)
+	b.string(10, v.LastError)
+	b.int(11, int64(v.ConsecutiveFailures))
+	b.timestamp(12, v.CircuitOpenUntil)
+	b.bool(13, v.Flapping)
+	b.bool(14, v.Disabled)
+	b.bool(15, v.Paused)
+	b.string(16, v.KeyState)
+	b.int(17, v.KeyAgeSeconds)
+	return b
+}
+
+func encodePauseState(data []byte) (protoBuffer, error) {
+	var d pauseData
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+	var b protoBuffer
+	b.bool(1, d.All)
+	for _, c := range d.Configs {
+		b.string(2, c)
+	}
+	for _, v := range d.Vaults {
+		var m protoBuffer
+		m.string(1, v.Config)
+		m.string(2, v.Address)
+		b.message(3, m)
+	}
+	return b, nil
+}
+
+// gRPC status codes, from google.golang.org/grpc/codes.
+const (
+	grpcOK                 = 0
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcNotFound           = 5
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+// grpcCode translates the status code of the HTTP handler an RPC ran.
+func grpcCode(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInvalidArgument
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcNotFound
+	case http.StatusConflict:
+		return grpcFailedPrecondition
+	case http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case http.StatusInternalServerError:
+		return grpcInternal
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return grpcUnavailable
+	}
+	return grpcUnknown
+}
+
+// grpcRecorder captures the response of the HTTP handler an RPC runs.
+type grpcRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (r *grpcRecorder) Header() http.Header { return r.header }
+
+func (r *grpcRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+}
+
+func (r *grpcRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
+
+// handleGRPC serves the RPCs of grpcService by running them against api, the
+// mux of the HTTP endpoints. Authentication has already happened for the
+// gRPC request, whose headers, such as authorization, the HTTP request
+// inherits.
+func (u *Unsealer) handleGRPC(api http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || !isGRPCContentType(r.Header.Get("Content-Type")) {
+			http.Error(w, "gRPC requests need HTTP/2 and content type application/grpc", http.StatusUnsupportedMediaType)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		method, ok := grpcMethods[r.PathValue("method")]
+		if !ok {
+			writeGRPCStatus(w, grpcUnimplemented, "unknown method "+r.PathValue("method"))
+			return
+		}
+		fields, err := readGRPCRequest(r)
+		if err != nil {
+			writeGRPCStatus(w, grpcInvalidArgument, err.Error())
+			return
+		}
+		httpMethod, path, body, err := method.request(fields)
+		if err != nil {
+			writeGRPCStatus(w, grpcInvalidArgument, err.Error())
+			return
+		}
+
+		ctx := r.Context()
+		if timeout, ok := parseGRPCTimeout(r.Header.Get("Grpc-Timeout")); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		// RefreshKeys waits for the provider, which can take longer than the
+		// server's write timeout.
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(2 * time.Minute))
+
+		var payload io.Reader
+		if body != nil {
+			data, _ := json.Marshal(body)
+			payload = bytes.NewReader(data)
+		}
+		req, err := http.NewRequestWithContext(ctx, httpMethod, path, payload)
+		if err != nil {
+			writeGRPCStatus(w, grpcInternal, err.Error())
+			return
+		}
+		req.Header = r.Header.Clone()
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr, req.TLS = r.RemoteAddr, r.TLS
+		rec := &grpcRecorder{header: http.Header{}}
+		api.ServeHTTP(rec, req)
+
+		if ctx.Err() == context.DeadlineExceeded {
+			writeGRPCStatus(w, grpcDeadlineExceeded, "deadline exceeded")
+			return
+		}
+		if rec.code >= 300 {
+			writeGRPCStatus(w, grpcCode(rec.code), strings.TrimSpace(rec.body.String()))
+			return
+		}
+		msg, err := method.response(rec.body.Bytes())
+		if err != nil {
+			writeGRPCStatus(w, grpcInternal, "failed to encode response: "+err.Error())
+			return
+		}
+		frame := make([]byte, 5, 5+len(msg))
+		binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+		w.Write(append(frame, msg...))
+		writeGRPCStatus(w, grpcOK, "")
+	}
+}
+
+func isGRPCContentType(contentType string) bool {
+	return contentType == "application/grpc" || contentType == "application/grpc+proto"
+}
+
+// readGRPCRequest reads the single, uncompressed message of a unary call.
+func readGRPCRequest(r *http.Request) (protoFields, error) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return protoFields{}, fmt.Errorf("failed to read request: %w", err)
+	}
+	if len(data) < 5 {
+		return protoFields{}, fmt.Errorf("request has no message")
+	}
+	if data[0] != 0 {
+		return protoFields{}, fmt.Errorf("compressed messages are not supported")
+	}
+	if n := binary.BigEndian.Uint32(data[1:5]); int(n) != len(data)-5 {
+		return protoFields{}, fmt.Errorf("request must hold exactly one message")
+	}
+	return decodeProto(data[5:])
+}
+
+// writeGRPCStatus sets the status of the call, which is sent in the trailers
+// once the handler returns.
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", grpcEscape(message))
+	}
+}
+
+// grpcEscape percent-encodes a status message as the gRPC protocol requires.
+func grpcEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// parseGRPCTimeout parses a grpc-timeout header, such as "10S" or "500m".
+func parseGRPCTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{'H': time.Hour, 'M': time.Minute, 'S': time.Second, 'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond}
+	unit, ok := units[value[len(value)-1]]
+	return time.Duration(n) * unit, ok
+}
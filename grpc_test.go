@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseGRPCTimeout(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"10S", 10 * time.Second, true},
+		{"500m", 500 * time.Millisecond, true},
+		{"2H", 2 * time.Hour, true},
+		{"3M", 3 * time.Minute, true},
+		{"250u", 250 * time.Microsecond, true},
+		{"100n", 100 * time.Nanosecond, true},
+		{"0S", 0, true},
+		{"", 0, false},
+		{"S", 0, false},
+		{"10", 0, false},
+		{"10s", 0, false},
+		{"-1S", 0, false},
+		{"1.5S", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseGRPCTimeout(tt.value)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("parseGRPCTimeout(%q) = %s, %v, want %s, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
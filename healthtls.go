@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// healthTLS serves the health endpoints over HTTPS. The certificate is read
+// again when its files change, so certificates renewed by cert-manager or a
+// similar tool are picked up without a restart.
+type healthTLS struct {
+	certFile string
+	keyFile  string
+	config   *tls.Config
+	// optional client certificates are verified when presented and only
+	// required outside probePaths.
+	optional bool
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	statTime time.Time
+}
+
+// probePaths stay reachable without a client certificate with
+// HEALTH_TLS_CLIENT_AUTH=optional, since kubelet probes cannot present one.
+var probePaths = map[string]bool{"/health": true, "/ready": true}
+
+// loadHealthTLS reads HEALTH_TLS_CERT, HEALTH_TLS_KEY, HEALTH_TLS_CLIENT_CA
+// and HEALTH_TLS_CLIENT_AUTH. It returns nil when TLS is not configured.
+func loadHealthTLS(policy *tlsPolicy) (*healthTLS, error) {
+	certFile, keyFile := os.Getenv("HEALTH_TLS_CERT"), os.Getenv("HEALTH_TLS_KEY")
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("HEALTH_TLS_CERT and HEALTH_TLS_KEY must be set together")
+	}
+	clientCA := os.Getenv("HEALTH_TLS_CLIENT_CA")
+	if certFile == "" {
+		if clientCA != "" {
+			return nil, fmt.Errorf("HEALTH_TLS_CLIENT_CA requires HEALTH_TLS_CERT and HEALTH_TLS_KEY")
+		}
+		return nil, nil
+	}
+
+	h := &healthTLS{certFile: certFile, keyFile: keyFile, config: &tls.Config{}}
+	policy.apply(h.config)
+	h.config.GetCertificate = h.getCertificate
+	if _, err := h.getCertificate(nil); err != nil {
+		return nil, err
+	}
+
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read HEALTH_TLS_CLIENT_CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("HEALTH_TLS_CLIENT_CA contains no certificates")
+		}
+		h.config.ClientCAs = pool
+		switch mode := getEnv("HEALTH_TLS_CLIENT_AUTH", "require"); mode {
+		case "require":
+			h.config.ClientAuth = tls.RequireAndVerifyClientCert
+		case "optional":
+			h.config.ClientAuth = tls.VerifyClientCertIfGiven
+			h.optional = true
+		default:
+			return nil, fmt.Errorf("HEALTH_TLS_CLIENT_AUTH must be require or optional, got %q", mode)
+		}
+	}
+	return h, nil
+}
+
+// getCertificate returns the current certificate, loading it again if the
+// certificate file changed. Files are checked at most every 10 seconds, and a
+// certificate that fails to load keeps the previous one in use.
+func (h *healthTLS) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.cert != nil && time.Since(h.statTime) < 10*time.Second {
+		return h.cert, nil
+	}
+	h.statTime = time.Now()
+	info, err := os.Stat(h.certFile)
+	if err != nil {
+		if h.cert != nil {
+			return h.cert, nil
+		}
+		return nil, fmt.Errorf("failed to read HEALTH_TLS_CERT: %w", err)
+	}
+	if h.cert != nil && info.ModTime().Equal(h.modTime) {
+		return h.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(h.certFile, h.keyFile)
+	if err != nil {
+		if h.cert != nil {
+			return h.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load health server certificate: %w", err)
+	}
+	h.cert, h.modTime = &cert, info.ModTime()
+	return h.cert, nil
+}
+
+// verifiesClients reports whether requests outside probePaths need a verified
+// client certificate.
+func (h *healthTLS) verifiesClients() bool {
+	return h != nil && h.config.ClientCAs != nil
+}
+
+// requireClientCert rejects requests without a verified client certificate,
+// except for the probe endpoints, when client certificates are optional.
+func (h *healthTLS) requireClientCert(next http.Handler) http.Handler {
+	if !h.optional {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !probePaths[r.URL.Path] && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			http.Error(w, "client certificate required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
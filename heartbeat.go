@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// heartbeat pings a dead man's switch, such as Healthchecks.io or Dead Man's
+// Snitch, while the unsealer is ready. When the pings stop, because the
+// unsealer is down or wedged, the service raises the alarm.
+type heartbeat struct {
+	url      string
+	failURL  string
+	interval time.Duration
+	client   *http.Client
+}
+
+// newHeartbeat reads HEARTBEAT_URL, HEARTBEAT_FAIL_URL (either also with
+// _FILE) and HEARTBEAT_INTERVAL. It returns nil without HEARTBEAT_URL.
+func newHeartbeat() (*heartbeat, error) {
+	pingURL, err := readSecretEnv("HEARTBEAT_URL")
+	if err != nil || pingURL == "" {
+		return nil, err
+	}
+	failURL, err := readSecretEnv("HEARTBEAT_FAIL_URL")
+	if err != nil {
+		return nil, err
+	}
+	for name, raw := range map[string]string{"HEARTBEAT_URL": pingURL, "HEARTBEAT_FAIL_URL": failURL} {
+		if raw == "" {
+			continue
+		}
+		if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%s must be an http or https URL", name)
+		}
+	}
+	interval, err := time.ParseDuration(getEnv("HEARTBEAT_INTERVAL", "1m"))
+	if err != nil || interval < time.Second {
+		return nil, fmt.Errorf("HEARTBEAT_INTERVAL must be a duration of at least 1s")
+	}
+	return &heartbeat{url: pingURL, failURL: failURL, interval: interval, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// heartbeatLoop pings the heartbeat URL every interval while the unsealer is
+// ready. While it is not, it pings the fail URL if there is one, and
+// otherwise stays silent so the switch times out. The first ping waits an
+// interval, for the first poll cycle to finish.
+func (u *Unsealer) heartbeatLoop(ctx context.Context, h *heartbeat) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		ready, state := u.readiness()
+		if u.operator != nil {
+			ready, state = u.operator.ready()
+		}
+		target := h.url
+		if !ready {
+			target = h.failURL
+			u.logger.Debug("unsealer not ready for a heartbeat", "state", state)
+		}
+		if target != "" {
+			if err := h.ping(ctx, target); err != nil && ctx.Err() == nil {
+				u.logger.Warn("heartbeat failed", "ready", ready, "error", err)
+			}
+		}
+	}
+}
+
+func (h *heartbeat) ping(ctx context.Context, target string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		// The error includes the URL, which holds the check's token.
+		if uerr, ok := err.(*url.Error); ok {
+			return uerr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
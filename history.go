@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types kept in the history.
+const (
+	historySealDetected  = "seal_detected"
+	historyUnsealSuccess = "unseal_succeeded"
+	historyUnsealFailure = "unseal_failed"
+	historyKeyRefresh    = "key_refresh"
+	historyProviderError = "provider_error"
+	historyVaultAdded    = "vault_discovered"
+	historyVaultRemoved  = "vault_removed"
+	historyFlapping      = "vault_flapping"
+	historyFlapResolved  = "vault_flapping_resolved"
+	historyEscalated     = "unseal_escalated"
+	historyStarted       = "unsealer_started"
+	historyStopped       = "unsealer_stopped"
+	historyInitRefused   = "init_refused"
+)
+
+// historyTypes holds every event type, to validate filters in settings.
+var historyTypes = map[string]bool{
+	historySealDetected:  true,
+	historyUnsealSuccess: true,
+	historyUnsealFailure: true,
+	historyKeyRefresh:    true,
+	historyProviderError: true,
+	historyVaultAdded:    true,
+	historyVaultRemoved:  true,
+	historyFlapping:      true,
+	historyFlapResolved:  true,
+	historyEscalated:     true,
+	historyStarted:       true,
+	historyStopped:       true,
+	historyInitRefused:   true,
+}
+
+const (
+	severityInfo    = "info"
+	severityWarning = "warning"
+	severityError   = "error"
+	// severityCritical is only used for escalations.
+	severityCritical = "critical"
+)
+
+type historyEvent struct {
+	ID        int64     `json:"id"`
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Severity  string    `json:"severity"`
+	Vault     string    `json:"vault,omitempty"`
+	Config    string    `json:"config,omitempty"`
+	Message   string    `json:"message"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// eventHistory is a ring buffer of the most recent events, so an operator can
+// see what happened overnight without going through the logs.
+type eventHistory struct {
+	mu     sync.Mutex
+	events []historyEvent
+	next   int
+	full   bool
+	lastID int64
+	subs   map[chan historyEvent]bool
+}
+
+func newEventHistory(size int) *eventHistory {
+	return &eventHistory{events: make([]historyEvent, size), subs: make(map[chan historyEvent]bool)}
+}
+
+func (h *eventHistory) add(e historyEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastID++
+	e.ID = h.lastID
+	h.events[h.next] = e
+	h.next = (h.next + 1) % len(h.events)
+	if h.next == 0 {
+		h.full = true
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			// A subscriber that cannot keep up is dropped. It reconnects
+			// with Last-Event-ID and catches up from the buffer.
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns a channel receiving every event added from now on, and
+// the matching events after afterID that are still buffered, oldest first.
+func (h *eventHistory) subscribe(f historyFilter, afterID int64) (chan historyEvent, []historyEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var missed []historyEvent
+	if afterID > 0 {
+		n := h.next
+		if h.full {
+			n = len(h.events)
+		}
+		for i := n; i >= 1; i-- {
+			e := h.events[(h.next-i+len(h.events))%len(h.events)]
+			if e.ID > afterID && f.matches(e) {
+				missed = append(missed, e)
+			}
+		}
+	}
+	ch := make(chan historyEvent, 64)
+	h.subs[ch] = true
+	return ch, missed
+}
+
+func (h *eventHistory) unsubscribe(ch chan historyEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[ch] {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// closeSubscribers ends all streams, so the health server can shut down.
+func (h *eventHistory) closeSubscribers() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// historyFilter selects events for /events. Zero values match everything.
+type historyFilter struct {
+	types    map[string]bool
+	severity string
+	vault    string
+	since    time.Time
+	before   int64
+	limit    int
+}
+
+// typeFilter parses a comma-separated list of event types.
+func typeFilter(value string) map[string]bool {
+	types := splitList(value)
+	if len(types) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(types))
+	for _, t := range types {
+		set[t] = true
+	}
+	return set
+}
+
+func (f historyFilter) matches(e historyEvent) bool {
+	switch {
+	case len(f.types) > 0 && !f.types[e.Type],
+		f.severity != "" && e.Severity != f.severity,
+		f.vault != "" && !strings.Contains(e.Vault, f.vault),
+		!f.since.IsZero() && e.Time.Before(f.since):
+		return false
+	}
+	return true
+}
+
+// list returns the matching events, newest first, and whether older matches
+// were left out by the limit.
+func (h *eventHistory) list(f historyFilter) ([]historyEvent, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n := h.next
+	if h.full {
+		n = len(h.events)
+	}
+	result := []historyEvent{}
+	for i := 1; i <= n; i++ {
+		e := h.events[(h.next-i+len(h.events))%len(h.events)]
+		if (f.before > 0 && e.ID >= f.before) || !f.matches(e) {
+			continue
+		}
+		if len(result) == f.limit {
+			return result, true
+		}
+		result = append(result, e)
+	}
+	return result, false
+}
+
+// record adds an event to the history, if it is kept, and sends it to the
+// notification sinks.
+func (u *Unsealer) record(ctx context.Context, eventType, severity string, v *vaultConfig, message string) {
+	u.recordOutcome(ctx, eventType, severity, v, message, eventOutcome{})
+}
+
+// eventOutcome is what a notification adds to a history event: the error
+// behind a failure and how long the operation took.
+type eventOutcome struct {
+	err      error
+	duration time.Duration
+}
+
+// recordOutcome is record with the details for notification templates.
+func (u *Unsealer) recordOutcome(ctx context.Context, eventType, severity string, v *vaultConfig, message string, o eventOutcome) {
+	if u.history == nil && u.notifier == nil {
+		return
+	}
+	e := historyEvent{Time: time.Now(), Type: eventType, Severity: severity, Config: u.shardKey, Message: message, RequestID: requestIDOf(ctx)}
+	if v != nil {
+		e.Vault = v.addr
+	}
+	if u.history != nil {
+		u.history.add(e)
+	}
+	if u.notifier != nil {
+		u.notifier.notify(e, v, o)
+	}
+}
+
+// handleEvents serves the history. Query parameters: type (comma-separated),
+// severity, vault (substring), since (RFC 3339 time or a duration such as
+// 12h), limit, and before, the id to continue from for the next page.
+func (u *Unsealer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if u.history == nil {
+		http.Error(w, "event history is disabled", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	f := historyFilter{types: typeFilter(q.Get("type")), severity: q.Get("severity"), vault: q.Get("vault"), limit: 100}
+	if since := q.Get("since"); since != "" {
+		if d, err := time.ParseDuration(since); err == nil {
+			f.since = time.Now().Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, since); err == nil {
+			f.since = t
+		} else {
+			http.Error(w, "since must be an RFC 3339 time or a duration", http.StatusBadRequest)
+			return
+		}
+	}
+	if limit := q.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > 1000 {
+			http.Error(w, "limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		f.limit = n
+	}
+	if before := q.Get("before"); before != "" {
+		n, err := strconv.ParseInt(before, 10, 64)
+		if err != nil || n <= 0 {
+			http.Error(w, "before must be an event id", http.StatusBadRequest)
+			return
+		}
+		f.before = n
+	}
+
+	events, more := u.history.list(f)
+	resp := map[string]interface{}{"events": events}
+	if more {
+		resp["next_before"] = events[len(events)-1].ID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleEventStream streams new events as Server-Sent Events. It takes the
+// type, severity and vault filters of /events. A client reconnecting with
+// Last-Event-ID (or ?last_event_id=) first gets the events it missed, as far
+// as they are still kept.
+func (u *Unsealer) handleEventStream(w http.ResponseWriter, r *http.Request) {
+	if u.history == nil {
+		http.Error(w, "event history is disabled", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	f := historyFilter{types: typeFilter(q.Get("type")), severity: q.Get("severity"), vault: q.Get("vault")}
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = q.Get("last_event_id")
+	}
+	var lastID int64
+	if last != "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "Last-Event-ID must be an event id", http.StatusBadRequest)
+			return
+		}
+		lastID = n
+	}
+
+	// The server's write timeout is meant for ordinary requests.
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	ch, missed := u.history.subscribe(f, lastID)
+	defer u.history.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(e historyEvent) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	for _, e := range missed {
+		if send(e) != nil {
+			return
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	// Comments keep proxies and load balancers from closing an idle stream.
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if f.matches(e) && send(e) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
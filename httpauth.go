@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// endpointAuth protects every health server endpoint except the probes with
+// a bearer token or basic auth, and optionally limits it to some networks.
+type endpointAuth struct {
+	token     string
+	tokenFile string
+	username  string
+	password  string
+	allowed   []*net.IPNet
+	// admin credentials are accepted too, so that admin API callers need
+	// only one set.
+	admin *adminAuth
+}
+
+// loadEndpointAuth reads HEALTH_AUTH_TOKEN, HEALTH_AUTH_TOKEN_FILE,
+// HEALTH_AUTH_USERNAME, HEALTH_AUTH_PASSWORD and HEALTH_ALLOWED_CIDRS. It
+// returns nil when none of them is set.
+func loadEndpointAuth() (*endpointAuth, error) {
+	a := &endpointAuth{
+		token:     os.Getenv("HEALTH_AUTH_TOKEN"),
+		tokenFile: os.Getenv("HEALTH_AUTH_TOKEN_FILE"),
+		username:  os.Getenv("HEALTH_AUTH_USERNAME"),
+		password:  os.Getenv("HEALTH_AUTH_PASSWORD"),
+	}
+	if a.token != "" && a.tokenFile != "" {
+		return nil, fmt.Errorf("HEALTH_AUTH_TOKEN and HEALTH_AUTH_TOKEN_FILE cannot both be set")
+	}
+	if (a.username == "") != (a.password == "") {
+		return nil, fmt.Errorf("HEALTH_AUTH_USERNAME and HEALTH_AUTH_PASSWORD must be set together")
+	}
+	if a.tokenFile != "" {
+		if _, err := a.currentToken(); err != nil {
+			return nil, err
+		}
+	}
+	for _, cidr := range splitList(os.Getenv("HEALTH_ALLOWED_CIDRS")) {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HEALTH_ALLOWED_CIDRS entry: %w", err)
+		}
+		a.allowed = append(a.allowed, network)
+	}
+	if a.token == "" && a.tokenFile == "" && a.username == "" && len(a.allowed) == 0 {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// currentToken returns the expected bearer token. A token file is read on
+// every request, so a rotated Secret takes effect without a restart.
+func (a *endpointAuth) currentToken() (string, error) {
+	if a.tokenFile == "" {
+		return a.token, nil
+	}
+	data, err := os.ReadFile(a.tokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read HEALTH_AUTH_TOKEN_FILE: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("HEALTH_AUTH_TOKEN_FILE is empty")
+	}
+	return token, nil
+}
+
+func (a *endpointAuth) allowedAddr(remoteAddr string) bool {
+	if len(a.allowed) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range a.allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasCredentials reports whether requests must carry a token or basic auth,
+// rather than only come from an allowed address.
+func (a *endpointAuth) hasCredentials() bool {
+	return a != nil && (a.token != "" || a.tokenFile != "" || a.username != "")
+}
+
+// authorized reports whether r carries one of the configured credentials or
+// valid admin credentials. Without credentials only the address check
+// applies.
+func (a *endpointAuth) authorized(r *http.Request) bool {
+	if !a.hasCredentials() {
+		return true
+	}
+	if header, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && (a.token != "" || a.tokenFile != "") {
+		token, err := a.currentToken()
+		if err == nil && subtle.ConstantTimeCompare([]byte(header), []byte(token)) == 1 {
+			return true
+		}
+	}
+	if user, pass, ok := r.BasicAuth(); ok && a.username != "" {
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(a.password)) == 1
+		return userOK && passOK
+	}
+	if a.admin != nil {
+		// Credentials with the role none, such as any token the cluster
+		// authenticates, grant nothing.
+		role, ok := a.admin.credentialRole(r)
+		return ok && role != roleNone
+	}
+	return false
+}
+
+// wrap checks the address and credentials of every request outside
+// probePaths, which stay open for the kubelet.
+func (a *endpointAuth) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if probePaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !a.allowedAddr(r.RemoteAddr) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if !a.authorized(r) {
+			if a.username != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="vault-unsealer"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
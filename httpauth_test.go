@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// httpOK answers every request with 200.
+var httpOK = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+func TestEndpointAuthAuthorized(t *testing.T) {
+	admin := &adminAuth{
+		tokensFile:  writeTokens(t, "operator op-token\nread-only ro-token\nnone no-token\n"),
+		defaultRole: roleReadOnly,
+	}
+	tests := []struct {
+		name       string
+		auth       endpointAuth
+		token      string
+		user, pass string
+		want       bool
+	}{
+		{name: "no credentials configured", want: true},
+		{name: "token", auth: endpointAuth{token: "secret"}, token: "secret", want: true},
+		{name: "wrong token", auth: endpointAuth{token: "secret"}, token: "other"},
+		{name: "missing token", auth: endpointAuth{token: "secret"}},
+		{name: "basic auth", auth: endpointAuth{username: "prom", password: "pw"}, user: "prom", pass: "pw", want: true},
+		{name: "wrong password", auth: endpointAuth{username: "prom", password: "pw"}, user: "prom", pass: "nope"},
+		{name: "admin operator token", auth: endpointAuth{token: "secret", admin: admin}, token: "op-token", want: true},
+		{name: "admin read-only token", auth: endpointAuth{token: "secret", admin: admin}, token: "ro-token", want: true},
+		{name: "admin none token", auth: endpointAuth{token: "secret", admin: admin}, token: "no-token"},
+		{name: "unknown token with admin", auth: endpointAuth{token: "secret", admin: admin}, token: "other"},
+		{name: "no token with admin", auth: endpointAuth{token: "secret", admin: admin}},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/metrics", nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.pass)
+		}
+		if got := tt.auth.authorized(r); got != tt.want {
+			t.Errorf("%s: authorized() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEndpointAuthAllowedAddr(t *testing.T) {
+	t.Setenv("HEALTH_ALLOWED_CIDRS", "10.0.0.0/8, 192.168.1.5, ::1")
+	a, err := loadEndpointAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.1.2.3:5000", true},
+		{"192.168.1.5:80", true},
+		{"192.168.1.6:80", false},
+		{"[::1]:8080", true},
+		{"172.16.0.1", false},
+		{"not-an-ip", false},
+	}
+	for _, tt := range tests {
+		if got := a.allowedAddr(tt.addr); got != tt.want {
+			t.Errorf("allowedAddr(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestEndpointAuthHasCredentials(t *testing.T) {
+	tests := []struct {
+		name string
+		auth *endpointAuth
+		want bool
+	}{
+		{"not configured", nil, false},
+		{"address allowlist only", &endpointAuth{}, false},
+		{"token", &endpointAuth{token: "secret"}, true},
+		{"token file", &endpointAuth{tokenFile: "/secrets/token"}, true},
+		{"basic auth", &endpointAuth{username: "prom", password: "pw"}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.auth.hasCredentials(); got != tt.want {
+			t.Errorf("%s: hasCredentials() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+type initResponse struct {
+	Keys       []string `json:"keys"`
+	KeysBase64 []string `json:"keys_base64"`
+	RootToken  string   `json:"root_token"`
+}
+
+func (u *Unsealer) autoInitEnabled() bool {
+	for _, v := range u.vaultList() {
+		if v.autoInit {
+			return true
+		}
+	}
+	return false
+}
+
+// initVault initializes a brand-new vault, writes the generated shares back
+// to the key provider and loads them so the caller can unseal right away.
+func (u *Unsealer) initVault(ctx context.Context, v *vaultConfig) error {
+	store, ok := u.getProvider().(keyStore)
+	if !ok {
+		return fmt.Errorf("key provider cannot store keys")
+	}
+
+	// Ask the provider before taking initMu, so a slow provider does not
+	// hold up the other vaults.
+	stored := u.storedKeyCount()
+
+	u.initMu.Lock()
+	defer u.initMu.Unlock()
+
+	// The vault may have been initialized, by another pass or by joining its
+	// cluster, since it was found uninitialized.
+	status, err := v.api.sealStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if status.Initialized {
+		return nil
+	}
+
+	// A valid key set, loaded or in the provider, belongs to a cluster that
+	// already exists, such as the one a new raft node has not joined yet.
+	// Initializing would overwrite its keys, so refuse.
+	if reason := u.existingKeys(stored); reason != "" {
+		msg := "refusing to initialize the vault: " + reason + " and would be overwritten"
+		if !u.initRefused[v.addr] {
+			if u.initRefused == nil {
+				u.initRefused = make(map[string]bool)
+			}
+			u.initRefused[v.addr] = true
+			u.logger.Error(msg, "vault", v.addr)
+			u.record(ctx, historyInitRefused, severityError, v, msg)
+		}
+		return fmt.Errorf("%s", msg)
+	}
+
+	shares := store.keyCount()
+	if u.initThreshold > shares {
+		return fmt.Errorf("threshold %d is larger than the %d configured key secrets", u.initThreshold, shares)
+	}
+
+	u.logger.Warn("initializing vault", "vault", v.addr, "shares", shares, "threshold", u.initThreshold)
+
+	result, err := v.api.initialize(ctx, shares, u.initThreshold)
+	if err != nil {
+		return fmt.Errorf("init request failed: %w", err)
+	}
+	if len(result.Keys) != shares {
+		return fmt.Errorf("vault returned %d keys, expected %d", len(result.Keys), shares)
+	}
+
+	// Load the new shares first so the vault can still be unsealed from memory
+	// if writing them back to the provider fails.
+	if err := u.loadKeys(result.Keys); err != nil {
+		return err
+	}
+
+	backoff := time.Second
+	for i := 0; ; i++ {
+		err := store.storeKeys(result.Keys)
+		if err == nil {
+			break
+		}
+		if i == 2 {
+			u.logger.Error("failed to store generated unseal keys, they only exist in memory", "vault", v.addr, "error", err)
+			return fmt.Errorf("failed to store generated keys: %w", err)
+		}
+		u.logger.Warn("failed to store generated unseal keys, retrying", "vault", v.addr, "error", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			u.logger.Error("failed to store generated unseal keys, they only exist in memory", "vault", v.addr, "error", err)
+			return fmt.Errorf("failed to store generated keys: %w", err)
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+
+	u.logger.Info("vault initialized and keys stored", "vault", v.addr)
+	u.handleRootToken(v, result.RootToken)
+	return nil
+}
+
+// storedKeyCount returns the number of keys the provider holds if they form a
+// valid key set, or 0. Keys that fail validation, such as placeholders in a
+// new deployment, do not count.
+func (u *Unsealer) storedKeyCount() int {
+	keys, err := u.provider.fetchKeys()
+	if err != nil || validateKeys(keys) != nil {
+		return 0
+	}
+	return len(keys)
+}
+
+// existingKeys describes the valid key set the unsealer already has, given
+// the number of valid keys in the provider, or returns "" when there is none.
+func (u *Unsealer) existingKeys(stored int) string {
+	u.keysMu.RLock()
+	loaded := len(u.keys)
+	u.keysMu.RUnlock()
+	if loaded > 0 {
+		return fmt.Sprintf("%d keys are loaded", loaded)
+	}
+	if stored > 0 {
+		return fmt.Sprintf("the key provider holds %d valid keys", stored)
+	}
+	return ""
+}
+
+// handleRootToken applies ROOT_TOKEN_POLICY to the token returned by sys/init.
+// Revocation has to wait until the vault is unsealed, so for that policy the
+// token is parked until revokeRootToken runs.
+func (u *Unsealer) handleRootToken(v *vaultConfig, token string) {
+	switch u.rootTokenPolicy {
+	case "store":
+		store, ok := u.getProvider().(secretStore)
+		if !ok {
+			u.logger.Error("key provider cannot store the root token, discarding it", "vault", v.addr)
+			return
+		}
+		if err := store.storeSecret(u.rootTokenSecret, token); err != nil {
+			u.logger.Error("failed to store root token, discarding it", "vault", v.addr, "error", err)
+			return
+		}
+		u.logger.Info("root token stored", "vault", v.addr)
+	case "print":
+		if err := printRootToken(u.rootTokenFile, v.addr, token); err != nil {
+			u.logger.Error("failed to print root token, discarding it", "vault", v.addr, "error", err)
+		}
+	case "revoke":
+		u.pendingRevoke.Store(v.addr, token)
+	default:
+		u.logger.Warn("root token discarded, generate a new one with the unseal keys when needed", "vault", v.addr)
+	}
+}
+
+// printRootToken writes the token exactly once, either to stderr or to a new
+// file that is never overwritten.
+func printRootToken(path, addr, token string) error {
+	line := fmt.Sprintf("vault %s root token: %s\n", addr, token)
+	if path == "" {
+		_, err := fmt.Fprint(os.Stderr, line)
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(line)
+	return err
+}
+
+// revokeRootToken revokes a root token parked by handleRootToken once the
+// vault it belongs to has been unsealed.
+func (u *Unsealer) revokeRootToken(ctx context.Context, v *vaultConfig) {
+	value, ok := u.pendingRevoke.LoadAndDelete(v.addr)
+	if !ok {
+		return
+	}
+
+	if err := v.api.revokeSelf(ctx, value.(string)); err != nil {
+		var se *statusError
+		if errors.As(err, &se) {
+			u.logger.Error("root token revocation rejected", "vault", v.addr, "status", se.code)
+			return
+		}
+		u.logger.Error("failed to revoke root token", "vault", v.addr, "error", err)
+		return
+	}
+	u.logger.Info("root token revoked", "vault", v.addr)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+type fakeProvider struct {
+	keys []string
+	err  error
+}
+
+func (p *fakeProvider) fetchKeys() ([]string, error) { return p.keys, p.err }
+
+func TestExistingKeys(t *testing.T) {
+	share := func(b byte) string { return strings.Repeat(string("0123456789abcdef"[b]), 66) }
+	valid := []string{share(1), share(2), share(3)}
+	tests := []struct {
+		name     string
+		loaded   []string
+		provider *fakeProvider
+		want     string
+	}{
+		{"nothing", nil, &fakeProvider{}, ""},
+		{"placeholders", nil, &fakeProvider{keys: []string{"changeme", "changeme"}}, ""},
+		{"provider error", nil, &fakeProvider{keys: valid, err: errors.New("down")}, ""},
+		{"provider keys", nil, &fakeProvider{keys: valid}, "the key provider holds 3 valid keys"},
+		{"loaded keys", valid[:2], &fakeProvider{}, "2 keys are loaded"},
+	}
+	for _, tt := range tests {
+		u := &Unsealer{provider: tt.provider, keys: tt.loaded}
+		if got := u.existingKeys(u.storedKeyCount()); got != tt.want {
+			t.Errorf("%s: existingKeys() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient is a minimal Kubernetes API client using the pod's service
+// account, or a kubeconfig context for remote clusters. It only covers the few
+// calls the unsealer needs.
+type kubeClient struct {
+	baseURL   string
+	namespace string
+	client    *http.Client
+
+	// cluster is the kubeconfig context name, empty for the local cluster.
+	cluster   string
+	token     string
+	tokenFile string
+}
+
+// newKubeClient returns a client for the local cluster: the service account
+// when running in a pod, otherwise KUBERNETES_CONTEXT (or the current context)
+// of KUBECONFIG.
+func newKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		path := os.Getenv("KUBECONFIG")
+		if path == "" {
+			return nil, fmt.Errorf("not running inside Kubernetes (KUBERNETES_SERVICE_HOST is not set) and KUBECONFIG is not set")
+		}
+		cfg, err := loadKubeconfig(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KUBECONFIG: %w", err)
+		}
+		k, err := cfg.client(getEnv("KUBERNETES_CONTEXT", cfg.CurrentContext))
+		if err != nil {
+			return nil, err
+		}
+		// The kubeconfig context is the local cluster here.
+		k.cluster = ""
+		if namespace := os.Getenv("KUBERNETES_NAMESPACE"); namespace != "" {
+			k.namespace = namespace
+		}
+		return k, nil
+	}
+
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in service account CA")
+	}
+
+	namespace := os.Getenv("KUBERNETES_NAMESPACE")
+	if namespace == "" {
+		data, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read service account namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(data))
+	}
+
+	return &kubeClient{
+		baseURL:   "https://" + net.JoinHostPort(host, port),
+		namespace: namespace,
+		tokenFile: serviceAccountDir + "/token",
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig:     &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+				TLSHandshakeTimeout: 10 * time.Second,
+			},
+		},
+	}, nil
+}
+
+type kubeError struct {
+	code    int
+	message string
+}
+
+func (e *kubeError) Error() string {
+	return fmt.Sprintf("kubernetes API status code %d: %s", e.code, e.message)
+}
+
+func isKubeStatus(err error, code int) bool {
+	var kerr *kubeError
+	return errors.As(err, &kerr) && kerr.code == code
+}
+
+// inNamespace returns a client for the same cluster in another namespace.
+func (k *kubeClient) inNamespace(namespace string) *kubeClient {
+	c := *k
+	c.namespace = namespace
+	return &c
+}
+
+// authorize adds the bearer token, if any. Token files are read on every call
+// since projected tokens are rotated by the kubelet.
+func (k *kubeClient) authorize(req *http.Request) error {
+	token := k.token
+	if k.tokenFile != "" {
+		data, err := os.ReadFile(k.tokenFile)
+		if err != nil {
+			return fmt.Errorf("failed to read service account token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Accept", "application/json")
+	return nil
+}
+
+// do sends a request to the API server.
+func (k *kubeClient) do(ctx context.Context, method, path, contentType string, payload, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, k.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if err := k.authorize(req); err != nil {
+		return err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var status struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&status)
+		return &kubeError{code: resp.StatusCode, message: status.Message}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("bad response from kubernetes API: %w", err)
+	}
+	return nil
+}
+
+func (k *kubeClient) get(ctx context.Context, path string, out interface{}) error {
+	return k.do(ctx, "GET", path, "", nil, out)
+}
+
+// secretValue reads one key of a Secret in the client's namespace.
+func (k *kubeClient) secretValue(ctx context.Context, name, key string) ([]byte, error) {
+	var secret struct {
+		Data map[string][]byte `json:"data"`
+	}
+	if err := k.get(ctx, "/api/v1/namespaces/"+url.PathEscape(k.namespace)+"/secrets/"+url.PathEscape(name), &secret); err != nil {
+		return nil, fmt.Errorf("failed to read secret %s: %w", name, err)
+	}
+	value, ok := secret.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("secret %s has no key %s", name, key)
+	}
+	return value, nil
+}
+
+// configMapValue reads one key of a ConfigMap in the client's namespace.
+func (k *kubeClient) configMapValue(ctx context.Context, name, key string) ([]byte, error) {
+	var configMap struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := k.get(ctx, "/api/v1/namespaces/"+url.PathEscape(k.namespace)+"/configmaps/"+url.PathEscape(name), &configMap); err != nil {
+		return nil, fmt.Errorf("failed to read configmap %s: %w", name, err)
+	}
+	value, ok := configMap.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("configmap %s has no key %s", name, key)
+	}
+	return []byte(value), nil
+}
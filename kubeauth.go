@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// kubeAuthCacheTTL is how long a reviewed token keeps its role, so that a
+// caller's requests do not each cost two API calls. At most
+// kubeAuthCacheSize tokens are kept.
+const (
+	kubeAuthCacheTTL  = 30 * time.Second
+	kubeAuthCacheSize = 1000
+)
+
+// kubeAuth gives Kubernetes service accounts and users an admin API role. A
+// bearer token is validated with a TokenReview, and SubjectAccessReviews ask
+// RBAC whether its user may update (operator) or get (read-only) the virtual
+// resource "admin" of the unsealer.mackcoding.io group in the unsealer's
+// namespace.
+type kubeAuth struct {
+	logger    hclog.Logger
+	kube      *kubeClient
+	audiences []string
+	// limiter bounds the reviews of tokens that are not cached, so that
+	// requests with made-up tokens cannot flood the API server.
+	limiter *rateLimiter
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]kubeAuthEntry
+}
+
+type kubeAuthEntry struct {
+	role          string
+	authenticated bool
+	expires       time.Time
+}
+
+// newKubeAuth reads ADMIN_KUBE_AUTH, ADMIN_KUBE_AUDIENCES and
+// ADMIN_KUBE_REVIEW_LIMIT. It returns nil when Kubernetes authentication is
+// off.
+func newKubeAuth(log hclog.Logger) (*kubeAuth, error) {
+	if getEnv("ADMIN_KUBE_AUTH", "false") != "true" {
+		return nil, nil
+	}
+	kube, err := newKubeClient()
+	if err != nil {
+		return nil, fmt.Errorf("ADMIN_KUBE_AUTH: %w", err)
+	}
+	limit, err := strconv.Atoi(getEnv("ADMIN_KUBE_REVIEW_LIMIT", "60"))
+	if err != nil || limit < 0 {
+		return nil, fmt.Errorf("ADMIN_KUBE_REVIEW_LIMIT must be a non-negative number")
+	}
+	return &kubeAuth{
+		logger:    log,
+		kube:      kube,
+		audiences: splitList(os.Getenv("ADMIN_KUBE_AUDIENCES")),
+		limiter:   newRateLimiter(limit),
+		cache:     map[[sha256.Size]byte]kubeAuthEntry{},
+	}, nil
+}
+
+type tokenReview struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Spec       tokenReviewSpec   `json:"spec"`
+	Status     tokenReviewStatus `json:"status"`
+}
+
+type tokenReviewSpec struct {
+	Token     string   `json:"token"`
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+type tokenReviewStatus struct {
+	Authenticated bool     `json:"authenticated"`
+	User          kubeUser `json:"user"`
+	Error         string   `json:"error,omitempty"`
+}
+
+type kubeUser struct {
+	Username string              `json:"username"`
+	UID      string              `json:"uid,omitempty"`
+	Groups   []string            `json:"groups,omitempty"`
+	Extra    map[string][]string `json:"extra,omitempty"`
+}
+
+type subjectAccessReview struct {
+	APIVersion string                    `json:"apiVersion"`
+	Kind       string                    `json:"kind"`
+	Spec       subjectAccessReviewSpec   `json:"spec"`
+	Status     subjectAccessReviewStatus `json:"status"`
+}
+
+type subjectAccessReviewSpec struct {
+	ResourceAttributes resourceAttributes  `json:"resourceAttributes"`
+	User               string              `json:"user"`
+	UID                string              `json:"uid,omitempty"`
+	Groups             []string            `json:"groups,omitempty"`
+	Extra              map[string][]string `json:"extra,omitempty"`
+}
+
+type resourceAttributes struct {
+	Namespace string `json:"namespace"`
+	Verb      string `json:"verb"`
+	Group     string `json:"group"`
+	Resource  string `json:"resource"`
+}
+
+type subjectAccessReviewStatus struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// role returns the role of token, and false when the API server does not
+// accept it or the review fails. Rejected tokens are cached like accepted
+// ones, but reviews that fail are not, and none are made over the rate limit.
+func (k *kubeAuth) role(ctx context.Context, token string) (string, bool) {
+	key := sha256.Sum256([]byte(token))
+	k.mu.Lock()
+	entry, ok := k.cache[key]
+	k.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.role, entry.authenticated
+	}
+
+	if k.limiter != nil {
+		ok, dropped := k.limiter.allow(time.Now())
+		if !ok {
+			if dropped == 1 {
+				k.logger.Warn("admin API token review rate limit reached, refusing uncached tokens")
+			}
+			return "", false
+		}
+		if dropped > 0 {
+			k.logger.Warn("refused admin API tokens over the review rate limit", "refused", dropped)
+		}
+	}
+	role, authenticated, err := k.review(ctx, token)
+	if err != nil {
+		k.logger.Warn("failed to review admin API token", "error", err)
+		return "", false
+	}
+	k.store(key, kubeAuthEntry{role: role, authenticated: authenticated, expires: time.Now().Add(kubeAuthCacheTTL)})
+	return role, authenticated
+}
+
+// store caches entry, first dropping expired entries and, when the cache is
+// still full, the one closest to expiry.
+func (k *kubeAuth) store(key [sha256.Size]byte, entry kubeAuthEntry) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := time.Now()
+	for key, e := range k.cache {
+		if now.After(e.expires) {
+			delete(k.cache, key)
+		}
+	}
+	if len(k.cache) >= kubeAuthCacheSize {
+		var oldest [sha256.Size]byte
+		var oldestExpires time.Time
+		for key, e := range k.cache {
+			if oldestExpires.IsZero() || e.expires.Before(oldestExpires) {
+				oldest, oldestExpires = key, e.expires
+			}
+		}
+		delete(k.cache, oldest)
+	}
+	k.cache[key] = entry
+}
+
+func (k *kubeAuth) review(ctx context.Context, token string) (string, bool, error) {
+	tr := tokenReview{
+		APIVersion: "authentication.k8s.io/v1",
+		Kind:       "TokenReview",
+		Spec:       tokenReviewSpec{Token: token, Audiences: k.audiences},
+	}
+	if err := k.kube.do(ctx, "POST", "/apis/authentication.k8s.io/v1/tokenreviews", "application/json", tr, &tr); err != nil {
+		return "", false, fmt.Errorf("TokenReview failed: %w", err)
+	}
+	if !tr.Status.Authenticated {
+		return "", false, nil
+	}
+	for _, check := range []struct{ verb, role string }{{"update", roleOperator}, {"get", roleReadOnly}} {
+		sar := subjectAccessReview{
+			APIVersion: "authorization.k8s.io/v1",
+			Kind:       "SubjectAccessReview",
+			Spec: subjectAccessReviewSpec{
+				ResourceAttributes: resourceAttributes{
+					Namespace: k.kube.namespace,
+					Verb:      check.verb,
+					Group:     "unsealer.mackcoding.io",
+					Resource:  "admin",
+				},
+				User:   tr.Status.User.Username,
+				UID:    tr.Status.User.UID,
+				Groups: tr.Status.User.Groups,
+				Extra:  tr.Status.User.Extra,
+			},
+		}
+		if err := k.kube.do(ctx, "POST", "/apis/authorization.k8s.io/v1/subjectaccessreviews", "application/json", sar, &sar); err != nil {
+			return "", false, fmt.Errorf("SubjectAccessReview failed: %w", err)
+		}
+		if sar.Status.Allowed {
+			return check.role, true, nil
+		}
+	}
+	return roleNone, true, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// fakeKubeAuthServer authenticates the token "ci-token" as the user ci, who
+// may update the admin resource, and "viewer-token" as viewer, who may only
+// get it. With fail set, every review answers 500.
+func fakeKubeAuthServer(t *testing.T, reviews *atomic.Int32, fail *atomic.Bool) *kubeAuth {
+	users := map[string]string{"ci-token": "ci", "viewer-token": "viewer"}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, `{"message":"unavailable"}`, http.StatusInternalServerError)
+			return
+		}
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/tokenreviews"):
+			reviews.Add(1)
+			var tr tokenReview
+			json.NewDecoder(r.Body).Decode(&tr)
+			if user, ok := users[tr.Spec.Token]; ok {
+				tr.Status = tokenReviewStatus{Authenticated: true, User: kubeUser{Username: user}}
+			}
+			json.NewEncoder(w).Encode(tr)
+		case strings.HasSuffix(r.URL.Path, "/subjectaccessreviews"):
+			var sar subjectAccessReview
+			json.NewDecoder(r.Body).Decode(&sar)
+			verb := sar.Spec.ResourceAttributes.Verb
+			sar.Status.Allowed = sar.Spec.User == "ci" || sar.Spec.User == "viewer" && verb == "get"
+			json.NewEncoder(w).Encode(sar)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return &kubeAuth{
+		logger: hclog.NewNullLogger(),
+		kube:   &kubeClient{baseURL: srv.URL, namespace: "vault", client: srv.Client(), token: "sa-token"},
+		cache:  map[[sha256.Size]byte]kubeAuthEntry{},
+	}
+}
+
+func TestKubeAuthRole(t *testing.T) {
+	var reviews atomic.Int32
+	var fail atomic.Bool
+	k := fakeKubeAuthServer(t, &reviews, &fail)
+	ctx := context.Background()
+
+	tests := []struct {
+		token         string
+		role          string
+		authenticated bool
+	}{
+		{"ci-token", roleOperator, true},
+		{"viewer-token", roleReadOnly, true},
+		{"made-up", "", false},
+	}
+	for _, tt := range tests {
+		// The second lookup is answered from the cache.
+		for i := 0; i < 2; i++ {
+			role, ok := k.role(ctx, tt.token)
+			if role != tt.role || ok != tt.authenticated {
+				t.Errorf("role(%q) = %q, %v, want %q, %v", tt.token, role, ok, tt.role, tt.authenticated)
+			}
+		}
+	}
+	if n := reviews.Load(); n != 3 {
+		t.Errorf("made %d TokenReviews, want 3", n)
+	}
+
+	// Failed reviews are not cached.
+	fail.Store(true)
+	if _, ok := k.role(ctx, "other"); ok {
+		t.Error("role() accepted a token while the API server failed")
+	}
+	fail.Store(false)
+	if _, ok := k.role(ctx, "other"); ok {
+		t.Error("role() accepted an unknown token")
+	}
+	if n := reviews.Load(); n != 4 {
+		t.Errorf("made %d TokenReviews, want 4", n)
+	}
+}
+
+func TestKubeAuthRateLimit(t *testing.T) {
+	var reviews atomic.Int32
+	var fail atomic.Bool
+	k := fakeKubeAuthServer(t, &reviews, &fail)
+	k.limiter = newRateLimiter(2)
+	ctx := context.Background()
+
+	for _, token := range []string{"made-up-1", "ci-token", "made-up-2", "made-up-3"} {
+		k.role(ctx, token)
+	}
+	if n := reviews.Load(); n != 2 {
+		t.Errorf("made %d TokenReviews over a limit of 2, want 2", n)
+	}
+	// Cached tokens are not limited.
+	if role, ok := k.role(ctx, "ci-token"); role != roleOperator || !ok {
+		t.Errorf("role() of a cached token = %q, %v over the rate limit", role, ok)
+	}
+}
+
+func TestKubeAuthCacheSize(t *testing.T) {
+	k := &kubeAuth{cache: map[[sha256.Size]byte]kubeAuthEntry{}}
+	now := time.Now()
+	for i := 0; i < kubeAuthCacheSize; i++ {
+		key := sha256.Sum256([]byte{byte(i), byte(i >> 8)})
+		k.store(key, kubeAuthEntry{expires: now.Add(time.Minute + time.Duration(i)*time.Millisecond)})
+	}
+	k.store(sha256.Sum256([]byte("expired")), kubeAuthEntry{expires: now.Add(-time.Second)})
+	newest := sha256.Sum256([]byte("newest"))
+	k.store(newest, kubeAuthEntry{expires: now.Add(time.Hour)})
+
+	if len(k.cache) != kubeAuthCacheSize {
+		t.Errorf("cache holds %d entries, want %d", len(k.cache), kubeAuthCacheSize)
+	}
+	if _, ok := k.cache[newest]; !ok {
+		t.Error("cache dropped the newest entry")
+	}
+	if _, ok := k.cache[sha256.Sum256([]byte{0, 0})]; ok {
+		t.Error("cache kept the entry closest to expiry")
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// kubeconfig is the part of a kubeconfig file needed to reach other clusters.
+// Only the JSON form is read, as written by
+// "kubectl config view --flatten --raw -o json".
+type kubeconfig struct {
+	// dir is the directory of the file, which relative paths are based on.
+	dir string
+
+	CurrentContext string `json:"current-context"`
+	Clusters       []struct {
+		Name    string `json:"name"`
+		Cluster struct {
+			Server                   string `json:"server"`
+			TLSServerName            string `json:"tls-server-name"`
+			CertificateAuthority     string `json:"certificate-authority"`
+			CertificateAuthorityData []byte `json:"certificate-authority-data"`
+		} `json:"cluster"`
+	} `json:"clusters"`
+	Users []struct {
+		Name string `json:"name"`
+		User struct {
+			Token                 string          `json:"token"`
+			TokenFile             string          `json:"tokenFile"`
+			ClientCertificate     string          `json:"client-certificate"`
+			ClientCertificateData []byte          `json:"client-certificate-data"`
+			ClientKey             string          `json:"client-key"`
+			ClientKeyData         []byte          `json:"client-key-data"`
+			Exec                  json.RawMessage `json:"exec"`
+		} `json:"user"`
+	} `json:"users"`
+	Contexts []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster   string `json:"cluster"`
+			User      string `json:"user"`
+			Namespace string `json:"namespace"`
+		} `json:"context"`
+	} `json:"contexts"`
+}
+
+func loadKubeconfig(path string) (*kubeconfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg kubeconfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("kubeconfig must be JSON (kubectl config view --flatten --raw -o json): %w", err)
+	}
+	cfg.dir = filepath.Dir(path)
+	return &cfg, nil
+}
+
+func (c *kubeconfig) readFile(path string) ([]byte, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(c.dir, path)
+	}
+	return os.ReadFile(path)
+}
+
+// client builds an API client for one context.
+func (c *kubeconfig) client(name string) (*kubeClient, error) {
+	var cluster, user, namespace string
+	found := false
+	for _, ctx := range c.Contexts {
+		if ctx.Name == name {
+			cluster, user, namespace, found = ctx.Context.Cluster, ctx.Context.User, ctx.Context.Namespace, true
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("kubeconfig has no current context, set KUBERNETES_CONTEXT")
+	}
+	if !found {
+		return nil, fmt.Errorf("context %s not found", name)
+	}
+
+	k := &kubeClient{cluster: name, namespace: namespace}
+	if k.namespace == "" {
+		k.namespace = "default"
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	found = false
+	for _, cl := range c.Clusters {
+		if cl.Name != cluster {
+			continue
+		}
+		found = true
+		k.baseURL = strings.TrimRight(cl.Cluster.Server, "/")
+		tlsConfig.ServerName = cl.Cluster.TLSServerName
+		ca := cl.Cluster.CertificateAuthorityData
+		if cl.Cluster.CertificateAuthority != "" {
+			var err error
+			if ca, err = c.readFile(cl.Cluster.CertificateAuthority); err != nil {
+				return nil, fmt.Errorf("context %s: failed to read CA: %w", name, err)
+			}
+		}
+		if len(ca) > 0 {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("context %s: no certificates found in CA", name)
+			}
+			tlsConfig.RootCAs = pool
+		}
+	}
+	if !found || k.baseURL == "" {
+		return nil, fmt.Errorf("context %s: cluster %s not found or has no server", name, cluster)
+	}
+
+	for _, u := range c.Users {
+		if u.Name != user {
+			continue
+		}
+		if len(u.User.Exec) > 0 && string(u.User.Exec) != "null" {
+			return nil, fmt.Errorf("context %s: exec credential plugins are not supported, use a token", name)
+		}
+		k.token, k.tokenFile = u.User.Token, u.User.TokenFile
+		if k.tokenFile != "" && !filepath.IsAbs(k.tokenFile) {
+			k.tokenFile = filepath.Join(c.dir, k.tokenFile)
+		}
+
+		certPEM, keyPEM := u.User.ClientCertificateData, u.User.ClientKeyData
+		var err error
+		if u.User.ClientCertificate != "" {
+			if certPEM, err = c.readFile(u.User.ClientCertificate); err != nil {
+				return nil, fmt.Errorf("context %s: failed to read client certificate: %w", name, err)
+			}
+		}
+		if u.User.ClientKey != "" {
+			if keyPEM, err = c.readFile(u.User.ClientKey); err != nil {
+				return nil, fmt.Errorf("context %s: failed to read client key: %w", name, err)
+			}
+		}
+		if len(certPEM) > 0 {
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				return nil, fmt.Errorf("context %s: invalid client certificate: %w", name, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	k.client = &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+	return k, nil
+}
+
+// kubeTargets returns a client for every cluster and namespace that discovery
+// and operator mode cover: each context in KUBERNETES_CONTEXTS ("in-cluster"
+// for the local cluster), or the local cluster when it is unset, combined
+// with each namespace in KUBERNETES_NAMESPACES, or the client's own namespace
+// when that is unset.
+func kubeTargets() ([]*kubeClient, error) {
+	var clusters []*kubeClient
+	if contexts := splitList(os.Getenv("KUBERNETES_CONTEXTS")); len(contexts) > 0 {
+		path := getEnv("KUBECONFIG", "")
+		if path == "" {
+			return nil, fmt.Errorf("KUBERNETES_CONTEXTS requires KUBECONFIG")
+		}
+		cfg, err := loadKubeconfig(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KUBECONFIG: %w", err)
+		}
+		for _, name := range contexts {
+			var k *kubeClient
+			if name == "in-cluster" {
+				k, err = newKubeClient()
+			} else {
+				k, err = cfg.client(name)
+			}
+			if err != nil {
+				return nil, err
+			}
+			clusters = append(clusters, k)
+		}
+	} else {
+		k, err := newKubeClient()
+		if err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, k)
+	}
+
+	namespaces := splitList(os.Getenv("KUBERNETES_NAMESPACES"))
+	if len(namespaces) == 0 {
+		return clusters, nil
+	}
+	var targets []*kubeClient
+	for _, k := range clusters {
+		for _, ns := range namespaces {
+			targets = append(targets, k.inNamespace(ns))
+		}
+	}
+	return targets, nil
+}
+
+// qualify prefixes name with the context and namespace of the client, for
+// logs and keys when several targets are watched.
+func (k *kubeClient) qualify(name string) string {
+	if k.cluster != "" {
+		return k.cluster + "/" + k.namespace + "/" + name
+	}
+	return k.namespace + "/" + name
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// leaseTimeFormat is the MicroTime format the API server uses for leases.
+const leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+type lease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace,omitempty"`
+		ResourceVersion string            `json:"resourceVersion,omitempty"`
+		Labels          map[string]string `json:"labels,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions"`
+	} `json:"spec"`
+}
+
+// held reports whether the lease has a holder whose last renewal has not
+// expired yet.
+func (l *lease) held(now time.Time) bool {
+	if l.Spec.HolderIdentity == "" {
+		return false
+	}
+	renewed, err := time.Parse(leaseTimeFormat, l.Spec.RenewTime)
+	if err != nil {
+		return false
+	}
+	return now.Before(renewed.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+func leasePath(namespace string) string {
+	return "/apis/coordination.k8s.io/v1/namespaces/" + url.PathEscape(namespace) + "/leases"
+}
+
+// leaseIdentity names this replica in leases: the pod name when set through
+// the downward API, otherwise the host name, which is the pod name as well.
+func leaseIdentity() (string, error) {
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name, nil
+	}
+	return os.Hostname()
+}
+
+// leaderElector holds a Lease so that only one of several unsealer replicas
+// submits keys. A replica counts itself as leader only until its last
+// successful renewal is a full lease duration old, so it steps down before
+// another replica can take over.
+type leaderElector struct {
+	logger   hclog.Logger
+	kube     *kubeClient
+	name     string
+	identity string
+	duration time.Duration
+
+	mu        sync.Mutex
+	renewedAt time.Time
+}
+
+func newLeaderElector(log hclog.Logger) (*leaderElector, error) {
+	kube, err := newKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	identity, err := leaseIdentity()
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine replica identity: %w", err)
+	}
+	duration, err := time.ParseDuration(getEnv("LEADER_ELECTION_LEASE_DURATION", "15s"))
+	if err != nil || duration < 5*time.Second {
+		return nil, fmt.Errorf("LEADER_ELECTION_LEASE_DURATION must be a duration of at least 5s")
+	}
+	return &leaderElector{
+		logger:   log,
+		kube:     kube,
+		name:     getEnv("LEADER_ELECTION_LEASE", "vault-unsealer"),
+		identity: identity,
+		duration: duration,
+	}, nil
+}
+
+func (e *leaderElector) isLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !e.renewedAt.IsZero() && time.Since(e.renewedAt) < e.duration
+}
+
+// run tries to acquire or renew the lease three times per lease duration and
+// calls elected whenever this replica becomes the leader. The lease is
+// released on shutdown so another replica can take over right away.
+func (e *leaderElector) run(ctx context.Context, elected func()) {
+	ticker := time.NewTicker(e.duration / 3)
+	defer ticker.Stop()
+
+	leading := false
+	for {
+		start := time.Now()
+		ok, err := e.tryAcquire(ctx)
+		if err != nil && ctx.Err() == nil {
+			e.logger.Warn("leader election failed", "lease", e.name, "error", err)
+		}
+		if ok {
+			e.mu.Lock()
+			e.renewedAt = start
+			e.mu.Unlock()
+		}
+
+		if now := e.isLeader(); now != leading {
+			leading = now
+			if leading {
+				e.logger.Info("became leader, unsealing", "lease", e.name, "identity", e.identity)
+				elected()
+			} else {
+				e.logger.Warn("lost leadership, no longer unsealing", "lease", e.name, "identity", e.identity)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			e.release()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tryAcquire creates the lease, renews it or takes it over once the current
+// holder let it expire. Losing an update race to another replica is not an
+// error.
+func (e *leaderElector) tryAcquire(ctx context.Context) (bool, error) {
+	path := leasePath(e.kube.namespace)
+	now := time.Now()
+
+	var l lease
+	err := e.kube.get(ctx, path+"/"+url.PathEscape(e.name), &l)
+	if isKubeStatus(err, http.StatusNotFound) {
+		l.APIVersion, l.Kind = "coordination.k8s.io/v1", "Lease"
+		l.Metadata.Name = e.name
+		claimLease(&l, e.identity, e.duration, now)
+		err = e.kube.do(ctx, "POST", path, "application/json", &l, nil)
+		if isKubeStatus(err, http.StatusConflict) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if l.Spec.HolderIdentity != e.identity && l.held(now) {
+		return false, nil
+	}
+	claimLease(&l, e.identity, e.duration, now)
+	err = e.kube.do(ctx, "PUT", path+"/"+url.PathEscape(e.name), "application/json", &l, nil)
+	if isKubeStatus(err, http.StatusConflict) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// claimLease makes identity the holder of l and renews it.
+func claimLease(l *lease, identity string, duration time.Duration, now time.Time) {
+	if l.Spec.HolderIdentity != identity {
+		l.Spec.HolderIdentity = identity
+		l.Spec.AcquireTime = now.UTC().Format(leaseTimeFormat)
+		l.Spec.LeaseTransitions++
+	}
+	l.Spec.LeaseDurationSeconds = int(duration.Seconds())
+	l.Spec.RenewTime = now.UTC().Format(leaseTimeFormat)
+}
+
+// release gives up the lease if this replica still holds it.
+func (e *leaderElector) release() {
+	if !e.isLeader() {
+		return
+	}
+	e.mu.Lock()
+	e.renewedAt = time.Time{}
+	e.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	path := leasePath(e.kube.namespace) + "/" + url.PathEscape(e.name)
+	var l lease
+	if err := e.kube.get(ctx, path, &l); err != nil || l.Spec.HolderIdentity != e.identity {
+		return
+	}
+	l.Spec.HolderIdentity = ""
+	if err := e.kube.do(ctx, "PUT", path, "application/json", &l, nil); err != nil {
+		e.logger.Warn("failed to release leader lease", "lease", e.name, "error", err)
+		return
+	}
+	e.logger.Info("released leader lease", "lease", e.name)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLeaseHeld(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		holder   string
+		renewed  string
+		duration int
+		want     bool
+	}{
+		{"renewed recently", "unsealer-0", now.Add(-5 * time.Second).Format(leaseTimeFormat), 15, true},
+		{"expired", "unsealer-0", now.Add(-20 * time.Second).Format(leaseTimeFormat), 15, false},
+		{"expires now", "unsealer-0", now.Add(-15 * time.Second).Format(leaseTimeFormat), 15, false},
+		{"no holder", "", now.Format(leaseTimeFormat), 15, false},
+		{"no renew time", "unsealer-0", "", 15, false},
+		{"invalid renew time", "unsealer-0", "yesterday", 15, false},
+	}
+	for _, tt := range tests {
+		var l lease
+		l.Spec.HolderIdentity = tt.holder
+		l.Spec.RenewTime = tt.renewed
+		l.Spec.LeaseDurationSeconds = tt.duration
+		if got := l.held(now); got != tt.want {
+			t.Errorf("%s: held() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func parseLogLevel(value string) (hclog.Level, error) {
+	switch strings.ToLower(value) {
+	case "trace":
+		return hclog.Trace, nil
+	case "debug":
+		return hclog.Debug, nil
+	case "info":
+		return hclog.Info, nil
+	case "warn", "warning":
+		return hclog.Warn, nil
+	case "error":
+		return hclog.Error, nil
+	}
+	return hclog.NoLevel, fmt.Errorf("must be trace, debug, info, warn or error, got %q", value)
+}
+
+// logLevelControl changes the log level at runtime, for example to debug a
+// stuck unseal without restarting and losing the in-memory state. A raised
+// level falls back to the configured one after a timeout, so a forgotten
+// debug session does not flood the logs.
+type logLevelControl struct {
+	log     hclog.Logger
+	base    hclog.Level
+	timeout time.Duration
+
+	mu    sync.Mutex
+	timer *time.Timer
+}
+
+func newLogLevelControl(log hclog.Logger, base hclog.Level, timeout time.Duration) *logLevelControl {
+	return &logLevelControl{log: log, base: base, timeout: timeout}
+}
+
+// set switches to level. Unless it is the configured level, the configured
+// one is restored after the timeout, if there is one.
+func (c *logLevelControl) set(level hclog.Level) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.log.SetLevel(level)
+	if level == c.base || c.timeout <= 0 {
+		c.log.Info("log level changed", "level", level.String())
+		return
+	}
+	c.log.Info("log level changed", "level", level.String(), "reverts_in", c.timeout)
+	c.timer = time.AfterFunc(c.timeout, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.timer = nil
+		c.log.SetLevel(c.base)
+		c.log.Info("log level reverted", "level", c.base.String())
+	})
+}
+
+// toggle switches between debug and the configured level.
+func (c *logLevelControl) toggle() {
+	if c.log.GetLevel() == c.base && c.base != hclog.Debug {
+		c.set(hclog.Debug)
+		return
+	}
+	c.set(c.base)
+}
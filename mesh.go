@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// errMeshUnavailable marks a response generated by the mesh sidecar rather
+// than by Vault, for example while the vault pod is being replaced.
+var errMeshUnavailable = errors.New("service mesh could not reach vault")
+
+// meshReadyURLs are the readiness endpoints of the sidecar proxies.
+var meshReadyURLs = map[string]string{
+	"istio":   "http://localhost:15021/healthz/ready",
+	"linkerd": "http://localhost:4191/ready",
+}
+
+// meshError reports whether resp was produced by the sidecar of the given
+// mesh instead of the upstream vault. Linkerd marks its own errors with
+// l5d-proxy-error; Envoy's local replies lack the upstream service time that
+// every proxied response carries.
+func meshError(mesh string, resp *http.Response) (string, bool) {
+	switch mesh {
+	case "linkerd":
+		if reason := resp.Header.Get("l5d-proxy-error"); reason != "" {
+			return reason, true
+		}
+	case "istio":
+		if resp.StatusCode >= 500 && resp.Header.Get("Server") == "envoy" && resp.Header.Get("X-Envoy-Upstream-Service-Time") == "" {
+			return resp.Status, true
+		}
+	}
+	return "", false
+}
+
+// waitForMesh blocks until the sidecar reports ready, so the first key
+// provider login and vault calls do not fail while the proxy starts. After
+// timeout it gives up and lets the normal retries take over.
+func waitForMesh(ctx context.Context, log hclog.Logger, url string, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	client := &http.Client{Timeout: 2 * time.Second}
+
+	start := time.Now()
+	for {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			log.Warn("invalid mesh readiness URL, not waiting for the sidecar", "url", url, "error", err)
+			return
+		}
+		resp, err := client.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				log.Info("mesh sidecar ready", "waited", time.Since(start).Round(time.Millisecond))
+				return
+			}
+			err = fmt.Errorf("status code %d", resp.StatusCode)
+		}
+		log.Debug("waiting for mesh sidecar", "url", url, "error", err)
+		select {
+		case <-ctx.Done():
+			log.Warn("mesh sidecar not ready, continuing anyway", "url", url, "timeout", timeout)
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
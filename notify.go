@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// notification is an event as sent to the notification sinks.
+type notification struct {
+	Type      string    `json:"type"`
+	Severity  string    `json:"severity"`
+	Time      time.Time `json:"time"`
+	Vault     string    `json:"vault,omitempty"`
+	Config    string    `json:"config,omitempty"`
+	Group     string    `json:"group,omitempty"`
+	Message   string    `json:"message"`
+	RequestID string    `json:"request_id,omitempty"`
+	Instance  string    `json:"instance"`
+	// State is the vault's status when the event was recorded, such as
+	// sealed or unsealed.
+	State           string        `json:"state,omitempty"`
+	Error           string        `json:"error,omitempty"`
+	Duration        time.Duration `json:"-"`
+	DurationSeconds float64       `json:"duration_seconds,omitempty"`
+	// Reminder is set on the reminders of an unresolved condition, with the
+	// time it started and the events suppressed since the last notification.
+	Reminder   bool      `json:"reminder,omitempty"`
+	Since      time.Time `json:"since,omitzero"`
+	Suppressed int       `json:"suppressed,omitempty"`
+}
+
+// defaultNotifyEvents are the events worth telling someone about.
+const defaultNotifyEvents = "seal_detected,unseal_succeeded,unseal_failed,unseal_escalated,provider_error,init_refused,vault_flapping,vault_flapping_resolved"
+
+// sink delivers notifications to one destination. name identifies it in
+// logs and must not contain credentials. send is called for one notification
+// at a time and should give up when ctx is done; the notifier retries it
+// unless retryableSendError says the error is permanent, so HTTP sinks
+// return a statusError for a failed response. Sinks can implement
+// resolvingSink, eventSelector and backgroundSink for more control.
+type sink interface {
+	name() string
+	send(ctx context.Context, n notification) error
+}
+
+// sinkLoader reads the settings of one kind of sink and returns its sinks,
+// none when that kind is not configured.
+type sinkLoader func() ([]sink, error)
+
+type sinkKind struct {
+	kind string
+	load sinkLoader
+}
+
+// sinkKinds are the registered kinds of sinks.
+var sinkKinds []sinkKind
+
+// registerSink adds a kind of sink. Every kind registers itself from an init
+// function in its own file, which can sit behind a build tag, so a new sink
+// needs no change to the notifier. The kind is the name NOTIFY_ROUTES uses.
+func registerSink(kind string, load sinkLoader) {
+	for _, k := range sinkKinds {
+		if k.kind == kind {
+			panic("notification sink registered twice: " + kind)
+		}
+	}
+	sinkKinds = append(sinkKinds, sinkKind{kind, load})
+}
+
+// singleSink adapts the loader of a kind that has at most one sink.
+func singleSink(load func() (sink, error)) sinkLoader {
+	return func() ([]sink, error) {
+		s, err := load()
+		if err != nil || s == nil {
+			return nil, err
+		}
+		return []sink{s}, nil
+	}
+}
+
+// alertResolutions maps the events that end a condition to the events that
+// started it, whose alerts they resolve.
+var alertResolutions = map[string][]string{
+	historyUnsealSuccess: {historySealDetected, historyUnsealFailure, historyEscalated},
+	historyKeyRefresh:    {historyProviderError},
+	historyFlapResolved:  {historyFlapping},
+}
+
+// resolvingSink is implemented by sinks that open alerts and close them
+// again. They also receive the events that end a condition, such as
+// key_refresh after provider_error, when NOTIFY_EVENTS leaves them out.
+type resolvingSink interface {
+	sink
+	resolves(eventType string) bool
+}
+
+// eventSelector is implemented by sinks with their own choice of events
+// instead of NOTIFY_EVENTS. A nil set means NOTIFY_EVENTS.
+type eventSelector interface {
+	events() map[string]bool
+}
+
+// backgroundSink is implemented by sinks with work of their own between
+// notifications. run returns when ctx is cancelled.
+type backgroundSink interface {
+	run(ctx context.Context)
+}
+
+// notifier queues notifications for every sink and delivers them in the
+// background, so a slow or unreachable destination never delays an unseal.
+// Each sink has its own queue; when one is full its notifications are
+// dropped.
+type notifier struct {
+	logger   hclog.Logger
+	instance string
+	retries  int
+	queues   []*sinkQueue
+
+	// conditions is nil when NOTIFY_DEDUP is off.
+	conditionsMu sync.Mutex
+	conditions   map[string]*condition
+	reminder     time.Duration
+}
+
+type sinkQueue struct {
+	kind   string
+	sink   sink
+	events map[string]bool
+	// routes are the NOTIFY_ROUTES rules that name the sink, nil if none do.
+	routes  []*notifyRoute
+	limiter *rateLimiter
+	queue   chan notification
+}
+
+// newNotifier reads NOTIFY_EVENTS, NOTIFY_RETRIES, NOTIFY_ROUTES,
+// NOTIFY_RATE_LIMIT and the deduplication settings and sets up the
+// configured sinks. It returns nil when no sink is configured.
+func newNotifier(log hclog.Logger) (*notifier, error) {
+	var queues []*sinkQueue
+	kinds := map[string]bool{}
+	for _, k := range sinkKinds {
+		sinks, err := k.load()
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range sinks {
+			queues = append(queues, &sinkQueue{kind: k.kind, sink: s})
+			kinds[k.kind] = true
+		}
+	}
+	if len(queues) == 0 {
+		return nil, nil
+	}
+
+	events, err := eventTypesEnv("NOTIFY_EVENTS", defaultNotifyEvents)
+	if err != nil {
+		return nil, err
+	}
+	retries, err := strconv.Atoi(getEnv("NOTIFY_RETRIES", "3"))
+	if err != nil || retries < 0 {
+		return nil, fmt.Errorf("NOTIFY_RETRIES must be a non-negative number")
+	}
+	instance, err := leaseIdentity()
+	if err != nil {
+		instance = "vault-unsealer"
+	}
+	routes, err := parseRoutes(os.Getenv("NOTIFY_ROUTES"), kinds)
+	if err != nil {
+		return nil, err
+	}
+	rateLimit, err := rateLimitEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	n := &notifier{logger: log, instance: instance, retries: retries}
+	if err := n.loadDedup(); err != nil {
+		return nil, err
+	}
+	for _, q := range queues {
+		q.events = events
+		q.limiter = newRateLimiter(rateLimit)
+		q.queue = make(chan notification, 100)
+		if sel, ok := q.sink.(eventSelector); ok && sel.events() != nil {
+			q.events = sel.events()
+		}
+		for _, r := range routes {
+			if r.sinks[q.kind] {
+				q.routes = append(q.routes, r)
+			}
+		}
+		n.queues = append(n.queues, q)
+	}
+	return n, nil
+}
+
+// eventTypesEnv reads a comma-separated list of event types.
+func eventTypesEnv(name, def string) (map[string]bool, error) {
+	events := typeFilter(getEnv(name, def))
+	for t := range events {
+		if !historyTypes[t] {
+			return nil, fmt.Errorf("unknown event type %q in %s", t, name)
+		}
+	}
+	return events, nil
+}
+
+// notify queues e, about v if not nil, for every sink that takes its type.
+func (n *notifier) notify(e historyEvent, v *vaultConfig, o eventOutcome) {
+	msg := notification{
+		Type:      e.Type,
+		Severity:  e.Severity,
+		Time:      e.Time,
+		Vault:     e.Vault,
+		Config:    e.Config,
+		Message:   e.Message,
+		RequestID: e.RequestID,
+		Instance:  n.instance,
+		Duration:  o.duration,
+	}
+	if v != nil {
+		msg.State = v.state.getStatus()
+		msg.Group = v.group
+	}
+	if o.err != nil {
+		msg.Error = o.err.Error()
+	}
+	msg.DurationSeconds = o.duration.Seconds()
+	if n.conditions != nil && !n.track(msg) {
+		return
+	}
+	n.enqueue(msg)
+}
+
+func (n *notifier) enqueue(msg notification) {
+	for _, q := range n.queues {
+		if !q.accepts(msg) {
+			continue
+		}
+		// Resolutions are not rate limited, so no alert is left open.
+		if q.limiter != nil && alertResolutions[msg.Type] == nil {
+			ok, dropped := q.limiter.allow(time.Now())
+			if !ok {
+				if dropped == 1 {
+					n.logger.Warn("notification rate limit reached, dropping notifications", "sink", q.sink.name())
+				}
+				continue
+			}
+			if dropped > 0 {
+				n.logger.Warn("dropped notifications over the rate limit", "sink", q.sink.name(), "dropped", dropped)
+			}
+		}
+		select {
+		case q.queue <- msg:
+		default:
+			n.logger.Warn("notification queue full, dropping notification", "sink", q.sink.name(), "type", msg.Type)
+		}
+	}
+}
+
+// run delivers notifications until ctx is cancelled, then gives the
+// notifications still queued five more seconds.
+func (n *notifier) run(ctx context.Context) {
+	done := make(chan struct{})
+	for _, q := range n.queues {
+		if b, ok := q.sink.(backgroundSink); ok {
+			go b.run(ctx)
+		}
+		go func(q *sinkQueue) {
+			defer func() { done <- struct{}{} }()
+			for {
+				select {
+				case <-ctx.Done():
+					n.drain(q)
+					return
+				case msg := <-q.queue:
+					n.deliver(ctx, q.sink, msg)
+				}
+			}
+		}(q)
+	}
+	if n.conditions != nil && n.reminder > 0 {
+		go func() {
+			ticker := time.NewTicker(time.Minute)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case now := <-ticker.C:
+					n.remind(now)
+				}
+			}
+		}()
+	}
+	for range n.queues {
+		<-done
+	}
+}
+
+func (n *notifier) drain(q *sinkQueue) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for {
+		select {
+		case msg := <-q.queue:
+			n.deliver(ctx, q.sink, msg)
+		default:
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// deliver sends msg, retrying with exponential backoff from one second as
+// long as the error may be temporary.
+func (n *notifier) deliver(ctx context.Context, s sink, msg notification) {
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err := s.send(ctx, msg)
+		if err == nil {
+			return
+		}
+		if attempt >= n.retries || !retryableSendError(err) || ctx.Err() != nil {
+			n.logger.Error("failed to send notification", "sink", s.name(), "type", msg.Type, "attempts", attempt+1, "error", err)
+			return
+		}
+		n.logger.Debug("notification failed, retrying", "sink", s.name(), "type", msg.Type, "retry_in", delay, "error", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// retryableSendError reports whether a failed delivery may succeed later:
+// anything but a response that rejects the request itself.
+func retryableSendError(err error) bool {
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.code >= 500 || status.code == http.StatusTooManyRequests
+	}
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		// SMTP reply codes from 500 up are permanent failures.
+		return reply.Code < 500
+	}
+	return true
+}
+
+// postJSON posts body to url and returns a statusError for any response
+// outside 2xx.
+func postJSON(ctx context.Context, client *http.Client, url string, body []byte, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &statusError{code: resp.StatusCode, message: fmt.Sprintf("status code %d: %s", resp.StatusCode, bytes.TrimSpace(detail))}
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// readSecretEnv returns the value of name, or the trimmed content of the file
+// named by name_FILE.
+func readSecretEnv(name string) (string, error) {
+	value, file := os.Getenv(name), os.Getenv(name+"_FILE")
+	if value != "" && file != "" {
+		return "", fmt.Errorf("%s and %s_FILE cannot both be set", name, name)
+	}
+	if file == "" {
+		return value, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s_FILE: %w", name, err)
+	}
+	return string(bytes.TrimSpace(data)), nil
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const vaultUnsealConfigPath = "/apis/unsealer.mackcoding.io/v1alpha1/namespaces/%s/vaultunsealconfigs"
+
+type vaultUnsealConfigList struct {
+	Items []vaultUnsealConfig `json:"items"`
+}
+
+type vaultUnsealConfig struct {
+	Metadata struct {
+		Name       string `json:"name"`
+		Namespace  string `json:"namespace"`
+		UID        string `json:"uid"`
+		Generation int64  `json:"generation"`
+	} `json:"metadata"`
+	Spec vaultUnsealSpec `json:"spec"`
+}
+
+// vaultUnsealSpec declares one vault cluster. Vault entries use the VAULT_URLS
+// syntax, options are per-vault option defaults for the whole cluster and the
+// unseal keys are key provider references like UNSEAL_KEY_<n>.
+type vaultUnsealSpec struct {
+	Vaults       []string          `json:"vaults"`
+	UnsealKeys   []string          `json:"unsealKeys"`
+	Options      map[string]string `json:"options"`
+	PollInterval string            `json:"pollInterval"`
+}
+
+// operator reconciles VaultUnsealConfig resources. Every resource gets its own
+// Unsealer with its own vaults, key provider and keys, built from the global
+// settings of the template.
+type operator struct {
+	template *Unsealer
+	targets  []*kubeClient
+	interval time.Duration
+	pollInt  time.Duration
+
+	mu       sync.Mutex
+	synced   bool
+	clusters map[string]*managedCluster
+}
+
+// managedCluster is the running unsealer of one resource generation. A
+// generation that failed to start is kept with its error so it is not retried
+// until the resource changes.
+type managedCluster struct {
+	kube       *kubeClient
+	name       string
+	generation int64
+	u          *Unsealer
+	err        error
+	cancel     context.CancelFunc
+	done       chan struct{}
+
+	// written is the status last written to the resource.
+	written *vaultUnsealStatus
+}
+
+// vaultUnsealStatus is written to the status subresource so the state of the
+// fleet shows up in kubectl.
+type vaultUnsealStatus struct {
+	ObservedGeneration int64             `json:"observedGeneration"`
+	Unsealed           string            `json:"unsealed"`
+	Conditions         []statusCondition `json:"conditions"`
+	Vaults             []vaultCondition  `json:"vaults"`
+}
+
+type statusCondition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"`
+	Reason             string `json:"reason"`
+	Message            string `json:"message"`
+	LastTransitionTime string `json:"lastTransitionTime"`
+}
+
+type vaultCondition struct {
+	Address        string `json:"address"`
+	State          string `json:"state"`
+	Role           string `json:"role,omitempty"`
+	LastUnsealTime string `json:"lastUnsealTime,omitempty"`
+	LastError      string `json:"lastError,omitempty"`
+}
+
+func newOperator(template *Unsealer, interval, pollInt time.Duration) (*operator, error) {
+	targets, err := kubeTargets()
+	if err != nil {
+		return nil, err
+	}
+	return &operator{
+		template: template,
+		targets:  targets,
+		interval: interval,
+		pollInt:  pollInt,
+		clusters: make(map[string]*managedCluster),
+	}, nil
+}
+
+func (o *operator) run(ctx context.Context) {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+
+	o.reconcile(ctx)
+	o.updateStatus(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			o.mu.Lock()
+			for name, c := range o.clusters {
+				o.stop(name, c)
+			}
+			o.mu.Unlock()
+			return
+		case <-ticker.C:
+			o.reconcile(ctx)
+			o.updateStatus(ctx)
+		}
+	}
+}
+
+// key names a resource in logs, /status and shard assignment. It is qualified
+// with the namespace and context only when several targets are watched.
+func (o *operator) key(kube *kubeClient, name string) string {
+	if len(o.targets) == 1 {
+		return name
+	}
+	return kube.qualify(name)
+}
+
+// reconcile starts an unsealer for every new resource, restarts the ones whose
+// generation changed and stops the ones that were deleted. When listing a
+// target fails its running unsealers are left alone.
+func (o *operator) reconcile(ctx context.Context) {
+	lists := make(map[*kubeClient]*vaultUnsealConfigList, len(o.targets))
+	for _, kube := range o.targets {
+		var list vaultUnsealConfigList
+		if err := kube.get(ctx, fmt.Sprintf(vaultUnsealConfigPath, url.PathEscape(kube.namespace)), &list); err != nil {
+			o.template.logger.Warn("failed to list VaultUnsealConfig resources, keeping current clusters", "context", kube.cluster, "namespace", kube.namespace, "error", err)
+			continue
+		}
+		lists[kube] = &list
+	}
+	if len(lists) == 0 {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.synced = true
+
+	seen := make(map[string]bool)
+	for key, c := range o.clusters {
+		if lists[c.kube] == nil {
+			seen[key] = true
+		}
+	}
+	for kube, list := range lists {
+		for i := range list.Items {
+			cfg := &list.Items[i]
+			key := o.key(kube, cfg.Metadata.Name)
+			seen[key] = true
+
+			current, ok := o.clusters[key]
+			if ok && current.generation == cfg.Metadata.Generation {
+				continue
+			}
+			if ok {
+				o.template.logger.Info("VaultUnsealConfig changed, restarting its unsealer", "config", key)
+				o.stop(key, current)
+			}
+			o.clusters[key] = o.start(ctx, kube, key, cfg)
+		}
+	}
+
+	for key, c := range o.clusters {
+		if !seen[key] {
+			o.template.logger.Info("VaultUnsealConfig deleted, stopping its unsealer", "config", key)
+			o.stop(key, c)
+		}
+	}
+}
+
+func (o *operator) start(ctx context.Context, kube *kubeClient, key string, cfg *vaultUnsealConfig) *managedCluster {
+	c := &managedCluster{kube: kube, name: cfg.Metadata.Name, generation: cfg.Metadata.Generation}
+	u, pollInt, err := o.build(key, cfg)
+	if err != nil {
+		o.template.logger.Error("invalid VaultUnsealConfig", "config", key, "error", err)
+		c.err = err
+		return c
+	}
+	u.eventRef = &objectRef{
+		kube:       kube,
+		apiVersion: "unsealer.mackcoding.io/v1alpha1",
+		kind:       "VaultUnsealConfig",
+		namespace:  kube.namespace,
+		name:       cfg.Metadata.Name,
+		uid:        cfg.Metadata.UID,
+	}
+	if err := u.fetchKeys(); err != nil {
+		u.logger.Error("failed to fetch keys, retrying at the next key refresh", "error", err)
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	c.u, c.cancel, c.done = u, cancel, make(chan struct{})
+	go func() {
+		defer close(c.done)
+		u.runCluster(runCtx, pollInt)
+	}()
+	u.logger.Info("VaultUnsealConfig reconciled", "vaults", len(u.vaults), "generation", c.generation)
+	return c
+}
+
+func (o *operator) stop(name string, c *managedCluster) {
+	if c.cancel != nil {
+		c.cancel()
+		<-c.done
+	}
+	delete(o.clusters, name)
+}
+
+// build turns a resource into an unsealer. Vaults are parsed and connected
+// exactly like VAULT_URLS, on top of the global defaults and the resource's
+// own options.
+func (o *operator) build(key string, cfg *vaultUnsealConfig) (*Unsealer, time.Duration, error) {
+	spec := cfg.Spec
+	if len(spec.Vaults) == 0 {
+		return nil, 0, fmt.Errorf("spec.vaults is empty")
+	}
+	if len(spec.UnsealKeys) == 0 {
+		return nil, 0, fmt.Errorf("spec.unsealKeys is empty")
+	}
+
+	pollInt := o.pollInt
+	if spec.PollInterval != "" {
+		d, err := time.ParseDuration(spec.PollInterval)
+		if err != nil || d < time.Second {
+			return nil, 0, fmt.Errorf("spec.pollInterval must be a duration of at least 1s")
+		}
+		pollInt = d
+	}
+
+	defaults := o.template.vaultDefaults
+	keys := make([]string, 0, len(spec.Options))
+	for key := range spec.Options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := defaults.setOption(key, spec.Options[key]); err != nil {
+			return nil, 0, fmt.Errorf("spec.options: %w", err)
+		}
+	}
+
+	var vaults []*vaultConfig
+	for _, entry := range spec.Vaults {
+		v, err := parseVaultSpec(entry, defaults)
+		if err != nil {
+			return nil, 0, fmt.Errorf("spec.vaults: %w", err)
+		}
+		if err := v.connect(o.template.tlsPolicy); err != nil {
+			return nil, 0, fmt.Errorf("vault %s: %w", v.addr, err)
+		}
+		vaults = append(vaults, v)
+	}
+
+	log := o.template.logger.With("config", key)
+	provider, err := newKeyProviderWithRefs(log, spec.UnsealKeys)
+	if err != nil {
+		return nil, 0, fmt.Errorf("key provider init failed: %w", err)
+	}
+	if err := checkVaultCredentials(vaults, provider); err != nil {
+		return nil, 0, fmt.Errorf("vault credential configuration failed: %w", err)
+	}
+	u := o.template.child(log, key, vaults, defaults, provider)
+	u.pollInterval = pollInt
+	u.newProvider = func() (keyProvider, error) { return newKeyProviderWithRefs(log, spec.UnsealKeys) }
+	return u, pollInt, nil
+}
+
+// child returns an unsealer for a different set of vaults that shares this
+// unsealer's global settings but none of its state. With sharding all of its
+// vaults belong to the shard of shardKey.
+func (u *Unsealer) child(log hclog.Logger, shardKey string, vaults []*vaultConfig, defaults vaultConfig, provider keyProvider) *Unsealer {
+	return &Unsealer{
+		logger:           log,
+		vaults:           vaults,
+		staticVaults:     vaults,
+		vaultDefaults:    defaults,
+		provider:         provider,
+		keyChangeWebhook: u.keyChangeWebhook,
+		keyMaxStaleness:  u.keyMaxStaleness,
+		keyStalePolicy:   u.keyStalePolicy,
+		keyFetchDuration: newHistogram(durationBuckets),
+		readyMaxPollAge:  u.readyMaxPollAge,
+		lastPoll:         time.Now().UnixNano(),
+		flap:             u.flap,
+
+		keyRefreshInterval: u.keyRefreshInterval,
+		refreshNow:         make(chan struct{}, 1),
+		unsealNow:          make(chan string, 1),
+		unsealVaultNow:     make(chan *vaultConfig, 16),
+		initThreshold:      u.initThreshold,
+		rootTokenPolicy:    u.rootTokenPolicy,
+		rootTokenSecret:    u.rootTokenSecret,
+		rootTokenFile:      u.rootTokenFile,
+		tlsPolicy:          u.tlsPolicy,
+		caReloadInterval:   u.caReloadInterval,
+		leader:             u.leader,
+		shards:             u.shards,
+		shardKey:           shardKey,
+		events:             u.events,
+		history:            u.history,
+		notifier:           u.notifier,
+		auditLog:           u.auditLog,
+		pauses:             u.pauses,
+	}
+}
+
+// runCluster is the poll loop of an operator-managed unsealer. It returns once
+// ctx is cancelled and all in-flight unseals have finished.
+func (u *Unsealer) runCluster(ctx context.Context, pollInt time.Duration) {
+	go u.keyRefreshLoop(ctx)
+	if u.caReloadInterval > 0 {
+		go u.caReloadLoop(ctx, u.caReloadInterval)
+	}
+
+	ticker := time.NewTicker(pollInt)
+	defer ticker.Stop()
+
+	u.unsealAll(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			u.wg.Wait()
+			return
+		case <-ticker.C:
+			u.unsealAll(ctx)
+		case initiator := <-u.unsealNow:
+			u.unsealAll(withInitiator(ctx, initiator))
+		case v := <-u.unsealVaultNow:
+			u.unsealVault(withInitiator(ctx, initiatorAPI), v)
+		}
+	}
+}
+
+// unsealers returns the running unsealers by resource name.
+func (o *operator) unsealers() map[string]*Unsealer {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	running := make(map[string]*Unsealer, len(o.clusters))
+	for name, c := range o.clusters {
+		if c.u != nil {
+			running[name] = c.u
+		}
+	}
+	return running
+}
+
+func (o *operator) requestUnseal(initiator string) {
+	for _, u := range o.unsealers() {
+		u.requestUnseal(initiator)
+	}
+}
+
+func (o *operator) requestKeyRefresh() {
+	for _, u := range o.unsealers() {
+		u.requestKeyRefresh()
+	}
+}
+
+// ready reports whether the resources were listed at least once and every
+// one of them was started and has usable keys.
+func (o *operator) ready() (bool, string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.synced {
+		return false, "not_synced"
+	}
+	for name, c := range o.clusters {
+		if c.err != nil {
+			return false, "invalid_config:" + name
+		}
+		if ready, state := c.u.readiness(); !ready {
+			return false, state + ":" + name
+		}
+	}
+	return true, "ready"
+}
+
+// status builds the current status of a resource. The Ready condition keeps
+// its transition time from the last written status while it does not change.
+func (c *managedCluster) status() *vaultUnsealStatus {
+	status := &vaultUnsealStatus{ObservedGeneration: c.generation, Vaults: []vaultCondition{}}
+	ready := statusCondition{Type: "Ready", Status: "False"}
+
+	switch {
+	case c.err != nil:
+		ready.Reason, ready.Message = "InvalidSpec", c.err.Error()
+	default:
+		unsealed := 0
+		list := c.u.vaultList()
+		for _, v := range list {
+			vc := vaultCondition{Address: v.addr, State: v.state.getStatus(), Role: v.state.getRole()}
+			lastUnseal, lastError := v.state.getLastResult()
+			if !lastUnseal.IsZero() {
+				vc.LastUnsealTime = lastUnseal.UTC().Format(time.RFC3339)
+			}
+			vc.LastError = lastError
+			if vc.State == statusUnsealed {
+				unsealed++
+			}
+			status.Vaults = append(status.Vaults, vc)
+		}
+		status.Unsealed = fmt.Sprintf("%d/%d", unsealed, len(list))
+
+		if state, _ := c.u.keyState(); state != "ready" {
+			ready.Reason, ready.Message = "KeysUnavailable", "key set is "+state
+		} else if unsealed < len(list) {
+			ready.Reason, ready.Message = "VaultsSealed", fmt.Sprintf("%d of %d vaults unsealed", unsealed, len(list))
+		} else {
+			ready.Status, ready.Reason, ready.Message = "True", "AllUnsealed", fmt.Sprintf("%d of %d vaults unsealed", unsealed, len(list))
+		}
+	}
+
+	ready.LastTransitionTime = time.Now().UTC().Format(time.RFC3339)
+	if c.written != nil && len(c.written.Conditions) > 0 && c.written.Conditions[0].Status == ready.Status {
+		ready.LastTransitionTime = c.written.Conditions[0].LastTransitionTime
+	}
+	status.Conditions = []statusCondition{ready}
+	return status
+}
+
+// updateStatus writes the status of every resource whose status changed
+// since it was last written. Only the replica that unseals a resource's vaults
+// writes its status, since the others would report stale state.
+func (o *operator) updateStatus(ctx context.Context) {
+	type pending struct {
+		c      *managedCluster
+		status *vaultUnsealStatus
+	}
+	o.mu.Lock()
+	updates := make(map[string]pending)
+	for name, c := range o.clusters {
+		if !o.template.owns(name) {
+			// Another replica writes it now and may change it at any time.
+			c.written = nil
+			continue
+		}
+		status := c.status()
+		if !reflect.DeepEqual(status, c.written) {
+			updates[name] = pending{c, status}
+		}
+	}
+	o.mu.Unlock()
+
+	for key, p := range updates {
+		kube := p.c.kube
+		path := fmt.Sprintf(vaultUnsealConfigPath, url.PathEscape(kube.namespace)) + "/" + url.PathEscape(p.c.name) + "/status"
+		payload := map[string]interface{}{"status": p.status}
+		if err := kube.do(ctx, "PATCH", path, "application/merge-patch+json", payload, nil); err != nil {
+			o.template.logger.Warn("failed to update VaultUnsealConfig status", "config", key, "error", err)
+			continue
+		}
+		o.mu.Lock()
+		p.c.written = p.status
+		o.mu.Unlock()
+	}
+}
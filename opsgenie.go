@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const opsgenieAPIURL = "https://api.opsgenie.com"
+
+// opsgenieDefaultPriorities are the alert priorities of the events that open
+// an alert. Other events only close alerts.
+var opsgenieDefaultPriorities = map[string]string{
+	historyEscalated:     "P1",
+	historyUnsealFailure: "P1",
+	historyFlapping:      "P2",
+	historyProviderError: "P2",
+	historySealDetected:  "P3",
+}
+
+// opsgenieSink creates an Opsgenie alert when a problem starts and closes it
+// when it ends. Alerts are deduplicated by an alias of the event type and the
+// vault, so a vault that stays sealed keeps one alert.
+type opsgenieSink struct {
+	apiURL     string
+	apiKey     string
+	priorities map[string]string
+	tags       []string
+	client     *http.Client
+}
+
+func init() {
+	registerSink("opsgenie", singleSink(loadOpsgenieSink))
+}
+
+// loadOpsgenieSink reads OPSGENIE_API_KEY (or OPSGENIE_API_KEY_FILE),
+// OPSGENIE_API_URL, OPSGENIE_TAGS and OPSGENIE_PRIORITY_<EVENT_TYPE>. It
+// returns nil when Opsgenie is not configured.
+func loadOpsgenieSink() (sink, error) {
+	key, err := readSecretEnv("OPSGENIE_API_KEY")
+	if err != nil || key == "" {
+		return nil, err
+	}
+	apiURL := getEnv("OPSGENIE_API_URL", opsgenieAPIURL)
+	if u, err := url.Parse(apiURL); err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("OPSGENIE_API_URL must be an https URL")
+	}
+	s := &opsgenieSink{
+		apiURL:     apiURL,
+		apiKey:     key,
+		priorities: make(map[string]string),
+		tags:       splitList(getEnv("OPSGENIE_TAGS", "vault,vault-unsealer")),
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+	for eventType, def := range opsgenieDefaultPriorities {
+		name := "OPSGENIE_PRIORITY_" + envSuffix(eventType)
+		switch p := getEnv(name, def); p {
+		case "P1", "P2", "P3", "P4", "P5":
+			s.priorities[eventType] = p
+		default:
+			return nil, fmt.Errorf("%s must be P1 to P5, got %q", name, p)
+		}
+	}
+	return s, nil
+}
+
+func (s *opsgenieSink) name() string {
+	return "opsgenie"
+}
+
+func (s *opsgenieSink) resolves(eventType string) bool {
+	return alertResolutions[eventType] != nil
+}
+
+// alias identifies the alert of an event type for a vault, or for the key
+// provider of a VaultUnsealConfig.
+func (s *opsgenieSink) alias(eventType string, n notification) string {
+	return "vault-unsealer:" + eventType + ":" + n.Config + ":" + n.Vault
+}
+
+func (s *opsgenieSink) send(ctx context.Context, n notification) error {
+	if priority, ok := s.priorities[n.Type]; ok {
+		return s.create(ctx, n, priority)
+	}
+	for _, eventType := range alertResolutions[n.Type] {
+		if err := s.close(ctx, s.alias(eventType, n), n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *opsgenieSink) create(ctx context.Context, n notification, priority string) error {
+	subject := n.Message
+	if n.Vault != "" {
+		subject = n.Vault + ": " + n.Message
+	}
+	if len(subject) > 130 {
+		subject = subject[:127] + "..."
+	}
+	details := map[string]string{"type": n.Type, "instance": n.Instance}
+	for k, v := range map[string]string{"vault": n.Vault, "config": n.Config, "request_id": n.RequestID} {
+		if v != "" {
+			details[k] = v
+		}
+	}
+	return s.post(ctx, "/v2/alerts", map[string]interface{}{
+		"message":     subject,
+		"alias":       s.alias(n.Type, n),
+		"description": n.Message,
+		"priority":    priority,
+		"source":      n.Instance,
+		"tags":        s.tags,
+		"details":     details,
+	})
+}
+
+// close closes an alert by alias. Closing an alert that does not exist is
+// accepted by Opsgenie and fails later in its own processing, so every
+// success event can try to close its alerts.
+func (s *opsgenieSink) close(ctx context.Context, alias string, n notification) error {
+	path := "/v2/alerts/" + url.PathEscape(alias) + "/close?identifierType=alias"
+	return s.post(ctx, path, map[string]string{"source": n.Instance, "note": n.Message})
+}
+
+func (s *opsgenieSink) post(ctx context.Context, path string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Authorization", "GenieKey "+s.apiKey)
+	return postJSON(ctx, s.client, s.apiURL+path, body, header)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// pauseData is what is paused: everything, whole VaultUnsealConfigs, or
+// single vaults.
+type pauseData struct {
+	All     bool          `json:"all,omitempty"`
+	Configs []string      `json:"configs,omitempty"`
+	Vaults  []pausedVault `json:"vaults,omitempty"`
+}
+
+type pausedVault struct {
+	Config  string `json:"config,omitempty"`
+	Address string `json:"address"`
+}
+
+// pauses holds the pause state shared by the unsealer and its operator
+// children. With a store, the state is reloaded every pauseReload, so that
+// a pause made through another replica takes effect here too.
+type pauses struct {
+	logger hclog.Logger
+	store  stateStore
+
+	mu       sync.Mutex
+	data     pauseData
+	loadedAt time.Time
+}
+
+const pauseReload = 10 * time.Second
+
+// newPauses reads PAUSE_STATE_FILE or PAUSE_STATE_CONFIGMAP and loads the
+// stored state.
+func newPauses(log hclog.Logger) (*pauses, error) {
+	store, err := newStateStore("PAUSE_STATE", "pause")
+	if err != nil || store == nil {
+		return &pauses{logger: log}, err
+	}
+	p := &pauses{logger: log, store: store}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var data pauseData
+	if err := store.load(ctx, &data); err != nil {
+		return nil, fmt.Errorf("failed to load pause state: %w", err)
+	}
+	p.data, p.loadedAt = data, time.Now()
+	if data.All || len(data.Configs) > 0 || len(data.Vaults) > 0 {
+		log.Warn("unsealing is paused", "all", data.All, "configs", data.Configs, "vaults", len(data.Vaults))
+	}
+	return p, nil
+}
+
+// current returns the state, reloading it from the store when it is older
+// than pauseReload. A failed reload keeps the state last known.
+func (p *pauses) current() pauseData {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.store != nil && time.Since(p.loadedAt) > pauseReload {
+		p.loadedAt = time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		var data pauseData
+		err := p.store.load(ctx, &data)
+		cancel()
+		if err != nil {
+			p.logger.Warn("failed to reload pause state", "error", err)
+		} else {
+			p.data = data
+		}
+	}
+	return p.data
+}
+
+// paused reports whether the vault at addr of config is paused.
+func (p *pauses) paused(config, addr string) bool {
+	d := p.current()
+	return d.All || slices.Contains(d.Configs, config) || slices.Contains(d.Vaults, pausedVault{Config: config, Address: addr})
+}
+
+// update applies change to the latest stored state and saves the result.
+func (p *pauses) update(ctx context.Context, change func(d *pauseData)) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	data := p.data
+	if p.store != nil {
+		data = pauseData{}
+		if err := p.store.load(ctx, &data); err != nil {
+			return err
+		}
+	}
+	data.Configs = slices.Clone(data.Configs)
+	data.Vaults = slices.Clone(data.Vaults)
+	change(&data)
+	if p.store != nil {
+		if err := p.store.save(ctx, data); err != nil {
+			return err
+		}
+	}
+	p.data, p.loadedAt = data, time.Now()
+	return nil
+}
+
+// paused reports whether unsealing v is paused.
+func (u *Unsealer) paused(v *vaultConfig) bool {
+	return u.pauses != nil && u.pauses.paused(u.shardKey, v.addr)
+}
+
+func (u *Unsealer) handlePauseState(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, u.pauses.current())
+}
+
+// handlePause pauses unsealing of everything, of one VaultUnsealConfig with
+// ?config=, or of one vault.
+func (u *Unsealer) handlePause(w http.ResponseWriter, r *http.Request) {
+	u.handlePauseChange(w, r, true)
+}
+
+// handleResume lifts a pause made with the same scope. Resuming everything
+// lifts every pause.
+func (u *Unsealer) handleResume(w http.ResponseWriter, r *http.Request) {
+	u.handlePauseChange(w, r, false)
+}
+
+func (u *Unsealer) handlePauseChange(w http.ResponseWriter, r *http.Request, pause bool) {
+	config := r.URL.Query().Get("config")
+	var target *pausedVault
+	if name := r.PathValue("vault"); name != "" {
+		t, ok := u.findVault(w, r, name)
+		if !ok {
+			return
+		}
+		target = &pausedVault{Config: t.u.shardKey, Address: t.v.addr}
+	} else if config != "" {
+		if u.operator == nil {
+			http.Error(w, "config only applies in operator mode", http.StatusBadRequest)
+			return
+		}
+		if u.operator.unsealers()[config] == nil {
+			http.Error(w, fmt.Sprintf("unknown config %q", config), http.StatusNotFound)
+			return
+		}
+	}
+	err := u.pauses.update(r.Context(), func(d *pauseData) {
+		switch {
+		case target != nil:
+			d.Vaults = slices.DeleteFunc(d.Vaults, func(v pausedVault) bool { return v == *target })
+			if pause {
+				d.Vaults = append(d.Vaults, *target)
+			}
+		case config != "":
+			d.Configs = slices.DeleteFunc(d.Configs, func(c string) bool { return c == config })
+			if pause {
+				d.Configs = append(d.Configs, config)
+			}
+		case pause:
+			d.All = true
+		default:
+			// Resuming everything also lifts the pauses of single vaults.
+			*d = pauseData{}
+		}
+	})
+	if err != nil {
+		http.Error(w, "failed to save pause state: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	action := "resumed"
+	if pause {
+		action = "paused"
+	}
+	scope := "all"
+	switch {
+	case target != nil:
+		scope = target.Address
+	case config != "":
+		scope = "config " + config
+	}
+	u.logger.Warn("unsealing "+action+" through the admin API", "scope", scope, "remote", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, u.pauses.current())
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// pkcs11Provider stores each unseal share encrypted ("wrapped") with a key
+// that never leaves the HSM and unwraps it through OpenSC's pkcs11-tool.
+type pkcs11Provider struct {
+	logger    hclog.Logger
+	tool      string
+	module    string
+	slot      string
+	token     string
+	keyID     string
+	keyLabel  string
+	mechanism string
+	hash      string
+	pin       string
+	pinFile   string
+	wrapped   []string
+	timeout   time.Duration
+}
+
+func newPKCS11Provider(log hclog.Logger, refs []string) (*pkcs11Provider, error) {
+	p := &pkcs11Provider{
+		logger:    log,
+		tool:      getEnv("PKCS11_TOOL", "pkcs11-tool"),
+		module:    os.Getenv("PKCS11_MODULE"),
+		slot:      os.Getenv("PKCS11_SLOT"),
+		token:     os.Getenv("PKCS11_TOKEN_LABEL"),
+		keyID:     os.Getenv("PKCS11_KEY_ID"),
+		keyLabel:  os.Getenv("PKCS11_KEY_LABEL"),
+		mechanism: getEnv("PKCS11_MECHANISM", "RSA-PKCS-OAEP"),
+		hash:      getEnv("PKCS11_HASH", "SHA256"),
+		pin:       os.Getenv("PKCS11_PIN"),
+		pinFile:   os.Getenv("PKCS11_PIN_FILE"),
+		wrapped:   refs,
+		timeout:   30 * time.Second,
+	}
+
+	if p.module == "" {
+		return nil, fmt.Errorf("PKCS11_MODULE must be set")
+	}
+	if p.keyID == "" && p.keyLabel == "" {
+		return nil, fmt.Errorf("PKCS11_KEY_ID or PKCS11_KEY_LABEL must be set")
+	}
+	if p.pin == "" && p.pinFile == "" {
+		return nil, fmt.Errorf("PKCS11_PIN or PKCS11_PIN_FILE must be set")
+	}
+	if _, err := exec.LookPath(p.tool); err != nil {
+		return nil, fmt.Errorf("pkcs11 tool not found: %w", err)
+	}
+	for i, path := range refs {
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("wrapped share for UNSEAL_KEY_%d: %w", i+1, err)
+		}
+	}
+
+	log.Info("using pkcs11 key provider", "module", p.module, "mechanism", p.mechanism)
+	return p, nil
+}
+
+func (p *pkcs11Provider) fetchKeys() ([]string, error) {
+	pin := p.pin
+	if p.pinFile != "" {
+		data, err := os.ReadFile(p.pinFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PKCS11_PIN_FILE: %w", err)
+		}
+		pin = strings.TrimSpace(string(data))
+	}
+
+	keys := make([]string, 0, len(p.wrapped))
+	for i, path := range p.wrapped {
+		key, err := p.unwrap(path, pin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap key %d: %w", i+1, err)
+		}
+		if key == "" {
+			return nil, fmt.Errorf("empty value for key %d", i+1)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (p *pkcs11Provider) unwrap(path, pin string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	// The PIN is handed over through the child's environment so it never shows
+	// up in the process list.
+	args := []string{
+		"--module", p.module,
+		"--login", "--pin", "env:PKCS11_TOOL_PIN",
+		"--decrypt",
+		"--mechanism", p.mechanism,
+		"--input-file", path,
+	}
+	if strings.Contains(p.mechanism, "OAEP") {
+		args = append(args, "--hash-algorithm", p.hash, "--mgf", "MGF1-"+p.hash)
+	}
+	if p.slot != "" {
+		args = append(args, "--slot", p.slot)
+	}
+	if p.token != "" {
+		args = append(args, "--token-label", p.token)
+	}
+	if p.keyID != "" {
+		args = append(args, "--id", p.keyID)
+	} else {
+		args = append(args, "--label", p.keyLabel)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.tool, args...)
+	cmd.Env = append(os.Environ(), "PKCS11_TOOL_PIN="+pin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("pkcs11-tool timed out after %s", p.timeout)
+		}
+		return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricPrefix = "vault_unsealer_"
+
+// gaugeMetrics are the entries of the metrics map that describe the current
+// state. All others only ever grow and are exported as counters.
+var gaugeMetrics = map[string]bool{
+	"key_age_seconds":       true,
+	"uninitialized_vaults":  true,
+	"circuits_open":         true,
+	"standbys":              true,
+	"dr_secondaries":        true,
+	"perf_standbys":         true,
+	"perf_standbys_warning": true,
+	"shard_vaults":          true,
+	"shard_members":         true,
+	"leader":                true,
+
+	"provider_consecutive_failures":           true,
+	"provider_last_success_timestamp_seconds": true,
+}
+
+// metricHelp describes the metrics map entries in the Prometheus output.
+var metricHelp = map[string]string{
+	"unseal_attempts":          "Unseal attempts on sealed vaults.",
+	"unseal_successes":         "Vaults unsealed.",
+	"unseal_failures":          "Unseal runs that gave up after all retries.",
+	"key_changes":              "Key set changes detected by the key provider.",
+	"key_age_seconds":          "Age of the oldest loaded key set.",
+	"unseal_skipped_auto_seal": "Sealed auto-unseal vaults that were skipped.",
+	"unseal_skipped_by_role":   "Unseals skipped by a node role policy.",
+	"role_policy_alerts":       "Node role policy alerts.",
+	"invalid_key_refreshes":    "Key refreshes after a vault rejected a key.",
+	"uninitialized_vaults":     "Vaults that are not initialized.",
+	"uninitialized_alerts":     "Alerts about uninitialized vaults.",
+	"raft_joins":               "Raft joins performed.",
+	"unseal_verify_failures":   "Unseals that could not be verified.",
+	"identity_mismatches":      "Vaults whose cluster identity did not match their pin.",
+	"circuit_opens":            "Circuit breakers opened.",
+	"circuit_skips":            "Unseals skipped because of an open circuit.",
+	"circuits_open":            "Vaults with an open circuit breaker.",
+	"dns_changes":              "Vault host names that resolved to new addresses.",
+	"ca_reloads":               "Vault CA bundle reloads.",
+	"drain_detections":         "Vault pods found on draining or interrupted nodes.",
+	"standbys":                 "Vaults that are standby nodes.",
+	"dr_secondaries":           "Vaults that are DR secondaries.",
+	"perf_standbys":            "Vaults that are performance standbys.",
+	"perf_standbys_warning":    "Vaults that are performance standbys and flagged by the role policy.",
+	"shard_vaults":             "Vaults owned by this replica's shard.",
+	"shard_members":            "Live members of the shard group.",
+	"leader":                   "1 if this replica is the leader.",
+
+	"provider_consecutive_failures":           "Key fetches that failed since the last successful one.",
+	"provider_last_success_timestamp_seconds": "Unix time of the last successful key fetch.",
+	"provider_relogins":                       "Logins to the key provider after the initial one.",
+}
+
+// histogram is a Prometheus histogram with fixed buckets.
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// durationBuckets cover everything from a fast local call to a request that
+// runs into a timeout.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	s := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		if s <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += s
+	h.count++
+}
+
+// add merges o into h. Both must use the same buckets.
+func (h *histogram) add(o *histogram) {
+	o.mu.Lock()
+	counts, sum, count := append([]uint64(nil), o.counts...), o.sum, o.count
+	o.mu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := range counts {
+		h.counts[i] += counts[i]
+	}
+	h.sum += sum
+	h.count += count
+}
+
+func (h *histogram) write(w io.Writer, name, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=%q} %d\n", name, labels, sep, strconv.FormatFloat(b, 'g', -1, 64), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// promLabel formats one label pair with the value escaped as the text format
+// requires.
+func promLabel(name, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return name + `="` + value + `"`
+}
+
+// writePrometheus writes all metrics in the Prometheus text exposition format.
+func (u *Unsealer) writePrometheus(out io.Writer) {
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	build := getBuildInfo()
+	fmt.Fprintf(w, "# HELP %sbuild_info Version of the running unsealer, always 1.\n", metricPrefix)
+	fmt.Fprintf(w, "# TYPE %sbuild_info gauge\n", metricPrefix)
+	fmt.Fprintf(w, "%sbuild_info{%s,%s,%s,%s} 1\n", metricPrefix,
+		promLabel("version", build.Version), promLabel("commit", build.Commit),
+		promLabel("build_date", build.BuildDate), promLabel("go_version", build.GoVersion))
+
+	metrics := u.allMetrics()
+	names := make([]string, 0, len(metrics))
+	keyUses := make(map[int]int64)
+	for name, n := range metrics {
+		// Unseal failures are exported by reason only.
+		if name == "unseal_failures" || strings.HasPrefix(name, "unseal_failures_") {
+			continue
+		}
+		if pos, ok := strings.CutPrefix(name, "key_"); ok {
+			if pos, ok = strings.CutSuffix(pos, "_submissions"); ok {
+				if i, err := strconv.Atoi(pos); err == nil {
+					keyUses[i] = n
+					continue
+				}
+			}
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		full, kind := metricPrefix+name, "counter"
+		if gaugeMetrics[name] {
+			kind = "gauge"
+		} else {
+			full += "_total"
+		}
+		if help := metricHelp[name]; help != "" {
+			fmt.Fprintf(w, "# HELP %s %s\n", full, help)
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", full, kind)
+		fmt.Fprintf(w, "%s %d\n", full, metrics[name])
+	}
+
+	if len(keyUses) > 0 {
+		name := metricPrefix + "key_submissions_total"
+		fmt.Fprintf(w, "# HELP %s Key shares submitted, by position in the key set.\n", name)
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
+		keys := make([]int, 0, len(keyUses))
+		for i := range keyUses {
+			keys = append(keys, i)
+		}
+		sort.Ints(keys)
+		for _, i := range keys {
+			fmt.Fprintf(w, "%s{%s} %d\n", name, promLabel("key", strconv.Itoa(i)), keyUses[i])
+		}
+	}
+
+	name := metricPrefix + "unseal_failures_total"
+	fmt.Fprintf(w, "# HELP %s Unseal runs that gave up after all retries, by the reason of the last error.\n", name)
+	fmt.Fprintf(w, "# TYPE %s counter\n", name)
+	for _, reason := range failureReasons {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, promLabel("reason", reason), metrics["unseal_failures_"+reason])
+	}
+
+	name = metricPrefix + "vault_status"
+	fmt.Fprintf(w, "# HELP %s Last observed seal state of each vault, 1 for the current state.\n", name)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+	states := []string{statusUnsealed, statusSealed, statusUninitialized, statusUnreachable, statusUnknown}
+	for _, c := range u.clusterUnsealers() {
+		for _, v := range c.vaultList() {
+			current := v.state.getStatus()
+			for _, s := range states {
+				n := 0
+				if s == current {
+					n = 1
+				}
+				fmt.Fprintf(w, "%s{%s,%s} %d\n", name, c.vaultLabels(v), promLabel("state", s), n)
+			}
+		}
+	}
+
+	now := time.Now()
+	vaultMetrics := []struct {
+		name, kind, help string
+		value            func(h sealHistory) string
+	}{
+		{"vault_seal_events_total", "counter", "Times a vault was seen becoming sealed.", func(h sealHistory) string {
+			return strconv.FormatInt(h.events, 10)
+		}},
+		{"vault_sealed_duration_seconds", "gauge", "How long a vault has been sealed, 0 while it is unsealed.", func(h sealHistory) string {
+			if h.sealedSince.IsZero() {
+				return "0"
+			}
+			return formatFloat(now.Sub(h.sealedSince).Seconds())
+		}},
+		{"vault_sealed_seconds_total", "counter", "Total time a vault spent sealed before being unsealed again.", func(h sealHistory) string {
+			return formatFloat(h.sealedTotal.Seconds())
+		}},
+		{"vault_last_unseal_timestamp_seconds", "gauge", "Unix time a vault was last seen changing from sealed to unsealed, 0 if never.", func(h sealHistory) string {
+			if h.unsealedAt.IsZero() {
+				return "0"
+			}
+			return formatFloat(float64(h.unsealedAt.UnixMilli()) / 1000)
+		}},
+		{"vault_flapping", "gauge", "1 while a vault is sealing repeatedly within FLAP_WINDOW.", func(h sealHistory) string {
+			if h.flapping {
+				return "1"
+			}
+			return "0"
+		}},
+	}
+	for _, m := range vaultMetrics {
+		name := metricPrefix + m.name
+		fmt.Fprintf(w, "# HELP %s %s\n", name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, m.kind)
+		for _, c := range u.clusterUnsealers() {
+			for _, v := range c.vaultList() {
+				fmt.Fprintf(w, "%s{%s} %s\n", name, c.vaultLabels(v), m.value(v.state.getSealHistory()))
+			}
+		}
+	}
+
+	vaultHistograms := []struct {
+		name, help string
+		get        func(*vaultState) *histogram
+	}{
+		{"health_check_duration_seconds", "Round-trip time of seal status checks.", func(s *vaultState) *histogram { return s.checkDuration }},
+		{"unseal_duration_seconds", "Time from finding a vault sealed to a verified unseal.", func(s *vaultState) *histogram { return s.unsealDuration }},
+	}
+	for _, hist := range vaultHistograms {
+		name := metricPrefix + hist.name
+		fmt.Fprintf(w, "# HELP %s %s\n", name, hist.help)
+		fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+		for _, c := range u.clusterUnsealers() {
+			for _, v := range c.vaultList() {
+				hist.get(v.state).write(w, name, c.vaultLabels(v))
+			}
+		}
+	}
+
+	fetch := newHistogram(durationBuckets)
+	for _, c := range u.clusterUnsealers() {
+		fetch.add(c.keyFetchDuration)
+	}
+	name = metricPrefix + "key_fetch_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time taken to fetch the unseal keys from the key provider.\n", name)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	fetch.write(w, name, "")
+}
+
+// clusterUnsealers returns this unsealer and, in operator mode, the unsealers
+// of all VaultUnsealConfig resources.
+func (u *Unsealer) clusterUnsealers() []*Unsealer {
+	all := []*Unsealer{u}
+	if u.operator != nil {
+		children := u.operator.unsealers()
+		names := make([]string, 0, len(children))
+		for name := range children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			all = append(all, children[name])
+		}
+	}
+	return all
+}
+
+// vaultLabels identifies a vault in per-vault metrics. In operator mode the
+// VaultUnsealConfig is added, since addresses may repeat across resources.
+func (u *Unsealer) vaultLabels(v *vaultConfig) string {
+	labels := promLabel("vault", v.addr)
+	if u.shardKey != "" {
+		labels += "," + promLabel("config", u.shardKey)
+	}
+	return labels
+}
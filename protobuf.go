@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Just enough of the protobuf wire format for the gRPC admin API, whose
+// messages only hold strings, bools, numbers and nested messages.
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// protoFields are the fields of a decoded message by number. Only the last
+// value of a field is kept, so repeated fields are not supported.
+type protoFields struct {
+	varints map[int]uint64
+	bytes   map[int][]byte
+}
+
+func decodeProto(data []byte) (protoFields, error) {
+	f := protoFields{varints: map[int]uint64{}, bytes: map[int][]byte{}}
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return f, fmt.Errorf("invalid field key")
+		}
+		data = data[n:]
+		num, wire := int(key>>3), key&7
+		switch wire {
+		case wireVarint:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return f, fmt.Errorf("invalid varint in field %d", num)
+			}
+			f.varints[num] = v
+			data = data[n:]
+		case wireBytes:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || l > uint64(len(data)-n) {
+				return f, fmt.Errorf("invalid length of field %d", num)
+			}
+			f.bytes[num] = data[n : n+int(l)]
+			data = data[n+int(l):]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if wire == wireFixed32 {
+				size = 4
+			}
+			if len(data) < size {
+				return f, fmt.Errorf("truncated field %d", num)
+			}
+			data = data[size:]
+		default:
+			return f, fmt.Errorf("unsupported wire type %d in field %d", wire, num)
+		}
+	}
+	return f, nil
+}
+
+func (f protoFields) string(num int) string {
+	return string(f.bytes[num])
+}
+
+func (f protoFields) bool(num int) bool {
+	return f.varints[num] != 0
+}
+
+// protoBuffer encodes a message. Like proto3, it leaves out fields with their
+// default value.
+type protoBuffer []byte
+
+func (b *protoBuffer) key(num int, wire uint64) {
+	*b = binary.AppendUvarint(*b, uint64(num)<<3|wire)
+}
+
+func (b *protoBuffer) string(num int, s string) {
+	if s == "" {
+		return
+	}
+	b.key(num, wireBytes)
+	*b = binary.AppendUvarint(*b, uint64(len(s)))
+	*b = append(*b, s...)
+}
+
+func (b *protoBuffer) bool(num int, v bool) {
+	if v {
+		b.key(num, wireVarint)
+		*b = append(*b, 1)
+	}
+}
+
+// int encodes int32 and int64 fields, which share their encoding.
+func (b *protoBuffer) int(num int, v int64) {
+	if v != 0 {
+		b.key(num, wireVarint)
+		*b = binary.AppendUvarint(*b, uint64(v))
+	}
+}
+
+func (b *protoBuffer) double(num int, v float64) {
+	if v != 0 {
+		b.key(num, wireFixed64)
+		*b = binary.LittleEndian.AppendUint64(*b, math.Float64bits(v))
+	}
+}
+
+// message encodes a nested message, which unlike scalars is present even when
+// empty.
+func (b *protoBuffer) message(num int, m protoBuffer) {
+	b.key(num, wireBytes)
+	*b = binary.AppendUvarint(*b, uint64(len(m)))
+	*b = append(*b, m...)
+}
+
+// timestamp encodes a google.protobuf.Timestamp, leaving out nil times.
+func (b *protoBuffer) timestamp(num int, t *time.Time) {
+	if t == nil {
+		return
+	}
+	var m protoBuffer
+	m.int(1, t.Unix())
+	m.int(2, int64(t.Nanosecond()))
+	b.message(num, m)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestProtoBufferEncoding(t *testing.T) {
+	ts := time.Unix(1, 5)
+	tests := []struct {
+		name   string
+		encode func(b *protoBuffer)
+		want   []byte
+	}{
+		{"string", func(b *protoBuffer) { b.string(1, "hi") }, []byte{0x0a, 2, 'h', 'i'}},
+		{"empty string", func(b *protoBuffer) { b.string(1, "") }, nil},
+		{"true", func(b *protoBuffer) { b.bool(2, true) }, []byte{0x10, 1}},
+		{"false", func(b *protoBuffer) { b.bool(2, false) }, nil},
+		{"int", func(b *protoBuffer) { b.int(3, 300) }, []byte{0x18, 0xac, 0x02}},
+		{"zero int", func(b *protoBuffer) { b.int(3, 0) }, nil},
+		{"double", func(b *protoBuffer) { b.double(4, 1) }, []byte{0x21, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f}},
+		{"empty message", func(b *protoBuffer) { b.message(5, nil) }, []byte{0x2a, 0}},
+		{"timestamp", func(b *protoBuffer) { b.timestamp(6, &ts) }, []byte{0x32, 4, 0x08, 1, 0x10, 5}},
+		{"nil timestamp", func(b *protoBuffer) { b.timestamp(6, nil) }, nil},
+	}
+	for _, tt := range tests {
+		var b protoBuffer
+		tt.encode(&b)
+		if !bytes.Equal(b, tt.want) {
+			t.Errorf("%s: encoded % x, want % x", tt.name, []byte(b), tt.want)
+		}
+	}
+}
+
+func TestProtoRoundTrip(t *testing.T) {
+	var nested protoBuffer
+	nested.string(1, "inner")
+	var b protoBuffer
+	b.string(1, "vault-0")
+	b.bool(2, true)
+	b.int(3, 42)
+	b.double(4, 2.5)
+	b.message(5, nested)
+
+	f, err := decodeProto(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.string(1) != "vault-0" || !f.bool(2) || f.varints[3] != 42 {
+		t.Errorf("decoded %+v", f)
+	}
+	if f.bool(9) || f.string(9) != "" {
+		t.Errorf("missing fields must decode to their defaults")
+	}
+	inner, err := decodeProto(f.bytes[5])
+	if err != nil || inner.string(1) != "inner" {
+		t.Errorf("nested message decoded to %+v, %v", inner, err)
+	}
+}
+
+func TestDecodeProtoErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated key", []byte{0x80}},
+		{"truncated varint", []byte{0x08, 0x80}},
+		{"length past end", []byte{0x0a, 5, 'a'}},
+		{"truncated fixed64", []byte{0x09, 1, 2, 3}},
+		{"truncated fixed32", []byte{0x0d, 1}},
+		{"group wire type", []byte{0x0b}},
+	}
+	for _, tt := range tests {
+		if _, err := decodeProto(tt.data); err == nil {
+			t.Errorf("%s: decodeProto(% x) succeeded", tt.name, tt.data)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// keyProvider fetches the unseal key shares from wherever they are stored.
+type keyProvider interface {
+	fetchKeys() ([]string, error)
+}
+
+// keyStore is implemented by providers that can write a new key set back,
+// which auto-initialization needs.
+type keyStore interface {
+	keyCount() int
+	storeKeys(keys []string) error
+}
+
+// secretStore is implemented by providers that can write arbitrary secrets,
+// such as the root token produced by auto-init.
+type secretStore interface {
+	storeSecret(ref, value string) error
+}
+
+// secretSource is implemented by providers that can read arbitrary secrets,
+// such as bearer tokens for vaults behind an authenticating proxy.
+type secretSource interface {
+	fetchSecret(ref string) (string, error)
+}
+
+// authChecker is implemented by providers that keep a login session, so
+// readiness can fail when it is lost.
+type authChecker interface {
+	authError() error
+}
+
+// loginCounter is implemented by providers that log in again when their
+// session is lost or their credentials are rotated.
+type loginCounter interface {
+	relogins() int64
+}
+
+func (u *Unsealer) getProvider() keyProvider {
+	u.providerMu.RLock()
+	defer u.providerMu.RUnlock()
+	return u.provider
+}
+
+func (u *Unsealer) setProvider(p keyProvider) {
+	u.providerMu.Lock()
+	defer u.providerMu.Unlock()
+	// Replacing the provider is a login of its own. The old provider's
+	// count is kept so the metric never goes backwards.
+	n := int64(1)
+	if c, ok := u.provider.(loginCounter); ok {
+		n += c.relogins()
+	}
+	atomic.AddInt64(&u.retiredRelogins, n)
+	u.provider = p
+}
+
+// providerRelogins counts the logins after the first of every provider this
+// unsealer used.
+func (u *Unsealer) providerRelogins() int64 {
+	n := atomic.LoadInt64(&u.retiredRelogins)
+	if c, ok := u.getProvider().(loginCounter); ok {
+		n += c.relogins()
+	}
+	return n
+}
+
+func newKeyProvider(log hclog.Logger) (keyProvider, error) {
+	refs, err := loadKeyRefs()
+	if err != nil {
+		return nil, err
+	}
+	return newKeyProviderWithRefs(log, refs)
+}
+
+// newKeyProviderWithRefs creates the configured provider for an explicit list
+// of key references rather than UNSEAL_KEY_<n>.
+func newKeyProviderWithRefs(log hclog.Logger, refs []string) (keyProvider, error) {
+	switch name := getEnv("KEY_PROVIDER", "bitwarden"); name {
+	case "bitwarden":
+		return newBitwardenProvider(log, refs)
+	case "pkcs11":
+		return newPKCS11Provider(log, refs)
+	default:
+		return nil, fmt.Errorf("unknown KEY_PROVIDER %q", name)
+	}
+}
+
+// loadKeyRefs reads UNSEAL_KEY_1..4. What a reference means is up to the
+// provider: a secret ID for Bitwarden, a wrapped share file for PKCS#11.
+func loadKeyRefs() ([]string, error) {
+	refs := make([]string, 0, 4)
+	for i := 1; i <= 4; i++ {
+		keyName := fmt.Sprintf("UNSEAL_KEY_%d", i)
+		v := os.Getenv(keyName)
+		if v == "" {
+			return nil, fmt.Errorf("environment variable %s not set", keyName)
+		}
+		refs = append(refs, v)
+	}
+	return refs, nil
+}
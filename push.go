@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricsExporter pushes metrics to a collector, for environments where the
+// Prometheus endpoint cannot be scraped.
+type metricsExporter interface {
+	name() string
+	push(ctx context.Context, s *metricSnapshot) error
+}
+
+// metricSnapshot is the state of all metrics at one point in time.
+type metricSnapshot struct {
+	time   time.Time
+	values map[string]int64
+	vaults []vaultSample
+}
+
+// vaultSample holds the per-vault gauges that are pushed.
+type vaultSample struct {
+	vault         string
+	config        string
+	sealed        bool
+	sealedSeconds float64
+}
+
+func (u *Unsealer) snapshot() *metricSnapshot {
+	s := &metricSnapshot{time: time.Now(), values: u.allMetrics()}
+	for _, c := range u.clusterUnsealers() {
+		for _, v := range c.vaultList() {
+			h := v.state.getSealHistory()
+			sample := vaultSample{vault: v.addr, config: c.shardKey, sealed: v.state.getStatus() == statusSealed}
+			if !h.sealedSince.IsZero() {
+				sample.sealedSeconds = s.time.Sub(h.sealedSince).Seconds()
+			}
+			s.vaults = append(s.vaults, sample)
+		}
+	}
+	return s
+}
+
+// sortedNames returns the metric names of a snapshot in a stable order.
+func (s *metricSnapshot) sortedNames() []string {
+	names := make([]string, 0, len(s.values))
+	for name := range s.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newMetricsExporters() ([]metricsExporter, error) {
+	var exporters []metricsExporter
+	if addr := os.Getenv("STATSD_ADDR"); addr != "" {
+		e, err := newStatsdExporter(addr)
+		if err != nil {
+			return nil, err
+		}
+		exporters = append(exporters, e)
+	}
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT")
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimRight(base, "/") + "/v1/metrics"
+		}
+	}
+	if endpoint != "" {
+		e, err := newOTLPExporter(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		exporters = append(exporters, e)
+	}
+	return exporters, nil
+}
+
+// metricsPushLoop pushes a snapshot to every exporter each interval, and once
+// more on shutdown so short-lived runs are not lost.
+func (u *Unsealer) metricsPushLoop(ctx context.Context, exporters []metricsExporter, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	push := func(ctx context.Context) {
+		s := u.snapshot()
+		for _, e := range exporters {
+			if err := e.push(ctx, s); err != nil {
+				u.logger.Warn("metrics push failed", "exporter", e.name(), "error", err)
+			}
+		}
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			push(flushCtx)
+			cancel()
+			return
+		case <-ticker.C:
+			push(ctx)
+		}
+	}
+}
+
+// statsdExporter sends metrics over UDP. Counters are sent as the increase
+// since the last push. With DogStatsD tags the per-vault gauges are sent as
+// well, tagged with the vault.
+type statsdExporter struct {
+	addr   string
+	prefix string
+	dog    bool
+	tags   []string
+	last   map[string]int64
+}
+
+func newStatsdExporter(addr string) (*statsdExporter, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid STATSD_ADDR: %w", err)
+	}
+	e := &statsdExporter{
+		addr:   addr,
+		prefix: getEnv("STATSD_PREFIX", "vault_unsealer."),
+		tags:   splitList(os.Getenv("STATSD_TAGS")),
+		last:   make(map[string]int64),
+	}
+	switch format := getEnv("STATSD_FORMAT", "statsd"); format {
+	case "statsd":
+	case "dogstatsd":
+		e.dog = true
+	default:
+		return nil, fmt.Errorf("STATSD_FORMAT must be statsd or dogstatsd, got %q", format)
+	}
+	if len(e.tags) > 0 && !e.dog {
+		return nil, fmt.Errorf("STATSD_TAGS requires STATSD_FORMAT=dogstatsd")
+	}
+	return e, nil
+}
+
+func (e *statsdExporter) name() string { return "statsd" }
+
+func (e *statsdExporter) line(name, value, kind string, tags []string) string {
+	line := e.prefix + name + ":" + value + "|" + kind
+	if all := append(append([]string(nil), e.tags...), tags...); len(all) > 0 {
+		line += "|#" + strings.Join(all, ",")
+	}
+	return line
+}
+
+func (e *statsdExporter) push(ctx context.Context, s *metricSnapshot) error {
+	var lines []string
+	for _, name := range s.sortedNames() {
+		n := s.values[name]
+		if gaugeMetrics[name] {
+			lines = append(lines, e.line(name, strconv.FormatInt(n, 10), "g", nil))
+			continue
+		}
+		delta := n - e.last[name]
+		e.last[name] = n
+		if delta > 0 {
+			lines = append(lines, e.line(name, strconv.FormatInt(delta, 10), "c", nil))
+		}
+	}
+	if e.dog {
+		for _, v := range s.vaults {
+			tags := []string{"vault:" + v.vault}
+			if v.config != "" {
+				tags = append(tags, "config:"+v.config)
+			}
+			sealed := "0"
+			if v.sealed {
+				sealed = "1"
+			}
+			lines = append(lines,
+				e.line("vault_sealed", sealed, "g", tags),
+				e.line("vault_sealed_duration_seconds", strconv.FormatFloat(v.sealedSeconds, 'f', 0, 64), "g", tags))
+		}
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", e.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Keep datagrams below the usual 1432 byte payload limit.
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+len(line)+1 > 1432 {
+			if _, err := conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		_, err = conn.Write(buf.Bytes())
+	}
+	return err
+}
+
+// otlpExporter pushes metrics with OTLP over HTTP, using the JSON encoding so
+// no protobuf library is needed.
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+	start    time.Time
+}
+
+func newOTLPExporter(endpoint string) (*otlpExporter, error) {
+	headers := make(map[string]string)
+	for _, h := range splitList(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")) {
+		key, value, ok := strings.Cut(h, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS entry %q", h)
+		}
+		headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return &otlpExporter{
+		endpoint: endpoint,
+		headers:  headers,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		start:    time.Now(),
+	}, nil
+}
+
+func (e *otlpExporter) name() string { return "otlp" }
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func otlpAttributes(pairs ...string) []otlpAttribute {
+	var attrs []otlpAttribute
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if pairs[i+1] == "" {
+			continue
+		}
+		a := otlpAttribute{Key: pairs[i]}
+		a.Value.StringValue = pairs[i+1]
+		attrs = append(attrs, a)
+	}
+	return attrs
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsInt             string          `json:"asInt,omitempty"`
+	AsDouble          *float64        `json:"asDouble,omitempty"`
+}
+
+type otlpMetric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Unit        string     `json:"unit,omitempty"`
+	Sum         *otlpSum   `json:"sum,omitempty"`
+	Gauge       *otlpGauge `json:"gauge,omitempty"`
+}
+
+// otlpSum is a cumulative (aggregation temporality 2) sum.
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+func (e *otlpExporter) push(ctx context.Context, s *metricSnapshot) error {
+	now := strconv.FormatInt(s.time.UnixNano(), 10)
+	start := strconv.FormatInt(e.start.UnixNano(), 10)
+
+	var metrics []otlpMetric
+	for _, name := range s.sortedNames() {
+		m := otlpMetric{Name: "vault_unsealer." + name, Description: metricHelp[name]}
+		point := otlpDataPoint{TimeUnixNano: now, AsInt: strconv.FormatInt(s.values[name], 10)}
+		if gaugeMetrics[name] {
+			m.Gauge = &otlpGauge{DataPoints: []otlpDataPoint{point}}
+		} else {
+			point.StartTimeUnixNano = start
+			m.Sum = &otlpSum{DataPoints: []otlpDataPoint{point}, AggregationTemporality: 2, IsMonotonic: true}
+		}
+		metrics = append(metrics, m)
+	}
+
+	if len(s.vaults) > 0 {
+		sealed := otlpMetric{Name: "vault_unsealer.vault_sealed", Description: "1 if the vault was last seen sealed."}
+		duration := otlpMetric{Name: "vault_unsealer.vault_sealed_duration", Description: "How long the vault has been sealed.", Unit: "s"}
+		var sealedPoints, durationPoints []otlpDataPoint
+		for _, v := range s.vaults {
+			attrs := otlpAttributes("vault", v.vault, "config", v.config)
+			n := "0"
+			if v.sealed {
+				n = "1"
+			}
+			seconds := v.sealedSeconds
+			sealedPoints = append(sealedPoints, otlpDataPoint{Attributes: attrs, TimeUnixNano: now, AsInt: n})
+			durationPoints = append(durationPoints, otlpDataPoint{Attributes: attrs, TimeUnixNano: now, AsDouble: &seconds})
+		}
+		sealed.Gauge = &otlpGauge{DataPoints: sealedPoints}
+		duration.Gauge = &otlpGauge{DataPoints: durationPoints}
+		metrics = append(metrics, sealed, duration)
+	}
+
+	payload := map[string]interface{}{
+		"resourceMetrics": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": otlpAttributes(
+				"service.name", getEnv("OTEL_SERVICE_NAME", "vault-unsealer"),
+				"service.version", getBuildInfo().Version)},
+			"scopeMetrics": []interface{}{map[string]interface{}{
+				"scope":   map[string]string{"name": "vault-unsealer"},
+				"metrics": metrics,
+			}},
+		}},
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", e.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range e.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("collector returned status code %d", resp.StatusCode)
+	}
+	return nil
+}
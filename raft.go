@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// joinsRaft reports whether an uninitialized vault should join a Raft cluster
+// instead of being left alone or initialized. The leader itself never joins.
+func (v *vaultConfig) joinsRaft() bool {
+	return v.raftLeader != "" && v.raftLeader != v.addr
+}
+
+// raftJoin asks a new node to join the Raft cluster led by raftLeader. The
+// node stays sealed afterwards and is unsealed with the cluster's keys.
+func (u *Unsealer) raftJoin(ctx context.Context, v *vaultConfig) error {
+	var leaderCA string
+	if v.raftLeaderCA != "" {
+		pem, err := os.ReadFile(v.raftLeaderCA)
+		if err != nil {
+			return fmt.Errorf("failed to read leader CA certificate: %w", err)
+		}
+		leaderCA = string(pem)
+	}
+
+	joined, err := v.api.raftJoin(ctx, v.raftLeader, leaderCA)
+	if err != nil {
+		return err
+	}
+	if !joined {
+		return fmt.Errorf("vault did not join %s", v.raftLeader)
+	}
+
+	atomic.AddInt64(&u.raftJoins, 1)
+	u.logger.Info("vault joined raft cluster", "vault", v.addr, "leader", v.raftLeader)
+	return nil
+}
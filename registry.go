@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// vaultRegistry holds the vaults registered through the admin API, as entries
+// in the VAULT_URLS syntax. With a store, the entries survive restarts and
+// every replica picks up those registered through another one.
+type vaultRegistry struct {
+	store stateStore
+	// allowedHosts are the hosts that vaults without a TLS fingerprint pin
+	// may be registered for.
+	allowedHosts []*regexp.Regexp
+
+	// mu serializes changes and syncs, so that a sync never applies entries
+	// older than a change made meanwhile.
+	mu    sync.Mutex
+	specs []string
+}
+
+// newVaultRegistry reads VAULT_REGISTRY_FILE or VAULT_REGISTRY_CONFIGMAP and
+// VAULT_REGISTRY_ALLOWED_HOSTS.
+func newVaultRegistry() (*vaultRegistry, error) {
+	store, err := newStateStore("VAULT_REGISTRY", "vaults")
+	if err != nil {
+		return nil, err
+	}
+	allowed, err := compileFilters(os.Getenv("VAULT_REGISTRY_ALLOWED_HOSTS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAULT_REGISTRY_ALLOWED_HOSTS: %w", err)
+	}
+	return &vaultRegistry{store: store, allowedHosts: allowed}, nil
+}
+
+// checkIdentity refuses a vault whose identity is not pinned. Every vault is
+// sent the unseal keys and its bearer token, so a registered one needs a
+// tls_fingerprint pin on an https address or a host matching
+// VAULT_REGISTRY_ALLOWED_HOSTS. A cluster_id pin is not enough: a sealed vault
+// does not have to report its real cluster ID.
+func (r *vaultRegistry) checkIdentity(v *vaultConfig) error {
+	if v.tlsFingerprint != nil && strings.HasPrefix(v.addr, "https://") {
+		return nil
+	}
+	if p, err := url.Parse(v.addr); err == nil && matchesAny(r.allowedHosts, []string{p.Host, p.Hostname()}) {
+		return nil
+	}
+	return fmt.Errorf("vault %s needs a tls_fingerprint pin on an https:// address, or a host matching VAULT_REGISTRY_ALLOWED_HOSTS", v.addr)
+}
+
+// syncRegistry loads the registered vaults from the store and applies them.
+// A failed load keeps the current vaults.
+func (u *Unsealer) syncRegistry(ctx context.Context) {
+	r := u.registry
+	if r == nil || r.store == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	var specs []string
+	if err := r.store.load(ctx, &specs); err != nil {
+		u.logger.Warn("failed to load registered vaults, keeping current vault list", "error", err)
+		return
+	}
+	if !slices.Equal(specs, r.specs) {
+		u.applyRegistry(ctx, specs)
+	}
+}
+
+// updateRegistry applies change to the latest registered vaults, saves the
+// result and applies it.
+func (u *Unsealer) updateRegistry(ctx context.Context, change func(specs []string) ([]string, error)) error {
+	r := u.registry
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	specs := slices.Clone(r.specs)
+	if r.store != nil {
+		specs = nil
+		if err := r.store.load(ctx, &specs); err != nil {
+			return err
+		}
+	}
+	specs, err := change(specs)
+	if err != nil {
+		return err
+	}
+	if r.store != nil {
+		if err := r.store.save(ctx, specs); err != nil {
+			return fmt.Errorf("failed to save registered vaults: %w", err)
+		}
+	}
+	u.applyRegistry(ctx, specs)
+	return nil
+}
+
+// applyRegistry brings the vault list in line with specs. Registered vaults
+// whose entry is unchanged keep their state; an entry whose address is already
+// configured or discovered is ignored.
+func (u *Unsealer) applyRegistry(ctx context.Context, specs []string) {
+	u.registry.specs = specs
+
+	u.vaultsMu.Lock()
+	previous := u.registered
+	current := make(map[string]*vaultConfig, len(previous))
+	for _, e := range previous {
+		current[e.spec] = e.vault
+	}
+	static := make(map[string]bool, len(u.staticVaults))
+	for _, v := range u.staticVaults {
+		static[v.addr] = true
+	}
+
+	var registered []registeredVault
+	seen := make(map[string]bool)
+	added := 0
+	for _, spec := range specs {
+		if v, ok := current[spec]; ok {
+			registered = append(registered, registeredVault{spec, v})
+			seen[v.addr] = true
+			continue
+		}
+		v, err := parseVaultSpec(spec, u.vaultDefaults)
+		if err == nil && (static[v.addr] || seen[v.addr]) {
+			err = fmt.Errorf("vault is already configured")
+		}
+		if err == nil {
+			err = u.registry.checkIdentity(v)
+		}
+		if err == nil {
+			err = v.connect(u.tlsPolicy)
+		}
+		if err != nil {
+			u.logger.Warn("ignoring registered vault", "entry", spec, "error", err)
+			continue
+		}
+		u.logger.Info("vault registered", "vault", v.addr)
+		u.record(ctx, historyVaultAdded, severityInfo, v, "vault registered")
+		registered = append(registered, registeredVault{spec, v})
+		seen[v.addr] = true
+		added++
+	}
+
+	// Rebuild the list from the configured, registered and discovered vaults,
+	// in that order. A registered vault takes the place of a discovered one
+	// with the same address.
+	vaults := append([]*vaultConfig(nil), u.staticVaults...)
+	for _, e := range registered {
+		vaults = append(vaults, e.vault)
+	}
+	kept := make(map[*vaultConfig]bool, len(registered))
+	for _, e := range registered {
+		kept[e.vault] = true
+	}
+	wasRegistered := make(map[*vaultConfig]bool, len(previous))
+	for _, e := range previous {
+		wasRegistered[e.vault] = true
+		if !kept[e.vault] {
+			u.logger.Info("vault unregistered", "vault", e.vault.addr)
+			u.record(ctx, historyVaultRemoved, severityInfo, e.vault, "vault unregistered")
+		}
+	}
+	for _, v := range u.vaults {
+		if !static[v.addr] && !wasRegistered[v] && !seen[v.addr] {
+			vaults = append(vaults, v)
+		}
+	}
+	u.registered = registered
+	u.vaults = vaults
+	u.vaultsMu.Unlock()
+
+	if added > 0 {
+		u.refreshVaultCredentials()
+	}
+}
+
+type registeredVault struct {
+	spec  string
+	vault *vaultConfig
+}
+
+// registeredSpec returns the registry entry of v, if it was registered.
+func (u *Unsealer) registeredSpec(v *vaultConfig) (string, bool) {
+	u.vaultsMu.RLock()
+	defer u.vaultsMu.RUnlock()
+	for _, e := range u.registered {
+		if e.vault == v {
+			return e.spec, true
+		}
+	}
+	return "", false
+}
+
+// handleRegisterVault adds a vault from a VAULT_URLS entry, such as
+// {"vault": "https://vault-3.example.com:8200;group=prod"}, and starts its
+// first unseal attempt.
+func (u *Unsealer) handleRegisterVault(w http.ResponseWriter, r *http.Request) {
+	if u.operator != nil {
+		http.Error(w, "vaults cannot be registered in operator mode; add them to a VaultUnsealConfig", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Vault string `json:"vault"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&body); err != nil || body.Vault == "" {
+		http.Error(w, `the body must be {"vault": "<url>[;option=value...]"}`, http.StatusBadRequest)
+		return
+	}
+	v, err := parseVaultSpec(body.Vault, u.vaultDefaults)
+	if err == nil {
+		err = u.registry.checkIdentity(v)
+	}
+	if err == nil {
+		err = v.connect(u.tlsPolicy)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conflict := false
+	err = u.updateRegistry(r.Context(), func(specs []string) ([]string, error) {
+		for _, existing := range u.vaultList() {
+			if existing.addr == v.addr {
+				conflict = true
+				return nil, fmt.Errorf("vault %s is already configured", v.addr)
+			}
+		}
+		return append(specs, body.Vault), nil
+	})
+	if conflict {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u.logger.Info("vault registered through the admin API", "vault", v.addr, "remote", r.RemoteAddr)
+	for _, registered := range u.vaultList() {
+		if registered.addr == v.addr {
+			u.requestVaultUnseal(registered)
+		}
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"vault": v.addr})
+}
+
+// handleUnregisterVault removes a vault registered through the API. Vaults
+// from VAULT_URLS or discovery cannot be removed this way.
+func (u *Unsealer) handleUnregisterVault(w http.ResponseWriter, r *http.Request) {
+	if u.operator != nil {
+		http.Error(w, "vaults cannot be unregistered in operator mode; remove them from their VaultUnsealConfig", http.StatusBadRequest)
+		return
+	}
+	t, ok := u.findVault(w, r, r.PathValue("vault"))
+	if !ok {
+		return
+	}
+	spec, ok := u.registeredSpec(t.v)
+	if !ok {
+		http.Error(w, "the vault was not registered through the API; it comes from VAULT_URLS or discovery", http.StatusConflict)
+		return
+	}
+	err := u.updateRegistry(r.Context(), func(specs []string) ([]string, error) {
+		return slices.DeleteFunc(specs, func(s string) bool { return s == spec }), nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u.logger.Info("vault unregistered through the admin API", "vault", t.v.addr, "remote", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestRegistryCheckIdentity(t *testing.T) {
+	allowed, err := compileFilters("*.vault.svc:8200,re:^vault-[0-9]+\\.internal$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &vaultRegistry{allowedHosts: allowed}
+	pin := make([]byte, 32)
+
+	tests := []struct {
+		name    string
+		v       vaultConfig
+		wantErr bool
+	}{
+		{"https with fingerprint", vaultConfig{addr: "https://vault.example.com:8200", tlsFingerprint: pin}, false},
+		{"http with fingerprint", vaultConfig{addr: "http://vault.example.com:8200", tlsFingerprint: pin}, true},
+		{"no pin", vaultConfig{addr: "https://vault.example.com:8200"}, true},
+		{"cluster id only", vaultConfig{addr: "https://vault.example.com:8200", clusterID: "abc"}, true},
+		{"allowed host and port", vaultConfig{addr: "http://vault-0.vault.svc:8200"}, false},
+		{"allowed host other port", vaultConfig{addr: "http://vault-0.vault.svc:8201"}, true},
+		{"allowed hostname", vaultConfig{addr: "https://vault-3.internal:8200"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := r.checkIdentity(&tt.v)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkIdentity() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if err := (&vaultRegistry{}).checkIdentity(&vaultConfig{addr: "http://vault-0.vault.svc:8200"}); err == nil {
+		t.Error("checkIdentity() without VAULT_REGISTRY_ALLOWED_HOSTS accepted an unpinned vault")
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+type rekeyStatus struct {
+	Nonce                string `json:"nonce"`
+	Started              bool   `json:"started"`
+	T                    int    `json:"t"`
+	N                    int    `json:"n"`
+	Progress             int    `json:"progress"`
+	Required             int    `json:"required"`
+	VerificationRequired bool   `json:"verification_required"`
+}
+
+type rekeyUpdate struct {
+	Nonce                string   `json:"nonce"`
+	Complete             bool     `json:"complete"`
+	Keys                 []string `json:"keys"`
+	VerificationRequired bool     `json:"verification_required"`
+	VerificationNonce    string   `json:"verification_nonce"`
+}
+
+type rekeyVerify struct {
+	Nonce    string `json:"nonce"`
+	Complete bool   `json:"complete"`
+}
+
+// runRekey implements the "rekey" subcommand. It rekeys one vault cluster
+// using the currently stored shares, writes the new shares to the key
+// provider and only lets them take effect after they have been read back and
+// verified against Vault.
+func runRekey(log hclog.Logger, args []string) int {
+	fs := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	addr := fs.String("vault", "", "address of the active vault node to rekey")
+	threshold := fs.Int("threshold", 0, "number of new shares required to unseal (default: current threshold)")
+	timeout := fs.Duration("timeout", 5*time.Minute, "overall timeout for the rekey")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *addr == "" {
+		fmt.Fprintln(os.Stderr, "usage: vault-unsealer rekey -vault <url> [-threshold <n>]")
+		return 2
+	}
+
+	defaults, err := loadVaultDefaults()
+	if err != nil {
+		log.Error("invalid vault defaults", "error", err)
+		return 1
+	}
+	v, err := parseVaultSpec(*addr, defaults)
+	if err != nil {
+		log.Error("invalid -vault", "error", err)
+		return 2
+	}
+
+	provider, err := newKeyProvider(log)
+	if err != nil {
+		log.Error("key provider init failed", "error", err)
+		return 1
+	}
+	if err := checkVaultCredentials([]*vaultConfig{v}, provider); err != nil {
+		log.Error("vault credential configuration failed", "error", err)
+		return 1
+	}
+
+	u := &Unsealer{
+		logger:   log,
+		provider: provider,
+		vaults:   []*vaultConfig{v},
+	}
+	tlsPolicy, err := loadTLSPolicy()
+	if err != nil {
+		log.Error("invalid TLS settings", "error", err)
+		return 1
+	}
+	if err := v.connect(tlsPolicy); err != nil {
+		log.Error("invalid connection settings", "vault", v.addr, "error", err)
+		return 1
+	}
+	u.refreshVaultCredentials()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	if err := u.rekey(ctx, v, *threshold); err != nil {
+		log.Error("rekey failed", "vault", v.addr, "error", err)
+		return 1
+	}
+	log.Info("rekey complete, send SIGHUP to running unsealers to load the new keys")
+	return 0
+}
+
+func (u *Unsealer) rekey(ctx context.Context, v *vaultConfig, threshold int) error {
+	addr := v.addr
+	store, ok := u.getProvider().(keyStore)
+	if !ok {
+		return fmt.Errorf("key provider cannot store keys")
+	}
+
+	oldKeys, err := u.getProvider().fetchKeys()
+	if err != nil {
+		return fmt.Errorf("failed to fetch current keys: %w", err)
+	}
+	if err := validateKeys(oldKeys); err != nil {
+		return fmt.Errorf("current key set is malformed: %w", err)
+	}
+
+	status, err := v.api.sealStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if status.Sealed {
+		return fmt.Errorf("vault must be unsealed to rekey")
+	}
+	if threshold == 0 {
+		threshold = status.T
+	}
+	shares := store.keyCount()
+	if threshold > shares {
+		return fmt.Errorf("threshold %d is larger than the %d configured key secrets", threshold, shares)
+	}
+
+	// Step 1: start a rekey that requires verification, so the new shares do
+	// not replace the old ones until we have proven they were stored.
+	init, err := v.api.rekeyInit(ctx, shares, threshold)
+	if err != nil {
+		return fmt.Errorf("failed to start rekey: %w", err)
+	}
+	u.logger.Info("rekey started", "vault", addr, "shares", shares, "threshold", threshold, "required", init.Required)
+
+	abort := func(reason error) error {
+		if err := v.api.rekeyCancel(context.Background()); err != nil {
+			u.logger.Error("failed to cancel rekey, cancel it manually", "vault", addr, "error", err)
+		} else {
+			u.logger.Warn("rekey cancelled, the old keys remain valid", "vault", addr)
+		}
+		return reason
+	}
+
+	// Step 2: authorize the rekey with the existing shares.
+	update := &rekeyUpdate{}
+	for _, key := range oldKeys {
+		if update, err = v.api.rekeyUpdate(ctx, key, init.Nonce); err != nil {
+			return abort(fmt.Errorf("failed to submit existing share: %w", err))
+		}
+		if update.Complete {
+			break
+		}
+	}
+	if !update.Complete {
+		return abort(fmt.Errorf("rekey did not complete after submitting all existing shares"))
+	}
+	if len(update.Keys) != shares {
+		return abort(fmt.Errorf("vault returned %d new keys, expected %d", len(update.Keys), shares))
+	}
+	if err := validateKeys(update.Keys); err != nil {
+		return abort(fmt.Errorf("new key set is malformed: %w", err))
+	}
+	u.logger.Info("new shares generated", "vault", addr)
+
+	// Step 3: store the new shares. Until verification completes Vault still
+	// uses the old ones, so any failure rolls the provider back.
+	rollback := func(reason error) error {
+		if err := store.storeKeys(oldKeys); err != nil {
+			u.logger.Error("failed to restore the old keys in the key provider", "error", err)
+		}
+		return abort(reason)
+	}
+
+	if err := store.storeKeys(update.Keys); err != nil {
+		return rollback(fmt.Errorf("failed to store new keys: %w", err))
+	}
+
+	// Step 4: read the shares back and use exactly what the provider returns
+	// to verify the rekey.
+	stored, err := u.getProvider().fetchKeys()
+	if err != nil {
+		return rollback(fmt.Errorf("failed to read back new keys: %w", err))
+	}
+	if len(changedKeyIndexes(update.Keys, stored)) > 0 {
+		return rollback(fmt.Errorf("keys read back from the provider do not match the new keys"))
+	}
+
+	verify := &rekeyVerify{}
+	for _, key := range stored[:threshold] {
+		if verify, err = v.api.rekeyVerify(ctx, key, update.VerificationNonce); err != nil {
+			return rollback(fmt.Errorf("verification failed: %w", err))
+		}
+		if verify.Complete {
+			break
+		}
+	}
+	if !verify.Complete {
+		return rollback(fmt.Errorf("verification did not complete"))
+	}
+
+	u.logger.Info("rekey verified, new keys are active", "vault", addr, "fingerprint", keysFingerprint(stored))
+	return nil
+}
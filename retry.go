@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// retryPolicy controls how often and how patiently a failed unseal is retried
+// within one poll.
+type retryPolicy struct {
+	attempts   int
+	backoff    time.Duration
+	multiplier float64
+	maxBackoff time.Duration
+	jitter     float64
+}
+
+var defaultRetryPolicy = retryPolicy{attempts: 3, backoff: time.Second, multiplier: 2}
+
+// delay returns the wait after the given zero-based failed attempt.
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d := float64(p.backoff) * math.Pow(p.multiplier, float64(attempt))
+	if p.maxBackoff > 0 && d > float64(p.maxBackoff) {
+		d = float64(p.maxBackoff)
+	}
+	if p.jitter > 0 {
+		// Spread retries by up to +/- jitter so vaults behind the same link
+		// do not retry in lockstep.
+		d *= 1 + p.jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(d)
+}
+
+func (p *retryPolicy) set(key, value string) error {
+	switch key {
+	case "retry_attempts":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("must be a positive integer")
+		}
+		p.attempts = n
+	case "retry_backoff", "retry_max_backoff":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("must be a non-negative duration")
+		}
+		if key == "retry_backoff" {
+			p.backoff = d
+		} else {
+			p.maxBackoff = d
+		}
+	case "retry_multiplier":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 1 {
+			return fmt.Errorf("must be a number of at least 1")
+		}
+		p.multiplier = f
+	case "retry_jitter":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 0 || f > 1 {
+			return fmt.Errorf("must be between 0 and 1")
+		}
+		p.jitter = f
+	}
+	return nil
+}
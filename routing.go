@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// notifyRoute sends the events it matches to the sinks it names. Empty
+// conditions match everything; without types, the sink's own choice of events
+// applies.
+type notifyRoute struct {
+	sinks      map[string]bool
+	types      map[string]bool
+	vaults     []*regexp.Regexp
+	groups     map[string]bool
+	severities map[string]bool
+}
+
+// parseRoutes reads NOTIFY_ROUTES: comma-separated rules of the form
+// sinks;type=...;vault=...;group=...;severity=..., where sinks and every value are
+// lists separated by |. kinds are the kinds of the configured sinks.
+func parseRoutes(raw string, kinds map[string]bool) ([]*notifyRoute, error) {
+	var routes []*notifyRoute
+	for _, rule := range splitList(raw) {
+		parts := strings.Split(rule, ";")
+		r := &notifyRoute{sinks: pipeSet(parts[0])}
+		if len(r.sinks) == 0 {
+			return nil, fmt.Errorf("NOTIFY_ROUTES rule %q names no sink", rule)
+		}
+		for kind := range r.sinks {
+			if !kinds[kind] {
+				return nil, fmt.Errorf("NOTIFY_ROUTES rule %q: no %s sink is configured", rule, kind)
+			}
+		}
+		for _, opt := range parts[1:] {
+			if opt = strings.TrimSpace(opt); opt == "" {
+				continue
+			}
+			key, value, ok := strings.Cut(opt, "=")
+			if !ok {
+				return nil, fmt.Errorf("NOTIFY_ROUTES rule %q: option %q must be key=value", rule, opt)
+			}
+			switch strings.TrimSpace(key) {
+			case "type":
+				r.types = pipeSet(value)
+				for t := range r.types {
+					if !historyTypes[t] {
+						return nil, fmt.Errorf("NOTIFY_ROUTES rule %q: unknown event type %q", rule, t)
+					}
+				}
+			case "vault":
+				for pattern := range pipeSet(value) {
+					re, err := compilePattern(pattern)
+					if err != nil {
+						return nil, fmt.Errorf("NOTIFY_ROUTES rule %q: %w", rule, err)
+					}
+					r.vaults = append(r.vaults, re)
+				}
+			case "group":
+				r.groups = pipeSet(value)
+			case "severity":
+				r.severities = pipeSet(value)
+				for s := range r.severities {
+					if s != severityInfo && s != severityWarning && s != severityError && s != severityCritical {
+						return nil, fmt.Errorf("NOTIFY_ROUTES rule %q: unknown severity %q", rule, s)
+					}
+				}
+			default:
+				return nil, fmt.Errorf("NOTIFY_ROUTES rule %q: unknown option %q", rule, key)
+			}
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+func pipeSet(value string) map[string]bool {
+	set := map[string]bool{}
+	for _, item := range strings.Split(value, "|") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
+
+// matchesVault checks the vault groups and patterns, the latter against the
+// event's vault address and config. Events about no vault in particular,
+// such as provider_error, only match routes without either.
+func (r *notifyRoute) matchesVault(e notification) bool {
+	if r.groups != nil && !r.groups[e.Group] {
+		return false
+	}
+	if len(r.vaults) == 0 {
+		return true
+	}
+	var values []string
+	for _, value := range []string{e.Vault, e.Config} {
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+	return matchesAny(r.vaults, values)
+}
+
+// accepts reports whether q takes e. A sink that no route names takes the
+// events it selected; a routed one only what its routes match. Events that
+// close one of a resolving sink's alerts only need to match a route's vault
+// patterns, so the alerts of a routed vault are still closed.
+func (q *sinkQueue) accepts(e notification) bool {
+	resolution := false
+	if r, ok := q.sink.(resolvingSink); ok && r.resolves(e.Type) {
+		resolution = true
+	}
+	if q.routes == nil {
+		return q.events[e.Type] || resolution
+	}
+	for _, r := range q.routes {
+		if !r.matchesVault(e) {
+			continue
+		}
+		if resolution {
+			return true
+		}
+		if (r.types == nil && q.events[e.Type] || r.types[e.Type]) && (r.severities == nil || r.severities[e.Severity]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const shardGroupLabel = "unsealer.mackcoding.io/shard-group"
+
+// shardMembership splits the vaults between the replicas of a shard group.
+// Every replica holds its own Lease labelled with the group, the holders of
+// live leases are the members, and each vault belongs to one member chosen by
+// rendezvous hashing, so a member joining or leaving only moves its own share
+// of the vaults.
+//
+// A replica owns nothing until it has been a member for a full lease duration,
+// which gives the others time to see it and let go of its vaults, and nothing
+// once its last successful refresh is a lease duration old.
+type shardMembership struct {
+	logger   hclog.Logger
+	kube     *kubeClient
+	group    string
+	identity string
+	duration time.Duration
+
+	mu          sync.Mutex
+	members     []string
+	joinedAt    time.Time
+	refreshedAt time.Time
+}
+
+func newShardMembership(log hclog.Logger) (*shardMembership, error) {
+	kube, err := newKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	identity, err := leaseIdentity()
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine replica identity: %w", err)
+	}
+	duration, err := time.ParseDuration(getEnv("SHARD_LEASE_DURATION", "15s"))
+	if err != nil || duration < 5*time.Second {
+		return nil, fmt.Errorf("SHARD_LEASE_DURATION must be a duration of at least 5s")
+	}
+	return &shardMembership{
+		logger:   log,
+		kube:     kube,
+		group:    getEnv("SHARD_GROUP", "vault-unsealer"),
+		identity: identity,
+		duration: duration,
+	}, nil
+}
+
+// owns reports whether key, a vault address or VaultUnsealConfig name, is
+// handled by this replica.
+func (m *shardMembership) owns(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.joinedAt.IsZero() || time.Since(m.joinedAt) < m.duration || time.Since(m.refreshedAt) >= m.duration {
+		return false
+	}
+	return shardOwner(m.members, key) == m.identity
+}
+
+func (m *shardMembership) memberCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.members)
+}
+
+// shardOwner picks the member with the highest hash of member and key.
+func shardOwner(members []string, key string) string {
+	var owner string
+	var best uint64
+	for _, member := range members {
+		h := fnv.New64a()
+		h.Write([]byte(member))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if sum := h.Sum64(); owner == "" || sum > best {
+			owner, best = member, sum
+		}
+	}
+	return owner
+}
+
+// run renews this replica's lease and refreshes the member list three times
+// per lease duration. changed is called whenever the members change, and once
+// this replica may start owning vaults. The lease is deleted on shutdown.
+func (m *shardMembership) run(ctx context.Context, changed func()) {
+	ticker := time.NewTicker(m.duration / 3)
+	defer ticker.Stop()
+
+	active := false
+	for {
+		if members, err := m.refresh(ctx); err != nil {
+			if ctx.Err() == nil {
+				m.logger.Warn("shard membership refresh failed", "group", m.group, "error", err)
+			}
+		} else if members != nil {
+			m.logger.Info("shard members changed", "group", m.group, "members", members)
+			changed()
+		}
+
+		m.mu.Lock()
+		nowActive := !m.joinedAt.IsZero() && time.Since(m.joinedAt) >= m.duration
+		m.mu.Unlock()
+		if nowActive && !active {
+			m.logger.Info("joined shard group, unsealing owned vaults", "group", m.group, "identity", m.identity)
+			changed()
+		}
+		active = nowActive
+
+		select {
+		case <-ctx.Done():
+			m.leave()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh renews the own lease and lists the live members. It returns the new
+// member list if it differs from the previous one.
+func (m *shardMembership) refresh(ctx context.Context) ([]string, error) {
+	start := time.Now()
+	if err := m.renew(ctx, start); err != nil {
+		return nil, err
+	}
+
+	var list struct {
+		Items []lease `json:"items"`
+	}
+	selector := url.QueryEscape(shardGroupLabel + "=" + m.group)
+	if err := m.kube.get(ctx, leasePath(m.kube.namespace)+"?labelSelector="+selector, &list); err != nil {
+		return nil, fmt.Errorf("failed to list shard leases: %w", err)
+	}
+	now := time.Now()
+	var members []string
+	for i := range list.Items {
+		if l := &list.Items[i]; l.held(now) {
+			members = append(members, l.Spec.HolderIdentity)
+		}
+	}
+	sort.Strings(members)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.joinedAt.IsZero() || start.Sub(m.refreshedAt) >= m.duration {
+		// The others may have dropped this replica in the meantime, so it
+		// has to rejoin like a new member.
+		m.joinedAt = start
+	}
+	m.refreshedAt = start
+	if strings.Join(members, ",") == strings.Join(m.members, ",") {
+		return nil, nil
+	}
+	m.members = members
+	return members, nil
+}
+
+func (m *shardMembership) leaseName() string {
+	return m.group + "-" + m.identity
+}
+
+func (m *shardMembership) renew(ctx context.Context, now time.Time) error {
+	path := leasePath(m.kube.namespace)
+	var l lease
+	err := m.kube.get(ctx, path+"/"+url.PathEscape(m.leaseName()), &l)
+	if isKubeStatus(err, http.StatusNotFound) {
+		l.APIVersion, l.Kind = "coordination.k8s.io/v1", "Lease"
+		l.Metadata.Name = m.leaseName()
+		l.Metadata.Labels = map[string]string{shardGroupLabel: m.group}
+		claimLease(&l, m.identity, m.duration, now)
+		return m.kube.do(ctx, "POST", path, "application/json", &l, nil)
+	}
+	if err != nil {
+		return err
+	}
+	claimLease(&l, m.identity, m.duration, now)
+	return m.kube.do(ctx, "PUT", path+"/"+url.PathEscape(m.leaseName()), "application/json", &l, nil)
+}
+
+// leave deletes the own lease so the other members take over this replica's
+// vaults at their next refresh instead of after the lease expires.
+func (m *shardMembership) leave() {
+	m.mu.Lock()
+	m.joinedAt = time.Time{}
+	m.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	path := leasePath(m.kube.namespace) + "/" + url.PathEscape(m.leaseName())
+	if err := m.kube.do(ctx, "DELETE", path, "", nil, nil); err != nil && !isKubeStatus(err, http.StatusNotFound) {
+		m.logger.Warn("failed to delete shard lease", "group", m.group, "error", err)
+		return
+	}
+	m.logger.Info("left shard group", "group", m.group)
+}
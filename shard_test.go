@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestShardOwner(t *testing.T) {
+	tests := []struct {
+		members []string
+		key     string
+		want    string
+	}{
+		{nil, "https://vault-0:8200", ""},
+		{[]string{"unsealer-0"}, "https://vault-0:8200", "unsealer-0"},
+	}
+	for _, tt := range tests {
+		if got := shardOwner(tt.members, tt.key); got != tt.want {
+			t.Errorf("shardOwner(%v, %q) = %q, want %q", tt.members, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestShardOwnerOrder(t *testing.T) {
+	members := []string{"unsealer-0", "unsealer-1", "unsealer-2"}
+	reversed := []string{"unsealer-2", "unsealer-1", "unsealer-0"}
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("https://vault-%d:8200", i)
+		if a, b := shardOwner(members, key), shardOwner(reversed, key); a != b {
+			t.Errorf("owner of %s depends on member order: %s and %s", key, a, b)
+		}
+	}
+}
+
+// Removing a member only moves the keys it owned, which is the point of
+// rendezvous hashing.
+func TestShardOwnerRemoval(t *testing.T) {
+	members := []string{"unsealer-0", "unsealer-1", "unsealer-2"}
+	remaining := []string{"unsealer-0", "unsealer-2"}
+	owned := map[string]int{}
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("https://vault-%d:8200", i)
+		before, after := shardOwner(members, key), shardOwner(remaining, key)
+		owned[before]++
+		if before != "unsealer-1" && before != after {
+			t.Errorf("%s moved from %s to %s", key, before, after)
+		}
+	}
+	for _, member := range members {
+		if owned[member] < 50 {
+			t.Errorf("%s owns %d of 300 keys, want a fair share", member, owned[member])
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	slackAPIURL          = "https://slack.com/api/chat.postMessage"
+	defaultSlackTemplate = "{{emoji .Severity}} {{with .Vault}}*{{.}}*: {{end}}{{.Message}}"
+)
+
+// slackSink posts notifications to Slack, through an incoming webhook or as
+// a bot with chat.postMessage. Only the bot can choose the channel per event;
+// an incoming webhook always posts to the channel it was created for.
+type slackSink struct {
+	webhookURL string
+	botToken   string
+	apiURL     string
+	channels   map[string]string
+	templates  messageTemplates
+	client     *http.Client
+}
+
+func init() {
+	registerSink("slack", singleSink(loadSlackSink))
+}
+
+// loadSlackSink reads SLACK_WEBHOOK_URL or SLACK_BOT_TOKEN (or their _FILE
+// variants), SLACK_CHANNEL, SLACK_TEMPLATE and their per-event overrides.
+// It returns nil when Slack is not configured.
+func loadSlackSink() (sink, error) {
+	webhookURL, err := readSecretEnv("SLACK_WEBHOOK_URL")
+	if err != nil {
+		return nil, err
+	}
+	botToken, err := readSecretEnv("SLACK_BOT_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case webhookURL == "" && botToken == "":
+		return nil, nil
+	case webhookURL != "" && botToken != "":
+		return nil, fmt.Errorf("SLACK_WEBHOOK_URL and SLACK_BOT_TOKEN cannot both be set")
+	case webhookURL != "":
+		if u, err := url.Parse(webhookURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("SLACK_WEBHOOK_URL must be an https URL")
+		}
+	}
+
+	s := &slackSink{
+		webhookURL: webhookURL,
+		botToken:   botToken,
+		apiURL:     slackAPIURL,
+		channels:   make(map[string]string),
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+	channel := os.Getenv("SLACK_CHANNEL")
+	for eventType := range historyTypes {
+		s.channels[eventType] = getEnv("SLACK_CHANNEL_"+envSuffix(eventType), channel)
+		if botToken != "" && s.channels[eventType] == "" {
+			return nil, fmt.Errorf("SLACK_BOT_TOKEN requires SLACK_CHANNEL")
+		}
+	}
+	if s.templates, err = loadTemplates("SLACK_TEMPLATE", defaultSlackTemplate); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *slackSink) name() string {
+	return "slack"
+}
+
+func (s *slackSink) send(ctx context.Context, n notification) error {
+	text, err := s.templates.render(n)
+	if err != nil {
+		return err
+	}
+	msg := map[string]interface{}{"text": text}
+	if channel := s.channels[n.Type]; channel != "" {
+		msg["channel"] = channel
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if s.webhookURL != "" {
+		return postJSON(ctx, s.client, s.webhookURL, body, nil)
+	}
+	return s.postMessage(ctx, body)
+}
+
+// postMessage calls chat.postMessage. The Web API answers 200 even when it
+// rejects a message, with the reason in the body.
+func (s *slackSink) postMessage(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.apiURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+s.botToken)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{code: resp.StatusCode, message: fmt.Sprintf("status code %d", resp.StatusCode)}
+	}
+	var result struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("bad response from Slack: %w", err)
+	}
+	if !result.OK {
+		// Errors such as channel_not_found or invalid_auth will not go away
+		// on a retry.
+		return &statusError{code: http.StatusBadRequest, message: "slack rejected the message: " + result.Error}
+	}
+	return nil
+}
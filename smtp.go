@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSMTPSubject = "[vault-unsealer] {{.Type}}{{with .Vault}} {{.}}{{end}}"
+	defaultSMTPBody    = `{{.Message}}
+
+Event:    {{.Type}} ({{.Severity}})
+Time:     {{.Time.UTC.Format "2006-01-02 15:04:05 MST"}}
+{{with .Vault}}Vault:    {{.}}
+{{end}}{{with .Config}}Config:   {{.}}
+{{end}}{{with .RequestID}}Request:  {{.}}
+{{end}}Instance: {{.Instance}}
+`
+)
+
+// smtpSink sends notifications by email, for clusters that cannot reach any
+// chat or paging service.
+type smtpSink struct {
+	addr      string
+	host      string
+	mode      string
+	username  string
+	password  string
+	from      *mail.Address
+	to        []string
+	tlsConfig *tls.Config
+	selected  map[string]bool
+	subjects  messageTemplates
+	bodies    messageTemplates
+}
+
+func init() {
+	registerSink("smtp", singleSink(loadSMTPSink))
+}
+
+// loadSMTPSink reads the SMTP_* settings. It returns nil when SMTP_ADDR is
+// not set.
+func loadSMTPSink() (sink, error) {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return nil, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("SMTP_ADDR must be host:port: %w", err)
+	}
+	s := &smtpSink{
+		addr:      addr,
+		host:      host,
+		mode:      getEnv("SMTP_TLS", "starttls"),
+		username:  os.Getenv("SMTP_USERNAME"),
+		tlsConfig: &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12},
+	}
+	switch s.mode {
+	case "starttls", "tls", "none":
+	default:
+		return nil, fmt.Errorf("SMTP_TLS must be starttls, tls or none, got %q", s.mode)
+	}
+	if s.password, err = readSecretEnv("SMTP_PASSWORD"); err != nil {
+		return nil, err
+	}
+	if (s.username == "") != (s.password == "") {
+		return nil, fmt.Errorf("SMTP_USERNAME and SMTP_PASSWORD must be set together")
+	}
+	if s.username != "" && s.mode == "none" {
+		return nil, fmt.Errorf("SMTP_USERNAME requires SMTP_TLS starttls or tls")
+	}
+	if caFile := os.Getenv("SMTP_CA_FILE"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SMTP_CA_FILE: %w", err)
+		}
+		s.tlsConfig.RootCAs = x509.NewCertPool()
+		if !s.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("SMTP_CA_FILE contains no certificates")
+		}
+	}
+
+	from, err := mail.ParseAddress(os.Getenv("SMTP_FROM"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_FROM: %w", err)
+	}
+	s.from = from
+	to, err := mail.ParseAddressList(os.Getenv("SMTP_TO"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_TO: %w", err)
+	}
+	for _, a := range to {
+		s.to = append(s.to, a.Address)
+	}
+
+	if os.Getenv("SMTP_EVENTS") != "" {
+		if s.selected, err = eventTypesEnv("SMTP_EVENTS", ""); err != nil {
+			return nil, err
+		}
+	}
+	if s.subjects, err = loadTemplates("SMTP_SUBJECT_TEMPLATE", defaultSMTPSubject); err != nil {
+		return nil, err
+	}
+	if s.bodies, err = loadTemplates("SMTP_BODY_TEMPLATE", defaultSMTPBody); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *smtpSink) name() string {
+	return "smtp " + s.addr
+}
+
+func (s *smtpSink) events() map[string]bool {
+	return s.selected
+}
+
+func (s *smtpSink) send(ctx context.Context, n notification) error {
+	subject, err := s.subjects.render(n)
+	if err != nil {
+		return err
+	}
+	body, err := s.bodies.render(n)
+	if err != nil {
+		return err
+	}
+	// A template must not be able to add headers.
+	subject = strings.Join(strings.Fields(subject), " ")
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", s.from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+
+	return s.deliver(ctx, []byte(msg.String()))
+}
+
+func (s *smtpSink) deliver(ctx context.Context, msg []byte) error {
+	deadline := time.Now().Add(30 * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	dialer := &net.Dialer{Deadline: deadline}
+	var conn net.Conn
+	var err error
+	if s.mode == "tls" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: s.tlsConfig}).DialContext(ctx, "tcp", s.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", s.addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(deadline)
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if s.mode == "starttls" {
+		if err := c.StartTLS(s.tlsConfig); err != nil {
+			return fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+	if s.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.username, s.password, s.host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.from.Address); err != nil {
+		return err
+	}
+	for _, to := range s.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
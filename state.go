@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	roleActive      = "active"
+	roleStandby     = "standby"
+	roleDRSecondary = "dr_secondary"
+	rolePerfStandby = "perf_standby"
+
+	rolePerfStandbyWarning = "perf_standby_warning"
+)
+
+// Seal states shown by /status.
+const (
+	statusUnknown       = "unknown"
+	statusUnsealed      = "unsealed"
+	statusSealed        = "sealed"
+	statusUninitialized = "uninitialized"
+	statusUnreachable   = "unreachable"
+)
+
+var errNotInitialized = errors.New("vault is not initialized")
+
+// defaultHealthRoles maps the status codes returned by /v1/sys/health to node
+// roles. The health_codes option can add to or override these per vault.
+var defaultHealthRoles = map[int]string{
+	200: roleActive,
+	429: roleStandby,
+	472: roleDRSecondary,
+	473: rolePerfStandby,
+	474: rolePerfStandbyWarning,
+}
+
+// vaultState is what the unsealer last observed about a vault.
+type vaultState struct {
+	mu          sync.Mutex
+	status      string
+	role        string
+	bearerToken string
+	clientCert  *tls.Certificate
+	disabled    bool
+
+	failures  int
+	openUntil time.Time
+
+	resolved string
+
+	lastUnseal time.Time
+	lastError  string
+
+	// lastCheck is when the vault was last polled, sealType and version
+	// what it reported then.
+	lastCheck time.Time
+	sealType  string
+	version   string
+
+	// checkDuration is the round-trip time of seal status checks,
+	// unsealDuration the time from finding the vault sealed to a verified
+	// unseal.
+	checkDuration  *histogram
+	unsealDuration *histogram
+
+	// sealedSince is when the vault was first seen sealed, zero while it is
+	// unsealed. Becoming unreachable in between does not reset it.
+	sealedSince time.Time
+	unsealedAt  time.Time
+	sealEvents  int64
+	sealedTotal time.Duration
+
+	// sealTimes are the most recent seal events, kept for flap detection.
+	sealTimes []time.Time
+	flapping  bool
+}
+
+// sealHistory is what setStatus tracked about seal transitions.
+type sealHistory struct {
+	sealedSince time.Time
+	unsealedAt  time.Time
+	events      int64
+	sealedTotal time.Duration
+	flapping    bool
+}
+
+// setStatus records the seal state and returns the previous one. Every
+// change to sealed counts as a seal event, and every change back to unsealed
+// adds the time spent sealed.
+func (s *vaultState) setStatus(status string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.status
+	s.status = status
+
+	now := time.Now()
+	switch {
+	case status == statusSealed && s.sealedSince.IsZero():
+		s.sealedSince = now
+		s.sealEvents++
+		s.sealTimes = append(s.sealTimes, now)
+	case status == statusUnsealed && !s.sealedSince.IsZero():
+		s.sealedTotal += now.Sub(s.sealedSince)
+		s.sealedSince = time.Time{}
+		s.unsealedAt = now
+	}
+	return prev
+}
+
+func (s *vaultState) getSealHistory() sealHistory {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sealHistory{sealedSince: s.sealedSince, unsealedAt: s.unsealedAt, events: s.sealEvents, sealedTotal: s.sealedTotal, flapping: s.flapping}
+}
+
+func (s *vaultState) getStatus() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status == "" {
+		return statusUnknown
+	}
+	return s.status
+}
+
+// recordFailure counts a failed poll and reports whether it opened the
+// circuit. Once open, every further failure after the cooldown re-opens it.
+func (s *vaultState) recordFailure(threshold int, cooldown time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures++
+	if threshold <= 0 || s.failures < threshold {
+		return false
+	}
+	s.openUntil = time.Now().Add(cooldown)
+	return true
+}
+
+// recordSuccess resets the failure count and reports whether the circuit had
+// been opened before.
+func (s *vaultState) recordSuccess() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wasOpen := !s.openUntil.IsZero()
+	s.failures = 0
+	s.openUntil = time.Time{}
+	return wasOpen
+}
+
+func (s *vaultState) consecutiveFailures() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failures
+}
+
+func (s *vaultState) circuitOpenUntil() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.openUntil
+}
+
+// setLastUnseal records when this unsealer last completed an unseal.
+func (s *vaultState) setLastUnseal(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastUnseal = t
+}
+
+// setChecked records a poll of the vault, with the seal status it returned
+// if it answered.
+func (s *vaultState) setChecked(status *sealStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastCheck = time.Now()
+	if status != nil {
+		s.sealType = status.Type
+		s.version = status.Version
+	}
+}
+
+// setLastError records why the last poll failed, or clears it after a
+// successful one.
+func (s *vaultState) setLastError(msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError = msg
+}
+
+func (s *vaultState) getLastResult() (time.Time, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastUnseal, s.lastError
+}
+
+// setResolved records the addresses a vault host name resolved to and
+// returns the previous ones.
+func (s *vaultState) setResolved(addrs string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.resolved
+	s.resolved = addrs
+	return prev
+}
+
+// setRole records the role and returns the previous one.
+func (s *vaultState) setRole(role string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.role
+	s.role = role
+	return prev
+}
+
+func (s *vaultState) getRole() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.role
+}
+
+// setDisabled changes whether the vault is disabled and returns the previous
+// setting.
+func (s *vaultState) setDisabled(disabled bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := s.disabled
+	s.disabled = disabled
+	return prev
+}
+
+func (s *vaultState) isDisabled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.disabled
+}
+
+// holdReason returns why the unsealer leaves v alone while still polling it:
+// "disabled" or "paused". It is empty when the unsealer may act on v.
+func (u *Unsealer) holdReason(v *vaultConfig) string {
+	switch {
+	case v.state.isDisabled():
+		return "disabled"
+	case u.paused(v):
+		return "paused"
+	}
+	return ""
+}
+
+func (s *vaultState) setBearerToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bearerToken = token
+}
+
+func (s *vaultState) getBearerToken() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bearerToken
+}
+
+func (s *vaultState) setClientCert(cert *tls.Certificate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clientCert = cert
+}
+
+// getClientCert returns the loaded client certificate, or an empty one when
+// none could be loaded so the handshake continues without a certificate.
+func (s *vaultState) getClientCert() *tls.Certificate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clientCert == nil {
+		return &tls.Certificate{}
+	}
+	return s.clientCert
+}
+
+func (u *Unsealer) updateRole(ctx context.Context, v *vaultConfig) {
+	role, err := v.api.role(ctx)
+	if err != nil {
+		u.logger.Debug("failed to determine vault role", "vault", v.addr, "error", err)
+		return
+	}
+	if prev := v.state.setRole(role); prev != role {
+		u.logger.Info("vault role detected", "vault", v.addr, "role", role, "previous_role", prev)
+	}
+}
+
+// rolePolicyAllows applies the per-role policy to a sealed vault and reports
+// whether keys may be submitted.
+func (u *Unsealer) rolePolicyAllows(v *vaultConfig) bool {
+	role := v.state.getRole()
+	switch v.rolePolicy(role) {
+	case "skip":
+		atomic.AddInt64(&u.roleSkips, 1)
+		u.logger.Info("sealed vault skipped by role policy", "vault", v.addr, "role", role)
+		return false
+	case "alert":
+		atomic.AddInt64(&u.roleAlerts, 1)
+		u.logger.Error("sealed vault needs operator attention, not unsealing", "vault", v.addr, "role", role)
+		return false
+	}
+	return true
+}
+
+// reportUninitialized logs a vault that is not initialized and has no
+// auto-init, once per transition into that state.
+func (u *Unsealer) reportUninitialized(v *vaultConfig) {
+	if v.state.setStatus(statusUninitialized) == statusUninitialized {
+		return
+	}
+	if v.uninitPolicy == "alert" {
+		atomic.AddInt64(&u.uninitAlerts, 1)
+		u.logger.Error("vault is not initialized and needs operator attention", "vault", v.addr)
+		return
+	}
+	u.logger.Warn("vault is not initialized, skipping", "vault", v.addr)
+}
+
+// applyCodeActions checks the health endpoint first for vaults with a
+// status_codes map and reports whether that already settled this poll. Codes
+// without an action, and the "sealed" action, continue with the seal-status
+// check.
+func (u *Unsealer) applyCodeActions(ctx context.Context, v *vaultConfig) (bool, error) {
+	code, err := healthStatusCode(ctx, v)
+	v.state.setChecked(nil)
+	if err != nil {
+		v.state.setStatus(statusUnreachable)
+		return true, err
+	}
+
+	switch v.codeActions[code] {
+	case "healthy":
+		v.state.setStatus(statusUnsealed)
+		if role, ok := v.healthRoleFor(code); ok {
+			v.state.setRole(role)
+		}
+		return true, nil
+	case "skip":
+		u.logger.Debug("skipping vault by status code", "vault", v.addr, "status", code)
+		return true, nil
+	case "error":
+		return true, fmt.Errorf("health check returned status code %d", code)
+	}
+	return false, nil
+}
+
+func (u *Unsealer) countStatus(status string) int64 {
+	var n int64
+	for _, v := range u.vaultList() {
+		if v.state.getStatus() == status {
+			n++
+		}
+	}
+	return n
+}
+
+func (u *Unsealer) countOpenCircuits() int64 {
+	var n int64
+	for _, v := range u.vaultList() {
+		if time.Now().Before(v.state.circuitOpenUntil()) {
+			n++
+		}
+	}
+	return n
+}
+
+func (u *Unsealer) countRole(role string) int64 {
+	var n int64
+	for _, v := range u.vaultList() {
+		if v.state.getRole() == role {
+			n++
+		}
+	}
+	return n
+}
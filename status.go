@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// vaultStatus is the /status entry of one vault. Times are omitted when the
+// event has not happened yet.
+type vaultStatus struct {
+	Address             string     `json:"address"`
+	Config              string     `json:"config,omitempty"`
+	State               string     `json:"state"`
+	Role                string     `json:"role,omitempty"`
+	SealType            string     `json:"seal_type,omitempty"`
+	Version             string     `json:"version,omitempty"`
+	LastCheck           *time.Time `json:"last_check,omitempty"`
+	LastUnseal          *time.Time `json:"last_unseal,omitempty"`
+	SealedSince         *time.Time `json:"sealed_since,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	CircuitOpenUntil    *time.Time `json:"circuit_open_until,omitempty"`
+	Flapping            bool       `json:"flapping,omitempty"`
+	Disabled            bool       `json:"disabled,omitempty"`
+	Paused              bool       `json:"paused,omitempty"`
+	KeyState            string     `json:"key_state"`
+	KeyAgeSeconds       int64      `json:"key_age_seconds"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// report describes the vault as last observed. The caller adds the address
+// and the key state, which in operator mode differs per resource.
+func (s *vaultState) report() vaultStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := vaultStatus{
+		State:               s.status,
+		Role:                s.role,
+		SealType:            s.sealType,
+		Version:             s.version,
+		LastCheck:           optionalTime(s.lastCheck),
+		LastUnseal:          optionalTime(s.lastUnseal),
+		SealedSince:         optionalTime(s.sealedSince),
+		LastError:           s.lastError,
+		ConsecutiveFailures: s.failures,
+		Flapping:            s.flapping,
+		Disabled:            s.disabled,
+	}
+	if st.State == "" {
+		st.State = statusUnknown
+	}
+	if time.Now().Before(s.openUntil) {
+		st.CircuitOpenUntil = optionalTime(s.openUntil)
+	}
+	return st
+}
+
+func (u *Unsealer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	vaults := []vaultStatus{}
+	for _, c := range u.clusterUnsealers() {
+		keyState, keyAge := c.keyState()
+		for _, v := range c.vaultList() {
+			st := v.state.report()
+			st.Address = v.addr
+			st.Config = c.shardKey
+			st.KeyState = keyState
+			st.KeyAgeSeconds = int64(keyAge.Seconds())
+			st.Paused = c.paused(v)
+			vaults = append(vaults, st)
+		}
+	}
+	sort.SliceStable(vaults, func(i, j int) bool {
+		if vaults[i].Config != vaults[j].Config {
+			return vaults[i].Config < vaults[j].Config
+		}
+		return vaults[i].Address < vaults[j].Address
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"vaults": vaults})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// stateStore keeps runtime state changed through the admin API, such as the
+// pause state, as JSON so that it survives restarts.
+type stateStore interface {
+	// load decodes the stored state into v. It leaves v alone when nothing
+	// is stored yet.
+	load(ctx context.Context, v interface{}) error
+	save(ctx context.Context, v interface{}) error
+}
+
+// newStateStore returns the store that <name>_FILE or <name>_CONFIGMAP
+// configures, or nil when neither is set. key is the ConfigMap key to use, so
+// that several kinds of state can share one ConfigMap.
+func newStateStore(name, key string) (stateStore, error) {
+	file, configMap := os.Getenv(name+"_FILE"), os.Getenv(name+"_CONFIGMAP")
+	switch {
+	case file != "" && configMap != "":
+		return nil, fmt.Errorf("%s_FILE and %s_CONFIGMAP cannot both be set", name, name)
+	case file != "":
+		return &fileStore{path: file}, nil
+	case configMap != "":
+		kube, err := newKubeClient()
+		if err != nil {
+			return nil, fmt.Errorf("%s_CONFIGMAP: %w", name, err)
+		}
+		return &configMapStore{kube: kube, name: configMap, key: key}, nil
+	}
+	return nil, nil
+}
+
+// fileStore keeps the state in a JSON file, such as on a persistent volume.
+type fileStore struct {
+	path string
+}
+
+func (s *fileStore) load(ctx context.Context, v interface{}) error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("invalid %s: %w", s.path, err)
+	}
+	return nil
+}
+
+// save replaces the file through a rename, so a crash never leaves half a
+// file behind.
+func (s *fileStore) save(ctx context.Context, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".state-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// configMapStore keeps the state in one key of a ConfigMap in the unsealer's
+// namespace, which every replica reads.
+type configMapStore struct {
+	kube *kubeClient
+	name string
+	key  string
+}
+
+type stateConfigMap struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   objectMeta        `json:"metadata"`
+	Data       map[string]string `json:"data"`
+}
+
+type objectMeta struct {
+	Name            string `json:"name"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+func (s *configMapStore) path() string {
+	return "/api/v1/namespaces/" + url.PathEscape(s.kube.namespace) + "/configmaps"
+}
+
+func (s *configMapStore) get(ctx context.Context) (*stateConfigMap, error) {
+	var cm stateConfigMap
+	err := s.kube.get(ctx, s.path()+"/"+url.PathEscape(s.name), &cm)
+	if isKubeStatus(err, http.StatusNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configmap %s: %w", s.name, err)
+	}
+	return &cm, nil
+}
+
+func (s *configMapStore) load(ctx context.Context, v interface{}) error {
+	cm, err := s.get(ctx)
+	if err != nil || cm == nil || cm.Data[s.key] == "" {
+		return err
+	}
+	if err := json.Unmarshal([]byte(cm.Data[s.key]), v); err != nil {
+		return fmt.Errorf("invalid %s in configmap %s: %w", s.key, s.name, err)
+	}
+	return nil
+}
+
+// save creates the ConfigMap or replaces its key, leaving the others alone.
+// Replacing it with the resource version just read fails if another replica
+// wrote in between.
+func (s *configMapStore) save(ctx context.Context, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	cm, err := s.get(ctx)
+	if err != nil {
+		return err
+	}
+	if cm == nil {
+		cm = &stateConfigMap{APIVersion: "v1", Kind: "ConfigMap", Metadata: objectMeta{Name: s.name}}
+		cm.Data = map[string]string{s.key: string(data)}
+		return s.kube.do(ctx, "POST", s.path(), "application/json", cm, nil)
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[s.key] = string(data)
+	return s.kube.do(ctx, "PUT", s.path()+"/"+url.PathEscape(s.name), "application/json", cm, nil)
+}
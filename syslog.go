@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogWriter sends every log line as an RFC 5424 message, with the
+// severity taken from the hclog level. Stream connections use octet-counting
+// framing (RFC 6587).
+type syslogWriter struct {
+	network  string
+	address  string
+	facility int
+	appName  string
+	hostname string
+	echo     *os.File
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// newSyslogWriter connects to addr, which is udp://host:port, tcp://host:port
+// or unix:///path, or the local syslog socket when empty. With echo set every
+// line is also written there.
+func newSyslogWriter(addr, facility, appName string, echo *os.File) (*syslogWriter, error) {
+	fac, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	w := &syslogWriter{facility: fac, appName: appName, hostname: hostname, echo: echo}
+
+	if addr == "" {
+		for _, path := range []string{"/dev/log", "/var/run/syslog", "/var/run/log"} {
+			if _, err := os.Stat(path); err == nil {
+				w.network, w.address = "unixgram", path
+				break
+			}
+		}
+		if w.network == "" {
+			return nil, fmt.Errorf("no local syslog socket found, set SYSLOG_ADDR")
+		}
+	} else {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SYSLOG_ADDR: %w", err)
+		}
+		switch u.Scheme {
+		case "udp", "tcp":
+			w.network, w.address = u.Scheme, u.Host
+		case "unix":
+			w.network, w.address = "unixgram", u.Path
+		default:
+			return nil, fmt.Errorf("SYSLOG_ADDR must start with udp://, tcp:// or unix://, got %q", addr)
+		}
+	}
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *syslogWriter) connect() error {
+	conn, err := net.DialTimeout(w.network, w.address, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to connect to syslog at %s: %w", w.address, err)
+	}
+	w.conn = conn
+	return nil
+}
+
+func syslogSeverity(level hclog.Level) int {
+	switch level {
+	case hclog.Error:
+		return 3
+	case hclog.Warn:
+		return 4
+	case hclog.Info:
+		return 6
+	default:
+		return 7
+	}
+}
+
+func (w *syslogWriter) Write(p []byte) (int, error) {
+	return w.LevelWrite(hclog.Info, p)
+}
+
+// LevelWrite implements hclog.LevelWriter. A failed send is retried once on
+// a new connection, so a restarted syslog daemon does not lose the logs for
+// good.
+func (w *syslogWriter) LevelWrite(level hclog.Level, p []byte) (int, error) {
+	if w.echo != nil {
+		w.echo.Write(p)
+	}
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		w.facility*8+syslogSeverity(level),
+		time.Now().UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		w.hostname, w.appName, os.Getpid(),
+		strings.TrimRight(string(p), "\n"))
+	if w.network == "tcp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.conn.Write([]byte(msg))
+	if err != nil {
+		w.conn.Close()
+		if err = w.connect(); err == nil {
+			_, err = w.conn.Write([]byte(msg))
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
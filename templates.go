@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// templateFuncs are available in notification templates.
+var templateFuncs = template.FuncMap{
+	"emoji": func(severity string) string {
+		switch severity {
+		case severityCritical:
+			return ":fire:"
+		case severityError:
+			return ":rotating_light:"
+		case severityWarning:
+			return ":warning:"
+		}
+		return ":white_check_mark:"
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	// host returns the host name of a vault address, such as vault-2 for
+	// https://vault-2.vault-internal:8200.
+	"host": func(addr string) string {
+		u, err := url.Parse(addr)
+		if err != nil || u.Hostname() == "" {
+			return addr
+		}
+		return strings.SplitN(u.Hostname(), ".", 2)[0]
+	},
+	// json quotes a value for use in a JSON payload.
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"default": func(def, value interface{}) interface{} {
+		if value == nil || value == "" || value == time.Duration(0) {
+			return def
+		}
+		return value
+	},
+	"round": func(d time.Duration) time.Duration {
+		return d.Round(time.Millisecond)
+	},
+}
+
+// messageTemplates holds a sink's template for every event type.
+type messageTemplates map[string]*template.Template
+
+// loadTemplates reads the template in prefix and its per-event overrides in
+// prefix_<EVENT_TYPE>, such as SLACK_TEMPLATE_UNSEAL_FAILED, falling back
+// to def. Each of them can also be read from a file named by the variable
+// with a _FILE suffix.
+func loadTemplates(prefix, def string) (messageTemplates, error) {
+	text, err := readSecretEnv(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if text == "" {
+		text = def
+	}
+	base, err := parseTemplate(prefix, text)
+	if err != nil {
+		return nil, err
+	}
+	t := messageTemplates{}
+	for eventType := range historyTypes {
+		name := prefix + "_" + envSuffix(eventType)
+		t[eventType] = base
+		text, err := readSecretEnv(name)
+		if err != nil {
+			return nil, err
+		}
+		if text != "" {
+			if t[eventType], err = parseTemplate(name, text); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return t, nil
+}
+
+func parseTemplate(name, text string) (*template.Template, error) {
+	t, err := template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return t, nil
+}
+
+func (t messageTemplates) render(n notification) (string, error) {
+	var b strings.Builder
+	if err := t[n.Type].Execute(&b, n); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
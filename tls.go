@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// tlsPolicy holds the protocol settings applied to both the vault clients and
+// the health server.
+type tlsPolicy struct {
+	minVersion   uint16
+	cipherSuites []uint16
+	curves       []tls.CurveID
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// loadTLSPolicy reads TLS_MIN_VERSION, TLS_CIPHER_SUITES and TLS_CURVES.
+func loadTLSPolicy() (*tlsPolicy, error) {
+	p := &tlsPolicy{}
+
+	switch version := getEnv("TLS_MIN_VERSION", "1.2"); version {
+	case "1.2":
+		p.minVersion = tls.VersionTLS12
+	case "1.3":
+		p.minVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("TLS_MIN_VERSION must be 1.2 or 1.3, got %q", version)
+	}
+
+	for _, name := range splitList(os.Getenv("TLS_CIPHER_SUITES")) {
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return nil, fmt.Errorf("TLS_CIPHER_SUITES: unknown or insecure cipher suite %q", name)
+		}
+		p.cipherSuites = append(p.cipherSuites, id)
+	}
+
+	for _, name := range splitList(os.Getenv("TLS_CURVES")) {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("TLS_CURVES: unknown curve %q", name)
+		}
+		p.curves = append(p.curves, id)
+	}
+	return p, nil
+}
+
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+func splitList(raw string) []string {
+	var items []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (p *tlsPolicy) apply(c *tls.Config) {
+	c.MinVersion = p.minVersion
+	c.CipherSuites = p.cipherSuites
+	c.CurvePreferences = p.curves
+}
+
+// newVaultClient builds the HTTP client for a single vault from its TLS and
+// proxy options, so an insecure lab vault does not weaken the others.
+func newVaultClient(v *vaultConfig, policy *tlsPolicy) (*http.Client, error) {
+	var caPEM []byte
+	if v.caCert != "" {
+		var err error
+		if caPEM, err = readCACert(v.caCert); err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+	}
+	base, err := newVaultTransport(v, policy, caPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Timeout:   v.timeout,
+		Transport: &headerTransport{v: v, base: base, policy: policy, caPEM: caPEM},
+	}, nil
+}
+
+// newVaultTransport builds the transport underneath a vault client. It is
+// rebuilt when the CA bundle changes.
+func newVaultTransport(v *vaultConfig, policy *tlsPolicy, caPEM []byte) (*http.Transport, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: !v.verifyCert,
+		ServerName:         v.serverName,
+	}
+	policy.apply(tlsConfig)
+	if caPEM != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", v.caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if v.tlsFingerprint != nil {
+		// VerifyConnection also runs when verify_cert=false, so a pinned
+		// self-signed vault is still protected against impostors.
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("vault presented no certificate")
+			}
+			sum := sha256.Sum256(cs.PeerCertificates[0].Raw)
+			if !bytes.Equal(sum[:], v.tlsFingerprint) {
+				return fmt.Errorf("vault certificate fingerprint %x does not match the pinned fingerprint", sum)
+			}
+			return nil
+		}
+	}
+	if v.clientCert != "" {
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return v.state.getClientCert(), nil
+		}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	switch v.proxy {
+	case "":
+	case "direct":
+		proxy = nil
+	default:
+		proxyURL, err := url.Parse(v.proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %w", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Transport{
+		Proxy:                 proxy,
+		TLSHandshakeTimeout:   v.tlsHandshakeTimeout,
+		ResponseHeaderTimeout: v.responseHeaderTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}, nil
+}
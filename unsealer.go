@@ -3,59 +3,318 @@ package main
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
-	sdk "github.com/bitwarden/sdk-go"
 	"github.com/hashicorp/go-hclog"
 )
 
 type Unsealer struct {
 	logger       hclog.Logger
-	client       *http.Client
-	bw           sdk.BitwardenClientInterface
+	providerMu   sync.RWMutex
+	provider     keyProvider
+	newProvider  func() (keyProvider, error)
 	keys         []string
 	keysMu       sync.RWMutex
-	vaults       []string
+	keysInvalid  bool
+	keysLoadedAt time.Time
+	vaults       []*vaultConfig
 	attempts     int64
 	successes    int64
 	failures     int64
+	keyChanges   int64
 	working      sync.Map
 	wg           sync.WaitGroup
-	orgID        string
-	token        string
-	apiURL       string
-	identityURL  string
 	healthServer *http.Server
+
+	keyChangeWebhook string
+	keyMaxStaleness  time.Duration
+	keyStalePolicy   string
+
+	// pollInterval and readyMaxPollAge decide when /ready reports the poll
+	// loop as wedged. lastPoll is the start of the last unseal cycle in Unix
+	// nanoseconds.
+	pollInterval    time.Duration
+	readyMaxPollAge time.Duration
+	lastPoll        int64
+
+	// flap is when repeated seals count as flapping.
+	flap flapPolicy
+
+	// lastRefresh is when the key refresh loop last finished a fetch, zero
+	// if this unsealer has no refresh loop.
+	lastRefresh int64
+	watchdog    *watchdog
+
+	keyRefreshInterval time.Duration
+	refreshNow         chan struct{}
+	unsealNow          chan string
+	// unsealVaultNow takes the vaults to unseal outside the poll cycle.
+	unsealVaultNow chan *vaultConfig
+
+	autoSealSkips int64
+	roleSkips     int64
+	roleAlerts    int64
+
+	initMu          sync.Mutex
+	initThreshold   int
+	initRefused     map[string]bool
+	rootTokenPolicy string
+	rootTokenSecret string
+	rootTokenFile   string
+	pendingRevoke   sync.Map
+
+	invalidKeyMu        sync.Mutex
+	invalidKeyRefreshes int64
+	uninitAlerts        int64
+	raftJoins           int64
+	verifyFailures      int64
+	identityMismatches  int64
+
+	circuitOpens int64
+	circuitSkips int64
+	dnsChanges   int64
+	caReloads    int64
+
+	drainDetections int64
+
+	keyFetchDuration *histogram
+	notifier         *notifier
+	// keyFetchFailures counts key fetches failed since the last success,
+	// lastKeyFetch is the Unix nanoseconds of that success and
+	// retiredRelogins the logins of providers replaced by the watchdog.
+	keyFetchFailures int64
+	lastKeyFetch     int64
+	retiredRelogins  int64
+	history          *eventHistory
+	auditLog         *auditLog
+
+	keyUsesMu sync.Mutex
+	keyUses   map[int]int64
+
+	// failureReasons counts failed unseal runs by failureReason.
+	failureReasonsMu sync.Mutex
+	failureReasons   map[string]int64
+
+	vaultsMu      sync.RWMutex
+	staticVaults  []*vaultConfig
+	registered    []registeredVault
+	registry      *vaultRegistry
+	vaultDefaults vaultConfig
+	discoverer    discoverer
+	operator      *operator
+	leader        *leaderElector
+	shards        *shardMembership
+	shardKey      string
+	events        *eventRecorder
+	eventRef      *objectRef
+
+	tlsPolicy        *tlsPolicy
+	caReloadInterval time.Duration
+	healthTLS        *healthTLS
+	healthAuth       *endpointAuth
+	dashboard        bool
+	adminAPI         bool
+	adminAuth        *adminAuth
+	pauses           *pauses
 }
 
 func main() {
 	log := hclog.New(&hclog.LoggerOptions{Name: "vault-unsealer", Level: hclog.Info})
+	switch output := getEnv("LOG_OUTPUT", "stderr"); output {
+	case "stderr":
+	case "syslog", "both":
+		var echo *os.File
+		if output == "both" {
+			echo = os.Stderr
+		}
+		w, err := newSyslogWriter(os.Getenv("SYSLOG_ADDR"), getEnv("SYSLOG_FACILITY", "daemon"), getEnv("SYSLOG_APP_NAME", "vault-unsealer"), echo)
+		if err != nil {
+			log.Error("syslog init failed", "error", err)
+			os.Exit(1)
+		}
+		// The syslog header carries the time already.
+		log = hclog.New(&hclog.LoggerOptions{Name: "vault-unsealer", Level: hclog.Info, Output: w, DisableTime: echo == nil})
+	default:
+		log.Error("LOG_OUTPUT must be stderr, syslog or both", "value", output)
+		os.Exit(1)
+	}
+	logLevel, err := parseLogLevel(getEnv("LOG_LEVEL", "info"))
+	if err != nil {
+		log.Error("invalid LOG_LEVEL", "error", err)
+		os.Exit(1)
+	}
+	log.SetLevel(logLevel)
+	logDebugTimeout, err := time.ParseDuration(getEnv("LOG_DEBUG_TIMEOUT", "15m"))
+	if err != nil || logDebugTimeout < 0 {
+		log.Error("invalid LOG_DEBUG_TIMEOUT", "value", os.Getenv("LOG_DEBUG_TIMEOUT"))
+		os.Exit(1)
+	}
+	levels := newLogLevelControl(log, logLevel, logDebugTimeout)
+
+	if len(os.Args) > 1 && os.Args[1] == "version" {
+		fmt.Println(getBuildInfo())
+		os.Exit(0)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rekey" {
+		os.Exit(runRekey(log, os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "audit-verify" {
+		os.Exit(runAuditVerify(os.Args[2:]))
+	}
+
+	build := getBuildInfo()
+	log.Info("vault-unsealer starting", "version", build.Version, "commit", build.Commit, "build_date", build.BuildDate, "go_version", build.GoVersion)
 
-	vaultsRaw := strings.Split(getEnvRequired("VAULT_URLS"), ",")
-	vaults := make([]string, 0, len(vaultsRaw))
-	for _, v := range vaultsRaw {
-		if trimmed := strings.TrimSpace(v); trimmed != "" {
-			vaults = append(vaults, trimmed)
+	vaultDefaults, err := loadVaultDefaults()
+	if err != nil {
+		log.Error("invalid vault defaults", "error", err)
+		os.Exit(1)
+	}
+	if readyURL := getEnv("MESH_READY_URL", meshReadyURLs[vaultDefaults.mesh]); readyURL != "" {
+		timeout, err := time.ParseDuration(getEnv("MESH_READY_TIMEOUT", "2m"))
+		if err != nil || timeout <= 0 {
+			log.Error("invalid MESH_READY_TIMEOUT", "value", os.Getenv("MESH_READY_TIMEOUT"))
+			os.Exit(1)
 		}
+		waitForMesh(context.Background(), log, readyURL, timeout)
 	}
-	if len(vaults) == 0 {
+	operatorMode := getEnv("OPERATOR_MODE", "false") == "true"
+	discoveryMode := getEnv("VAULT_DISCOVERY", "")
+	vaultURLs := getEnv("VAULT_URLS", "")
+	if operatorMode && (vaultURLs != "" || discoveryMode != "") {
+		log.Error("OPERATOR_MODE cannot be combined with VAULT_URLS or VAULT_DISCOVERY")
+		os.Exit(1)
+	}
+	// With the admin API, all vaults may be registered at runtime.
+	adminAPI := getEnv("ADMIN_API", "false") == "true"
+	if discoveryMode == "" && !operatorMode && !adminAPI {
+		vaultURLs = getEnvRequired("VAULT_URLS")
+	}
+	vaults, err := parseVaults(vaultURLs, vaultDefaults)
+	if err != nil {
+		log.Error("invalid VAULT_URLS", "error", err)
+		os.Exit(1)
+	}
+	if len(vaults) == 0 && discoveryMode == "" && !operatorMode && !adminAPI {
 		log.Error("no valid vault URLs provided")
 		os.Exit(1)
 	}
-	orgID := getEnvRequired("ORGANIZATION_ID")
-	token := getEnvRequired("ACCESS_TOKEN")
-	apiURL := getEnv("API_URL", "")
-	identityURL := getEnv("IDENTITY_URL", "")
+	disc, err := newDiscoverer(discoveryMode)
+	if err != nil {
+		log.Error("vault discovery init failed", "error", err)
+		os.Exit(1)
+	}
+	var watchers []*podWatcher
+	if getEnv("VAULT_POD_WATCH", "false") == "true" {
+		if watchers, err = newPodWatchers(); err != nil {
+			log.Error("vault pod watch init failed", "error", err)
+			os.Exit(1)
+		}
+	}
+	var drain *drainWatcher
+	drainCheckInt, drainFastInt := 15*time.Second, 5*time.Second
+	if getEnv("DRAIN_WATCH", "false") == "true" {
+		if operatorMode {
+			log.Error("DRAIN_WATCH is not supported in OPERATOR_MODE")
+			os.Exit(1)
+		}
+		if drain, err = newDrainWatcher(log); err != nil {
+			log.Error("drain watch init failed", "error", err)
+			os.Exit(1)
+		}
+		drainCheckInt, err = time.ParseDuration(getEnv("DRAIN_CHECK_INTERVAL", "15s"))
+		if err != nil || drainCheckInt < time.Second {
+			log.Error("DRAIN_CHECK_INTERVAL must be a duration of at least 1s", "value", os.Getenv("DRAIN_CHECK_INTERVAL"))
+			os.Exit(1)
+		}
+		drainFastInt, err = time.ParseDuration(getEnv("DRAIN_FAST_POLL_INTERVAL", "5s"))
+		if err != nil || drainFastInt < time.Second {
+			log.Error("DRAIN_FAST_POLL_INTERVAL must be a duration of at least 1s", "value", os.Getenv("DRAIN_FAST_POLL_INTERVAL"))
+			os.Exit(1)
+		}
+	}
+	exporters, err := newMetricsExporters()
+	if err != nil {
+		log.Error("metrics export init failed", "error", err)
+		os.Exit(1)
+	}
+	pushInt, err := time.ParseDuration(getEnv("METRICS_PUSH_INTERVAL", "10s"))
+	if err != nil || pushInt < time.Second {
+		log.Error("METRICS_PUSH_INTERVAL must be a duration of at least 1s", "value", os.Getenv("METRICS_PUSH_INTERVAL"))
+		os.Exit(1)
+	}
+	heartbeat, err := newHeartbeat()
+	if err != nil {
+		log.Error("invalid heartbeat settings", "error", err)
+		os.Exit(1)
+	}
+	pauses, err := newPauses(log)
+	if err != nil {
+		log.Error("invalid pause settings", "error", err)
+		os.Exit(1)
+	}
+	var registry *vaultRegistry
+	if !operatorMode {
+		if registry, err = newVaultRegistry(); err != nil {
+			log.Error("invalid vault registry settings", "error", err)
+			os.Exit(1)
+		}
+	}
+	dnsRefreshInt, err := time.ParseDuration(getEnv("DNS_REFRESH_INTERVAL", "5m"))
+	if err != nil || dnsRefreshInt < 0 {
+		log.Warn("invalid DNS_REFRESH_INTERVAL, defaulting to 5m", "value", os.Getenv("DNS_REFRESH_INTERVAL"))
+		dnsRefreshInt = 5 * time.Minute
+	}
+	caReloadInt, err := time.ParseDuration(getEnv("CA_RELOAD_INTERVAL", "1m"))
+	if err != nil || caReloadInt < 0 {
+		log.Warn("invalid CA_RELOAD_INTERVAL, defaulting to 1m", "value", os.Getenv("CA_RELOAD_INTERVAL"))
+		caReloadInt = time.Minute
+	}
+	discoveryInt, err := time.ParseDuration(getEnv("DISCOVERY_INTERVAL", "30s"))
+	if err != nil || discoveryInt < 5*time.Second {
+		log.Warn("invalid DISCOVERY_INTERVAL, defaulting to 30s", "value", os.Getenv("DISCOVERY_INTERVAL"))
+		discoveryInt = 30 * time.Second
+	}
+	operatorInt, err := time.ParseDuration(getEnv("OPERATOR_RESYNC_INTERVAL", "30s"))
+	if err != nil || operatorInt < 5*time.Second {
+		log.Warn("invalid OPERATOR_RESYNC_INTERVAL, defaulting to 30s", "value", os.Getenv("OPERATOR_RESYNC_INTERVAL"))
+		operatorInt = 30 * time.Second
+	}
+
+	// In operator mode every VaultUnsealConfig brings its own key references,
+	// so there is no global provider.
+	var provider keyProvider
+	if !operatorMode {
+		provider, err = newKeyProvider(log)
+		if err != nil {
+			log.Error("key provider init failed", "error", err)
+			os.Exit(1)
+		}
+		credentialChecks := vaults
+		if disc != nil {
+			credentialChecks = append(credentialChecks, &vaultDefaults)
+		}
+		if err := checkVaultCredentials(credentialChecks, provider); err != nil {
+			log.Error("vault credential configuration failed", "error", err)
+			os.Exit(1)
+		}
+	}
 
 	pollIntStr := getEnv("POLL_INTERVAL", "60s")
 	pollInt, err := time.ParseDuration(pollIntStr)
@@ -68,49 +327,311 @@ func main() {
 		pollInt = time.Second
 	}
 
-	verifyCert := getEnv("VERIFY_CERT", "true") == "true"
+	refreshIntStr := getEnv("KEY_REFRESH_INTERVAL", "1h")
+	refreshInt, err := time.ParseDuration(refreshIntStr)
+	if err != nil {
+		log.Warn("invalid KEY_REFRESH_INTERVAL, defaulting to 1h", "error", err)
+		refreshInt = time.Hour
+	}
+	if refreshInt < 10*time.Second {
+		log.Warn("KEY_REFRESH_INTERVAL too short, enforcing 10s minimum")
+		refreshInt = 10 * time.Second
+	}
 
-	u := &Unsealer{
-		logger:      log,
-		vaults:      vaults,
-		orgID:       orgID,
-		token:       token,
-		apiURL:      apiURL,
-		identityURL: identityURL,
-		client: &http.Client{
-			Timeout: 30 * time.Second,
-			Transport: &http.Transport{
-				TLSHandshakeTimeout:   10 * time.Second,
-				ResponseHeaderTimeout: 10 * time.Second,
-				IdleConnTimeout:       90 * time.Second,
-				TLSClientConfig:       &tls.Config{InsecureSkipVerify: !verifyCert},
-			},
-		},
-	}
-
-	if err := u.initBitwardenClient(); err != nil {
-		log.Error("bitwarden init failed", "error", err)
+	initThreshold, err := strconv.Atoi(getEnv("AUTO_INIT_THRESHOLD", "3"))
+	if err != nil || initThreshold < 1 {
+		log.Warn("invalid AUTO_INIT_THRESHOLD, defaulting to 3", "value", os.Getenv("AUTO_INIT_THRESHOLD"))
+		initThreshold = 3
+	}
+
+	rootTokenPolicy := getEnv("ROOT_TOKEN_POLICY", "discard")
+	switch rootTokenPolicy {
+	case "discard", "print", "revoke":
+	case "store":
+		if os.Getenv("ROOT_TOKEN_SECRET_ID") == "" {
+			log.Error("ROOT_TOKEN_POLICY=store requires ROOT_TOKEN_SECRET_ID")
+			os.Exit(1)
+		}
+		if _, ok := provider.(secretStore); !ok && !operatorMode {
+			log.Error("ROOT_TOKEN_POLICY=store is not supported by the key provider")
+			os.Exit(1)
+		}
+	default:
+		log.Error("invalid ROOT_TOKEN_POLICY", "value", rootTokenPolicy)
 		os.Exit(1)
 	}
 
-	if err := u.fetchKeys(); err != nil {
-		log.Error("failed to fetch keys", "error", err)
+	var keyMaxStaleness time.Duration
+	if v := getEnv("KEY_MAX_STALENESS", ""); v != "" {
+		keyMaxStaleness, err = time.ParseDuration(v)
+		if err != nil || keyMaxStaleness < 0 {
+			log.Warn("invalid KEY_MAX_STALENESS, staleness checks disabled", "value", v)
+			keyMaxStaleness = 0
+		}
+	}
+	var readyMaxPollAge time.Duration
+	if v := getEnv("READY_MAX_POLL_AGE", ""); v != "" {
+		readyMaxPollAge, err = time.ParseDuration(v)
+		if err != nil || readyMaxPollAge < 0 {
+			log.Error("invalid READY_MAX_POLL_AGE", "value", v)
+			os.Exit(1)
+		}
+	}
+	var flap flapPolicy
+	if flap.threshold, err = strconv.Atoi(getEnv("FLAP_THRESHOLD", "3")); err != nil || flap.threshold < 0 {
+		log.Error("FLAP_THRESHOLD must be a non-negative number", "value", os.Getenv("FLAP_THRESHOLD"))
+		os.Exit(1)
+	}
+	if flap.window, err = time.ParseDuration(getEnv("FLAP_WINDOW", "10m")); err != nil || flap.window <= 0 {
+		log.Error("invalid FLAP_WINDOW", "value", os.Getenv("FLAP_WINDOW"))
+		os.Exit(1)
+	}
+	keyStalePolicy := getEnv("KEY_STALE_POLICY", "unready")
+	if keyStalePolicy != "unready" && keyStalePolicy != "refuse" {
+		log.Warn("invalid KEY_STALE_POLICY, defaulting to unready", "value", keyStalePolicy)
+		keyStalePolicy = "unready"
+	}
+
+	policy, err := loadTLSPolicy()
+	if err != nil {
+		log.Error("invalid TLS settings", "error", err)
+		os.Exit(1)
+	}
+	healthServerTLS, err := loadHealthTLS(policy)
+	if err != nil {
+		log.Error("invalid health server TLS settings", "error", err)
+		os.Exit(1)
+	}
+	healthAuth, err := loadEndpointAuth()
+	if err != nil {
+		log.Error("invalid health server auth settings", "error", err)
+		os.Exit(1)
+	}
+	var adminAuthn *adminAuth
+	if adminAPI {
+		if adminAuthn, err = loadAdminAuth(healthServerTLS, log); err != nil {
+			log.Error("invalid admin API auth settings", "error", err)
+			os.Exit(1)
+		}
+		if healthAuth != nil {
+			healthAuth.admin = adminAuthn
+		}
+		if adminAuthn.defaultRole == roleOperator && !healthAuth.hasCredentials() && !healthServerTLS.verifiesClients() {
+			log.Error("ADMIN_DEFAULT_ROLE=operator requires endpoint authentication, set HEALTH_AUTH_TOKEN, HEALTH_AUTH_USERNAME or HEALTH_TLS_CLIENT_CA")
+			os.Exit(1)
+		}
+	}
+
+	u := &Unsealer{
+		logger:           log,
+		vaults:           vaults,
+		staticVaults:     vaults,
+		vaultDefaults:    vaultDefaults,
+		discoverer:       disc,
+		keyFetchDuration: newHistogram(durationBuckets),
+		provider:         provider,
+		newProvider:      func() (keyProvider, error) { return newKeyProvider(log) },
+		keyChangeWebhook: getEnv("KEY_CHANGE_WEBHOOK_URL", ""),
+		keyMaxStaleness:  keyMaxStaleness,
+		keyStalePolicy:   keyStalePolicy,
+		pollInterval:     pollInt,
+		readyMaxPollAge:  readyMaxPollAge,
+		lastPoll:         time.Now().UnixNano(),
+		flap:             flap,
+
+		keyRefreshInterval: refreshInt,
+		refreshNow:         make(chan struct{}, 1),
+		unsealNow:          make(chan string, 1),
+		unsealVaultNow:     make(chan *vaultConfig, 16),
+		initThreshold:      initThreshold,
+		rootTokenPolicy:    rootTokenPolicy,
+		rootTokenSecret:    os.Getenv("ROOT_TOKEN_SECRET_ID"),
+		rootTokenFile:      os.Getenv("ROOT_TOKEN_PRINT_FILE"),
+		tlsPolicy:          policy,
+		caReloadInterval:   caReloadInt,
+		healthTLS:          healthServerTLS,
+		healthAuth:         healthAuth,
+		dashboard:          getEnv("DASHBOARD", "true") == "true",
+		adminAPI:           adminAPI,
+		adminAuth:          adminAuthn,
+		pauses:             pauses,
+		registry:           registry,
+	}
+	for _, v := range vaults {
+		if err := v.connect(policy); err != nil {
+			log.Error("invalid connection settings", "vault", v.addr, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if getEnv("LEADER_ELECTION", "false") == "true" {
+		if u.leader, err = newLeaderElector(log); err != nil {
+			log.Error("leader election init failed", "error", err)
+			os.Exit(1)
+		}
+	}
+	if getEnv("SHARDING", "false") == "true" {
+		if u.leader != nil {
+			log.Error("SHARDING cannot be combined with LEADER_ELECTION")
+			os.Exit(1)
+		}
+		if u.shards, err = newShardMembership(log); err != nil {
+			log.Error("sharding init failed", "error", err)
+			os.Exit(1)
+		}
+	}
+	if getEnv("KUBERNETES_EVENTS", "false") == "true" {
+		u.events = newEventRecorder(log)
+	}
+	historySize, err := strconv.Atoi(getEnv("EVENT_HISTORY_SIZE", "1000"))
+	if err != nil || historySize < 0 {
+		log.Error("EVENT_HISTORY_SIZE must be a non-negative number", "value", os.Getenv("EVENT_HISTORY_SIZE"))
 		os.Exit(1)
 	}
+	if historySize > 0 {
+		u.history = newEventHistory(historySize)
+	}
+	if u.notifier, err = newNotifier(log); err != nil {
+		log.Error("invalid notification settings", "error", err)
+		os.Exit(1)
+	}
+	if action := getEnv("WATCHDOG", "off"); action != "off" {
+		intervals, err := strconv.Atoi(getEnv("WATCHDOG_INTERVALS", "3"))
+		if err != nil {
+			log.Error("WATCHDOG_INTERVALS must be a number", "value", os.Getenv("WATCHDOG_INTERVALS"))
+			os.Exit(1)
+		}
+		if u.watchdog, err = newWatchdog(action, intervals); err != nil {
+			log.Error("watchdog init failed", "error", err)
+			os.Exit(1)
+		}
+	}
+	if path := os.Getenv("AUDIT_LOG_FILE"); path != "" {
+		if u.auditLog, err = openAuditLog(path); err != nil {
+			log.Error("failed to open audit log", "error", err)
+			os.Exit(1)
+		}
+	}
+	if operatorMode {
+		if u.operator, err = newOperator(u, operatorInt, pollInt); err != nil {
+			log.Error("operator init failed", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if u.discoverer != nil {
+		discoverCtx, discoverCancel := context.WithTimeout(context.Background(), 30*time.Second)
+		u.discover(discoverCtx)
+		discoverCancel()
+	}
+
+	if u.operator == nil {
+		if err := u.fetchKeys(); err != nil {
+			if !u.autoInitEnabled() {
+				log.Error("failed to fetch keys", "error", err)
+				os.Exit(1)
+			}
+			log.Warn("failed to fetch keys, continuing since auto-init is enabled", "error", err)
+		}
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	u.initHealthServer()
 	go u.startHealthServer()
-	go u.keyRefreshLoop(ctx)
+	if addr := os.Getenv("DIAGNOSTICS_ADDR"); addr != "" {
+		go u.startDiagnosticsServer(addr)
+	}
+	if u.leader != nil {
+		u.wg.Add(1)
+		go func() {
+			defer u.wg.Done()
+			u.leader.run(ctx, func() {
+				u.requestUnseal(initiatorLeaderChange)
+				if u.operator != nil {
+					u.operator.requestUnseal(initiatorLeaderChange)
+				}
+			})
+		}()
+	}
+	if u.shards != nil {
+		u.wg.Add(1)
+		go func() {
+			defer u.wg.Done()
+			u.shards.run(ctx, func() {
+				u.requestUnseal(initiatorShardChange)
+				if u.operator != nil {
+					u.operator.requestUnseal(initiatorShardChange)
+				}
+			})
+		}()
+	}
+	if len(exporters) > 0 {
+		u.wg.Add(1)
+		go func() {
+			defer u.wg.Done()
+			u.metricsPushLoop(ctx, exporters, pushInt)
+		}()
+	}
+	if u.operator != nil {
+		u.wg.Add(1)
+		go func() {
+			defer u.wg.Done()
+			u.operator.run(ctx)
+		}()
+	} else {
+		go u.keyRefreshLoop(ctx)
+	}
+	if u.discoverer != nil {
+		go u.discoveryLoop(ctx, discoveryInt)
+	}
+	if dnsRefreshInt > 0 {
+		go u.dnsRefreshLoop(ctx, dnsRefreshInt)
+	}
+	if caReloadInt > 0 {
+		go u.caReloadLoop(ctx, caReloadInt)
+	}
+	if u.events != nil {
+		go u.events.run(ctx)
+	}
+	if u.notifier != nil {
+		u.wg.Add(1)
+		go func() {
+			defer u.wg.Done()
+			u.notifier.run(ctx)
+		}()
+	}
+	for _, w := range watchers {
+		go u.podWatchLoop(ctx, w)
+	}
+	if drain != nil {
+		go u.drainWatchLoop(ctx, drain, drainCheckInt, drainFastInt)
+	}
+	if u.watchdog != nil {
+		go u.watchdogLoop(ctx, u.watchdog)
+	}
+	if heartbeat != nil {
+		go u.heartbeatLoop(ctx, heartbeat)
+	}
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+
 	ticker := time.NewTicker(pollInt)
 	defer ticker.Stop()
 
+	u.syncRegistry(ctx)
+	u.record(ctx, historyStarted, severityInfo, nil, u.startupSummary())
 	u.unsealAll(ctx)
 
 	for {
@@ -125,8 +646,10 @@ func main() {
 				log.Error("health server shutdown failed", "error", err)
 			}
 			return
-		case <-sig:
+		case s := <-sig:
 			log.Info("shutting down")
+			// Recorded before cancelling, so the notifier still delivers it.
+			u.record(ctx, historyStopped, severityInfo, nil, fmt.Sprintf("vault-unsealer %s stopping on %s", version, s))
 			cancel()
 			u.wg.Wait()
 			log.Info("shutting down health server")
@@ -136,69 +659,219 @@ func main() {
 				log.Error("health server shutdown failed", "error", err)
 			}
 			return
+		case <-usr1:
+			log.Info("received SIGUSR1, unsealing all vaults")
+			if u.operator != nil {
+				u.operator.requestUnseal(initiatorSignal)
+			} else {
+				u.requestUnseal(initiatorSignal)
+			}
+		case <-usr2:
+			levels.toggle()
+		case <-hup:
+			log.Info("received SIGHUP, reloading access tokens and refreshing keys")
+			if u.operator != nil {
+				u.operator.requestKeyRefresh()
+			} else {
+				u.requestKeyRefresh()
+			}
 		case <-ticker.C:
+			u.syncRegistry(ctx)
 			u.unsealAll(ctx)
+		case initiator := <-u.unsealNow:
+			u.syncRegistry(ctx)
+			if u.discoverer != nil {
+				u.discover(ctx)
+			}
+			u.unsealAll(withInitiator(ctx, initiator))
+		case v := <-u.unsealVaultNow:
+			u.unsealVault(withInitiator(ctx, initiatorAPI), v)
 		}
 	}
 }
 
-func (u *Unsealer) initBitwardenClient() error {
-	var err error
-	if u.apiURL != "" && u.identityURL != "" {
-		u.bw, err = sdk.NewBitwardenClient(&u.apiURL, &u.identityURL)
-	} else {
-		u.bw, err = sdk.NewBitwardenClient(nil, nil)
+func (u *Unsealer) fetchKeys() error {
+	u.refreshVaultCredentials()
+
+	start := time.Now()
+	keys, err := u.getProvider().fetchKeys()
+	u.keyFetchDuration.observe(time.Since(start))
+	if err == nil {
+		err = u.loadKeys(keys)
 	}
 	if err != nil {
-		return fmt.Errorf("failed to create client: %w", err)
+		atomic.AddInt64(&u.keyFetchFailures, 1)
+		u.recordOutcome(context.Background(), historyProviderError, severityError, nil, "key fetch failed: "+err.Error(), eventOutcome{err: err, duration: time.Since(start)})
+		return err
 	}
+	atomic.StoreInt64(&u.keyFetchFailures, 0)
+	atomic.StoreInt64(&u.lastKeyFetch, time.Now().UnixNano())
+	u.recordOutcome(context.Background(), historyKeyRefresh, severityInfo, nil, fmt.Sprintf("fetched %d keys", len(keys)), eventOutcome{duration: time.Since(start)})
+	return nil
+}
 
-	if err := u.bw.AccessTokenLogin(u.token, &u.orgID); err != nil {
-		return fmt.Errorf("login failed: %w", err)
+// loadKeys validates a key set and swaps it in as the active one.
+func (u *Unsealer) loadKeys(keys []string) error {
+	if err := validateKeys(keys); err != nil {
+		u.keysMu.Lock()
+		u.keysInvalid = true
+		u.keysMu.Unlock()
+		return fmt.Errorf("refusing to load malformed key set: %w", err)
 	}
 
+	u.keysMu.Lock()
+	previous := u.keys
+	u.keys = keys
+	u.keysInvalid = false
+	u.keysLoadedAt = time.Now()
+	u.keysMu.Unlock()
+
+	u.logger.Info("loaded keys", "count", len(keys))
+
+	if previous != nil {
+		if changed := changedKeyIndexes(previous, keys); len(changed) > 0 {
+			atomic.AddInt64(&u.keyChanges, 1)
+			change := keyChange{
+				Event:               "keys_changed",
+				Time:                time.Now().UTC(),
+				ChangedKeys:         changed,
+				PreviousFingerprint: keysFingerprint(previous),
+				Fingerprint:         keysFingerprint(keys),
+			}
+			u.logger.Warn("unseal keys changed, new key set is now in use",
+				"changed_keys", changed,
+				"previous_fingerprint", change.PreviousFingerprint,
+				"fingerprint", change.Fingerprint)
+			if u.keyChangeWebhook != "" {
+				go u.notifyKeyChange(change)
+			}
+		}
+	}
 	return nil
 }
 
-func (u *Unsealer) fetchKeys() error {
-	return u.doFetchKeys(true)
+type keyChange struct {
+	Event               string    `json:"event"`
+	Time                time.Time `json:"time"`
+	ChangedKeys         []int     `json:"changed_keys"`
+	PreviousFingerprint string    `json:"previous_fingerprint"`
+	Fingerprint         string    `json:"fingerprint"`
 }
 
-func (u *Unsealer) doFetchKeys(allowRelogin bool) error {
-	// Note: Bitwarden SDK doesn't support context timeouts
-	// If this hangs, the entire refresh loop blocks
-	keys := make([]string, 0, 4)
+// validateKeys checks that every share decodes as hex or base64, that all
+// shares have the same length (an AES key size plus the Shamir tag byte) and
+// that no share appears twice.
+func validateKeys(keys []string) error {
+	seen := make(map[string]int, len(keys))
+	shareLen := 0
+	for i, key := range keys {
+		raw, err := decodeKeyShare(key)
+		if err != nil {
+			return fmt.Errorf("key %d: %w", i+1, err)
+		}
 
-	for i := 1; i <= 4; i++ {
-		keyName := fmt.Sprintf("UNSEAL_KEY_%d", i)
-		keyID := os.Getenv(keyName)
-		if keyID == "" {
-			return fmt.Errorf("environment variable %s not set", keyName)
+		switch len(raw) - 1 {
+		case 16, 24, 32:
+		default:
+			return fmt.Errorf("key %d: unexpected share length of %d bytes", i+1, len(raw))
+		}
+		if shareLen == 0 {
+			shareLen = len(raw)
+		} else if len(raw) != shareLen {
+			return fmt.Errorf("key %d: share length %d does not match %d", i+1, len(raw), shareLen)
 		}
 
-		secret, err := u.bw.Secrets().Get(keyID)
-		if err != nil {
-			if allowRelogin && (strings.Contains(err.Error(), "unauthorized") || strings.Contains(err.Error(), "auth")) {
-				u.logger.Warn("authentication error detected, attempting re-login")
-				if reloginErr := u.initBitwardenClient(); reloginErr != nil {
-					return fmt.Errorf("re-login failed: %w", reloginErr)
-				}
-				return u.doFetchKeys(false)
-			}
-			return fmt.Errorf("failed to get key %d: %w", i, err)
+		if prev, dup := seen[string(raw)]; dup {
+			return fmt.Errorf("key %d is a duplicate of key %d", i+1, prev)
 		}
-		if secret.Value == "" {
-			return fmt.Errorf("empty value for key %d", i)
+		seen[string(raw)] = i + 1
+	}
+	return nil
+}
+
+func decodeKeyShare(key string) ([]byte, error) {
+	if raw, err := hex.DecodeString(key); err == nil {
+		return raw, nil
+	}
+	if raw, err := base64.StdEncoding.DecodeString(key); err == nil {
+		return raw, nil
+	}
+	return nil, fmt.Errorf("not valid hex or base64")
+}
+
+// changedKeyIndexes returns the 1-based positions whose values differ.
+func changedKeyIndexes(previous, current []string) []int {
+	var changed []int
+	for i := 0; i < len(previous) || i < len(current); i++ {
+		if i >= len(previous) || i >= len(current) || previous[i] != current[i] {
+			changed = append(changed, i+1)
 		}
-		keys = append(keys, secret.Value)
 	}
+	return changed
+}
 
-	u.keysMu.Lock()
-	u.keys = keys
-	u.keysMu.Unlock()
+// keysFingerprint identifies a key set in logs without revealing it.
+func keysFingerprint(keys []string) string {
+	h := sha256.New()
+	for _, key := range keys {
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
 
-	u.logger.Info("loaded keys", "count", len(keys))
-	return nil
+func (u *Unsealer) notifyKeyChange(change keyChange) {
+	data, err := json.Marshal(change)
+	if err != nil {
+		u.logger.Error("failed to marshal key change notification", "error", err)
+		return
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(u.keyChangeWebhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		u.logger.Error("key change notification failed", "error", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		u.logger.Error("key change notification rejected", "status", resp.StatusCode)
+	}
+}
+
+var errInvalidKey = errors.New("vault rejected an unseal key")
+
+// isInvalidKeyError reports whether Vault rejected a share itself rather than
+// the request, which usually means a rekey happened and our keys are stale.
+func isInvalidKeyError(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"invalid key", "checksum", "message authentication failed"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshAfterInvalidKey re-fetches the keys after a vault rejected one. When
+// several vaults reject keys at once only the first refresh goes to the
+// provider; the others reuse its result.
+func (u *Unsealer) refreshAfterInvalidKey() {
+	u.invalidKeyMu.Lock()
+	defer u.invalidKeyMu.Unlock()
+
+	u.keysMu.RLock()
+	loadedAt := u.keysLoadedAt
+	u.keysMu.RUnlock()
+	if time.Since(loadedAt) < 10*time.Second {
+		return
+	}
+
+	atomic.AddInt64(&u.invalidKeyRefreshes, 1)
+	if err := u.fetchKeys(); err != nil {
+		u.logger.Error("key refresh after rejected key failed", "error", err)
+	}
 }
 
 func (u *Unsealer) keyRefreshLoop(ctx context.Context) {
@@ -208,140 +881,525 @@ func (u *Unsealer) keyRefreshLoop(ctx context.Context) {
 		}
 	}()
 
+	ticker := time.NewTicker(u.keyRefreshInterval)
+	defer ticker.Stop()
+
+	atomic.StoreInt64(&u.lastRefresh, time.Now().UnixNano())
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(time.Hour):
-			if err := u.fetchKeys(); err != nil {
-				u.logger.Error("key refresh failed", "error", err)
-			} else {
-				u.logger.Info("keys refreshed")
-			}
+		case <-ticker.C:
+		case <-u.refreshNow:
+			u.logger.Info("forced key refresh requested")
+			ticker.Reset(u.keyRefreshInterval)
 		}
+
+		if err := u.fetchKeys(); err != nil {
+			u.logger.Error("key refresh failed", "error", err)
+		} else {
+			u.logger.Info("keys refreshed")
+		}
+		atomic.StoreInt64(&u.lastRefresh, time.Now().UnixNano())
+	}
+}
+
+// requestUnseal asks the main loop for an unseal pass outside the poll
+// interval. Requests made while one is pending are coalesced and keep the
+// initiator of the first.
+func (u *Unsealer) requestUnseal(initiator string) {
+	select {
+	case u.unsealNow <- initiator:
+	default:
+	}
+}
+
+// requestKeyRefresh asks the refresh loop to fetch keys immediately. Requests
+// arriving while one is already pending are coalesced.
+func (u *Unsealer) requestKeyRefresh() {
+	select {
+	case u.refreshNow <- struct{}{}:
+	default:
 	}
 }
 
+// owns reports whether this replica submits keys for the vault at addr. With
+// leader election it has to be the leader, with sharding it has to own the
+// shard of the vault, or of the whole VaultUnsealConfig in operator mode.
+func (u *Unsealer) owns(addr string) bool {
+	if u.leader != nil && !u.leader.isLeader() {
+		return false
+	}
+	if u.shards != nil {
+		key := addr
+		if u.shardKey != "" {
+			key = u.shardKey
+		}
+		return u.shards.owns(key)
+	}
+	return true
+}
+
 func (u *Unsealer) unsealAll(ctx context.Context) {
-	for _, vault := range u.vaults {
+	atomic.StoreInt64(&u.lastPoll, time.Now().UnixNano())
+	ctx = withCycleID(ctx)
+	u.log(ctx).Debug("starting unseal cycle", "initiator", initiatorOf(ctx))
+	for _, vault := range u.vaultList() {
+		if !u.owns(vault.addr) {
+			continue
+		}
 		u.wg.Add(1)
-		go func(addr string) {
+		go func(v *vaultConfig) {
 			defer u.wg.Done()
-			u.unsealWithRetry(ctx, addr)
+			u.unsealWithRetry(ctx, v)
 		}(vault)
 	}
 }
 
-func (u *Unsealer) unsealWithRetry(ctx context.Context, addr string) {
+func (u *Unsealer) unsealWithRetry(ctx context.Context, v *vaultConfig) {
+	addr := v.addr
+	ctx = withRequestID(ctx)
+	log := u.log(ctx)
 	defer func() {
 		if r := recover(); r != nil {
-			u.logger.Error("panic in unseal retry", "vault", addr, "panic", r)
-			atomic.AddInt64(&u.failures, 1)
+			log.Error("panic in unseal retry", "vault", addr, "panic", r)
+			u.countFailure(nil)
 		}
 	}()
 
 	if _, exists := u.working.LoadOrStore(addr, true); exists {
-		u.logger.Debug("unseal already in progress for vault", "vault", addr)
+		log.Debug("unseal already in progress for vault", "vault", addr)
 		return
 	}
 	defer u.working.Delete(addr)
 
-	backoff := time.Second
-	for i := 0; i < 3; i++ {
-		if err := u.unseal(ctx, addr); err == nil {
+	if until := v.state.circuitOpenUntil(); time.Now().Before(until) {
+		atomic.AddInt64(&u.circuitSkips, 1)
+		log.Debug("circuit open, skipping vault", "vault", addr, "until", until)
+		return
+	}
+
+	refreshed := false
+	var lastErr error
+	for i := 0; i < v.retry.attempts; i++ {
+		if !u.owns(addr) {
+			log.Info("no longer responsible for vault, abandoning unseal", "vault", addr)
 			return
-		} else if i < 2 {
-			u.logger.Warn("unseal attempt failed, retrying", "vault", addr, "attempt", i+1, "error", err)
+		}
+		err := u.unseal(ctx, v)
+		if errors.Is(err, errInvalidKey) && !refreshed {
+			refreshed = true
+			log.Warn("vault rejected a key, refreshing keys and retrying", "vault", addr, "error", err)
+			u.refreshAfterInvalidKey()
+			err = u.unseal(ctx, v)
+		}
+		if errors.Is(err, errNotInitialized) {
+			u.reportUninitialized(v)
+			return
+		}
+		lastErr = err
+		if err == nil {
+			v.state.setLastError("")
+			if v.state.recordSuccess() {
+				log.Info("circuit closed", "vault", addr)
+			}
+			return
+		} else if i < v.retry.attempts-1 {
+			// Drop keep-alive connections so the retry resolves the host
+			// name again, in case the vault moved to a new address.
+			v.client.CloseIdleConnections()
+			delay := v.retry.delay(i)
+			log.Warn("unseal attempt failed, retrying", "vault", addr, "attempt", i+1, "retry_in", delay, "error", err)
 			select {
 			case <-ctx.Done():
 				return
-			case <-time.After(backoff):
-				backoff *= 2
+			case <-time.After(delay):
 			}
+		} else {
+			log.Error("unseal failed, giving up until the next poll", "vault", addr, "attempts", v.retry.attempts, "error", err)
+			v.state.setLastError(err.Error())
+			u.event(ctx, v, "Warning", "UnsealFailed", fmt.Sprintf("unseal failed after %d attempts: %v", v.retry.attempts, err))
+			u.recordOutcome(ctx, historyUnsealFailure, severityError, v, fmt.Sprintf("unseal failed after %d attempts: %v", v.retry.attempts, err), eventOutcome{err: err})
 		}
 	}
-	atomic.AddInt64(&u.failures, 1)
+	u.countFailure(lastErr)
+	if v.state.recordFailure(v.breakerThreshold, v.breakerCooldown) {
+		atomic.AddInt64(&u.circuitOpens, 1)
+		log.Warn("circuit opened after consecutive failures, skipping vault", "vault", addr, "failures", v.breakerThreshold, "cooldown", v.breakerCooldown)
+	}
+	if failures := v.state.consecutiveFailures(); v.escalateAfter > 0 && failures == v.escalateAfter {
+		msg := fmt.Sprintf("unseal failed %d times in a row: %v", failures, lastErr)
+		log.Error("escalating repeated unseal failures", "vault", addr, "group", v.group, "failures", failures)
+		u.event(ctx, v, "Warning", "UnsealEscalated", msg)
+		u.recordOutcome(ctx, historyEscalated, severityCritical, v, msg, eventOutcome{err: lastErr})
+	}
 }
 
-func (u *Unsealer) unseal(ctx context.Context, addr string) error {
-	req, err := http.NewRequestWithContext(ctx, "GET", addr+"/v1/sys/health", nil)
-	if err != nil {
-		return fmt.Errorf("invalid vault URL: %w", err)
+// sealStatus is the response of /v1/sys/seal-status.
+type sealStatus struct {
+	Type         string `json:"type"`
+	Initialized  bool   `json:"initialized"`
+	Sealed       bool   `json:"sealed"`
+	T            int    `json:"t"`
+	N            int    `json:"n"`
+	Progress     int    `json:"progress"`
+	Nonce        string `json:"nonce"`
+	Version      string `json:"version"`
+	BuildDate    string `json:"build_date"`
+	Migration    bool   `json:"migration"`
+	ClusterName  string `json:"cluster_name"`
+	ClusterID    string `json:"cluster_id"`
+	RecoverySeal bool   `json:"recovery_seal"`
+	StorageType  string `json:"storage_type"`
+}
+
+func (u *Unsealer) unseal(ctx context.Context, v *vaultConfig) (err error) {
+	addr := v.addr
+	log := u.log(ctx)
+	if len(v.codeActions) > 0 && u.holdReason(v) == "" {
+		done, err := u.applyCodeActions(ctx, v)
+		if done || err != nil {
+			return err
+		}
 	}
 
-	resp, err := u.client.Do(req)
+	checkStart := time.Now()
+	status, err := v.api.sealStatus(ctx)
+	v.state.checkDuration.observe(time.Since(checkStart))
+	v.state.setChecked(status)
 	if err != nil {
-		return fmt.Errorf("health check failed: %w", err)
+		v.state.setStatus(statusUnreachable)
+		return err
 	}
-	resp.Body.Close()
+	if !status.Initialized {
+		switch {
+		case u.holdReason(v) != "":
+			log.Debug("vault is not initialized, leaving it alone", "vault", addr, "reason", u.holdReason(v))
+			return nil
+		case v.joinsRaft():
+			if err := u.raftJoin(ctx, v); err != nil {
+				return fmt.Errorf("raft join failed: %w", err)
+			}
+		case v.autoInit:
+			if err := u.initVault(ctx, v); err != nil {
+				return fmt.Errorf("auto-init failed: %w", err)
+			}
+		default:
+			return errNotInitialized
+		}
+		if status, err = v.api.sealStatus(ctx); err != nil {
+			return err
+		}
+	}
+	if !status.Sealed {
+		if prev := v.state.setStatus(statusUnsealed); prev != statusUnsealed && u.notifier != nil {
+			u.notifier.vaultUnsealed(u.shardKey, v.addr)
+		}
+		u.checkFlapping(ctx, v)
+		u.updateRole(ctx, v)
+		return nil
+	}
+	if prev := v.state.setStatus(statusSealed); prev != statusSealed {
+		u.record(ctx, historySealDetected, severityWarning, v, fmt.Sprintf("vault is sealed (seal type %s, threshold %d of %d)", status.Type, status.T, status.N))
+	}
+	u.checkFlapping(ctx, v)
 
-	switch resp.StatusCode {
-	case 200, 429, 472, 473:
+	if reason := u.holdReason(v); reason != "" {
+		log.Debug("vault is sealed, leaving it alone", "vault", addr, "reason", reason)
+		return nil
+	}
+	if !u.rolePolicyAllows(v) {
 		return nil
-	case 503:
-		// Sealed, continue to unseal
-	default:
-		return fmt.Errorf("vault unhealthy, status code: %d", resp.StatusCode)
+	}
+
+	if err := v.checkClusterIdentity(status); err != nil {
+		atomic.AddInt64(&u.identityMismatches, 1)
+		log.Error("vault identity does not match its pin, not submitting keys", "vault", addr, "error", err)
+		return err
+	}
+
+	if u.keyStalePolicy == "refuse" {
+		if state, age := u.keyState(); state == "stale_keys" {
+			return fmt.Errorf("refusing to unseal with stale keys (age %s)", age.Round(time.Second))
+		}
+	}
+
+	if status.Type != "" && status.Type != "shamir" {
+		if !(status.Migration && v.migrate) {
+			// Auto-unseal vaults are unsealed by their KMS; Shamir shares would
+			// only be rejected. Recovery keys are accepted during a migration.
+			atomic.AddInt64(&u.autoSealSkips, 1)
+			log.Warn("sealed vault uses auto-unseal, skipping key submission", "vault", addr, "seal_type", status.Type)
+			return nil
+		}
+		log.Info("submitting keys to auto-unseal vault for seal migration", "vault", addr, "seal_type", status.Type)
+	}
+
+	if status.Migration && !v.migrate {
+		log.Warn("vault is in seal migration mode but migrate is not enabled for it", "vault", addr)
 	}
 
 	atomic.AddInt64(&u.attempts, 1)
-	u.logger.Info("unsealing", "vault", addr)
+	unsealStart := time.Now()
+	defer func() {
+		if err != nil {
+			u.audit(ctx, v, auditUnseal, -1, "failed", err)
+		}
+	}()
+	log.Info("unsealing", "vault", addr, "seal_type", status.Type, "threshold", status.T, "shares", status.N, "version", status.Version, "migrate", v.migrate)
+	u.event(ctx, v, "Normal", "UnsealStarted", fmt.Sprintf("vault is sealed, submitting %d of %d key shares", status.T, status.N))
 
 	u.keysMu.RLock()
 	keys := u.keys
 	u.keysMu.RUnlock()
 
-	for i, key := range keys {
-		if i > 0 {
-			req, err := http.NewRequestWithContext(ctx, "GET", addr+"/v1/sys/health", nil)
-			if err == nil {
-				resp, err := u.client.Do(req)
-				if err == nil {
-					resp.Body.Close()
-					switch resp.StatusCode {
-					case 200, 429, 472, 473:
-						u.logger.Info("unsealed (quorum)", "vault", addr)
-						atomic.AddInt64(&u.successes, 1)
-						return nil
-					}
-				}
+	if status.Progress > 0 {
+		if v.resetProgress {
+			log.Warn("found unseal progress from another actor, resetting", "vault", addr, "progress", status.Progress)
+			if status, err = u.resetUnseal(ctx, v); err != nil {
+				u.audit(ctx, v, auditProgressReset, -1, "error", err)
+				return fmt.Errorf("failed to reset unseal progress: %w", err)
 			}
+			u.audit(ctx, v, auditProgressReset, -1, "reset", nil)
+		} else {
+			log.Warn("continuing unseal progress started by another actor", "vault", addr, "progress", status.Progress)
 		}
+	}
 
-		data, err := json.Marshal(map[string]string{"key": key})
-		if err != nil {
-			u.logger.Warn("failed to marshal unseal request", "vault", addr, "error", err)
-			continue
+	needed := status.T - status.Progress
+	if needed <= 0 {
+		needed = status.T
+	}
+	if len(keys) < needed {
+		return fmt.Errorf("vault needs %d more keys but only %d are loaded", needed, len(keys))
+	}
+
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	if v.shuffleKeys {
+		// Spread submissions over all shares so none is always left unused.
+		rand.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+	}
+
+	submitted := 0
+	nonce := ""
+	for _, i := range order {
+		if submitted >= needed {
+			break
 		}
 
-		req, err := http.NewRequestWithContext(ctx, "PUT", addr+"/v1/sys/unseal", bytes.NewBuffer(data))
+		result, err := u.submitKey(ctx, v, keys[i])
 		if err != nil {
+			if isInvalidKeyError(err) {
+				u.audit(ctx, v, auditKeySubmitted, i, "rejected", err)
+				// Our progress is built on shares from an old key generation.
+				if _, resetErr := u.resetUnseal(ctx, v); resetErr != nil {
+					log.Debug("failed to reset unseal progress", "vault", addr, "error", resetErr)
+				}
+				return fmt.Errorf("%w: %v", errInvalidKey, err)
+			}
+			u.audit(ctx, v, auditKeySubmitted, i, "error", err)
+			log.Warn("unseal key submission failed", "vault", addr, "error", err)
 			continue
 		}
-		req.Header.Set("Content-Type", "application/json")
+		u.audit(ctx, v, auditKeySubmitted, i, "accepted", nil)
+		submitted++
+		u.countKeyUse(i)
 
-		resp, err := u.client.Do(req)
-		if err != nil {
-			continue
+		if !result.Sealed {
+			verified, err := u.verifyUnsealed(ctx, v, result)
+			if err != nil {
+				atomic.AddInt64(&u.verifyFailures, 1)
+				return fmt.Errorf("unseal could not be verified: %w", err)
+			}
+			v.state.unsealDuration.observe(time.Since(unsealStart))
+			log.Info("unsealed", "vault", addr, "keys_submitted", submitted, "cluster_name", verified.ClusterName, "cluster_id", verified.ClusterID, "duration", time.Since(unsealStart).Round(time.Millisecond))
+			atomic.AddInt64(&u.successes, 1)
+			v.state.setStatus(statusUnsealed)
+			v.state.setLastUnseal(time.Now())
+			u.event(ctx, v, "Normal", "UnsealSucceeded", fmt.Sprintf("vault unsealed with %d key shares", submitted))
+			u.audit(ctx, v, auditUnseal, -1, "unsealed", nil)
+			u.recordOutcome(ctx, historyUnsealSuccess, severityInfo, v, fmt.Sprintf("vault unsealed with %d key shares in %s", submitted, time.Since(unsealStart).Round(time.Millisecond)), eventOutcome{duration: time.Since(unsealStart)})
+			u.revokeRootToken(ctx, v)
+			return nil
 		}
+		if nonce != "" && result.Nonce != nonce {
+			// Someone else reset or restarted the unseal process between our
+			// submissions, so our shares are now mixed with theirs.
+			if v.resetProgress {
+				if _, err := u.resetUnseal(ctx, v); err != nil {
+					return fmt.Errorf("unseal nonce changed and reset failed: %w", err)
+				}
+				return fmt.Errorf("unseal nonce changed during submission, progress reset")
+			}
+			log.Warn("unseal nonce changed during submission", "vault", addr)
+		}
+		nonce = result.Nonce
+		log.Debug("unseal progress", "vault", addr, "progress", result.Progress, "threshold", result.T)
+	}
+
+	return fmt.Errorf("failed to unseal after submitting %d of %d required keys", submitted, needed)
+}
 
-		var result map[string]interface{}
-		decodeErr := json.NewDecoder(resp.Body).Decode(&result)
-		resp.Body.Close()
+// verifyUnsealed confirms an unseal response with a separate seal-status call
+// instead of trusting the single sealed flag of the last submission.
+func (u *Unsealer) verifyUnsealed(ctx context.Context, v *vaultConfig, result *sealStatus) (*sealStatus, error) {
+	log := u.log(ctx)
+	status, err := v.api.sealStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case status.Sealed:
+		return nil, fmt.Errorf("vault reports sealed")
+	case status.Progress != 0:
+		return nil, fmt.Errorf("unseal progress was not reset (progress %d)", status.Progress)
+	case status.ClusterID == "":
+		return nil, fmt.Errorf("vault reports no cluster ID")
+	case result.ClusterID != "" && result.ClusterID != status.ClusterID:
+		return nil, fmt.Errorf("cluster ID changed from %s to %s", result.ClusterID, status.ClusterID)
+	}
+	if err := v.checkClusterIdentity(status); err != nil {
+		atomic.AddInt64(&u.identityMismatches, 1)
+		log.Error("unsealed vault does not match its identity pin", "vault", v.addr, "error", err)
+		return nil, err
+	}
+	return status, nil
+}
 
-		if decodeErr != nil {
-			u.logger.Warn("bad response from vault", "vault", addr, "error", decodeErr)
-			continue
+// countKeyUse records an accepted submission of the key at index i. Keys are
+// only ever identified by position.
+func (u *Unsealer) countKeyUse(i int) {
+	u.keyUsesMu.Lock()
+	defer u.keyUsesMu.Unlock()
+	if u.keyUses == nil {
+		u.keyUses = make(map[int]int64)
+	}
+	u.keyUses[i]++
+}
+
+func (u *Unsealer) submitKey(ctx context.Context, v *vaultConfig, key string) (*sealStatus, error) {
+	return v.api.unseal(ctx, unsealRequest{key: key, migrate: v.migrate})
+}
+
+func (u *Unsealer) resetUnseal(ctx context.Context, v *vaultConfig) (*sealStatus, error) {
+	return v.api.unseal(ctx, unsealRequest{reset: true})
+}
+
+// vaultJSON performs a Vault API call with an optional JSON body and decodes
+// the response into out. Non-2xx responses are turned into errors carrying
+// Vault's error messages.
+func vaultJSON(ctx context.Context, v *vaultConfig, method, path string, payload, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
 		}
+		body = bytes.NewReader(data)
+	}
 
-		if sealed, ok := result["sealed"].(bool); ok && !sealed {
-			u.logger.Info("unsealed", "vault", addr)
-			atomic.AddInt64(&u.successes, 1)
-			return nil
+	req, err := http.NewRequestWithContext(ctx, method, v.addr+path, body)
+	if err != nil {
+		return fmt.Errorf("invalid vault URL: %w", err)
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiErr struct {
+			Errors []string `json:"errors"`
 		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return &statusError{code: resp.StatusCode, message: fmt.Sprintf("status code %d: %s", resp.StatusCode, strings.Join(apiErr.Errors, "; "))}
+	}
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("bad response from vault: %w", err)
+	}
+	return nil
+}
+
+// keyState reports the readiness of the loaded key set and its age.
+func (u *Unsealer) keyState() (string, time.Duration) {
+	u.keysMu.RLock()
+	defer u.keysMu.RUnlock()
+
+	var age time.Duration
+	if !u.keysLoadedAt.IsZero() {
+		age = time.Since(u.keysLoadedAt)
 	}
 
-	return fmt.Errorf("failed to unseal")
+	switch {
+	case u.keysInvalid:
+		return "invalid_keys", age
+	case len(u.keys) == 0:
+		return "no_keys", age
+	case u.keyMaxStaleness > 0 && age > u.keyMaxStaleness:
+		return "stale_keys", age
+	}
+	return "ready", age
+}
+
+func (u *Unsealer) keyAge() time.Duration {
+	_, age := u.keyState()
+	return age
+}
+
+// startupSummary describes the configuration for the unsealer_started event.
+func (u *Unsealer) startupSummary() string {
+	var mode string
+	switch {
+	case u.operator != nil:
+		mode = "operator mode"
+	case u.discoverer != nil:
+		mode = "vault discovery"
+	default:
+		u.vaultsMu.RLock()
+		mode = fmt.Sprintf("%d vaults", len(u.vaults))
+		u.vaultsMu.RUnlock()
+	}
+	return fmt.Sprintf("vault-unsealer %s started with %s, key provider %s", version, mode, getEnv("KEY_PROVIDER", "bitwarden"))
+}
+
+// pollAge is the time since the last unseal cycle started.
+func (u *Unsealer) pollAge() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&u.lastPoll)))
+}
+
+// readiness reports whether the keys are usable, the key provider is still
+// logged in and the poll loop is running. A poll loop that has not started a
+// cycle within READY_MAX_POLL_AGE, by default three poll intervals, is taken
+// as wedged.
+func (u *Unsealer) readiness() (bool, string) {
+	if state, _ := u.keyState(); state != "ready" {
+		return false, state
+	}
+	if p, ok := u.getProvider().(authChecker); ok {
+		if err := p.authError(); err != nil {
+			return false, "provider_unauthenticated"
+		}
+	}
+	limit := u.readyMaxPollAge
+	if limit == 0 {
+		limit = 3 * u.pollInterval
+	}
+	if u.pollAge() > limit {
+		return false, "poll_stale"
+	}
+	return true, "ready"
 }
 
 func (u *Unsealer) initHealthServer() {
@@ -349,37 +1407,209 @@ func (u *Unsealer) initHealthServer() {
 
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
+		if u.watchdog != nil {
+			if stuck := u.watchdog.failures(); len(stuck) > 0 {
+				w.WriteHeader(503)
+				json.NewEncoder(w).Encode(map[string]interface{}{"status": "stuck", "stuck": stuck})
+				return
+			}
+		}
 		json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 	})
 
 	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
-		u.keysMu.RLock()
-		ready := len(u.keys) > 0
-		u.keysMu.RUnlock()
-
+		ready, state := u.readiness()
+		if u.operator != nil {
+			ready, state = u.operator.ready()
+		}
 		w.Header().Set("Content-Type", "application/json")
 		if !ready {
 			w.WriteHeader(503)
 		}
-		json.NewEncoder(w).Encode(map[string]bool{"ready": ready})
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ready":            ready,
+			"state":            state,
+			"key_age_seconds":  int64(u.keyAge().Seconds()),
+			"poll_age_seconds": int64(u.pollAge().Seconds()),
+		})
 	})
 
+	mux.HandleFunc("/events", u.handleEvents)
+	mux.HandleFunc("/events/stream", u.handleEventStream)
+	mux.HandleFunc("/version", handleVersion)
+
+	mux.HandleFunc("/status", u.handleStatus)
+	if u.dashboard {
+		mux.HandleFunc("GET /{$}", handleDashboard)
+	}
+	if u.adminAPI {
+		mux.HandleFunc("GET /api/openapi.json", handleOpenAPI)
+		mux.HandleFunc("POST /api/v1/unseal", u.handleUnsealAll)
+		mux.HandleFunc("POST /api/v1/unseal/{vault}", u.handleUnsealVault)
+		mux.HandleFunc("POST /api/v1/keys/refresh", u.handleKeyRefresh)
+		mux.HandleFunc("GET /api/v1/vaults", u.handleListVaults)
+		mux.HandleFunc("GET /api/v1/vaults/{vault}", u.handleGetVault)
+		mux.HandleFunc("POST /api/v1/vaults", u.handleRegisterVault)
+		mux.HandleFunc("DELETE /api/v1/vaults/{vault}", u.handleUnregisterVault)
+		mux.HandleFunc("POST /api/v1/vaults/{vault}/disable", u.handleDisableVault)
+		mux.HandleFunc("POST /api/v1/vaults/{vault}/enable", u.handleEnableVault)
+		mux.HandleFunc("GET /api/v1/pause", u.handlePauseState)
+		mux.HandleFunc("POST /api/v1/pause", u.handlePause)
+		mux.HandleFunc("POST /api/v1/pause/{vault}", u.handlePause)
+		mux.HandleFunc("POST /api/v1/resume", u.handleResume)
+		mux.HandleFunc("POST /api/v1/resume/{vault}", u.handleResume)
+		mux.HandleFunc("POST /"+grpcService+"/{method}", u.handleGRPC(mux))
+	}
+
 	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if wantsPrometheus(r) {
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+			u.writePrometheus(w)
+			return
+		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]int64{
-			"unseal_attempts":  atomic.LoadInt64(&u.attempts),
-			"unseal_successes": atomic.LoadInt64(&u.successes),
-			"unseal_failures":  atomic.LoadInt64(&u.failures),
-		})
+		json.NewEncoder(w).Encode(u.allMetrics())
 	})
 
+	var handler http.Handler = mux
+	if u.adminAuth != nil {
+		handler = u.adminAuth.wrap(handler)
+	}
+	if u.healthAuth != nil {
+		handler = u.healthAuth.wrap(handler)
+	}
+	if u.healthTLS != nil {
+		handler = u.healthTLS.requireClientCert(handler)
+	}
 	u.healthServer = &http.Server{
 		Addr:         ":8080",
-		Handler:      mux,
+		Handler:      handler,
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
+	if u.healthTLS != nil {
+		u.healthServer.TLSConfig = u.healthTLS.config
+	}
+	if u.adminAPI {
+		// gRPC needs HTTP/2, which without TLS is only served to clients
+		// that use it from the start, as gRPC clients do.
+		u.healthServer.Protocols = new(http.Protocols)
+		u.healthServer.Protocols.SetHTTP1(true)
+		u.healthServer.Protocols.SetHTTP2(true)
+		u.healthServer.Protocols.SetUnencryptedHTTP2(true)
+	}
+	if u.history != nil {
+		u.healthServer.RegisterOnShutdown(u.history.closeSubscribers)
+	}
+}
+
+// wantsPrometheus reports whether a /metrics request asks for the Prometheus
+// text format, through ?format=prometheus or an Accept header like the one
+// Prometheus scrapes with. Anything else gets the JSON document.
+func wantsPrometheus(r *http.Request) bool {
+	switch r.URL.Query().Get("format") {
+	case "prometheus":
+		return true
+	case "json":
+		return false
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/plain") || strings.Contains(accept, "application/openmetrics-text")
+}
+
+// allMetrics returns the counters of this unsealer combined with those of
+// all operator-managed clusters, plus the replica-wide gauges.
+func (u *Unsealer) allMetrics() map[string]int64 {
+	metrics := u.metrics()
+	if u.operator != nil {
+		for _, c := range u.operator.unsealers() {
+			for name, n := range c.metrics() {
+				switch name {
+				case "key_age_seconds", "provider_consecutive_failures":
+					// The oldest key set and the most failing provider
+					// are the ones that matter.
+					if n > metrics[name] {
+						metrics[name] = n
+					}
+					continue
+				case "provider_last_success_timestamp_seconds":
+					if _, ok := metrics[name]; !ok || n < metrics[name] {
+						metrics[name] = n
+					}
+					continue
+				}
+				metrics[name] += n
+			}
+		}
+	}
+	if u.shards != nil {
+		metrics["shard_members"] = int64(u.shards.memberCount())
+	}
+	if u.leader != nil {
+		metrics["leader"] = 0
+		if u.leader.isLeader() {
+			metrics["leader"] = 1
+		}
+	}
+	return metrics
+}
+
+// metrics returns the counters served on /metrics.
+func (u *Unsealer) metrics() map[string]int64 {
+	metrics := map[string]int64{
+		"unseal_attempts":          atomic.LoadInt64(&u.attempts),
+		"unseal_successes":         atomic.LoadInt64(&u.successes),
+		"unseal_failures":          atomic.LoadInt64(&u.failures),
+		"key_changes":              atomic.LoadInt64(&u.keyChanges),
+		"key_age_seconds":          int64(u.keyAge().Seconds()),
+		"unseal_skipped_auto_seal": atomic.LoadInt64(&u.autoSealSkips),
+		"unseal_skipped_by_role":   atomic.LoadInt64(&u.roleSkips),
+		"role_policy_alerts":       atomic.LoadInt64(&u.roleAlerts),
+		"invalid_key_refreshes":    atomic.LoadInt64(&u.invalidKeyRefreshes),
+		"uninitialized_vaults":     u.countStatus(statusUninitialized),
+		"uninitialized_alerts":     atomic.LoadInt64(&u.uninitAlerts),
+		"raft_joins":               atomic.LoadInt64(&u.raftJoins),
+		"unseal_verify_failures":   atomic.LoadInt64(&u.verifyFailures),
+		"identity_mismatches":      atomic.LoadInt64(&u.identityMismatches),
+		"circuit_opens":            atomic.LoadInt64(&u.circuitOpens),
+		"circuit_skips":            atomic.LoadInt64(&u.circuitSkips),
+		"circuits_open":            u.countOpenCircuits(),
+		"dns_changes":              atomic.LoadInt64(&u.dnsChanges),
+		"ca_reloads":               atomic.LoadInt64(&u.caReloads),
+		"drain_detections":         atomic.LoadInt64(&u.drainDetections),
+		"standbys":                 u.countRole(roleStandby),
+		"dr_secondaries":           u.countRole(roleDRSecondary),
+		"perf_standbys":            u.countRole(rolePerfStandby),
+		"perf_standbys_warning":    u.countRole(rolePerfStandbyWarning),
+	}
+	if u.getProvider() != nil {
+		metrics["provider_consecutive_failures"] = atomic.LoadInt64(&u.keyFetchFailures)
+		metrics["provider_relogins"] = u.providerRelogins()
+		if last := atomic.LoadInt64(&u.lastKeyFetch); last > 0 {
+			metrics["provider_last_success_timestamp_seconds"] = last / int64(time.Second)
+		}
+	}
+	if u.shards != nil {
+		var owned int64
+		for _, v := range u.vaultList() {
+			if u.owns(v.addr) {
+				owned++
+			}
+		}
+		metrics["shard_vaults"] = owned
+	}
+	u.keyUsesMu.Lock()
+	for i, n := range u.keyUses {
+		metrics[fmt.Sprintf("key_%d_submissions", i+1)] = n
+	}
+	u.keyUsesMu.Unlock()
+	u.failureReasonsMu.Lock()
+	for _, reason := range failureReasons {
+		metrics["unseal_failures_"+reason] = u.failureReasons[reason]
+	}
+	u.failureReasonsMu.Unlock()
+	return metrics
 }
 
 func (u *Unsealer) startHealthServer() {
@@ -389,8 +1619,14 @@ func (u *Unsealer) startHealthServer() {
 		}
 	}()
 
-	u.logger.Info("health server starting", "addr", ":8080")
-	if err := u.healthServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	u.logger.Info("health server starting", "addr", ":8080", "tls", u.healthTLS != nil)
+	var err error
+	if u.healthTLS != nil {
+		err = u.healthServer.ListenAndServeTLS("", "")
+	} else {
+		err = u.healthServer.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		u.logger.Error("health server failed", "error", err)
 	}
 }
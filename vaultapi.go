@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// vaultAPI is every call the unsealer makes to Vault. The default
+// implementation uses the official client (see vaultapi_official.go); the
+// built-in HTTP implementation remains as the api_client=http fallback.
+type vaultAPI interface {
+	sealStatus(ctx context.Context) (*sealStatus, error)
+	unseal(ctx context.Context, req unsealRequest) (*sealStatus, error)
+	role(ctx context.Context) (string, error)
+	initialize(ctx context.Context, shares, threshold int) (*initResponse, error)
+	raftJoin(ctx context.Context, leader, leaderCA string) (bool, error)
+	rekeyInit(ctx context.Context, shares, threshold int) (*rekeyStatus, error)
+	rekeyCancel(ctx context.Context) error
+	rekeyUpdate(ctx context.Context, key, nonce string) (*rekeyUpdate, error)
+	rekeyVerify(ctx context.Context, key, nonce string) (*rekeyVerify, error)
+	// revokeSelf revokes token, which is used instead of the bearer token.
+	revokeSelf(ctx context.Context, token string) error
+}
+
+type unsealRequest struct {
+	key     string
+	reset   bool
+	migrate bool
+}
+
+// connect builds the HTTP client and API implementation for a vault.
+func (v *vaultConfig) connect(policy *tlsPolicy) error {
+	var err error
+	if v.client, err = newVaultClient(v, policy); err != nil {
+		return err
+	}
+
+	v.api = &httpVaultAPI{v: v}
+	if v.apiClient != "http" {
+		if v.api, err = newOfficialVaultAPI(v, v.api); err != nil {
+			return fmt.Errorf("failed to create vault API client: %w", err)
+		}
+	}
+	return nil
+}
+
+type httpVaultAPI struct {
+	v *vaultConfig
+}
+
+func (a *httpVaultAPI) sealStatus(ctx context.Context) (*sealStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", a.v.addr+"/v1/sys/seal-status", nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid vault URL: %w", err)
+	}
+
+	resp, err := a.v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("seal status check failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{code: resp.StatusCode, message: fmt.Sprintf("seal status check failed, status code: %d", resp.StatusCode)}
+	}
+
+	var status sealStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("bad seal status response: %w", err)
+	}
+	return &status, nil
+}
+
+// unseal sends a request to /v1/sys/unseal. Vault answers with the same
+// document as /v1/sys/seal-status.
+func (a *httpVaultAPI) unseal(ctx context.Context, r unsealRequest) (*sealStatus, error) {
+	payload := map[string]interface{}{}
+	if r.reset {
+		payload["reset"] = true
+	} else {
+		payload["key"] = r.key
+	}
+	if r.migrate {
+		payload["migrate"] = true
+	}
+
+	var result sealStatus
+	if err := vaultJSON(ctx, a.v, "PUT", "/v1/sys/unseal", payload, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// role asks the health endpoint which role an unsealed node currently has.
+// A sealed node always answers 503, which is why the role is remembered from
+// the last time the node was unsealed.
+func (a *httpVaultAPI) role(ctx context.Context) (string, error) {
+	code, err := healthStatusCode(ctx, a.v)
+	if err != nil {
+		return "", err
+	}
+	if role, ok := a.v.healthRoleFor(code); ok {
+		return role, nil
+	}
+	return "", &statusError{code: code, message: fmt.Sprintf("unexpected health status code %d", code)}
+}
+
+// healthStatusCode calls the vault's health endpoint and returns the status
+// code of the response.
+func healthStatusCode(ctx context.Context, v *vaultConfig) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", v.healthURL(), nil)
+	if err != nil {
+		return 0, fmt.Errorf("invalid vault URL: %w", err)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("health check failed: %w", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func (a *httpVaultAPI) initialize(ctx context.Context, shares, threshold int) (*initResponse, error) {
+	var result initResponse
+	payload := map[string]int{"secret_shares": shares, "secret_threshold": threshold}
+	if err := vaultJSON(ctx, a.v, "PUT", "/v1/sys/init", payload, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (a *httpVaultAPI) raftJoin(ctx context.Context, leader, leaderCA string) (bool, error) {
+	payload := map[string]interface{}{"leader_api_addr": leader}
+	if leaderCA != "" {
+		payload["leader_ca_cert"] = leaderCA
+	}
+
+	var result struct {
+		Joined bool `json:"joined"`
+	}
+	if err := vaultJSON(ctx, a.v, "POST", "/v1/sys/storage/raft/join", payload, &result); err != nil {
+		return false, err
+	}
+	return result.Joined, nil
+}
+
+// rekeyInit starts a rekey that requires verification.
+func (a *httpVaultAPI) rekeyInit(ctx context.Context, shares, threshold int) (*rekeyStatus, error) {
+	var result rekeyStatus
+	payload := map[string]interface{}{
+		"secret_shares":        shares,
+		"secret_threshold":     threshold,
+		"require_verification": true,
+	}
+	if err := vaultJSON(ctx, a.v, "PUT", "/v1/sys/rekey/init", payload, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (a *httpVaultAPI) rekeyCancel(ctx context.Context) error {
+	return vaultJSON(ctx, a.v, "DELETE", "/v1/sys/rekey/init", nil, nil)
+}
+
+func (a *httpVaultAPI) rekeyUpdate(ctx context.Context, key, nonce string) (*rekeyUpdate, error) {
+	var result rekeyUpdate
+	payload := map[string]interface{}{"key": key, "nonce": nonce}
+	if err := vaultJSON(ctx, a.v, "PUT", "/v1/sys/rekey/update", payload, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (a *httpVaultAPI) rekeyVerify(ctx context.Context, key, nonce string) (*rekeyVerify, error) {
+	var result rekeyVerify
+	payload := map[string]interface{}{"key": key, "nonce": nonce}
+	if err := vaultJSON(ctx, a.v, "PUT", "/v1/sys/rekey/verify", payload, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+func (a *httpVaultAPI) revokeSelf(ctx context.Context, token string) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", a.v.addr+"/v1/auth/token/revoke-self", nil)
+	if err != nil {
+		return fmt.Errorf("invalid vault URL: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := a.v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return &statusError{code: resp.StatusCode, message: fmt.Sprintf("status code %d", resp.StatusCode)}
+	}
+	return nil
+}
+
+// headerTransport adds the per-vault bearer token and namespace to every
+// request, whichever API implementation sends it.
+type headerTransport struct {
+	v      *vaultConfig
+	policy *tlsPolicy
+
+	mu    sync.RWMutex
+	base  *http.Transport
+	caPEM []byte
+}
+
+func (t *headerTransport) transport() *http.Transport {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.base
+}
+
+func (t *headerTransport) CloseIdleConnections() {
+	t.transport().CloseIdleConnections()
+}
+
+// reloadCA swaps in a transport trusting caPEM if it differs from the bundle
+// in use. Requests already in flight finish on the old transport.
+func (t *headerTransport) reloadCA(caPEM []byte) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if bytes.Equal(caPEM, t.caPEM) {
+		return false, nil
+	}
+	base, err := newVaultTransport(t.v, t.policy, caPEM)
+	if err != nil {
+		return false, err
+	}
+	old := t.base
+	t.base, t.caPEM = base, caPEM
+	old.CloseIdleConnections()
+	return true, nil
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.transport()
+	token := t.v.state.getBearerToken()
+	requestID := requestIDOf(req.Context())
+	if token != "" || t.v.namespace != "" || requestID != "" {
+		req = req.Clone(req.Context())
+		if requestID != "" && req.Header.Get("X-Request-Id") == "" {
+			req.Header.Set("X-Request-Id", requestID)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if t.v.namespace != "" && req.Header.Get("X-Vault-Namespace") == "" {
+			req.Header.Set("X-Vault-Namespace", t.v.namespace)
+		}
+	}
+
+	resp, err := base.RoundTrip(req)
+	if err != nil || t.v.mesh == "" {
+		return resp, err
+	}
+	// A sidecar error says nothing about the vault, so it must not be read
+	// as one of Vault's own status codes, such as 503 for sealed.
+	if reason, ok := meshError(t.v.mesh, resp); ok {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", errMeshUnavailable, reason)
+	}
+	return resp, nil
+}
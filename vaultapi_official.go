@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/hashicorp/vault/api"
+)
+
+// newOfficialVaultAPI builds an official client on v's transport, so it
+// shares its TLS, proxy and header settings. fallback answers the calls the
+// official client cannot make the way v is configured.
+func newOfficialVaultAPI(v *vaultConfig, fallback vaultAPI) (vaultAPI, error) {
+	config := api.DefaultConfig()
+	config.Address = v.addr
+	// The client changes the redirect policy of the http.Client it is given,
+	// so it gets its own. The transport stays shared, so its connections and
+	// TLS settings are the same as for every other call to this vault.
+	config.HttpClient = &http.Client{
+		Transport:     v.client.Transport,
+		Timeout:       v.client.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	// Retries are handled by unsealWithRetry.
+	config.MaxRetries = 0
+
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	clearEnvSettings(client, v)
+	return &officialVaultAPI{v: v, client: client, fallback: fallback}, nil
+}
+
+// clearEnvSettings drops the token, namespace and headers that api.NewClient
+// reads from VAULT_TOKEN, VAULT_NAMESPACE and VAULT_HEADERS, which are meant
+// for the vault CLI and not for the vaults the unsealer talks to.
+func clearEnvSettings(client *api.Client, v *vaultConfig) {
+	client.ClearToken()
+	client.ClearNamespace()
+	client.SetHeaders(http.Header{api.RequestHeaderName: []string{"true"}})
+	if v.namespace != "" {
+		client.SetNamespace(v.namespace)
+	}
+}
+
+// officialVaultAPI implements vaultAPI with github.com/hashicorp/vault/api.
+type officialVaultAPI struct {
+	v        *vaultConfig
+	client   *api.Client
+	fallback vaultAPI
+}
+
+func (a *officialVaultAPI) sealStatus(ctx context.Context) (*sealStatus, error) {
+	resp, err := a.client.Sys().SealStatusWithContext(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("seal status check failed: %w", responseError(err))
+	}
+	return fromAPISealStatus(resp), nil
+}
+
+func (a *officialVaultAPI) unseal(ctx context.Context, r unsealRequest) (*sealStatus, error) {
+	resp, err := a.client.Sys().UnsealWithOptionsWithContext(ctx, &api.UnsealOpts{
+		Key:     r.key,
+		Reset:   r.reset,
+		Migrate: r.migrate,
+	})
+	if err != nil {
+		return nil, responseError(err)
+	}
+	return fromAPISealStatus(resp), nil
+}
+
+// responseError turns the client's error for an unexpected status code into
+// a statusError, so failures are classified as with the HTTP implementation.
+func responseError(err error) error {
+	var re *api.ResponseError
+	if errors.As(err, &re) {
+		return &statusError{code: re.StatusCode, message: err.Error()}
+	}
+	return err
+}
+
+// role uses the client's health call, which asks Vault to answer 200 in
+// every state and reports the role in the body. Custom health settings only
+// make sense with status codes, so they keep using the HTTP implementation.
+func (a *officialVaultAPI) role(ctx context.Context) (string, error) {
+	if a.v.healthPath != "" || a.v.healthQuery != "" || len(a.v.healthRoles) > 0 {
+		return a.fallback.role(ctx)
+	}
+
+	health, err := a.client.Sys().HealthWithContext(ctx)
+	if err != nil {
+		return "", fmt.Errorf("health check failed: %w", err)
+	}
+	switch {
+	case health.Sealed:
+		return "", fmt.Errorf("vault is sealed")
+	case health.ReplicationDRMode == "secondary":
+		return roleDRSecondary, nil
+	case health.PerformanceStandby:
+		return rolePerfStandby, nil
+	case health.Standby:
+		return roleStandby, nil
+	}
+	return roleActive, nil
+}
+
+func (a *officialVaultAPI) initialize(ctx context.Context, shares, threshold int) (*initResponse, error) {
+	resp, err := a.client.Sys().InitWithContext(ctx, &api.InitRequest{
+		SecretShares:    shares,
+		SecretThreshold: threshold,
+	})
+	if err != nil {
+		return nil, responseError(err)
+	}
+	return &initResponse{Keys: resp.Keys, KeysBase64: resp.KeysB64, RootToken: resp.RootToken}, nil
+}
+
+func (a *officialVaultAPI) raftJoin(ctx context.Context, leader, leaderCA string) (bool, error) {
+	resp, err := a.client.Sys().RaftJoinWithContext(ctx, &api.RaftJoinRequest{
+		LeaderAPIAddr: leader,
+		LeaderCACert:  leaderCA,
+	})
+	if err != nil {
+		return false, responseError(err)
+	}
+	return resp.Joined, nil
+}
+
+func (a *officialVaultAPI) rekeyInit(ctx context.Context, shares, threshold int) (*rekeyStatus, error) {
+	resp, err := a.client.Sys().RekeyInitWithContext(ctx, &api.RekeyInitRequest{
+		SecretShares:        shares,
+		SecretThreshold:     threshold,
+		RequireVerification: true,
+	})
+	if err != nil {
+		return nil, responseError(err)
+	}
+	return &rekeyStatus{
+		Nonce:                resp.Nonce,
+		Started:              resp.Started,
+		T:                    resp.T,
+		N:                    resp.N,
+		Progress:             resp.Progress,
+		Required:             resp.Required,
+		VerificationRequired: resp.VerificationRequired,
+	}, nil
+}
+
+func (a *officialVaultAPI) rekeyCancel(ctx context.Context) error {
+	return responseError(a.client.Sys().RekeyCancelWithContext(ctx))
+}
+
+func (a *officialVaultAPI) rekeyUpdate(ctx context.Context, key, nonce string) (*rekeyUpdate, error) {
+	resp, err := a.client.Sys().RekeyUpdateWithContext(ctx, key, nonce)
+	if err != nil {
+		return nil, responseError(err)
+	}
+	return &rekeyUpdate{
+		Nonce:                resp.Nonce,
+		Complete:             resp.Complete,
+		Keys:                 resp.Keys,
+		VerificationRequired: resp.VerificationRequired,
+		VerificationNonce:    resp.VerificationNonce,
+	}, nil
+}
+
+func (a *officialVaultAPI) rekeyVerify(ctx context.Context, key, nonce string) (*rekeyVerify, error) {
+	resp, err := a.client.Sys().RekeyVerificationUpdateWithContext(ctx, key, nonce)
+	if err != nil {
+		return nil, responseError(err)
+	}
+	return &rekeyVerify{Nonce: resp.Nonce, Complete: resp.Complete}, nil
+}
+
+// revokeSelf revokes token on a clone of the client, which leaves the shared
+// client without a token.
+func (a *officialVaultAPI) revokeSelf(ctx context.Context, token string) error {
+	client, err := a.client.Clone()
+	if err != nil {
+		return err
+	}
+	clearEnvSettings(client, a.v)
+	client.SetToken(token)
+	return responseError(client.Auth().Token().RevokeSelfWithContext(ctx, ""))
+}
+
+func fromAPISealStatus(resp *api.SealStatusResponse) *sealStatus {
+	return &sealStatus{
+		Type:         resp.Type,
+		Initialized:  resp.Initialized,
+		Sealed:       resp.Sealed,
+		T:            resp.T,
+		N:            resp.N,
+		Progress:     resp.Progress,
+		Nonce:        resp.Nonce,
+		Version:      resp.Version,
+		BuildDate:    resp.BuildDate,
+		Migration:    resp.Migration,
+		ClusterName:  resp.ClusterName,
+		ClusterID:    resp.ClusterID,
+		RecoverySeal: resp.RecoverySeal,
+		StorageType:  resp.StorageType,
+	}
+}
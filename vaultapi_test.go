@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// The official client must not pick up the vault CLI's environment, and must
+// not change the redirect policy of the vault's own HTTP client.
+func TestOfficialVaultAPIIgnoresEnvironment(t *testing.T) {
+	t.Setenv("VAULT_TOKEN", "cli-token")
+	t.Setenv("VAULT_NAMESPACE", "cli-namespace")
+	t.Setenv("VAULT_HEADERS", `{"X-Custom":"cli"}`)
+
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Write([]byte(`{"type":"shamir","initialized":true,"sealed":false}`))
+	}))
+	defer srv.Close()
+
+	for _, namespace := range []string{"", "team-a"} {
+		v := &vaultConfig{addr: srv.URL, namespace: namespace, client: srv.Client()}
+		api, err := newOfficialVaultAPI(v, &httpVaultAPI{v: v})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := api.sealStatus(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if token := got.Get("X-Vault-Token"); token != "" {
+			t.Errorf("namespace %q: sent token %q", namespace, token)
+		}
+		if ns := got.Get("X-Vault-Namespace"); ns != namespace {
+			t.Errorf("namespace %q: sent namespace %q", namespace, ns)
+		}
+		if h := got.Get("X-Custom"); h != "" {
+			t.Errorf("namespace %q: sent VAULT_HEADERS header %q", namespace, h)
+		}
+		if got.Get("X-Vault-Request") != "true" {
+			t.Errorf("namespace %q: X-Vault-Request header missing", namespace)
+		}
+		if v.client.CheckRedirect != nil {
+			t.Errorf("namespace %q: redirect policy of the vault client was changed", namespace)
+		}
+	}
+}
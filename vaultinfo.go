@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// redacted stands in for secret values in /api/v1/vaults.
+const redacted = "REDACTED"
+
+// vaultInfo is a vault as the unsealer sees it: where it came from, the
+// options in effect and its live state.
+type vaultInfo struct {
+	Address string `json:"address"`
+	Config  string `json:"config,omitempty"`
+	// Source is "configured" for VAULT_URLS or a VaultUnsealConfig,
+	// "registered" or "discovered".
+	Source       string        `json:"source"`
+	DiscoveredBy string        `json:"discovered_by,omitempty"`
+	Options      vaultSettings `json:"options"`
+	Status       vaultStatus   `json:"status"`
+}
+
+// vaultSettings are the effective per-vault options, named and formatted as in
+// VAULT_URLS, after the global defaults and the vault's own options applied.
+type vaultSettings struct {
+	Disabled              bool    `json:"disabled"`
+	Reset                 bool    `json:"reset"`
+	Migrate               bool    `json:"migrate"`
+	Shuffle               bool    `json:"shuffle"`
+	RetryAttempts         int     `json:"retry_attempts"`
+	RetryBackoff          string  `json:"retry_backoff"`
+	RetryMultiplier       float64 `json:"retry_multiplier"`
+	RetryMaxBackoff       string  `json:"retry_max_backoff,omitempty"`
+	RetryJitter           float64 `json:"retry_jitter"`
+	BreakerThreshold      int     `json:"breaker_threshold"`
+	BreakerCooldown       string  `json:"breaker_cooldown"`
+	Group                 string  `json:"group,omitempty"`
+	EscalateAfter         int     `json:"escalate_after"`
+	Timeout               string  `json:"timeout"`
+	TLSHandshakeTimeout   string  `json:"tls_handshake_timeout"`
+	ResponseHeaderTimeout string  `json:"response_header_timeout"`
+	Init                  bool    `json:"init"`
+	RaftJoin              string  `json:"raft_join,omitempty"`
+	RaftLeaderCACert      string  `json:"raft_leader_ca_cert,omitempty"`
+	DRSecondary           string  `json:"dr_secondary"`
+	PerfStandby           string  `json:"perf_standby"`
+	Standby               string  `json:"standby"`
+	Uninitialized         string  `json:"uninitialized"`
+	HealthPath            string  `json:"health_path,omitempty"`
+	HealthQuery           string  `json:"health_query,omitempty"`
+	HealthCodes           string  `json:"health_codes,omitempty"`
+	StatusCodes           string  `json:"status_codes,omitempty"`
+	BearerToken           string  `json:"bearer_token,omitempty"`
+	BearerTokenSecret     string  `json:"bearer_token_secret,omitempty"`
+	VerifyCert            bool    `json:"verify_cert"`
+	CACert                string  `json:"ca_cert,omitempty"`
+	ServerName            string  `json:"server_name,omitempty"`
+	Proxy                 string  `json:"proxy,omitempty"`
+	ClusterID             string  `json:"cluster_id,omitempty"`
+	ClusterName           string  `json:"cluster_name,omitempty"`
+	TLSFingerprint        string  `json:"tls_fingerprint,omitempty"`
+	APIClient             string  `json:"api_client,omitempty"`
+	Mesh                  string  `json:"mesh,omitempty"`
+	Namespace             string  `json:"namespace,omitempty"`
+	ClientCert            string  `json:"client_cert,omitempty"`
+	ClientKey             string  `json:"client_key,omitempty"`
+}
+
+// settings returns the options of v. The static bearer token is redacted, as
+// are credentials in the proxy URL; paths and Secret IDs are shown as they are.
+func (v *vaultConfig) settings() vaultSettings {
+	s := vaultSettings{
+		Disabled:              v.state.isDisabled(),
+		Reset:                 v.resetProgress,
+		Migrate:               v.migrate,
+		Shuffle:               v.shuffleKeys,
+		RetryAttempts:         v.retry.attempts,
+		RetryBackoff:          v.retry.backoff.String(),
+		RetryMultiplier:       v.retry.multiplier,
+		RetryJitter:           v.retry.jitter,
+		BreakerThreshold:      v.breakerThreshold,
+		BreakerCooldown:       v.breakerCooldown.String(),
+		Group:                 v.group,
+		EscalateAfter:         v.escalateAfter,
+		Timeout:               v.timeout.String(),
+		TLSHandshakeTimeout:   v.tlsHandshakeTimeout.String(),
+		ResponseHeaderTimeout: v.responseHeaderTimeout.String(),
+		Init:                  v.autoInit,
+		RaftJoin:              v.raftLeader,
+		RaftLeaderCACert:      v.raftLeaderCA,
+		DRSecondary:           v.drPolicy,
+		PerfStandby:           v.perfPolicy,
+		Standby:               v.standbyPolicy,
+		Uninitialized:         v.uninitPolicy,
+		HealthPath:            v.healthPath,
+		HealthQuery:           v.healthQuery,
+		HealthCodes:           formatCodeMap(v.healthRoles),
+		StatusCodes:           formatCodeMap(v.codeActions),
+		BearerTokenSecret:     v.bearerSecret,
+		VerifyCert:            v.verifyCert,
+		CACert:                v.caCert,
+		ServerName:            v.serverName,
+		Proxy:                 v.proxy,
+		ClusterID:             v.clusterID,
+		ClusterName:           v.clusterName,
+		APIClient:             v.apiClient,
+		Mesh:                  v.mesh,
+		Namespace:             v.namespace,
+		ClientCert:            v.clientCert,
+		ClientKey:             v.clientKey,
+	}
+	if v.retry.maxBackoff > 0 {
+		s.RetryMaxBackoff = v.retry.maxBackoff.String()
+	}
+	if v.bearerToken != "" {
+		s.BearerToken = redacted
+	}
+	if p, err := url.Parse(v.proxy); err == nil && p.User != nil {
+		s.Proxy = p.Redacted()
+	}
+	if len(v.tlsFingerprint) > 0 {
+		s.TLSFingerprint = fmt.Sprintf("%x", v.tlsFingerprint)
+	}
+	return s
+}
+
+// formatCodeMap writes health_codes and status_codes back in their option
+// syntax, ordered by status code.
+func formatCodeMap(m map[int]string) string {
+	codes := make([]int, 0, len(m))
+	for code := range m {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	pairs := make([]string, len(codes))
+	for i, code := range codes {
+		pairs[i] = strconv.Itoa(code) + ":" + m[code]
+	}
+	return strings.Join(pairs, "|")
+}
+
+// vaultInfo describes v, one of u's vaults.
+func (u *Unsealer) vaultInfo(v *vaultConfig) vaultInfo {
+	info := vaultInfo{Address: v.addr, Config: u.shardKey, Source: "discovered", Options: v.settings()}
+	u.vaultsMu.RLock()
+	for _, s := range u.staticVaults {
+		if s == v {
+			info.Source = "configured"
+		}
+	}
+	for _, e := range u.registered {
+		if e.vault == v {
+			info.Source = "registered"
+		}
+	}
+	u.vaultsMu.RUnlock()
+	if v.ref != nil {
+		info.DiscoveredBy = strings.ToLower(v.ref.kind) + "/" + v.ref.namespace + "/" + v.ref.name
+	}
+	keyState, keyAge := u.keyState()
+	info.Status = v.state.report()
+	info.Status.Address = v.addr
+	info.Status.Config = u.shardKey
+	info.Status.KeyState = keyState
+	info.Status.KeyAgeSeconds = int64(keyAge.Seconds())
+	info.Status.Paused = u.paused(v)
+	return info
+}
+
+// handleListVaults returns every vault with its effective options and live
+// state, optionally limited to one VaultUnsealConfig with ?config=.
+func (u *Unsealer) handleListVaults(w http.ResponseWriter, r *http.Request) {
+	config := r.URL.Query().Get("config")
+	vaults := []vaultInfo{}
+	for _, c := range u.clusterUnsealers() {
+		if config != "" && c.shardKey != config {
+			continue
+		}
+		for _, v := range c.vaultList() {
+			vaults = append(vaults, c.vaultInfo(v))
+		}
+	}
+	sort.SliceStable(vaults, func(i, j int) bool {
+		if vaults[i].Config != vaults[j].Config {
+			return vaults[i].Config < vaults[j].Config
+		}
+		return vaults[i].Address < vaults[j].Address
+	})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"vaults": vaults})
+}
+
+func (u *Unsealer) handleGetVault(w http.ResponseWriter, r *http.Request) {
+	t, ok := u.findVault(w, r, r.PathValue("vault"))
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, t.u.vaultInfo(t.v))
+}
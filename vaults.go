@@ -0,0 +1,442 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// vaultConfig holds the settings for a single vault. Entries in VAULT_URLS can
+// override the global defaults with ";key=value" options, for example
+// "https://vault-1:8200;reset=true".
+type vaultConfig struct {
+	addr string
+	// disabled vaults are polled but never acted on. The admin API can
+	// change this at runtime through the vault's state.
+	disabled      bool
+	resetProgress bool
+	migrate       bool
+	shuffleKeys   bool
+	retry         retryPolicy
+
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	// group names a set of vaults that share notification settings.
+	group         string
+	escalateAfter int
+
+	timeout               time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	autoInit              bool
+	raftLeader            string
+	raftLeaderCA          string
+	drPolicy              string
+	perfPolicy            string
+	standbyPolicy         string
+	uninitPolicy          string
+
+	healthPath  string
+	healthQuery string
+	healthRoles map[int]string
+	codeActions map[int]string
+
+	bearerToken  string
+	bearerSecret string
+
+	verifyCert bool
+	caCert     string
+	serverName string
+	clientCert string
+	clientKey  string
+	proxy      string
+
+	clusterID      string
+	clusterName    string
+	tlsFingerprint []byte
+
+	apiClient string
+	namespace string
+	mesh      string
+
+	// ref is the pod or service the vault was discovered through, kept
+	// from its first discovery.
+	ref *objectRef
+
+	state  *vaultState
+	client *http.Client
+	api    vaultAPI
+}
+
+// envOptions maps global environment variables to the per-vault option they
+// set the default for.
+var envOptions = []struct{ env, option string }{
+	{"UNSEAL_RESET_PROGRESS", "reset"},
+	{"SHUFFLE_KEYS", "shuffle"},
+	{"UNSEAL_RETRY_ATTEMPTS", "retry_attempts"},
+	{"UNSEAL_RETRY_BACKOFF", "retry_backoff"},
+	{"UNSEAL_RETRY_MULTIPLIER", "retry_multiplier"},
+	{"UNSEAL_RETRY_MAX_BACKOFF", "retry_max_backoff"},
+	{"UNSEAL_RETRY_JITTER", "retry_jitter"},
+	{"CIRCUIT_BREAKER_THRESHOLD", "breaker_threshold"},
+	{"CIRCUIT_BREAKER_COOLDOWN", "breaker_cooldown"},
+	{"ESCALATE_AFTER", "escalate_after"},
+	{"VAULT_TIMEOUT", "timeout"},
+	{"VAULT_TLS_HANDSHAKE_TIMEOUT", "tls_handshake_timeout"},
+	{"VAULT_RESPONSE_HEADER_TIMEOUT", "response_header_timeout"},
+	{"DR_SECONDARY_POLICY", "dr_secondary"},
+	{"PERF_STANDBY_POLICY", "perf_standby"},
+	{"STANDBY_POLICY", "standby"},
+	{"UNINITIALIZED_POLICY", "uninitialized"},
+	{"RAFT_LEADER_API_ADDR", "raft_join"},
+	{"RAFT_LEADER_CA_CERT", "raft_leader_ca_cert"},
+	{"HEALTH_PATH", "health_path"},
+	{"HEALTH_QUERY", "health_query"},
+	{"HEALTH_CODES", "health_codes"},
+	{"HEALTH_STATUS_CODES", "status_codes"},
+	{"VAULT_BEARER_TOKEN", "bearer_token"},
+	{"VAULT_BEARER_TOKEN_SECRET_ID", "bearer_token_secret"},
+	{"VERIFY_CERT", "verify_cert"},
+	{"VAULT_CA_CERT", "ca_cert"},
+	{"VAULT_TLS_SERVER_NAME", "server_name"},
+	{"VAULT_PROXY", "proxy"},
+	{"VAULT_API_CLIENT", "api_client"},
+	{"MESH_MODE", "mesh"},
+	{"VAULT_NAMESPACE", "namespace"},
+	{"VAULT_CLIENT_CERT", "client_cert"},
+	{"VAULT_CLIENT_KEY", "client_key"},
+}
+
+// loadVaultDefaults builds the settings every vault starts from before its own
+// options are applied.
+func loadVaultDefaults() (vaultConfig, error) {
+	v := vaultConfig{
+		drPolicy:      "unseal",
+		perfPolicy:    "unseal",
+		standbyPolicy: "unseal",
+		uninitPolicy:  "warn",
+		apiClient:     "official",
+		verifyCert:    true,
+		shuffleKeys:   true,
+		retry:         defaultRetryPolicy,
+
+		breakerThreshold: 5,
+		breakerCooldown:  5 * time.Minute,
+
+		timeout:               30 * time.Second,
+		tlsHandshakeTimeout:   10 * time.Second,
+		responseHeaderTimeout: 10 * time.Second,
+	}
+	for _, e := range envOptions {
+		if value := os.Getenv(e.env); value != "" {
+			if err := v.setOption(e.option, value); err != nil {
+				return v, fmt.Errorf("%s: %w", e.env, err)
+			}
+		}
+	}
+	return v, nil
+}
+
+func parseVaults(raw string, defaults vaultConfig) ([]*vaultConfig, error) {
+	var vaults []*vaultConfig
+	for _, spec := range strings.Split(raw, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		v, err := parseVaultSpec(spec, defaults)
+		if err != nil {
+			return nil, err
+		}
+		vaults = append(vaults, v)
+	}
+	return vaults, nil
+}
+
+func parseVaultSpec(spec string, defaults vaultConfig) (*vaultConfig, error) {
+	parts := strings.Split(spec, ";")
+	v := defaults
+	v.addr = strings.TrimRight(strings.TrimSpace(parts[0]), "/")
+	if v.addr == "" {
+		return nil, fmt.Errorf("vault entry %q has no URL", spec)
+	}
+
+	for _, opt := range parts[1:] {
+		if opt = strings.TrimSpace(opt); opt == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(opt, "=")
+		if !ok {
+			return nil, fmt.Errorf("vault %s: option %q must be key=value", v.addr, opt)
+		}
+		if err := v.setOption(strings.TrimSpace(key), strings.TrimSpace(value)); err != nil {
+			return nil, fmt.Errorf("vault %s: %w", v.addr, err)
+		}
+	}
+	v.state = &vaultState{
+		bearerToken:    v.bearerToken,
+		disabled:       v.disabled,
+		checkDuration:  newHistogram(durationBuckets),
+		unsealDuration: newHistogram(durationBuckets),
+	}
+	return &v, nil
+}
+
+func (v *vaultConfig) setOption(key, value string) error {
+	var err error
+	switch key {
+	case "reset":
+		v.resetProgress, err = strconv.ParseBool(value)
+	case "disabled":
+		v.disabled, err = strconv.ParseBool(value)
+	case "retry_attempts", "retry_backoff", "retry_multiplier", "retry_max_backoff", "retry_jitter":
+		err = v.retry.set(key, value)
+	case "breaker_threshold":
+		v.breakerThreshold, err = strconv.Atoi(value)
+		if err == nil && v.breakerThreshold < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+	case "group":
+		v.group = value
+		// ESCALATE_AFTER_<GROUP> overrides ESCALATE_AFTER for the group; an
+		// escalate_after option after the group overrides both.
+		if n := os.Getenv("ESCALATE_AFTER_" + envSuffix(value)); n != "" {
+			err = v.setOption("escalate_after", n)
+		}
+	case "escalate_after":
+		v.escalateAfter, err = strconv.Atoi(value)
+		if err == nil && v.escalateAfter < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+	case "breaker_cooldown":
+		v.breakerCooldown, err = time.ParseDuration(value)
+		if err == nil && v.breakerCooldown <= 0 {
+			err = fmt.Errorf("must be positive")
+		}
+	case "timeout":
+		v.timeout, err = parseTimeout(value)
+	case "tls_handshake_timeout":
+		v.tlsHandshakeTimeout, err = parseTimeout(value)
+	case "response_header_timeout":
+		v.responseHeaderTimeout, err = parseTimeout(value)
+	case "shuffle":
+		v.shuffleKeys, err = strconv.ParseBool(value)
+	case "migrate":
+		v.migrate, err = strconv.ParseBool(value)
+	case "init":
+		v.autoInit, err = strconv.ParseBool(value)
+	case "raft_join":
+		_, err = url.Parse(value)
+		v.raftLeader = strings.TrimRight(value, "/")
+	case "raft_leader_ca_cert":
+		v.raftLeaderCA = value
+	case "dr_secondary":
+		v.drPolicy, err = parseRolePolicy(value)
+	case "perf_standby":
+		v.perfPolicy, err = parseRolePolicy(value)
+	case "standby":
+		v.standbyPolicy, err = parseRolePolicy(value)
+	case "uninitialized":
+		if value != "warn" && value != "alert" {
+			err = fmt.Errorf("must be warn or alert, got %q", value)
+		}
+		v.uninitPolicy = value
+	case "health_path":
+		if !strings.HasPrefix(value, "/") {
+			err = fmt.Errorf("path must start with /")
+		}
+		v.healthPath = value
+	case "health_query":
+		_, err = url.ParseQuery(value)
+		v.healthQuery = value
+	case "health_codes":
+		v.healthRoles, err = parseHealthRoles(value)
+	case "status_codes":
+		v.codeActions, err = parseCodeActions(value)
+	case "bearer_token":
+		v.bearerToken, v.bearerSecret = value, ""
+	case "bearer_token_secret":
+		v.bearerToken, v.bearerSecret = "", value
+	case "verify_cert":
+		v.verifyCert, err = strconv.ParseBool(value)
+	case "ca_cert":
+		v.caCert = value
+	case "server_name":
+		v.serverName = value
+	case "proxy":
+		err = validateProxy(value)
+		v.proxy = value
+	case "cluster_id":
+		v.clusterID = value
+	case "cluster_name":
+		v.clusterName = value
+	case "tls_fingerprint":
+		v.tlsFingerprint, err = hex.DecodeString(strings.ReplaceAll(value, ":", ""))
+		if err == nil && len(v.tlsFingerprint) != sha256.Size {
+			err = fmt.Errorf("must be a SHA-256 fingerprint")
+		}
+	case "api_client":
+		if value != "http" && value != "official" {
+			err = fmt.Errorf("must be official or http, got %q", value)
+		}
+		v.apiClient = value
+	case "mesh":
+		switch value {
+		case "istio", "linkerd":
+			v.mesh = value
+		case "none":
+			v.mesh = ""
+		default:
+			err = fmt.Errorf("must be istio, linkerd or none, got %q", value)
+		}
+	case "namespace":
+		v.namespace = value
+	case "client_cert":
+		v.clientCert = value
+	case "client_key":
+		v.clientKey = value
+	default:
+		return fmt.Errorf("unknown option %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	return nil
+}
+
+// rolePolicy returns what to do when a node last seen in the given role is
+// found sealed: "unseal", "skip" or "alert".
+func (v *vaultConfig) rolePolicy(role string) string {
+	switch role {
+	case roleStandby:
+		return v.standbyPolicy
+	case roleDRSecondary:
+		return v.drPolicy
+	case rolePerfStandby, rolePerfStandbyWarning:
+		return v.perfPolicy
+	}
+	return "unseal"
+}
+
+// checkClusterIdentity compares the identity a vault reports with its pins.
+// Sealed vaults usually report no cluster name or ID; those pins are then
+// checked again after the unseal.
+func (v *vaultConfig) checkClusterIdentity(status *sealStatus) error {
+	if v.clusterID != "" && status.ClusterID != "" && status.ClusterID != v.clusterID {
+		return fmt.Errorf("cluster ID is %s, expected %s", status.ClusterID, v.clusterID)
+	}
+	if v.clusterName != "" && status.ClusterName != "" && status.ClusterName != v.clusterName {
+		return fmt.Errorf("cluster name is %s, expected %s", status.ClusterName, v.clusterName)
+	}
+	return nil
+}
+
+func (v *vaultConfig) healthRoleFor(code int) (string, bool) {
+	if role, ok := v.healthRoles[code]; ok {
+		return role, true
+	}
+	role, ok := defaultHealthRoles[code]
+	return role, ok
+}
+
+func (v *vaultConfig) healthURL() string {
+	path := v.healthPath
+	if path == "" {
+		path = "/v1/sys/health"
+	}
+	if v.healthQuery != "" {
+		return v.addr + path + "?" + v.healthQuery
+	}
+	return v.addr + path
+}
+
+// parseCodeActions parses "code:action" pairs separated by "|", for example
+// "502:sealed|520:skip". Actions are healthy, sealed, skip and error.
+func parseCodeActions(value string) (map[int]string, error) {
+	actions := make(map[int]string)
+	for _, pair := range strings.Split(value, "|") {
+		code, action, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			return nil, fmt.Errorf("%q must be code:action", pair)
+		}
+		n, err := strconv.Atoi(code)
+		if err != nil || n < 100 || n > 599 {
+			return nil, fmt.Errorf("invalid status code %q", code)
+		}
+		switch action {
+		case "healthy", "sealed", "skip", "error":
+		default:
+			return nil, fmt.Errorf("action must be healthy, sealed, skip or error, got %q", action)
+		}
+		actions[n] = action
+	}
+	return actions, nil
+}
+
+// parseHealthRoles parses "code:role" pairs separated by "|", for example
+// "200:active|299:standby".
+func parseHealthRoles(value string) (map[int]string, error) {
+	roles := make(map[int]string)
+	for _, pair := range strings.Split(value, "|") {
+		code, role, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			return nil, fmt.Errorf("%q must be code:role", pair)
+		}
+		n, err := strconv.Atoi(code)
+		if err != nil || n < 100 || n > 599 {
+			return nil, fmt.Errorf("invalid status code %q", code)
+		}
+		switch role {
+		case roleActive, roleStandby, roleDRSecondary, rolePerfStandby, rolePerfStandbyWarning:
+		default:
+			return nil, fmt.Errorf("unknown role %q", role)
+		}
+		roles[n] = role
+	}
+	return roles, nil
+}
+
+// validateProxy accepts "direct" or an http, https or socks5 proxy URL.
+func validateProxy(value string) error {
+	if value == "direct" {
+		return nil
+	}
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	switch parsed.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return fmt.Errorf("proxy scheme must be http, https or socks5, got %q", parsed.Scheme)
+	}
+	if parsed.Host == "" {
+		return fmt.Errorf("proxy URL %q has no host", value)
+	}
+	return nil
+}
+
+func parseTimeout(value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return d, nil
+}
+
+func parseRolePolicy(value string) (string, error) {
+	switch value {
+	case "unseal", "skip", "alert":
+		return value, nil
+	}
+	return "", fmt.Errorf("policy must be unseal, skip or alert, got %q", value)
+}
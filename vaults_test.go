@@ -0,0 +1,191 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseVaultSpec(t *testing.T) {
+	defaults := vaultConfig{verifyCert: true, timeout: 30 * time.Second}
+	tests := []struct {
+		spec    string
+		check   func(v *vaultConfig) bool
+		wantErr string
+	}{
+		{
+			spec: " https://vault-0:8200/ ",
+			check: func(v *vaultConfig) bool {
+				return v.addr == "https://vault-0:8200" && !v.resetProgress && v.verifyCert
+			},
+		},
+		{
+			spec: "https://vault-0:8200; reset=true ;;timeout=5s",
+			check: func(v *vaultConfig) bool {
+				return v.resetProgress && v.timeout == 5*time.Second
+			},
+		},
+		{
+			spec:  "https://vault-0:8200;verify_cert=false;server_name=vault.internal",
+			check: func(v *vaultConfig) bool { return !v.verifyCert && v.serverName == "vault.internal" },
+		},
+		{
+			spec:  "https://vault-0:8200;api_client=http;namespace=team-a",
+			check: func(v *vaultConfig) bool { return v.apiClient == "http" && v.namespace == "team-a" },
+		},
+		{
+			spec:  "https://vault-0:8200;raft_join=https://vault-leader:8200/",
+			check: func(v *vaultConfig) bool { return v.raftLeader == "https://vault-leader:8200" && v.joinsRaft() },
+		},
+		{
+			spec:  "https://vault-leader:8200;raft_join=https://vault-leader:8200",
+			check: func(v *vaultConfig) bool { return !v.joinsRaft() },
+		},
+		{
+			spec:  "https://vault-0:8200;bearer_token=abc",
+			check: func(v *vaultConfig) bool { return v.bearerToken == "abc" && v.state.getBearerToken() == "abc" },
+		},
+		{
+			spec:  "https://vault-0:8200;bearer_token=abc;bearer_token_secret=proj:id",
+			check: func(v *vaultConfig) bool { return v.bearerToken == "" && v.bearerSecret == "proj:id" },
+		},
+		{spec: "", wantErr: "has no URL"},
+		{spec: ";reset=true", wantErr: "has no URL"},
+		{spec: "https://vault-0:8200;reset", wantErr: `option "reset" must be key=value`},
+		{spec: "https://vault-0:8200;colour=blue", wantErr: `unknown option "colour"`},
+		{spec: "https://vault-0:8200;reset=maybe", wantErr: "invalid value for reset"},
+	}
+	for _, tt := range tests {
+		v, err := parseVaultSpec(tt.spec, defaults)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseVaultSpec(%q) error = %v, want %q", tt.spec, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseVaultSpec(%q) error = %v", tt.spec, err)
+			continue
+		}
+		if !tt.check(v) {
+			t.Errorf("parseVaultSpec(%q) = %+v", tt.spec, *v)
+		}
+	}
+}
+
+// parseVaultSpec copies the defaults, so options never leak between vaults.
+func TestParseVaultSpecDefaults(t *testing.T) {
+	defaults := vaultConfig{healthRoles: map[int]string{}, timeout: time.Second}
+	if _, err := parseVaultSpec("https://a;timeout=9s;health_codes=472:standby", defaults); err != nil {
+		t.Fatal(err)
+	}
+	if defaults.timeout != time.Second || len(defaults.healthRoles) != 0 {
+		t.Errorf("defaults were modified: %+v", defaults)
+	}
+}
+
+func TestSetOption(t *testing.T) {
+	tests := []struct {
+		key, value string
+		wantErr    bool
+	}{
+		{"reset", "true", false},
+		{"reset", "maybe", true},
+		{"migrate", "true", false},
+		{"migrate", "yes", true},
+		{"init", "true", false},
+		{"init", "sometimes", true},
+		{"dr_secondary", "skip", false},
+		{"dr_secondary", "ignore", true},
+		{"perf_standby", "alert", false},
+		{"perf_standby", "ignore", true},
+		{"standby", "skip", false},
+		{"standby", "", true},
+		{"health_path", "/v1/sys/health", false},
+		{"health_path", "v1/sys/health", true},
+		{"health_query", "standbyok=true", false},
+		{"health_query", "a=%zz", true},
+		{"health_codes", "472:standby|473:perf_standby", false},
+		{"health_codes", "472:leader", true},
+		{"health_codes", "47:standby", true},
+		{"verify_cert", "false", false},
+		{"verify_cert", "no-way", true},
+		{"proxy", "socks5://bastion:1080", false},
+		{"proxy", "direct", false},
+		{"proxy", "ftp://bastion", true},
+		{"proxy", "http://", true},
+		{"api_client", "official", false},
+		{"api_client", "http", false},
+		{"api_client", "grpc", true},
+		{"uninitialized", "alert", false},
+		{"uninitialized", "init", true},
+		{"mesh", "istio", false},
+		{"mesh", "none", false},
+		{"mesh", "consul", true},
+		{"tls_fingerprint", strings.Repeat("ab:", 31) + "ab", false},
+		{"tls_fingerprint", "abcd", true},
+		{"tls_fingerprint", "xyz", true},
+		{"retry_attempts", "3", false},
+		{"retry_attempts", "0", true},
+		{"retry_backoff", "soon", true},
+		{"retry_multiplier", "0.5", true},
+		{"retry_jitter", "0.2", false},
+		{"retry_jitter", "2", true},
+		{"breaker_threshold", "0", false},
+		{"breaker_threshold", "-1", true},
+		{"breaker_cooldown", "0s", true},
+		{"breaker_cooldown", "1m", false},
+		{"timeout", "0s", true},
+		{"timeout", "10s", false},
+		{"status_codes", "502:sealed|520:skip", false},
+		{"status_codes", "502", true},
+		{"status_codes", "abc:sealed", true},
+		{"status_codes", "502:restart", true},
+		{"escalate_after", "-2", true},
+		{"escalate_after", "3", false},
+		{"disabled", "true", false},
+		{"disabled", "off", true},
+		{"unknown", "x", true},
+	}
+	for _, tt := range tests {
+		var v vaultConfig
+		err := v.setOption(tt.key, tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("setOption(%q, %q) error = %v, want error %v", tt.key, tt.value, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSetOptionGroupEscalation(t *testing.T) {
+	t.Setenv("ESCALATE_AFTER_EU_WEST", "7")
+	tests := []struct {
+		spec string
+		want int
+	}{
+		{"https://a;group=eu-west", 7},
+		{"https://a;group=eu-west;escalate_after=2", 2},
+		{"https://a;escalate_after=2;group=eu-west", 7},
+		{"https://a;group=us-east", 0},
+	}
+	for _, tt := range tests {
+		v, err := parseVaultSpec(tt.spec, vaultConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.escalateAfter != tt.want {
+			t.Errorf("%s: escalate_after = %d, want %d", tt.spec, v.escalateAfter, tt.want)
+		}
+	}
+}
+
+func TestParseCodeActions(t *testing.T) {
+	got, err := parseCodeActions(" 502:sealed | 520:skip|200:healthy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]string{502: "sealed", 520: "skip", 200: "healthy"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseCodeActions() = %v, want %v", got, want)
+	}
+}
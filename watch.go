@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+type podList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []pod `json:"items"`
+}
+
+type pod struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		UID             string `json:"uid"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Status struct {
+		Conditions []struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"conditions"`
+		ContainerStatuses []struct {
+			RestartCount int `json:"restartCount"`
+		} `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+// podState is what the watcher remembers about a vault pod to tell which
+// changes deserve an immediate unseal.
+type podState struct {
+	ready    bool
+	restarts int
+}
+
+func (p *pod) state() podState {
+	var s podState
+	for _, c := range p.Status.Conditions {
+		if c.Type == "Ready" {
+			s.ready = c.Status == "True"
+		}
+	}
+	for _, c := range p.Status.ContainerStatuses {
+		s.restarts += c.RestartCount
+	}
+	return s
+}
+
+// podWatcher watches vault pods and requests an unseal as soon as one is
+// created, restarts or changes readiness, instead of waiting for the next poll.
+type podWatcher struct {
+	kube     *kubeClient
+	selector string
+	pods     map[string]podState
+}
+
+// newPodWatchers returns a watcher for every namespace and cluster in
+// kubeTargets.
+func newPodWatchers() ([]*podWatcher, error) {
+	selector := getEnv("KUBERNETES_POD_SELECTOR", os.Getenv("KUBERNETES_LABEL_SELECTOR"))
+	if selector == "" {
+		return nil, fmt.Errorf("VAULT_POD_WATCH requires KUBERNETES_POD_SELECTOR or KUBERNETES_LABEL_SELECTOR")
+	}
+	targets, err := kubeTargets()
+	if err != nil {
+		return nil, err
+	}
+	watchers := make([]*podWatcher, 0, len(targets))
+	for _, kube := range targets {
+		watchers = append(watchers, &podWatcher{kube: kube, selector: selector})
+	}
+	return watchers, nil
+}
+
+func (u *Unsealer) podWatchLoop(ctx context.Context, w *podWatcher) {
+	backoff := time.Second
+	for {
+		err := w.run(ctx, u)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			u.logger.Warn("vault pod watch failed, restarting", "context", w.kube.cluster, "namespace", w.kube.namespace, "error", err, "retry_in", backoff)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if err != nil && backoff < time.Minute {
+			backoff *= 2
+		} else if err == nil {
+			backoff = time.Second
+		}
+	}
+}
+
+// run lists the pods and then follows the watch until the server ends it.
+func (w *podWatcher) run(ctx context.Context, u *Unsealer) error {
+	path := "/api/v1/namespaces/" + url.PathEscape(w.kube.namespace) + "/pods?labelSelector=" + url.QueryEscape(w.selector)
+
+	var list podList
+	if err := w.kube.get(ctx, path, &list); err != nil {
+		return fmt.Errorf("failed to list pods: %w", err)
+	}
+	w.pods = make(map[string]podState, len(list.Items))
+	for _, p := range list.Items {
+		w.pods[p.Metadata.UID] = p.state()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", w.kube.baseURL+path+"&watch=true&timeoutSeconds=300&resourceVersion="+list.Metadata.ResourceVersion, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := w.kube.stream(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var event struct {
+			Type   string `json:"type"`
+			Object pod    `json:"object"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("bad watch event: %w", err)
+		}
+		if reason := w.handle(event.Type, &event.Object); reason != "" {
+			u.logger.Info("vault pod changed, unsealing now", "pod", event.Object.Metadata.Name, "reason", reason)
+			u.requestUnseal(initiatorPodWatch)
+		}
+	}
+	return scanner.Err()
+}
+
+// handle applies a watch event and returns why it should trigger an unseal,
+// or "" if it should not.
+func (w *podWatcher) handle(eventType string, p *pod) string {
+	uid := p.Metadata.UID
+	switch eventType {
+	case "ERROR", "BOOKMARK":
+		return ""
+	case "DELETED":
+		delete(w.pods, uid)
+		return ""
+	}
+
+	current := p.state()
+	prev, known := w.pods[uid]
+	w.pods[uid] = current
+	switch {
+	case !known:
+		return "created"
+	case current.restarts > prev.restarts:
+		return "restarted"
+	case current.ready != prev.ready:
+		return "readiness changed"
+	}
+	return ""
+}
+
+// stream sends a long-running request, such as a watch, without the client
+// timeout used for regular calls.
+func (k *kubeClient) stream(req *http.Request) (*http.Response, error) {
+	if err := k.authorize(req); err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Transport: k.client.Transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &kubeError{code: resp.StatusCode, message: "watch rejected"}
+	}
+	return resp, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// watchdog notices poll and key refresh loops that stopped making progress,
+// typically because the Bitwarden SDK hangs in a call that cannot be
+// cancelled. A stalled key refresh is healed once by logging in with a fresh
+// provider; anything still stuck fails /health so the kubelet restarts the
+// container.
+type watchdog struct {
+	heal      bool
+	intervals int
+
+	mu     sync.Mutex
+	stuck  []string
+	healed map[*Unsealer]time.Time
+}
+
+func newWatchdog(action string, intervals int) (*watchdog, error) {
+	if intervals < 2 {
+		return nil, fmt.Errorf("WATCHDOG_INTERVALS must be at least 2")
+	}
+	w := &watchdog{intervals: intervals, healed: make(map[*Unsealer]time.Time)}
+	switch action {
+	case "heal":
+		w.heal = true
+	case "fail":
+	default:
+		return nil, fmt.Errorf("WATCHDOG must be off, heal or fail, got %q", action)
+	}
+	return w, nil
+}
+
+// failures returns what is stuck, or nothing while all loops are healthy.
+func (w *watchdog) failures() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stuck
+}
+
+func (u *Unsealer) watchdogLoop(ctx context.Context, w *watchdog) {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var stuck []string
+		running := make(map[*Unsealer]bool)
+		for _, c := range u.clusterUnsealers() {
+			running[c] = true
+			if reason := w.check(c); reason != "" {
+				if c.shardKey != "" {
+					reason = c.shardKey + ": " + reason
+				}
+				stuck = append(stuck, reason)
+			}
+		}
+		sort.Strings(stuck)
+
+		w.mu.Lock()
+		if len(stuck) > 0 && len(w.stuck) == 0 {
+			u.logger.Error("watchdog found stuck loops, failing liveness", "stuck", stuck)
+		} else if len(stuck) == 0 && len(w.stuck) > 0 {
+			u.logger.Info("watchdog: all loops are making progress again")
+		}
+		w.stuck = stuck
+		for c := range w.healed {
+			if !running[c] {
+				delete(w.healed, c)
+			}
+		}
+		w.mu.Unlock()
+	}
+}
+
+// check returns why c counts as stuck, or "" if it does not. The operator's
+// own unsealer has no vaults and no key refresh loop, so only its poll loop
+// is checked.
+func (w *watchdog) check(c *Unsealer) string {
+	n := time.Duration(w.intervals)
+	if c.pollInterval > 0 && c.pollAge() > n*c.pollInterval {
+		return fmt.Sprintf("poll loop has not run for %s", c.pollAge().Round(time.Second))
+	}
+
+	last := atomic.LoadInt64(&c.lastRefresh)
+	if last == 0 {
+		return ""
+	}
+	age := time.Since(time.Unix(0, last))
+	if age <= n*c.keyRefreshInterval {
+		w.mu.Lock()
+		delete(w.healed, c)
+		w.mu.Unlock()
+		return ""
+	}
+
+	w.mu.Lock()
+	healedAt, healed := w.healed[c]
+	if w.heal && !healed {
+		w.healed[c] = time.Now()
+	}
+	w.mu.Unlock()
+	if w.heal && !healed {
+		c.logger.Warn("key refresh has not completed, recreating the key provider", "last_refresh", age.Round(time.Second))
+		go c.healProvider()
+		return ""
+	}
+	if w.heal && time.Since(healedAt) <= c.keyRefreshInterval {
+		return ""
+	}
+	return fmt.Sprintf("key refresh has not completed for %s", age.Round(time.Second))
+}
+
+// healProvider replaces the key provider with a new one, logged in with new
+// clients, and fetches the keys with it. The call that hung keeps its old
+// client and is left behind.
+func (u *Unsealer) healProvider() {
+	if u.newProvider == nil {
+		return
+	}
+	p, err := u.newProvider()
+	if err != nil {
+		u.logger.Error("watchdog failed to recreate the key provider", "error", err)
+		return
+	}
+	u.setProvider(p)
+	if err := u.fetchKeys(); err != nil {
+		u.logger.Error("key fetch with the recreated provider failed", "error", err)
+	} else {
+		u.logger.Info("keys refreshed with the recreated provider")
+	}
+	atomic.StoreInt64(&u.lastRefresh, time.Now().UnixNano())
+}
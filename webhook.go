@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// webhookSink posts notifications as JSON to a URL. With a secret, every
+// request is signed so the receiver can check where it came from.
+type webhookSink struct {
+	url       string
+	secret    []byte
+	client    *http.Client
+	templates messageTemplates
+}
+
+func init() {
+	registerSink("webhook", loadWebhookSinks)
+}
+
+// defaultWebhookTemplate renders the notification as it is.
+const defaultWebhookTemplate = "{{json .}}"
+
+// loadWebhookSinks reads NOTIFY_WEBHOOK_URLS, NOTIFY_WEBHOOK_SECRET (or
+// NOTIFY_WEBHOOK_SECRET_FILE) and NOTIFY_WEBHOOK_TEMPLATE. Every URL becomes
+// its own sink, so one that is down does not hold up the others.
+func loadWebhookSinks() ([]sink, error) {
+	urls := splitList(os.Getenv("NOTIFY_WEBHOOK_URLS"))
+	secret, err := readSecretEnv("NOTIFY_WEBHOOK_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	if len(urls) == 0 {
+		return nil, nil
+	}
+	templates, err := loadTemplates("NOTIFY_WEBHOOK_TEMPLATE", defaultWebhookTemplate)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	var sinks []sink
+	for _, raw := range urls {
+		if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid NOTIFY_WEBHOOK_URLS entry %q", raw)
+		}
+		s := &webhookSink{url: raw, client: client, templates: templates}
+		if secret != "" {
+			s.secret = []byte(secret)
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+// name identifies the sink in logs without any credentials in the URL.
+func (s *webhookSink) name() string {
+	u, _ := url.Parse(s.url)
+	return "webhook " + u.Host
+}
+
+func (s *webhookSink) send(ctx context.Context, n notification) error {
+	text, err := s.templates.render(n)
+	if err != nil {
+		return err
+	}
+	body := []byte(text)
+	if !json.Valid(body) {
+		return fmt.Errorf("NOTIFY_WEBHOOK_TEMPLATE did not render valid JSON for %s", n.Type)
+	}
+	header := http.Header{}
+	if s.secret != nil {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		header.Set("X-Unsealer-Timestamp", ts)
+		header.Set("X-Unsealer-Signature", "sha256="+webhookSignature(s.secret, ts, body))
+	}
+	return postJSON(ctx, s.client, s.url, body, header)
+}
+
+// webhookSignature is the hex HMAC-SHA256 of the timestamp, a dot and the
+// body. Signing the timestamp lets receivers reject replayed requests.
+func webhookSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}